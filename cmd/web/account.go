@@ -0,0 +1,361 @@
+// Package main contains the account settings handlers for the Gratitude Jar
+// application: changing the username, password and email address.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darynforman/gratitude-jar1/internal/auth"
+	"github.com/darynforman/gratitude-jar1/internal/data"
+	"github.com/darynforman/gratitude-jar1/internal/mailer"
+	"github.com/darynforman/gratitude-jar1/internal/security"
+	"github.com/darynforman/gratitude-jar1/internal/validator"
+)
+
+// account shows the account settings page
+func (app *application) account(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		app.methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	user, ok := app.accountUser(w, r)
+	if !ok {
+		return
+	}
+	app.renderAccount(w, r, http.StatusOK, user, PageData{})
+}
+
+// changeUsername gives the logged-in user a new username, if nobody has it
+func (app *application) changeUsername(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		app.methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	user, ok := app.accountUser(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		app.clientError(w, r, http.StatusBadRequest, "")
+		return
+	}
+	username := strings.TrimSpace(r.PostForm.Get("username"))
+
+	v := validator.ValidateUsername(username)
+	v.Check(username != user.Username, "username", "validation.username.unchanged")
+	if v.ValidData() {
+		if taken, _ := app.models.Users.GetByUsername(r.Context(), username); taken != nil {
+			v.AddError("username", "validation.username.taken")
+		}
+	}
+	if v.ValidData() {
+		err := app.models.Users.UpdateUsername(r.Context(), user.ID, username)
+		if errors.Is(err, data.ErrDuplicateUsername) {
+			v.AddError("username", "validation.username.taken")
+		} else if err != nil {
+			app.serverError(w, r, fmt.Errorf("changing username: %w", err))
+			return
+		}
+	}
+	if !v.ValidData() {
+		app.renderAccount(w, r, http.StatusUnprocessableEntity, user, PageData{
+			Errors:    v.Errors,
+			ErrorArgs: v.Args,
+			Form:      map[string]string{"username": username},
+		})
+		return
+	}
+
+	app.audit(r, security.EventUsernameChange, user.ID, username, fmt.Sprintf("changed from %q", user.Username), true)
+	app.flash(r, "flash.username_changed", "username", username)
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// changePassword replaces the logged-in user's password after checking the
+// current one
+func (app *application) changePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		app.methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	user, ok := app.accountUser(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		app.clientError(w, r, http.StatusBadRequest, "")
+		return
+	}
+	current := r.PostForm.Get("current_password")
+	password := r.PostForm.Get("new_password")
+
+	v := validator.ValidatePasswordChange(current, password, r.PostForm.Get("confirm_password"))
+	app.screenPassword(v, "new_password", password, user.Username, user.Email)
+	if validator.NotBlank(current) && !app.checkPassword(r, user, current) {
+		app.audit(r, security.EventPasswordChange, user.ID, user.Username, "current password incorrect", false)
+		app.strike(r, "failed password check")
+		v.AddError("current_password", "validation.current_password.incorrect")
+	}
+	if !v.ValidData() {
+		app.renderAccount(w, r, http.StatusUnprocessableEntity, user, PageData{Errors: v.Errors, ErrorArgs: v.Args})
+		return
+	}
+
+	hash, err := app.passwords.Hash(password)
+	if err != nil {
+		app.serverError(w, r, fmt.Errorf("hashing password: %w", err))
+		return
+	}
+	if err := app.models.Users.UpdatePassword(r.Context(), user.ID, hash); err != nil {
+		app.serverError(w, r, fmt.Errorf("changing password: %w", err))
+		return
+	}
+
+	app.audit(r, security.EventPasswordChange, user.ID, user.Username, "password changed", true)
+	app.flash(r, "flash.password_changed")
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// changeEmail sends a confirmation link to the new address. The email is
+// only changed when the link is followed, proving the user can read mail
+// there.
+func (app *application) changeEmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		app.methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	user, ok := app.accountUser(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		app.clientError(w, r, http.StatusBadRequest, "")
+		return
+	}
+	email := strings.TrimSpace(r.PostForm.Get("email"))
+	password := r.PostForm.Get("password")
+
+	v := validator.ValidateEmail(email)
+	v.Check(!strings.EqualFold(email, user.Email), "email", "validation.email.unchanged")
+	v.Check(validator.NotBlank(password), "password", "validation.password.required")
+	if v.ValidData() {
+		if taken, _ := app.models.Users.GetByEmail(r.Context(), email); taken != nil {
+			v.AddError("email", "validation.email.taken")
+		}
+	}
+	if validator.NotBlank(password) && !app.checkPassword(r, user, password) {
+		app.audit(r, security.EventEmailChangeRequest, user.ID, user.Username, "current password incorrect", false)
+		app.strike(r, "failed password check")
+		v.AddError("password", "validation.current_password.incorrect")
+	}
+	if !v.ValidData() {
+		app.renderAccount(w, r, http.StatusUnprocessableEntity, user, PageData{
+			Errors:    v.Errors,
+			ErrorArgs: v.Args,
+			Form:      map[string]string{"email": email},
+		})
+		return
+	}
+
+	ttl := app.config.Mail.LinkTTL
+	token, err := app.models.EmailChanges.Request(r.Context(), user.ID, email, ttl)
+	if err != nil {
+		app.serverError(w, r, fmt.Errorf("requesting email change: %w", err))
+		return
+	}
+
+	tr := app.translator(r)
+	expires := time.Now().Add(ttl).In(app.preferences(r).Location())
+	msg := mailer.Message{
+		To:      email,
+		Subject: tr.T("mail.email_change.subject"),
+		Body: tr.T("mail.email_change.body",
+			"username", user.Username,
+			"link", app.absoluteURL(r, "/account/email/confirm?token="+token),
+			"expires", tr.Date(expires)+expires.Format(" 15:04 MST"),
+		),
+	}
+	if err := app.mailer.Send(r.Context(), msg); err != nil {
+		app.logger.Printf("Error sending email confirmation to user %d: %v", user.ID, err)
+		app.renderAccount(w, r, http.StatusBadGateway, user, PageData{
+			Errors: map[string]string{"email": "account.email.send_failed"},
+			Form:   map[string]string{"email": email},
+		})
+		return
+	}
+
+	app.audit(r, security.EventEmailChangeRequest, user.ID, user.Username, "confirmation sent to "+email, true)
+	app.flash(r, "flash.email_confirmation_sent", "email", email)
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// confirmEmail applies an email change from the link in the confirmation
+// mail. The link works without being logged in; the old address is told
+// about the change.
+func (app *application) confirmEmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		app.methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	change, err := app.models.EmailChanges.Confirm(r.Context(), r.URL.Query().Get("token"))
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		app.clientError(w, r, http.StatusBadRequest, "error.email_link_invalid")
+		return
+	case errors.Is(err, data.ErrDuplicateEmail):
+		app.clientError(w, r, http.StatusConflict, "validation.email.taken")
+		return
+	case err != nil:
+		app.serverError(w, r, fmt.Errorf("confirming email change: %w", err))
+		return
+	}
+
+	app.audit(r, security.EventEmailChange, change.UserID, change.Username, fmt.Sprintf("changed from %s to %s", change.OldEmail, change.NewEmail), true)
+
+	tr := app.translator(r)
+	notice := mailer.Message{
+		To:      change.OldEmail,
+		Subject: tr.T("mail.email_changed.subject"),
+		Body:    tr.T("mail.email_changed.body", "username", change.Username, "email", change.NewEmail),
+	}
+	if err := app.mailer.Send(r.Context(), notice); err != nil {
+		app.logger.Printf("Error notifying user %d of their email change: %v", change.UserID, err)
+	}
+
+	app.flash(r, "flash.email_changed", "email", change.NewEmail)
+	if app.sessions.GetInt(r, "userID") == change.UserID {
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// accountApps lists the apps the user has let act on their notes
+func (app *application) accountApps(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		app.methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	grants, err := app.models.OAuth.Grants(r.Context(), app.sessions.GetInt(r, "userID"))
+	if err != nil {
+		app.serverError(w, r, fmt.Errorf("listing authorized apps: %w", err))
+		return
+	}
+	app.render(w, r, "account-apps.tmpl", PageData{Title: "Account", OAuthGrants: grants})
+}
+
+// revokeApp takes away an app's access to the user's notes, ending its
+// tokens at once. The app has to ask again to get it back.
+func (app *application) revokeApp(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		app.methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		app.clientError(w, r, http.StatusBadRequest, "")
+		return
+	}
+	id, err := strconv.ParseInt(r.PostForm.Get("id"), 10, 64)
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest, "")
+		return
+	}
+
+	userID := app.sessions.GetInt(r, "userID")
+	grant, err := app.models.OAuth.RevokeGrant(r.Context(), userID, id)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		app.flash(r, "flash.app_already_revoked")
+	case err != nil:
+		app.serverError(w, r, fmt.Errorf("revoking app: %w", err))
+		return
+	default:
+		app.audit(r, security.EventOAuthRevoke, userID, app.username(r, userID), fmt.Sprintf("revoked %s (%s)", grant.ClientName, grant.ClientID), true)
+		app.flash(r, "flash.app_revoked", "app", grant.ClientName)
+	}
+	http.Redirect(w, r, "/account/apps", http.StatusSeeOther)
+}
+
+// accountUser loads the logged-in user, sending an error response if that
+// fails
+func (app *application) accountUser(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	user, err := app.models.Users.Get(r.Context(), app.sessions.GetInt(r, "userID"))
+	if err != nil {
+		app.serverError(w, r, fmt.Errorf("loading account: %w", err))
+		return nil, false
+	}
+	if user == nil {
+		app.notFound(w, r)
+		return nil, false
+	}
+	return user, true
+}
+
+// checkPassword reports whether password is user's. A hash made with an
+// outdated algorithm or parameters is replaced with a fresh one while the
+// plaintext is at hand; hashes that cannot be read never match.
+func (app *application) checkPassword(r *http.Request, user *data.User, password string) bool {
+	rehash, err := app.passwords.Verify(password, user.PasswordHash)
+	if err != nil {
+		if !errors.Is(err, auth.ErrMismatchedPassword) {
+			app.logger.Printf("Error verifying the password of user %d: %v", user.ID, err)
+		}
+		return false
+	}
+	if rehash {
+		hash, err := app.passwords.Hash(password)
+		if err == nil {
+			err = app.models.Users.UpdatePassword(r.Context(), user.ID, hash)
+		}
+		if err != nil {
+			app.logger.Printf("Error upgrading the password hash of user %d: %v", user.ID, err)
+		} else {
+			user.PasswordHash = hash
+		}
+	}
+	return true
+}
+
+// renderAccount renders the account page for user. Form values from pageData
+// take the place of the user's current ones.
+func (app *application) renderAccount(w http.ResponseWriter, r *http.Request, status int, user *data.User, pageData PageData) {
+	form := map[string]string{"username": user.Username}
+	for field, value := range pageData.Form {
+		form[field] = value
+	}
+	pageData.Title = "Account"
+	pageData.Account = user
+	pageData.DeletionGraceDays = int(app.config.Account.DeletionGracePeriod / (24 * time.Hour))
+	if app.db != nil {
+		export, err := app.models.DataExports.Latest(r.Context(), user.ID)
+		if err != nil {
+			app.serverError(w, r, fmt.Errorf("loading data export: %w", err))
+			return
+		}
+		pageData.Export = export
+		if export != nil && export.Status == data.ExportReady {
+			pageData.ExportURL = app.exportURL(export)
+		}
+	}
+	pageData.Form = form
+	app.renderPage(w, r, status, "account.tmpl", pageData)
+}
+
+// absoluteURL returns the public URL of path, for links in mail. Without a
+// configured base URL it is built from the request.
+func (app *application) absoluteURL(r *http.Request, path string) string {
+	if base := app.config.Server.BaseURL; base != "" {
+		return strings.TrimRight(base, "/") + path
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + path
+}
@@ -0,0 +1,161 @@
+// Package main contains account deletion for the Gratitude Jar application:
+// scheduling it, ending the sessions of deleted accounts and erasing them
+// once the grace period is over.
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/darynforman/gratitude-jar1/internal/data"
+	"github.com/darynforman/gratitude-jar1/internal/mailer"
+	"github.com/darynforman/gratitude-jar1/internal/security"
+	"github.com/darynforman/gratitude-jar1/internal/validator"
+)
+
+// deleteAccount schedules the logged-in user's account for deletion after
+// checking their password, and logs them out. Logging in again before the
+// grace period ends cancels the deletion.
+func (app *application) deleteAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		app.methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	user, ok := app.accountUser(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		app.clientError(w, r, http.StatusBadRequest, "")
+		return
+	}
+	password := r.PostForm.Get("delete_password")
+
+	v := validator.NewValidator()
+	v.Check(validator.NotBlank(password), "delete_password", "validation.password.required")
+	if validator.NotBlank(password) && !app.checkPassword(r, user, password) {
+		app.audit(r, security.EventAccountDeletionRequest, user.ID, user.Username, "current password incorrect", false)
+		app.strike(r, "failed password check")
+		v.AddError("delete_password", "validation.current_password.incorrect")
+	}
+	if !v.ValidData() {
+		app.renderAccount(w, r, http.StatusUnprocessableEntity, user, PageData{Errors: v.Errors, ErrorArgs: v.Args})
+		return
+	}
+
+	at := time.Now().Add(app.config.Account.DeletionGracePeriod)
+	if err := app.models.Users.ScheduleDeletion(r.Context(), user.ID, at); err != nil {
+		app.serverError(w, r, fmt.Errorf("scheduling account deletion: %w", err))
+		return
+	}
+	app.audit(r, security.EventAccountDeletionRequest, user.ID, user.Username, "erasure scheduled for "+at.UTC().Format(time.RFC3339), true)
+
+	tr := app.translator(r)
+	when := at.In(app.preferences(r).Location())
+	date := tr.Date(when) + when.Format(" 15:04 MST")
+	notice := mailer.Message{
+		To:      user.Email,
+		Subject: tr.T("mail.account_deletion.subject"),
+		Body:    tr.T("mail.account_deletion.body", "username", user.Username, "date", date),
+	}
+	if err := app.mailer.Send(r.Context(), notice); err != nil {
+		app.logger.Printf("Error notifying user %d of their account deletion: %v", user.ID, err)
+	}
+
+	// Log out, keeping the session for the flash message
+	app.sessions.Put(r, "userID", nil)
+	app.sessions.Put(r, "role", nil)
+	app.flash(r, "flash.deletion_scheduled", "date", date)
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// AccountStatusMiddleware ends the session of a user whose account has been
+// erased, is scheduled for deletion or was deactivated, so other browsers
+// they were logged in with cannot keep using it. Sessions live in signed cookies, so this is
+// the only way to end them from the server.
+func (app *application) AccountStatusMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := app.sessions.GetInt(r, "userID")
+		if userID == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		active, err := app.models.Users.Active(r.Context(), userID)
+		if err != nil {
+			app.logger.Printf("Error checking account status of user %d: %v", userID, err)
+		} else if !active {
+			app.sessions.Put(r, "userID", nil)
+			app.sessions.Put(r, "role", nil)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// purgeDeletedAccounts erases accounts whose deletion is due, and removes
+// expired data exports and OAuth codes and tokens, every interval until ctx
+// is cancelled
+func (app *application) purgeDeletedAccounts(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		app.eraseDueAccounts(ctx)
+		if _, err := app.models.DataExports.DeleteExpired(ctx); err != nil {
+			app.logger.Printf("Error deleting expired data exports: %v", err)
+		}
+		if _, err := app.models.OAuth.DeleteExpired(ctx); err != nil {
+			app.logger.Printf("Error deleting expired OAuth tokens: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// eraseDueAccounts erases every account due for deletion, recording each
+// under its pseudonym
+func (app *application) eraseDueAccounts(ctx context.Context) {
+	ids, err := app.models.Users.DueForDeletion(ctx)
+	if err != nil {
+		app.logger.Printf("Error finding accounts due for deletion: %v", err)
+		return
+	}
+
+	for _, id := range ids {
+		pseudonym := app.pseudonym(id)
+		err := app.models.Users.Erase(ctx, id, pseudonym)
+		if errors.Is(err, data.ErrRecordNotFound) {
+			continue // cancelled by logging in since it was listed
+		}
+		if err != nil {
+			app.logger.Printf("Error erasing account %s: %v", pseudonym, err)
+			continue
+		}
+		app.record(ctx, &data.SecurityEvent{
+			EventType: string(security.EventAccountDeleted),
+			Username:  pseudonym,
+			Details:   "account and data erased",
+			Success:   true,
+		})
+	}
+}
+
+// pseudonym is the name a deleted user's audit records are kept under. It is
+// keyed with a key derived from the session secret, so the same user always
+// gets the same pseudonym but it cannot be traced back to their ID without
+// the secret.
+func (app *application) pseudonym(userID int) string {
+	mac := hmac.New(sha256.New, app.derivedKey("pseudonym"))
+	mac.Write([]byte("deleted-user:" + strconv.Itoa(userID)))
+	return "deleted-" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
@@ -0,0 +1,164 @@
+// Package main contains the JSON API that third-party apps use, with the
+// OAuth access tokens users grant them, for the Gratitude Jar application.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/darynforman/gratitude-jar1/internal/data"
+	"github.com/darynforman/gratitude-jar1/internal/httperr"
+	"github.com/darynforman/gratitude-jar1/internal/oauth"
+	"github.com/darynforman/gratitude-jar1/internal/validator"
+)
+
+// apiHandler handles an API request authenticated with token
+type apiHandler func(w http.ResponseWriter, r *http.Request, token *data.OAuthToken)
+
+// apiNote is a note as the API returns it
+type apiNote struct {
+	ID        int       `json:"id"`
+	Title     string    `json:"title"`
+	Content   string    `json:"content"`
+	Category  string    `json:"category"`
+	Emoji     string    `json:"emoji"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// requireScope lets through API requests with an access token that includes
+// scope, for an account that is still active. Failures are answered with a
+// WWW-Authenticate challenge (RFC 6750) and problem details.
+func (app *application) requireScope(scope string, next apiHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		raw := bearerToken(r)
+		if raw == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			app.clientError(w, r, http.StatusUnauthorized, "error.api_token")
+			return
+		}
+
+		token, err := app.models.OAuth.Token(r.Context(), raw)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			app.serverError(w, r, fmt.Errorf("looking up access token: %w", err))
+			return
+		}
+		active := false
+		if err == nil && token.Kind == data.TokenAccess {
+			if active, err = app.models.Users.Active(r.Context(), token.UserID); err != nil {
+				app.serverError(w, r, fmt.Errorf("checking account status: %w", err))
+				return
+			}
+		}
+		if !active {
+			app.strike(r, "invalid API token")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+			app.clientError(w, r, http.StatusUnauthorized, "error.api_token")
+			return
+		}
+
+		if !slices.Contains(strings.Fields(token.Scope), scope) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="api", error="insufficient_scope", scope=%q`, scope))
+			app.clientError(w, r, http.StatusForbidden, "error.api_scope")
+			return
+		}
+		next(w, r, token)
+	}
+}
+
+// apiNotes lists the user's notes, newest first (GET, notes:read) or adds
+// one from a JSON body (POST, notes:write)
+func (app *application) apiNotes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		app.requireScope(oauth.ScopeNotesRead, app.apiListNotes)(w, r)
+	case http.MethodPost:
+		app.requireScope(oauth.ScopeNotesWrite, app.apiCreateNote)(w, r)
+	default:
+		app.methodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+	}
+}
+
+// apiListNotes sends the user's notes
+func (app *application) apiListNotes(w http.ResponseWriter, r *http.Request, token *data.OAuthToken) {
+	notes, err := app.models.Gratitudes.GetAll(r.Context(), token.UserID)
+	if err != nil {
+		app.serverError(w, r, fmt.Errorf("listing notes: %w", err))
+		return
+	}
+	list := make([]apiNote, 0, len(notes))
+	for _, n := range notes {
+		list = append(list, newAPINote(n))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"notes": list})
+}
+
+// apiCreateNote adds a note, checked like one added from the form
+func (app *application) apiCreateNote(w http.ResponseWriter, r *http.Request, token *data.OAuthToken) {
+	var input struct {
+		Title    string `json:"title"`
+		Content  string `json:"content"`
+		Category string `json:"category"`
+		Emoji    string `json:"emoji"`
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&input); err != nil {
+		app.errorResponse(w, r, httperr.Wrap(http.StatusBadRequest, "error.api_body", err))
+		return
+	}
+
+	v := validator.ValidateGratitudeNote(input.Title, input.Content, input.Category, input.Emoji)
+	if !v.ValidData() {
+		tr := app.translator(r)
+		errs := make(map[string]string, len(v.Errors))
+		for field, key := range v.Errors {
+			errs[field] = tr.T(key, v.Args[field]...)
+		}
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]any{"errors": errs})
+		return
+	}
+
+	now := time.Now()
+	note := &data.GratitudeNote{
+		Title:     input.Title,
+		Content:   input.Content,
+		Category:  input.Category,
+		Emoji:     input.Emoji,
+		UserID:    token.UserID,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := app.models.Gratitudes.Insert(r.Context(), note); err != nil {
+		app.serverError(w, r, fmt.Errorf("inserting note: %w", err))
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{"note": newAPINote(*note)})
+}
+
+// newAPINote converts a note for the API
+func newAPINote(n data.GratitudeNote) apiNote {
+	return apiNote{
+		ID:        n.ID,
+		Title:     n.Title,
+		Content:   n.Content,
+		Category:  n.Category,
+		Emoji:     n.Emoji,
+		CreatedAt: n.CreatedAt,
+		UpdatedAt: n.UpdatedAt,
+	}
+}
+
+// writeJSON sends v as a JSON response of the API or the OAuth endpoints.
+// Notes and tokens are private, so it must not be cached.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/darynforman/gratitude-jar1/internal/clientip"
+	"github.com/darynforman/gratitude-jar1/internal/data"
+	"github.com/darynforman/gratitude-jar1/internal/security"
+)
+
+// audit records a security event for the request
+func (app *application) audit(r *http.Request, eventType security.EventType, userID int, username, details string, success bool) {
+	app.record(r.Context(), &data.SecurityEvent{
+		EventType: string(eventType),
+		UserID:    userID,
+		Username:  username,
+		IP:        clientip.FromRequest(r),
+		Details:   details,
+		Success:   success,
+	})
+}
+
+// record logs a security event and, when a database is available, keeps it
+// in the security_events table
+func (app *application) record(ctx context.Context, event *data.SecurityEvent) {
+	security.LogSecurityEvent(security.EventType(event.EventType), event.UserID, event.Username, event.IP, event.Details, event.Success)
+
+	if app.db == nil {
+		return
+	}
+	if err := app.models.SecurityEvents.Insert(ctx, event); err != nil {
+		app.logger.Printf("Error storing security event %s: %v", event.EventType, err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/darynforman/gratitude-jar1/internal/security"
+	"github.com/justinas/nosurf"
+)
+
+// csrfFailureMessage is shown when a form or HTMX request carries no valid token
+const csrfFailureMessage = "error.csrf"
+
+// CSRFMiddleware adds CSRF protection with nosurf, configured from the csrf
+// settings. Requests to the API and SCIM routes that authenticate with a
+// bearer token carry no cookies a forged request could ride on, so they are
+// exempt, as are the CSP report endpoint and the OAuth endpoints apps call
+// from their servers with client credentials.
+func (app *application) CSRFMiddleware(next http.Handler) http.Handler {
+	cfg := app.config.CSRF
+	csrfHandler := nosurf.New(next)
+
+	csrfHandler.SetBaseCookie(http.Cookie{
+		Name:     cfg.CookieName,
+		Path:     "/",
+		MaxAge:   int(cfg.MaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   app.config.SecureCookies(),
+		SameSite: map[string]http.SameSite{
+			"strict": http.SameSiteStrictMode,
+			"lax":    http.SameSiteLaxMode,
+			"none":   http.SameSiteNoneMode,
+		}[cfg.SameSite],
+	})
+	csrfHandler.SetFailureHandler(http.HandlerFunc(app.csrfFailure))
+	csrfHandler.ExemptFunc(isTokenAuthenticated)
+	csrfHandler.ExemptPaths("/csp-report", "/oauth/token", "/oauth/revoke", "/oauth/introspect")
+	for _, path := range cfg.ExemptPaths {
+		// A trailing slash exempts the whole subtree
+		if strings.HasSuffix(path, "/") {
+			csrfHandler.ExemptRegexp("^" + regexp.QuoteMeta(path))
+		} else {
+			csrfHandler.ExemptPath(path)
+		}
+	}
+	return csrfHandler
+}
+
+// tokenAuthenticatedPrefixes are the routes that authenticate with a bearer
+// token rather than the session: the API for OAuth apps and SCIM provisioning
+var tokenAuthenticatedPrefixes = []string{"/api/", "/scim/"}
+
+// isTokenAuthenticated reports whether r goes to a route that authenticates
+// with a bearer token and carries one. Elsewhere the header is ignored, so
+// it cannot switch off the check for pages that use the session.
+func isTokenAuthenticated(r *http.Request) bool {
+	if bearerToken(r) == "" {
+		return false
+	}
+	for _, prefix := range tokenAuthenticatedPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// csrfFailure responds to requests that fail CSRF validation, auditing them
+// and counting them towards a ban. HTMX requests get the message swapped into
+// the page's #error-container instead of an error page.
+func (app *application) csrfFailure(w http.ResponseWriter, r *http.Request) {
+	userID, _ := app.sessions.GetLoggedInUser(r)
+	app.audit(r, security.EventCSRFFailure, userID, "", fmt.Sprintf("%s %s: %v", r.Method, r.URL.Path, nosurf.Reason(r)), false)
+	app.strike(r, "CSRF failure")
+
+	app.clientError(w, r, http.StatusForbidden, csrfFailureMessage)
+}
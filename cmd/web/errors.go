@@ -0,0 +1,134 @@
+// Package main contains the central error responses for the Gratitude Jar application.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/darynforman/gratitude-jar1/internal/httperr"
+	"github.com/darynforman/gratitude-jar1/internal/i18n"
+)
+
+// problem is an RFC 9457 problem details body
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail"`
+	Instance  string `json:"instance"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// errorResponse is the one place failed requests are answered. err is turned
+// into an *httperr.Error (anything else is a 500) and sent as problem+json to
+// API clients, as a toast in #error-container to HTMX, or as the themed error
+// page for the status. Internal causes are logged with the request ID and
+// never shown.
+func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	e := httperr.From(err)
+	if e.Err != nil {
+		app.logger.Printf("%s %s: %v (request %s)", r.Method, r.URL.Path, e, requestID(r))
+	}
+
+	e, title := localizeError(app.translator(r), e)
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(e.Status)
+		json.NewEncoder(w).Encode(problem{
+			Type:      "about:blank",
+			Title:     title,
+			Status:    e.Status,
+			Detail:    e.Message,
+			Instance:  r.URL.Path,
+			RequestID: requestID(r),
+		})
+		return
+	}
+
+	v := view{
+		Page:   errorPage(e.Status),
+		Block:  "error-toast",
+		Status: e.Status,
+		HX:     hxHeaders{Retarget: "#error-container", Reswap: "innerHTML"},
+	}
+	buf, err := app.viewHTML(r, v, PageData{Title: title, Error: e, RequestID: requestID(r)})
+	if err != nil {
+		// The error page itself is broken; renderView would come back here
+		app.logger.Printf("%s %s: rendering the error page: %v (request %s)", r.Method, r.URL.Path, err, requestID(r))
+		http.Error(w, http.StatusText(e.Status), e.Status)
+		return
+	}
+	app.writeView(w, r, v, buf)
+}
+
+// localizeError translates e's message, which is a catalog key or literal
+// text, and its title. Default messages have a key per status.
+func localizeError(tr *i18n.Translator, e *httperr.Error) (*httperr.Error, string) {
+	class := e.Status
+	if class >= 500 {
+		class = http.StatusInternalServerError
+	}
+
+	message := tr.T(e.Message)
+	if key := fmt.Sprintf("error.message.%d", class); e.Message == httperr.DefaultMessage(e.Status) && tr.Has(key) {
+		message = tr.T(key)
+	}
+	title := e.Title()
+	if key := fmt.Sprintf("error.title.%d", e.Status); tr.Has(key) {
+		title = tr.T(key)
+	}
+	return &httperr.Error{Status: e.Status, Message: message, Err: e.Err}, title
+}
+
+// errorPage picks the error template for status, falling back to the one for
+// its class
+func errorPage(status int) string {
+	switch status {
+	case http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusTooManyRequests:
+		return fmt.Sprintf("%d.tmpl", status)
+	}
+	if status >= 500 {
+		return "500.tmpl"
+	}
+	return "400.tmpl"
+}
+
+// wantsJSON reports whether the client asked for JSON rather than HTML, as
+// API clients do. Requests to the API always get JSON.
+func wantsJSON(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		return true
+	}
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "text/html") {
+		return false
+	}
+	return strings.Contains(accept, "json") || isTokenAuthenticated(r)
+}
+
+// clientError sends a 4xx error with a message for the user; an empty
+// message uses the default for the status
+func (app *application) clientError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	app.errorResponse(w, r, httperr.New(status, message))
+}
+
+// notFound sends the 404 page
+func (app *application) notFound(w http.ResponseWriter, r *http.Request) {
+	app.errorResponse(w, r, httperr.NotFound())
+}
+
+// methodNotAllowed sends a 405 listing the allowed methods
+func (app *application) methodNotAllowed(w http.ResponseWriter, r *http.Request, allowed ...string) {
+	if len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+	}
+	app.errorResponse(w, r, httperr.MethodNotAllowed())
+}
+
+// serverError logs err and sends the 500 page
+func (app *application) serverError(w http.ResponseWriter, r *http.Request, err error) {
+	app.errorResponse(w, r, httperr.Internal(err))
+}
@@ -0,0 +1,228 @@
+// Package main contains the personal data export (takeout) for the Gratitude
+// Jar application: requesting an export, building it in the background and
+// downloading it through a signed link.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darynforman/gratitude-jar1/internal/data"
+	"github.com/darynforman/gratitude-jar1/internal/mailer"
+	"github.com/darynforman/gratitude-jar1/internal/security"
+	"github.com/darynforman/gratitude-jar1/internal/takeout"
+)
+
+// requestExport queues an export of the logged-in user's data and wakes the
+// export worker. The user is emailed when it is ready.
+func (app *application) requestExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		app.methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	userID := app.sessions.GetInt(r, "userID")
+
+	export, created, err := app.models.DataExports.Request(r.Context(), userID, app.absoluteURL(r, ""))
+	if err != nil {
+		app.serverError(w, r, fmt.Errorf("requesting data export: %w", err))
+		return
+	}
+	if created {
+		app.audit(r, security.EventDataExportRequest, userID, "", fmt.Sprintf("export %d", export.ID), true)
+		select {
+		case app.exportQueue <- struct{}{}:
+		default: // the worker is already awake
+		}
+	}
+
+	app.flash(r, "flash.export_requested")
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// downloadExport sends a ready export. The signed link is what authorizes
+// the download, so it also works from the email in a browser that is not
+// logged in.
+func (app *application) downloadExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		app.methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	query := r.URL.Query()
+	id, err := strconv.ParseInt(query.Get("id"), 10, 64)
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest, "error.export_link_invalid")
+		return
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() >= expires || !hmac.Equal([]byte(query.Get("sig")), []byte(app.exportSignature(id, expires))) {
+		app.clientError(w, r, http.StatusForbidden, "error.export_link_invalid")
+		return
+	}
+
+	export, archive, err := app.models.DataExports.Archive(r.Context(), id)
+	if errors.Is(err, data.ErrRecordNotFound) || (err == nil && export.ExpiresAt.Unix() != expires) {
+		app.clientError(w, r, http.StatusNotFound, "error.export_link_invalid")
+		return
+	}
+	if err != nil {
+		app.serverError(w, r, fmt.Errorf("loading data export %d: %w", id, err))
+		return
+	}
+	app.audit(r, security.EventDataExportDownload, export.UserID, "", fmt.Sprintf("export %d", export.ID), true)
+
+	filename := "gratitude-jar-" + export.CompletedAt.UTC().Format("2006-01-02") + ".zip"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(archive)))
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := w.Write(archive); err != nil {
+		app.logger.Printf("Error sending data export %d: %v", export.ID, err)
+	}
+}
+
+// exportURL is the signed download path of a ready export
+func (app *application) exportURL(e *data.DataExport) string {
+	expires := e.ExpiresAt.Unix()
+	v := url.Values{}
+	v.Set("id", strconv.FormatInt(e.ID, 10))
+	v.Set("expires", strconv.FormatInt(expires, 10))
+	v.Set("sig", app.exportSignature(e.ID, expires))
+	return "/account/export/download?" + v.Encode()
+}
+
+// exportSignature signs an export's download link, keyed with a key derived
+// from the session secret for the purpose
+func (app *application) exportSignature(id, expires int64) string {
+	mac := hmac.New(sha256.New, app.derivedKey("data-export"))
+	fmt.Fprintf(mac, "data-export:%d:%d", id, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// runExports builds pending exports when woken by a request, and every
+// interval to pick up requests made on other instances, until ctx is
+// cancelled
+func (app *application) runExports(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		app.buildExports(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-app.exportQueue:
+		}
+	}
+}
+
+// buildExports builds every pending export and emails each user a link
+func (app *application) buildExports(ctx context.Context) {
+	for ctx.Err() == nil {
+		var user *data.User
+		export, err := app.models.DataExports.BuildNext(ctx, app.config.Account.ExportTTL, func(e *data.DataExport) ([]byte, error) {
+			var err error
+			user, err = app.models.Users.Get(ctx, e.UserID)
+			if err == nil && user == nil {
+				err = data.ErrRecordNotFound
+			}
+			if err != nil {
+				return nil, err
+			}
+			return app.buildArchive(ctx, user)
+		})
+		if export == nil {
+			if err != nil {
+				app.logger.Printf("Error building data export: %v", err)
+			}
+			return
+		}
+		if err != nil {
+			app.logger.Printf("Error building data export %d: %v", export.ID, err)
+			continue
+		}
+		app.notifyExportReady(ctx, user, export)
+	}
+}
+
+// buildArchive collects everything kept about user into a takeout zip, in
+// their language and time zone
+func (app *application) buildArchive(ctx context.Context, user *data.User) ([]byte, error) {
+	notes, err := app.models.Gratitudes.GetAll(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	prefs, err := app.models.Preferences.Get(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	grants, err := app.models.OAuth.Grants(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := app.models.OAuth.Tokens(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	identities, err := app.models.Identities.ForUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	events, err := app.models.SecurityEvents.ForUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	records := takeout.Records{
+		User:        user,
+		Notes:       notes,
+		Preferences: prefs,
+		Grants:      grants,
+		Tokens:      tokens,
+		Identities:  identities,
+		Events:      events,
+	}
+	tr := app.i18n.Translator(app.i18n.Negotiate(prefs.Locale, ""))
+	var buf bytes.Buffer
+	if err := takeout.Write(&buf, takeout.New(records, time.Now()), tr, prefs.Location()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// notifyExportReady emails user the download link of export
+func (app *application) notifyExportReady(ctx context.Context, user *data.User, export *data.DataExport) {
+	prefs, err := app.models.Preferences.Get(ctx, user.ID)
+	if err != nil {
+		prefs = data.DefaultPreferences(user.ID)
+	}
+	tr := app.i18n.Translator(app.i18n.Negotiate(prefs.Locale, ""))
+
+	base := strings.TrimRight(app.config.Server.BaseURL, "/")
+	if base == "" {
+		base = export.Origin
+	}
+	expires := export.ExpiresAt.In(prefs.Location())
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: tr.T("mail.export_ready.subject"),
+		Body: tr.T("mail.export_ready.body",
+			"username", user.Username,
+			"link", base+app.exportURL(export),
+			"expires", tr.Date(expires)+expires.Format(" 15:04 MST"),
+		),
+	}
+	if err := app.mailer.Send(ctx, msg); err != nil {
+		app.logger.Printf("Error notifying user %d that export %d is ready: %v", user.ID, export.ID, err)
+	}
+}
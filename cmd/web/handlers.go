@@ -3,27 +3,24 @@
 package main
 
 import (
-	"encoding/json"
-	"html/template"
-	"log"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/darynforman/gratitude-jar1/internal/config"
 	"github.com/darynforman/gratitude-jar1/internal/data"
-	"github.com/darynforman/gratitude-jar1/internal/session"
+	"github.com/darynforman/gratitude-jar1/internal/security"
 	"github.com/darynforman/gratitude-jar1/internal/validator"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // home handles requests to the root path ("/").
 // It displays the welcome page of the Gratitude Jar application.
-func home(w http.ResponseWriter, r *http.Request) {
+func (app *application) home(w http.ResponseWriter, r *http.Request) {
 	// Only handle the root path
 	if r.URL.Path != "/" {
-		http.NotFound(w, r)
+		app.notFound(w, r)
 		return
 	}
 
@@ -32,68 +29,57 @@ func home(w http.ResponseWriter, r *http.Request) {
 		Title: "Welcome to Gratitude Jar",
 	}
 	// Render the home template with the given data
-	render(w, r, "home.tmpl", data)
+	app.render(w, r, "home.tmpl", data)
 }
 
-// getGratitudeModel returns a new GratitudeModel instance with the current database connection
-func getGratitudeModel() *data.GratitudeModel {
-	return data.NewModels(config.DB).Gratitudes
-}
-
-// getUserModel returns a new UserModel instance with the current database connection
-func getUserModel() *data.UserModel {
-	return data.NewModels(config.DB).Users
-}
-
-// viewNotes handles requests to view all gratitude notes.
+// viewNotes handles requests to view the user's gratitude notes, a page at a
+// time in the order and page size from their preferences.
 // It supports both full page loads and HTMX partial updates.
-func viewNotes(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Handling view notes request")
+func (app *application) viewNotes(w http.ResponseWriter, r *http.Request) {
+	app.logger.Printf("Handling view notes request")
 
 	// Get user info from session
-	userID := session.Manager.GetInt(r, "userID")
+	userID := app.sessions.GetInt(r, "userID")
+	prefs := app.preferences(r)
+
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
 
 	// Get notes from database with context
-	notes, err := getGratitudeModel().GetAll(r.Context(), userID)
+	notes, total, err := app.models.Gratitudes.GetPage(r.Context(), userID, prefs.SortOrder, prefs.NotesPerPage, (page-1)*prefs.NotesPerPage)
 	if err != nil {
-		log.Printf("Error fetching notes: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		app.serverError(w, r, fmt.Errorf("fetching notes: %w", err))
 		return
 	}
 
 	// Get user role from session
-	role := session.Manager.GetString(r, "role")
+	role := app.sessions.GetString(r, "role")
 
 	data := PageData{
 		Title:           "My Gratitude Notes",
 		Notes:           notes,
 		IsAuthenticated: userID > 0,
 		UserRole:        role,
+		NoteCount:       total,
+		Page:            page,
+		PageCount:       (total + prefs.NotesPerPage - 1) / prefs.NotesPerPage,
 	}
-	log.Printf("Created PageData with %d notes", len(data.Notes))
-
-	// Check if the request is from HTMX (for partial updates)
-	if r.Header.Get("HX-Request") == "true" {
-		log.Printf("HTMX request detected, rendering partial template")
-		// Load and parse only the notes-list section from view-notes.tmpl
-		tmpl := template.Must(template.ParseFiles("ui/html/view-notes.tmpl"))
-		tmpl.ExecuteTemplate(w, "notes-list", data)
-		return
-	}
+	app.logger.Printf("Created PageData with %d notes", len(data.Notes))
 
-	log.Printf("Rendering view notes template")
-	// Otherwise, render the view notes template
-	render(w, r, "notes.tmpl", data)
+	// HTMX requests (e.g. cancelling an edit) get just the list of notes
+	app.renderView(w, r, view{Page: "notes.tmpl", Block: "notes-list"}, data)
 }
 
 // gratitude handles requests to the gratitude page where users can add new notes.
 // It supports both full page loads and HTMX partial updates.
-func gratitude(w http.ResponseWriter, r *http.Request) {
-	emojis := []string{"✨", "🌟", "💫", "🙏", "❤️", "🌈"}
+func (app *application) gratitude(w http.ResponseWriter, r *http.Request) {
+	emojis := noteEmojis
 	if r.Method == http.MethodPost {
 		err := r.ParseForm()
 		if err != nil {
-			http.Error(w, "Bad Request", http.StatusBadRequest)
+			app.clientError(w, r, http.StatusBadRequest, "")
 			return
 		}
 		title := r.PostForm.Get("title")
@@ -103,9 +89,10 @@ func gratitude(w http.ResponseWriter, r *http.Request) {
 		v := validator.ValidateGratitudeNote(title, content, category, emoji)
 		if !v.ValidData() {
 			data := PageData{
-				Title:  "Add Gratitude Note",
-				Errors: v.Errors,
-				Emojis: emojis,
+				Title:     "Add Gratitude Note",
+				Errors:    v.Errors,
+				ErrorArgs: v.Args,
+				Emojis:    emojis,
 				Form: map[string]string{
 					"title":    title,
 					"content":  content,
@@ -113,12 +100,12 @@ func gratitude(w http.ResponseWriter, r *http.Request) {
 					"emoji":    emoji,
 				},
 			}
-			render(w, r, "add-note.tmpl", data)
+			app.render(w, r, "add-note.tmpl", data)
 			return
 		}
-		userID := session.Manager.GetInt(r, "userID")
+		userID := app.sessions.GetInt(r, "userID")
 		if userID == 0 {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			app.clientError(w, r, http.StatusUnauthorized, "")
 			return
 		}
 		note := &data.GratitudeNote{
@@ -130,118 +117,109 @@ func gratitude(w http.ResponseWriter, r *http.Request) {
 			CreatedAt: time.Now(),
 			UpdatedAt: time.Now(),
 		}
-		err = getGratitudeModel().Insert(r.Context(), note)
+		err = app.models.Gratitudes.Insert(r.Context(), note)
 		if err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			app.serverError(w, r, fmt.Errorf("inserting note: %w", err))
 			return
 		}
 		http.Redirect(w, r, "/notes", http.StatusSeeOther)
 		return
 	}
-	// GET: show empty form
+	// GET: show the form with the user's default category and emoji
+	prefs := app.preferences(r)
 	data := PageData{
 		Title:  "Add Gratitude Note",
 		Emojis: emojis,
-		Form:   map[string]string{},
+		Form: map[string]string{
+			"category": prefs.DefaultCategory,
+			"emoji":    prefs.DefaultEmoji,
+		},
 	}
-	render(w, r, "add-note.tmpl", data)
+	app.render(w, r, "add-note.tmpl", data)
 }
 
 // updateGratitude handles both updating and deleting gratitude notes.
 // It processes PUT and DELETE requests and supports HTMX partial updates.
-func updateGratitude(w http.ResponseWriter, r *http.Request) {
+func (app *application) updateGratitude(w http.ResponseWriter, r *http.Request) {
 	method := r.Method
 	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" {
 		method = override
 	}
-	log.Printf("Handling update/delete request with method: %s", method)
-	log.Printf("Request URL: %s", r.URL.Path)
 
 	// Get user info from session
-	userID := session.Manager.GetInt(r, "userID")
+	userID := app.sessions.GetInt(r, "userID")
 	if userID == 0 {
-		log.Printf("No user ID found in session")
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		app.clientError(w, r, http.StatusUnauthorized, "")
 		return
 	}
 
 	// Extract ID from URL path
 	parts := strings.Split(r.URL.Path, "/")
 	if len(parts) < 3 {
-		log.Printf("Invalid URL path: %s", r.URL.Path)
-		http.Error(w, "Invalid URL", http.StatusBadRequest)
+		app.notFound(w, r)
 		return
 	}
 
 	idStr := parts[len(parts)-1]
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		log.Printf("Invalid ID: %v", err)
-		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		app.notFound(w, r)
 		return
 	}
-	log.Printf("Parsed ID: %d", id)
 
 	// Handle DELETE request
 	if method == http.MethodDelete {
-		log.Printf("Processing DELETE request for note ID: %d", id)
-		err = getGratitudeModel().Delete(r.Context(), id, userID)
+		err = app.models.Gratitudes.Delete(r.Context(), id, userID)
 		if err != nil {
-			log.Printf("Error deleting note: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			app.serverError(w, r, fmt.Errorf("deleting note: %w", err))
 			return
 		}
-		// Return empty response for HTMX to remove the element
-		w.WriteHeader(http.StatusOK)
+		app.flash(r, "flash.note_deleted")
+		if !isHTMX(r) {
+			http.Redirect(w, r, "/notes", http.StatusSeeOther)
+			return
+		}
+		// An empty body makes HTMX remove the card; the flash toast goes out of band
+		app.renderView(w, r, view{Page: "notes.tmpl", HX: hxHeaders{Trigger: "noteDeleted"}}, PageData{})
 		return
 	}
 
 	// Accept both PUT and POST for updates
 	if method != http.MethodPut && method != http.MethodPost {
-		log.Printf("Invalid method: %s", method)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		app.methodNotAllowed(w, r, http.MethodPut, http.MethodPost, http.MethodDelete)
 		return
 	}
 
-	log.Printf("Processing PUT request for note ID: %d", id)
-
 	// Parse form data
 	if err := r.ParseForm(); err != nil {
-		log.Printf("Error parsing form: %v", err)
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+		app.clientError(w, r, http.StatusBadRequest, "")
 		return
 	}
 
-	// Debug: Log all incoming form data
-	log.Printf("Raw form data: %v", r.PostForm)
-
 	// Get form values
 	title := r.PostForm.Get("title")
 	content := r.PostForm.Get("content")
 	category := r.PostForm.Get("category")
 	emoji := r.PostForm.Get("emoji")
 
-	// Log form values for debugging
-	log.Printf("Form values - Title: %s, Content: %s, Category: %s, Emoji: %s", title, content, category, emoji)
-
 	// Validate the form data
 	v := validator.ValidateGratitudeNote(title, content, category, emoji)
 	if !v.ValidData() {
-		log.Printf("Validation errors: %v", v.Errors)
-		// If validation fails, return the errors
-		if r.Header.Get("HX-Request") == "true" {
-			// For HTMX requests, return the errors as JSON
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(v.Errors)
-			return
-		}
-		// For regular requests, render the form with errors
+		// Show the form again with the errors, in place of the card for HTMX
 		data := PageData{
-			Title:  "Edit Gratitude Note",
-			Errors: v.Errors,
+			Title:     "Edit Gratitude Note",
+			Errors:    v.Errors,
+			ErrorArgs: v.Args,
+			Note: &data.GratitudeNote{
+				ID:       id,
+				Title:    title,
+				Content:  content,
+				Category: category,
+				Emoji:    emoji,
+			},
+			Emojis: editEmojis,
 		}
-		render(w, r, "edit-note.tmpl", data)
+		app.renderView(w, r, view{Page: "edit-form.tmpl", Block: "edit-form", Status: http.StatusUnprocessableEntity}, data)
 		return
 	}
 
@@ -255,61 +233,57 @@ func updateGratitude(w http.ResponseWriter, r *http.Request) {
 		UserID:    userID,
 		UpdatedAt: time.Now(),
 	}
-	log.Printf("Created note object: %+v", note)
 
 	// Update note in database with context
-	err = getGratitudeModel().Update(r.Context(), note)
+	err = app.models.Gratitudes.Update(r.Context(), note)
 	if err != nil {
-		log.Printf("Error updating note in database: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		app.serverError(w, r, fmt.Errorf("updating note in database: %w", err))
 		return
 	}
-	log.Printf("Successfully updated note in database")
 
 	// Fetch the updated note with context
-	updatedNote, err := getGratitudeModel().Get(r.Context(), id)
+	updatedNote, err := app.models.Gratitudes.Get(r.Context(), id)
 	if err != nil {
-		log.Printf("Error fetching updated note: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		app.serverError(w, r, fmt.Errorf("fetching updated note: %w", err))
 		return
 	}
-	log.Printf("Fetched updated note: %+v", updatedNote)
 
-	// For HTMX requests, return the updated note HTML
-	if r.Header.Get("HX-Request") == "true" {
-		w.Header().Set("Content-Type", "text/html")
-		tmpl := template.Must(template.ParseFiles("ui/html/partials/note-card.tmpl"))
-		if err := tmpl.ExecuteTemplate(w, "note-card", updatedNote); err != nil {
-			log.Printf("Error executing template: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
+	app.flash(r, "flash.note_updated")
+
+	// For regular requests, redirect to notes page
+	if !isHTMX(r) {
+		http.Redirect(w, r, "/notes", http.StatusSeeOther)
 		return
 	}
 
-	// For regular requests, redirect to notes page
-	http.Redirect(w, r, "/notes", http.StatusSeeOther)
+	// For HTMX requests, swap the updated card in place of the form
+	app.renderView(w, r, view{Page: "notes.tmpl", Block: "note", HX: hxHeaders{Trigger: "noteUpdated"}}, PageData{Note: updatedNote})
 }
 
+// noteEmojis are the emojis offered when adding a note, and as the default
+// emoji on the settings page
+var noteEmojis = []string{"✨", "🌟", "💫", "🙏", "❤️", "🌈"}
+
+// editEmojis are the emojis offered when editing a note
+var editEmojis = []string{"✨", "🌟", "💫", "🙏", "❤️", "🌈", "🌞", "🌺", "🎉", "💝", "🌱", "⭐"}
+
 // getNoteForEdit handles requests to get a note for editing.
 // It retrieves a specific note by ID and renders it in the edit form.
-func getNoteForEdit(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Handling get note for edit request")
+func (app *application) getNoteForEdit(w http.ResponseWriter, r *http.Request) {
+	app.logger.Printf("Handling get note for edit request")
 
 	// Extract ID from URL
 	idStr := r.URL.Path[len("/gratitude/edit/"):]
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		log.Printf("Invalid ID: %v", err)
-		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		app.notFound(w, r)
 		return
 	}
 
 	// Get note from database with context
-	note, err := getGratitudeModel().Get(r.Context(), id)
+	note, err := app.models.Gratitudes.Get(r.Context(), id)
 	if err != nil {
-		log.Printf("Error fetching note: %v", err)
-		http.Error(w, "Note not found", http.StatusNotFound)
+		app.notFound(w, r)
 		return
 	}
 
@@ -317,28 +291,27 @@ func getNoteForEdit(w http.ResponseWriter, r *http.Request) {
 	data := PageData{
 		Title:  "Edit Gratitude Note",
 		Note:   note,
-		Emojis: []string{"✨", "🌟", "💫", "🙏", "❤️", "🌈", "🌞", "🌺", "🎉", "💝", "🌱", "⭐"},
+		Emojis: editEmojis,
 	}
 
-	// Render edit form
-	w.Header().Set("Content-Type", "text/html")
-	render(w, r, "edit-form.tmpl", data)
+	// Render the edit form; HTMX swaps it in place of the note card
+	app.renderView(w, r, view{Page: "edit-form.tmpl", Block: "edit-form"}, data)
 }
 
 // registerHandler handles user registration (GET shows form, POST processes registration).
-func registerHandler(w http.ResponseWriter, r *http.Request) {
+func (app *application) registerHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
 		data := PageData{
 			Title: "Register",
 			Form:  map[string]string{}, // Explicitly set empty form data
 		}
-		render(w, r, "register.tmpl", data)
+		app.render(w, r, "register.tmpl", data)
 		return
 	}
 	if r.Method == http.MethodPost {
 		err := r.ParseForm()
 		if err != nil {
-			http.Error(w, "Bad Request", http.StatusBadRequest)
+			app.clientError(w, r, http.StatusBadRequest, "")
 			return
 		}
 		username := r.FormValue("username")
@@ -348,88 +321,76 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 
 		// Validate all registration fields
 		v := validator.ValidateRegistration(username, email, password, confirmPassword)
+		app.screenPassword(v, "password", password, username, email)
 
 		// Check for existing username/email with context
-		userModel := getUserModel()
+		userModel := app.models.Users
 		if user, _ := userModel.GetByUsername(r.Context(), username); user != nil {
-			v.AddError("username", "Username already taken")
+			v.AddError("username", "validation.username.taken")
 		}
 		if user, _ := userModel.GetByEmail(r.Context(), email); user != nil {
-			v.AddError("email", "Email already registered")
+			v.AddError("email", "validation.email.taken")
 		}
 
 		if !v.ValidData() {
 			data := PageData{
-				Title:  "Register",
-				Errors: v.Errors,
+				Title:     "Register",
+				Errors:    v.Errors,
+				ErrorArgs: v.Args,
 				Form: map[string]string{
 					"username": username,
 					"email":    email,
 				},
 			}
-			render(w, r, "register.tmpl", data)
+			app.render(w, r, "register.tmpl", data)
 			return
 		}
 
-		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		hash, err := app.passwords.Hash(password)
 		if err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			app.serverError(w, r, fmt.Errorf("hashing password: %w", err))
 			return
 		}
 
 		// Insert new user with context
-		err = userModel.Insert(r.Context(), username, email, string(hash), "user")
+		err = userModel.Insert(r.Context(), username, email, hash, "user")
 		if err != nil {
+			app.logger.Printf("Error registering user %q: %v", username, err)
 			data := PageData{
 				Title:  "Register",
-				Errors: map[string]string{"generic": "Registration failed: " + err.Error()},
+				Errors: map[string]string{"generic": "register.error.failed"},
 				Form: map[string]string{
 					"username": username,
 					"email":    email,
 				},
 			}
-			render(w, r, "register.tmpl", data)
+			app.render(w, r, "register.tmpl", data)
 			return
 		}
 
 		// Set flash message for successful registration
-		session.Manager.Put(r, "flash", "Registration successful! Please log in.")
+		app.flash(r, "flash.registered")
 		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 		return
 	}
-	http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	app.methodNotAllowed(w, r, http.MethodGet, http.MethodPost)
 }
 
 // loginHandler handles user login (GET shows form, POST processes login).
-func loginHandler(w http.ResponseWriter, r *http.Request) {
+func (app *application) loginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
-		// If this is an HTMX request, return just the navigation
-		if r.Header.Get("HX-Request") == "true" {
-			// Get user info from session
-			userID := session.Manager.GetInt(r, "userID")
-			role := session.Manager.GetString(r, "role")
-
-			data := PageData{
-				Title:           "Navigation",
-				IsAuthenticated: userID > 0,
-				UserRole:        role,
-			}
-			render(w, r, "partials/nav.tmpl", data)
-			return
-		}
-
-		// For regular requests, show the login form with empty form data
+		// Show the login form with empty form data
 		data := PageData{
 			Title: "Login",
 			Form:  map[string]string{}, // Explicitly set empty form data
 		}
-		render(w, r, "login.tmpl", data)
+		app.render(w, r, "login.tmpl", data)
 		return
 	}
 	if r.Method == http.MethodPost {
 		err := r.ParseForm()
 		if err != nil {
-			http.Error(w, "Bad Request", http.StatusBadRequest)
+			app.clientError(w, r, http.StatusBadRequest, "")
 			return
 		}
 		username := r.FormValue("username")
@@ -437,95 +398,146 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 
 		// Validate input fields
 		v := validator.NewValidator()
-		v.Check(validator.NotBlank(username), "username", "Username is required")
+		v.Check(validator.NotBlank(username), "username", "validation.username.required")
 
 		// Validate password format
 		if validator.NotBlank(password) {
 			passwordValidator := validator.ValidatePassword(password)
 			if !passwordValidator.ValidData() {
-				v.AddError("password", "Invalid password format")
+				v.AddError("password", "validation.password.format")
 			}
 		} else {
-			v.AddError("password", "Password is required")
+			v.AddError("password", "validation.password.required")
 		}
 
 		// If there are validation errors
 		if !v.ValidData() {
-			errorMessage := "Please check your username and password format"
-			if r.Header.Get("HX-Request") == "true" {
-				// For HTMX requests, render just the error message template
-				tmpl := template.Must(template.ParseFiles("ui/html/login.tmpl"))
-				tmpl.ExecuteTemplate(w, "error-message", errorMessage)
-				return
-			}
-			// For regular requests, render the full page with error
-			data := PageData{
-				Title:  "Login",
-				Errors: v.Errors,
-			}
-			render(w, r, "login.tmpl", data)
+			v.AddError("generic", "login.error.format")
+			app.loginFailed(w, r, v.Errors)
 			return
 		}
 
 		// Attempt authentication
-		userModel := getUserModel()
+		userModel := app.models.Users
 		user, err := userModel.GetByUsername(r.Context(), username)
 
 		// Check for authentication errors
 		var errorMessage string
 		if err != nil || user == nil {
-			errorMessage = "Invalid username or password"
-		} else if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
-			errorMessage = "Invalid username or password"
+			errorMessage = "login.error.invalid"
+		} else if !app.checkPassword(r, user, password) {
+			errorMessage = "login.error.invalid"
 		}
 
 		// If there's an authentication error
 		if errorMessage != "" {
-			if r.Header.Get("HX-Request") == "true" {
-				// For HTMX requests, render just the error message template
-				tmpl := template.Must(template.ParseFiles("ui/html/login.tmpl"))
-				tmpl.ExecuteTemplate(w, "error-message", errorMessage)
-				return
-			}
-			// For regular requests, render the full page with error
-			data := PageData{
-				Title:  "Login",
-				Errors: map[string]string{"generic": errorMessage},
-			}
-			render(w, r, "login.tmpl", data)
+			app.audit(r, security.EventLogin, 0, username, "invalid username or password", false)
+			app.strike(r, "failed login")
+			app.loginFailed(w, r, map[string]string{"generic": errorMessage})
 			return
 		}
 
-		// Set session values
-		session.Manager.Put(r, "userID", user.ID)
-		session.Manager.Put(r, "role", user.Role)
-		session.Manager.Put(r, "flash", "Successfully logged in!")
-
-		// Check if this is an HTMX request
-		if r.Header.Get("HX-Request") == "true" {
-			// Set HX-Redirect header for successful login
-			w.Header().Set("HX-Redirect", "/")
-			// Also trigger navigation update
-			w.Header().Set("HX-Trigger", "loginSuccess")
+		err = app.logIn(r, user, "password login")
+		if errors.Is(err, data.ErrRecordNotFound) {
+			// Erased while the password was being checked
+			app.loginFailed(w, r, map[string]string{"generic": "login.error.invalid"})
+			return
+		}
+		if errors.Is(err, errAccountDeactivated) {
+			app.loginFailed(w, r, map[string]string{"generic": "login.error.deactivated"})
+			return
+		}
+		if err != nil {
+			app.serverError(w, r, err)
 			return
 		}
 
-		// For regular requests, redirect to home page
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		// HTMX requests load the next page in full, so the flash is shown there
+		if isHTMX(r) {
+			hxHeaders{Redirect: app.loginRedirect(r)}.write(w)
+			return
+		}
+
+		// For regular requests, redirect to the home page or the page that
+		// asked the user to log in
+		http.Redirect(w, r, app.loginRedirect(r), http.StatusSeeOther)
 		return
 	}
 
-	http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	app.methodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+}
+
+// loginFailed shows the login form with errors; HTMX requests get just the
+// error message above the form
+func (app *application) loginFailed(w http.ResponseWriter, r *http.Request, errors map[string]string) {
+	data := PageData{
+		Title:  "Login",
+		Errors: errors,
+	}
+	app.renderView(w, r, view{Page: "login.tmpl", Block: "error-message", Status: http.StatusUnprocessableEntity}, data)
+}
+
+// errAccountDeactivated means the directory has deactivated the account
+var errAccountDeactivated = errors.New("account deactivated")
+
+// logIn starts a session for user, who signed in by method. Logging in
+// during the grace period keeps an account the user asked to delete; if the
+// account was erased in the meantime ErrRecordNotFound is returned.
+// Deactivated accounts are refused with errAccountDeactivated.
+func (app *application) logIn(r *http.Request, user *data.User, method string) error {
+	if user.DeactivatedAt != nil {
+		app.audit(r, security.EventLogin, user.ID, user.Username, method+": account deactivated", false)
+		return errAccountDeactivated
+	}
+
+	flash := "flash.logged_in"
+	if user.DeletionScheduledAt != nil {
+		err := app.models.Users.CancelDeletion(r.Context(), user.ID)
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("cancelling account deletion: %w", err)
+		}
+		app.audit(r, security.EventAccountDeletionCancel, user.ID, user.Username, "cancelled by logging in", true)
+		flash = "flash.deletion_cancelled"
+	}
+
+	app.audit(r, security.EventLogin, user.ID, user.Username, method, true)
+
+	// Set session values
+	app.sessions.Put(r, "userID", user.ID)
+	app.sessions.Put(r, "role", user.Role)
+	app.flash(r, flash)
+	return nil
+}
+
+// requireLoginFor sends a user who is not logged in to the login page,
+// remembering next, a path on this site, so they come back to it
+func (app *application) requireLoginFor(w http.ResponseWriter, r *http.Request, next string) {
+	app.sessions.Put(r, "returnTo", next)
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// loginRedirect returns where to go after logging in: the page remembered by
+// requireLoginFor, or else the home page. Only paths on this site are
+// followed.
+func (app *application) loginRedirect(r *http.Request) string {
+	next := app.sessions.PopString(r, "returnTo")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
 }
 
 // logoutHandler logs out the user by destroying the session.
-func logoutHandler(w http.ResponseWriter, r *http.Request) {
+func (app *application) logoutHandler(w http.ResponseWriter, r *http.Request) {
 	// Clear session data first
-	session.Manager.Put(r, "userID", nil)
-	session.Manager.Put(r, "role", nil)
+	app.sessions.Put(r, "userID", nil)
+	app.sessions.Put(r, "role", nil)
 
 	// Force the session to be saved with cleared values
-	session.Manager.Put(r, "_cleared", time.Now().Unix())
+	app.sessions.Put(r, "_cleared", time.Now().Unix())
 
 	// Redirect to login page
 	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
@@ -533,20 +545,19 @@ func logoutHandler(w http.ResponseWriter, r *http.Request) {
 
 // contact handles requests to the contact page.
 // It displays the contact information and form.
-func contact(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Contact handler called with path: %s and method: %s", r.URL.Path, r.Method)
+func (app *application) contact(w http.ResponseWriter, r *http.Request) {
+	app.logger.Printf("Contact handler called with path: %s and method: %s", r.URL.Path, r.Method)
 
 	// Only handle exact /contact path
 	if r.URL.Path != "/contact" {
-		log.Printf("Invalid contact path: %s", r.URL.Path)
-		http.NotFound(w, r)
+		app.logger.Printf("Invalid contact path: %s", r.URL.Path)
+		app.notFound(w, r)
 		return
 	}
 
 	// Only handle GET requests
 	if r.Method != http.MethodGet {
-		log.Printf("Invalid method for contact: %s", r.Method)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		app.methodNotAllowed(w, r, http.MethodGet)
 		return
 	}
 
@@ -555,22 +566,22 @@ func contact(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Render the contact template with the given data
-	render(w, r, "contact.tmpl", data)
-	log.Printf("Contact page rendered successfully")
+	app.render(w, r, "contact.tmpl", data)
+	app.logger.Printf("Contact page rendered successfully")
 }
 
 // about handles requests to the about page.
-func about(w http.ResponseWriter, r *http.Request) {
+func (app *application) about(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/about" {
-		http.NotFound(w, r)
+		app.notFound(w, r)
 		return
 	}
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		app.methodNotAllowed(w, r, http.MethodGet)
 		return
 	}
 	data := PageData{
 		Title: "About",
 	}
-	render(w, r, "about.tmpl", data)
+	app.render(w, r, "about.tmpl", data)
 }
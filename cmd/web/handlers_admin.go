@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darynforman/gratitude-jar1/internal/data"
+	"github.com/darynforman/gratitude-jar1/internal/ipfilter"
+	"github.com/darynforman/gratitude-jar1/internal/oauth"
+	"github.com/darynforman/gratitude-jar1/internal/security"
+	"github.com/darynforman/gratitude-jar1/internal/validator"
+)
+
+// adminIPRules lists the IP allow/deny rules (GET) and adds a rule (POST)
+func (app *application) adminIPRules(w http.ResponseWriter, r *http.Request) {
+	data := PageData{
+		Title: "IP Rules",
+		Form:  map[string]string{},
+	}
+	status := http.StatusOK
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			app.clientError(w, r, http.StatusBadRequest, "")
+			return
+		}
+		cidr := strings.TrimSpace(r.PostForm.Get("cidr"))
+		action := r.PostForm.Get("action")
+		reason := strings.TrimSpace(r.PostForm.Get("reason"))
+		duration := r.PostForm.Get("duration")
+
+		v := validator.NewValidator()
+		prefix, err := ipfilter.ParsePrefix(cidr)
+		v.Check(err == nil, "cidr", "validation.cidr.invalid")
+		v.Check(action == string(ipfilter.Allow) || action == string(ipfilter.Deny), "action", "validation.action.invalid")
+		v.Check(validator.MaxLength(reason, 200), "reason", "validation.reason.too_long", "count", 200)
+		var expiresAt time.Time
+		if duration != "" {
+			d, err := time.ParseDuration(duration)
+			v.Check(err == nil && d > 0, "duration", "validation.duration.invalid")
+			expiresAt = time.Now().Add(d)
+		}
+
+		if v.ValidData() {
+			userID, _ := app.sessions.GetLoggedInUser(r)
+			username := app.username(r, userID)
+			rule := ipfilter.Rule{
+				Prefix:    prefix,
+				Action:    ipfilter.Action(action),
+				Reason:    reason,
+				CreatedBy: username,
+				ExpiresAt: expiresAt,
+			}
+			if err := app.ipFilter.Add(r.Context(), &rule); err != nil {
+				app.serverError(w, r, fmt.Errorf("adding IP rule: %w", err))
+				return
+			}
+			app.audit(r, ruleAddedEvent(rule), userID, username, describeRule(rule), true)
+			app.flash(r, "admin.flash.added", "action", rule.Action, "network", rule.Prefix)
+			http.Redirect(w, r, "/admin/ip-rules", http.StatusSeeOther)
+			return
+		}
+
+		data.Errors, data.ErrorArgs = v.Errors, v.Args
+		data.Form = map[string]string{"cidr": cidr, "action": action, "reason": reason}
+		status = http.StatusUnprocessableEntity
+	default:
+		app.methodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+		return
+	}
+
+	data.IPRules = app.ipFilter.Rules()
+	app.renderPage(w, r, status, "admin-ip-rules.tmpl", data)
+}
+
+// adminRemoveIPRule deletes a runtime IP rule, lifting a ban or an allowance
+func (app *application) adminRemoveIPRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		app.methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		app.clientError(w, r, http.StatusBadRequest, "")
+		return
+	}
+	id, err := strconv.Atoi(r.PostForm.Get("id"))
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest, "error.invalid_rule_id")
+		return
+	}
+
+	rule, err := app.ipFilter.Remove(r.Context(), id)
+	switch {
+	case errors.Is(err, ipfilter.ErrRuleNotFound):
+		app.flash(r, "admin.flash.rule_gone")
+	case err != nil:
+		app.serverError(w, r, fmt.Errorf("removing IP rule %d: %w", id, err))
+		return
+	default:
+		userID, _ := app.sessions.GetLoggedInUser(r)
+		app.audit(r, ruleRemovedEvent(rule), userID, app.username(r, userID), describeRule(rule)+" removed", true)
+		app.flash(r, "admin.flash.removed", "action", rule.Action, "network", rule.Prefix)
+	}
+	http.Redirect(w, r, "/admin/ip-rules", http.StatusSeeOther)
+}
+
+// adminOAuthClients lists the apps registered as OAuth clients (GET) and
+// registers one (POST). The page that follows a registration shows the new
+// app's secret, which is not stored and cannot be shown again.
+func (app *application) adminOAuthClients(w http.ResponseWriter, r *http.Request) {
+	pageData := PageData{
+		Title: "OAuth Clients",
+		Form:  map[string]string{"type": "confidential"},
+	}
+	status := http.StatusOK
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			app.clientError(w, r, http.StatusBadRequest, "")
+			return
+		}
+		name := strings.TrimSpace(r.PostForm.Get("name"))
+		redirectURIs := strings.Fields(r.PostForm.Get("redirect_uris"))
+		clientType := r.PostForm.Get("type")
+
+		v := validator.NewValidator()
+		v.Check(validator.NotBlank(name), "name", "validation.client_name.required")
+		v.Check(validator.MaxLength(name, 100), "name", "validation.client_name.too_long", "count", 100)
+		v.Check(validator.PermittedValue(clientType, "confidential", "public"), "type", "validation.client_type.invalid")
+		v.Check(len(redirectURIs) > 0, "redirect_uris", "validation.redirect_uris.required")
+		for _, uri := range redirectURIs {
+			if oauth.CheckRedirectURI(uri) != nil {
+				v.AddError("redirect_uris", "validation.redirect_uris.invalid", "uri", uri)
+				break
+			}
+		}
+
+		if v.ValidData() {
+			userID, _ := app.sessions.GetLoggedInUser(r)
+			username := app.username(r, userID)
+			client, secret, err := app.models.OAuth.CreateClient(r.Context(), name, redirectURIs, clientType == "confidential", username)
+			if err != nil {
+				app.serverError(w, r, fmt.Errorf("registering OAuth client: %w", err))
+				return
+			}
+			app.audit(r, security.EventOAuthClient, userID, username,
+				fmt.Sprintf("registered %s (%s) redirecting to %s", client.Name, client.ID, strings.Join(redirectURIs, " ")), true)
+			pageData.OAuthClient = client
+			pageData.ClientSecret = secret
+			break
+		}
+
+		pageData.Errors, pageData.ErrorArgs = v.Errors, v.Args
+		pageData.Form = map[string]string{"name": name, "redirect_uris": r.PostForm.Get("redirect_uris"), "type": clientType}
+		status = http.StatusUnprocessableEntity
+	default:
+		app.methodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+		return
+	}
+
+	clients, err := app.models.OAuth.Clients(r.Context())
+	if err != nil {
+		app.serverError(w, r, fmt.Errorf("listing OAuth clients: %w", err))
+		return
+	}
+	pageData.OAuthClients = clients
+	app.renderPage(w, r, status, "admin-oauth-clients.tmpl", pageData)
+}
+
+// adminRemoveOAuthClient removes a registered app, revoking its access to
+// every user's notes
+func (app *application) adminRemoveOAuthClient(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		app.methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		app.clientError(w, r, http.StatusBadRequest, "")
+		return
+	}
+
+	client, err := app.models.OAuth.DeleteClient(r.Context(), r.PostForm.Get("id"))
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		app.flash(r, "admin.oauth.flash.gone")
+	case err != nil:
+		app.serverError(w, r, fmt.Errorf("removing OAuth client: %w", err))
+		return
+	default:
+		userID, _ := app.sessions.GetLoggedInUser(r)
+		app.audit(r, security.EventOAuthClient, userID, app.username(r, userID), fmt.Sprintf("removed %s (%s)", client.Name, client.ID), true)
+		app.flash(r, "admin.oauth.flash.removed", "name", client.Name)
+	}
+	http.Redirect(w, r, "/admin/oauth-clients", http.StatusSeeOther)
+}
+
+// username looks up the name of the logged-in user for audit records
+func (app *application) username(r *http.Request, userID int) string {
+	user, err := app.models.Users.Get(r.Context(), userID)
+	if err != nil || user == nil {
+		return ""
+	}
+	return user.Username
+}
+
+// describeRule summarises rule for the audit log
+func describeRule(rule ipfilter.Rule) string {
+	s := fmt.Sprintf("%s %s", rule.Action, rule.Prefix)
+	if !rule.ExpiresAt.IsZero() {
+		s += " until " + rule.ExpiresAt.Format(time.RFC3339)
+	}
+	if rule.Reason != "" {
+		s += ": " + rule.Reason
+	}
+	return s
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/darynforman/gratitude-jar1/internal/clientip"
+	"github.com/darynforman/gratitude-jar1/internal/config"
+	"github.com/darynforman/gratitude-jar1/internal/csp"
+	"github.com/darynforman/gratitude-jar1/internal/security"
+)
+
+// maxCSPReportBytes bounds the size of a violation report body
+const maxCSPReportBytes = 64 << 10
+
+// newCSPPolicy builds the Content-Security-Policy from configuration
+func newCSPPolicy(cfg config.HeadersConfig) csp.Policy {
+	policy := csp.Default("/csp-report")
+	policy.ReportOnly = cfg.CSPReportOnly
+	return policy
+}
+
+// cspReport records Content-Security-Policy violation reports sent by
+// browsers. Repeats of a violation from the same client within
+// headers.csp_report_window are dropped.
+func (app *application) cspReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		app.methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCSPReportBytes))
+	if err != nil {
+		app.clientError(w, r, http.StatusRequestEntityTooLarge, "")
+		return
+	}
+	violations, err := csp.ParseReports(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest, "")
+		return
+	}
+
+	userID, _ := app.sessions.GetLoggedInUser(r)
+	ip := clientip.FromRequest(r)
+	for _, v := range violations {
+		if !app.cspReports.First(ip, v) {
+			continue
+		}
+		details := fmt.Sprintf("%s blocked %q on %s", v.EffectiveDirective, v.BlockedURI, v.DocumentURI)
+		if v.SourceFile != "" {
+			details += fmt.Sprintf(" (%s:%d)", v.SourceFile, v.LineNumber)
+		}
+		if v.Sample != "" {
+			details += fmt.Sprintf(" sample %q", v.Sample)
+		}
+		if v.Disposition == "report" {
+			details += " [report only]"
+		}
+		app.audit(r, security.EventCSPViolation, userID, "", details, false)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,110 @@
+// Package main contains the HTMX response helpers for the Gratitude Jar application.
+// Handlers describe a response once as a view; full page loads get the page
+// through the base layout and HTMX requests get just the fragment they swap.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+)
+
+// isHTMX reports whether the request was made by HTMX
+func isHTMX(r *http.Request) bool {
+	return r.Header.Get("HX-Request") == "true"
+}
+
+// hxHeaders are the HTMX response headers a handler can send. Empty fields are
+// not sent.
+type hxHeaders struct {
+	Trigger  string // HX-Trigger: client-side event(s) to fire, e.g. "noteDeleted"
+	Redirect string // HX-Redirect: load this URL as a full page
+	Location string // HX-Location: load this URL with HTMX, without a full reload
+	PushURL  string // HX-Push-Url: URL to push into the browser history
+	Retarget string // HX-Retarget: CSS selector to swap into instead of hx-target
+	Reswap   string // HX-Reswap: swap style to use instead of hx-swap
+	Refresh  bool   // HX-Refresh: reload the whole page
+}
+
+// write sets the headers on w; it must be called before the body is written
+func (h hxHeaders) write(w http.ResponseWriter) {
+	set := func(name, value string) {
+		if value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+	set("HX-Trigger", h.Trigger)
+	set("HX-Redirect", h.Redirect)
+	set("HX-Location", h.Location)
+	set("HX-Push-Url", h.PushURL)
+	set("HX-Retarget", h.Retarget)
+	set("HX-Reswap", h.Reswap)
+	if h.Refresh {
+		w.Header().Set("HX-Refresh", "true")
+	}
+}
+
+// view describes a response that is a full page for normal requests and a
+// fragment for HTMX requests
+type view struct {
+	Page   string    // template set, e.g. "notes.tmpl"; normal requests render its "base"
+	Block  string    // template in Page sent to HTMX requests; "" sends only the out-of-band updates
+	Status int       // status code; defaults to 200
+	HX     hxHeaders // sent with HTMX responses only
+	Nav    bool      // also refresh the navigation out of band, e.g. after logging in
+}
+
+// renderView renders v. HTMX responses also carry any pending flash message
+// as an out-of-band toast, so it is shown even though the layout is not
+// re-rendered.
+func (app *application) renderView(w http.ResponseWriter, r *http.Request, v view, data PageData) {
+	buf, err := app.viewHTML(r, v, data)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.writeView(w, r, v, buf)
+}
+
+// writeView sends a rendered view with its status code and, to HTMX
+// requests, its HTMX headers
+func (app *application) writeView(w http.ResponseWriter, r *http.Request, v view, buf *bytes.Buffer) {
+	status := v.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if isHTMX(r) {
+		v.HX.write(w)
+	}
+	app.writeHTML(w, status, buf)
+}
+
+// viewHTML executes v: the whole page for normal requests, the fragment and
+// out-of-band updates for HTMX requests
+func (app *application) viewHTML(r *http.Request, v view, data PageData) (*bytes.Buffer, error) {
+	if !isHTMX(r) {
+		return app.pageHTML(r, v.Page, data)
+	}
+
+	tmpl, err := app.getTemplate(v.Page)
+	if err != nil {
+		return nil, fmt.Errorf("template %s: %w", v.Page, err)
+	}
+
+	td := app.newTemplateData(r, data)
+	var blocks []string
+	if v.Block != "" {
+		blocks = append(blocks, v.Block)
+	}
+	if td.Flash != "" {
+		blocks = append(blocks, "flash-oob")
+	}
+	if v.Nav {
+		blocks = append(blocks, "nav-oob")
+	}
+	buf, err := executeBlocks(tmpl, td, blocks...)
+	if err != nil {
+		return nil, fmt.Errorf("executing fragment %v of %s: %w", blocks, v.Page, err)
+	}
+	return buf, nil
+}
@@ -0,0 +1,96 @@
+// Package main contains the locale negotiation for the Gratitude Jar application.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/darynforman/gratitude-jar1/internal/i18n"
+)
+
+// localeOption is one entry of the language switcher
+type localeOption struct {
+	Code    string // Locale code, e.g. "es"
+	Name    string // Name of the language in that language, e.g. "Español"
+	Current bool   // Whether it is the locale of this response
+}
+
+// LocaleMiddleware picks the locale for each request: the language in the
+// user's preferences or, for visitors, the one chosen in the switcher, when
+// set, otherwise the best match for Accept-Language. The translator is
+// stored in the request context for handlers and templates.
+func (app *application) LocaleMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		preferred := app.preferences(r).Locale
+		if preferred == "" {
+			preferred = app.sessions.GetString(r, "locale")
+		}
+		locale := app.i18n.Negotiate(preferred, r.Header.Get("Accept-Language"))
+		w.Header().Set("Content-Language", locale)
+		w.Header().Add("Vary", "Accept-Language")
+		next.ServeHTTP(w, r.WithContext(i18n.WithTranslator(r.Context(), app.i18n.Translator(locale))))
+	})
+}
+
+// translator returns the request's translator or, outside LocaleMiddleware
+// (for clients refused by the IP filter or the rate limiter), the best match
+// for Accept-Language
+func (app *application) translator(r *http.Request) *i18n.Translator {
+	if t := i18n.FromContext(r.Context()); t != nil {
+		return t
+	}
+	return app.i18n.Translator(app.i18n.Negotiate("", r.Header.Get("Accept-Language")))
+}
+
+// flash stores a flash message for the next page, translated into the
+// request's locale. args fill the message's placeholders.
+func (app *application) flash(r *http.Request, key string, args ...any) {
+	app.sessions.Put(r, "flash", app.translator(r).T(key, args...))
+}
+
+// localeOptions lists the supported locales for the language switcher
+func (app *application) localeOptions(current string) []localeOption {
+	locales := app.i18n.Locales()
+	options := make([]localeOption, 0, len(locales))
+	for _, code := range locales {
+		options = append(options, localeOption{
+			Code:    code,
+			Name:    app.i18n.Translator(code).T("language.name"),
+			Current: code == current,
+		})
+	}
+	return options
+}
+
+// setLanguage saves the language chosen in the switcher and returns to the
+// page it was chosen on
+func (app *application) setLanguage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		app.methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		app.clientError(w, r, http.StatusBadRequest, "")
+		return
+	}
+	locale := r.PostForm.Get("locale")
+	if !app.i18n.Supported(locale) {
+		app.clientError(w, r, http.StatusBadRequest, "error.unsupported_language")
+		return
+	}
+	app.sessions.Put(r, "locale", locale)
+	if userID := app.sessions.GetInt(r, "userID"); userID > 0 {
+		if err := app.models.Preferences.SetLocale(r.Context(), userID, locale); err != nil {
+			app.serverError(w, r, fmt.Errorf("saving language: %w", err))
+			return
+		}
+	}
+
+	// Only redirect to local paths
+	next := "/"
+	if u, err := url.Parse(r.PostForm.Get("next")); err == nil && u.Host == "" && u.Scheme == "" && len(u.Path) > 0 && u.Path[0] == '/' && (len(u.Path) == 1 || u.Path[1] != '/') {
+		next = u.RequestURI()
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
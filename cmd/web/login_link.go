@@ -0,0 +1,261 @@
+// Package main contains signing in with a single-use link sent by mail for
+// the Gratitude Jar application.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/darynforman/gratitude-jar1/internal/clientip"
+	"github.com/darynforman/gratitude-jar1/internal/data"
+	"github.com/darynforman/gratitude-jar1/internal/i18n"
+	"github.com/darynforman/gratitude-jar1/internal/mailer"
+	"github.com/darynforman/gratitude-jar1/internal/security"
+	"github.com/darynforman/gratitude-jar1/internal/validator"
+)
+
+// loginLinkCookie holds the nonce that binds a sign-in link to the browser
+// that asked for it
+const loginLinkCookie = "login_link"
+
+// requestLoginLink shows the form asking for an email address and sends a
+// sign-in link to it. The response is the same whether or not the address
+// belongs to an account, so the form cannot be used to find out.
+func (app *application) requestLoginLink(w http.ResponseWriter, r *http.Request) {
+	if !app.config.Account.LoginLinks {
+		app.notFound(w, r)
+		return
+	}
+	if r.Method == http.MethodGet {
+		app.render(w, r, "login-link.tmpl", PageData{Title: "Login", Form: map[string]string{}})
+		return
+	}
+	if r.Method != http.MethodPost {
+		app.methodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		app.clientError(w, r, http.StatusBadRequest, "")
+		return
+	}
+
+	email := strings.TrimSpace(r.PostForm.Get("email"))
+	v := validator.ValidateEmail(email)
+	if !v.ValidData() {
+		app.renderPage(w, r, http.StatusUnprocessableEntity, "login-link.tmpl", PageData{
+			Title:  "Login",
+			Errors: v.Errors,
+			Form:   map[string]string{"email": email},
+		})
+		return
+	}
+
+	// The middleware limits requests per IP; each address gets its own
+	// budget too, so nobody's inbox can be flooded from many addresses
+	decision, err := app.limiter.AllowEmail(r.Context(), r.Method, r.URL.Path, email)
+	if err != nil {
+		app.logger.Printf("Rate limit store error: %v", err)
+	}
+	if !decision.Allowed {
+		app.audit(r, security.EventRateLimitExceeded, 0, "", "rule "+decision.Rule+" for "+email, false)
+		w.Header().Set("Retry-After", fmt.Sprint(ceilSeconds(decision.RetryAfter)))
+		app.clientError(w, r, http.StatusTooManyRequests, "")
+		return
+	}
+
+	nonce, err := randomToken()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// The address is looked up and the mail sent in the background, so the
+	// response takes as long whether or not the address has an account
+	req := loginLinkRequest{
+		email:   email,
+		nonce:   nonce,
+		ip:      clientip.FromRequest(r),
+		confirm: app.absoluteURL(r, "/user/login/link/confirm?token="),
+		tr:      app.translator(r),
+		loc:     app.preferences(r).Location(),
+	}
+	select {
+	case app.loginLinkQueue <- req:
+	default:
+		app.logger.Printf("Sign-in link queue is full; dropping the request for %s", email)
+		app.audit(r, security.EventLoginLinkRequest, 0, "", "queue full for "+email, false)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginLinkCookie,
+		Value:    nonce,
+		Path:     "/user/login/link",
+		MaxAge:   int(app.config.Account.LoginLinkTTL.Seconds()),
+		Secure:   app.config.SecureCookies(),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	app.render(w, r, "login-link.tmpl", PageData{
+		Title:         "Login",
+		LoginLinkSent: true,
+		Form:          map[string]string{"email": email},
+	})
+}
+
+// loginLinkRequest is a sign-in link to send, with what the mail needs from
+// the request that asked for it
+type loginLinkRequest struct {
+	email   string
+	nonce   string // binds the link to the browser that asked for it
+	ip      string
+	confirm string // absolute URL of the confirmation page, up to the token
+	tr      *i18n.Translator
+	loc     *time.Location
+}
+
+// sendLoginLinks sends the queued sign-in links until ctx is cancelled
+func (app *application) sendLoginLinks(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case req := <-app.loginLinkQueue:
+			app.sendLoginLink(ctx, req)
+		}
+	}
+}
+
+// sendLoginLink looks up the account of req's address and, unless it is
+// deactivated, records a sign-in link bound to req's nonce and mails it.
+// The outcome is audited.
+func (app *application) sendLoginLink(ctx context.Context, req loginLinkRequest) {
+	user, err := app.models.Users.GetByEmail(ctx, req.email)
+	if err != nil {
+		app.logger.Printf("Error looking up user by email for a sign-in link: %v", err)
+		return
+	}
+
+	event := &data.SecurityEvent{EventType: string(security.EventLoginLinkRequest), IP: req.ip}
+	switch {
+	case user == nil:
+		event.Details = "no account for " + req.email
+	case user.DeactivatedAt != nil:
+		event.UserID, event.Username, event.Details = user.ID, user.Username, "account deactivated"
+	default:
+		event.UserID, event.Username = user.ID, user.Username
+		if err := app.mailLoginLink(ctx, user, req); err != nil {
+			app.logger.Printf("Error sending sign-in link to user %d: %v", user.ID, err)
+			event.Details = "sending failed"
+		} else {
+			event.Details, event.Success = "link sent to "+req.email, true
+		}
+	}
+	app.record(ctx, event)
+}
+
+// mailLoginLink records a sign-in link for user and mails it
+func (app *application) mailLoginLink(ctx context.Context, user *data.User, req loginLinkRequest) error {
+	ttl := app.config.Account.LoginLinkTTL
+	token, err := app.models.LoginLinks.Request(ctx, user.ID, req.nonce, ttl)
+	if err != nil {
+		return fmt.Errorf("requesting sign-in link: %w", err)
+	}
+
+	expires := time.Now().Add(ttl).In(req.loc)
+	return app.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: req.tr.T("mail.login_link.subject"),
+		Body: req.tr.T("mail.login_link.body",
+			"username", user.Username,
+			"link", req.confirm+token,
+			"expires", expires.Format("15:04 MST"),
+			"ip", req.ip,
+		),
+	})
+}
+
+// confirmLoginLink signs in with a link from the mail. Opening the link only
+// shows a button that posts it back, so mail scanners that follow links do
+// not use it up, and the sign-in happens in a same-site request that carries
+// the nonce cookie.
+func (app *application) confirmLoginLink(w http.ResponseWriter, r *http.Request) {
+	if !app.config.Account.LoginLinks {
+		app.notFound(w, r)
+		return
+	}
+	if r.Method == http.MethodGet {
+		app.render(w, r, "login-link.tmpl", PageData{Title: "Login", LoginLinkToken: r.URL.Query().Get("token")})
+		return
+	}
+	if r.Method != http.MethodPost {
+		app.methodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		app.clientError(w, r, http.StatusBadRequest, "")
+		return
+	}
+
+	var nonce string
+	if cookie, err := r.Cookie(loginLinkCookie); err == nil {
+		nonce = cookie.Value
+	}
+	userID, err := app.models.LoginLinks.Consume(r.Context(), r.PostForm.Get("token"), nonce)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		app.clientError(w, r, http.StatusBadRequest, "error.login_link_invalid")
+		return
+	case errors.Is(err, data.ErrLoginLinkBrowser):
+		app.audit(r, security.EventLogin, userID, "", "sign-in link opened in another browser", false)
+		app.clientError(w, r, http.StatusBadRequest, "error.login_link_browser")
+		return
+	case err != nil:
+		app.serverError(w, r, fmt.Errorf("using sign-in link: %w", err))
+		return
+	}
+
+	user, err := app.models.Users.Get(r.Context(), userID)
+	switch {
+	case err == nil && user == nil:
+		err = data.ErrRecordNotFound
+	case err == nil:
+		err = app.logIn(r, user, "sign-in link")
+	}
+	if errors.Is(err, data.ErrRecordNotFound) {
+		app.clientError(w, r, http.StatusBadRequest, "error.login_link_invalid")
+		return
+	}
+	if errors.Is(err, errAccountDeactivated) {
+		app.clientError(w, r, http.StatusForbidden, "error.account_deactivated")
+		return
+	}
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginLinkCookie,
+		Path:     "/user/login/link",
+		MaxAge:   -1,
+		Secure:   app.config.SecureCookies(),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, app.loginRedirect(r), http.StatusSeeOther)
+}
+
+// randomToken returns 32 random bytes as unpadded base64url
+func randomToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
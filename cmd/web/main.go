@@ -3,46 +3,222 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"database/sql"
+	"fmt"
+	"io/fs"
 	"log"
+	"os"
+	_ "time/tzdata" // Time zones for user preferences, even without system zoneinfo
 
+	"github.com/darynforman/gratitude-jar1/internal/auth"
+	"github.com/darynforman/gratitude-jar1/internal/breach"
+	"github.com/darynforman/gratitude-jar1/internal/clientip"
 	"github.com/darynforman/gratitude-jar1/internal/config"
+	"github.com/darynforman/gratitude-jar1/internal/csp"
 	"github.com/darynforman/gratitude-jar1/internal/data"
+	"github.com/darynforman/gratitude-jar1/internal/i18n"
+	"github.com/darynforman/gratitude-jar1/internal/ipfilter"
+	"github.com/darynforman/gratitude-jar1/internal/mailer"
+	"github.com/darynforman/gratitude-jar1/internal/oidc"
+	"github.com/darynforman/gratitude-jar1/internal/ratelimit"
+	"github.com/darynforman/gratitude-jar1/internal/session"
+	"github.com/darynforman/gratitude-jar1/ui"
 )
 
-// application holds the application-wide dependencies and configuration
+// application holds the application-wide dependencies and configuration.
+// Handlers and middleware are methods on it, so several independent
+// instances can live in one process (e.g. in tests).
 type application struct {
-	config *config.Config
-	models *data.Models
-	DB     *sql.DB
+	config    *config.Config
+	db        *sql.DB
+	models    *data.Models
+	sessions  *session.Manager
+	logger    *log.Logger
+	limiter   *ratelimit.Policy
+	clientIP  *clientip.Resolver
+	ipFilter  *ipfilter.Filter
+	csp       csp.Policy
+	templates *templateEngine
+	static    fs.FS
+	i18n      *i18n.Bundle
+	mailer    mailer.Sender
+	passwords *auth.Hasher
+	breached  *breach.Corpus            // nil without a breached password corpus
+	sso       map[string]*oidc.Provider // OpenID Connect providers by name
+	// exportQueue wakes the export worker when an export is requested
+	exportQueue chan struct{}
+	// loginLinkQueue holds the sign-in links for the mail worker to send
+	loginLinkQueue chan loginLinkRequest
+	// cspReports drops repeated violation reports before they are audited
+	cspReports *csp.Deduplicator
 }
 
-var app *application
+// newApplication wires up an application for cfg using db. db may be nil for
+// handlers that do not touch the database.
+func newApplication(cfg *config.Config, db *sql.DB) (*application, error) {
+	// Templates and static files come from the binary, or from disk with
+	// live reload during development
+	uiFS := fs.FS(ui.Files)
+	if cfg.UIFromDisk() {
+		uiFS = os.DirFS(cfg.UI.Dir)
+	}
+	htmlFS, err := fs.Sub(uiFS, "html")
+	if err != nil {
+		return nil, err
+	}
+	staticFS, err := fs.Sub(uiFS, "static")
+	if err != nil {
+		return nil, err
+	}
+	templates, err := newTemplateEngine(htmlFS, cfg.UIFromDisk())
+	if err != nil {
+		return nil, err
+	}
+
+	bundle, err := i18n.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	resolver, err := clientip.NewResolver(cfg.Server.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	ipFilter, err := newIPFilter(cfg.IPFilter, db)
+	if err != nil {
+		return nil, err
+	}
+
+	var breached *breach.Corpus
+	if cfg.Password.BreachedCorpus != "" {
+		if breached, err = breach.Open(cfg.Password.BreachedCorpus); err != nil {
+			return nil, fmt.Errorf("opening breached password corpus: %w", err)
+		}
+	}
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+
+	// Without an SMTP server, mail is written to the log
+	var sender mailer.Sender = &mailer.Log{Logger: logger}
+	if cfg.Mail.Host != "" {
+		sender = &mailer.SMTP{
+			Host:     cfg.Mail.Host,
+			Port:     cfg.Mail.Port,
+			Username: cfg.Mail.Username,
+			Password: cfg.Mail.Password,
+			From:     cfg.Mail.Sender,
+		}
+	}
+
+	app := &application{
+		config: cfg,
+		db:     db,
+		models: data.NewModels(db),
+		// Cookies must only travel over HTTPS in production or when we serve it
+		sessions: session.New(
+			[]byte(cfg.Session.Secret),
+			cfg.Session.Lifetime,
+			cfg.Session.IdleTimeout,
+			cfg.SecureCookies(),
+		),
+		logger:    logger,
+		limiter:   newRateLimitPolicy(cfg.RateLimit, db),
+		clientIP:  resolver,
+		ipFilter:  ipFilter,
+		csp:       newCSPPolicy(cfg.Headers),
+		templates: templates,
+		static:    staticFS,
+		i18n:      bundle,
+		mailer:    sender,
+		breached:  breached,
+		sso:       newSSOProviders(cfg.SSO.Providers),
+		passwords: &auth.Hasher{
+			Algorithm:     cfg.Password.Algorithm,
+			Argon2Memory:  uint32(cfg.Password.Argon2Memory),
+			Argon2Time:    uint32(cfg.Password.Argon2Time),
+			Argon2Threads: uint8(cfg.Password.Argon2Threads),
+			BcryptCost:    cfg.Password.BcryptCost,
+			Pepper:        []byte(cfg.Password.Pepper),
+		},
+		exportQueue:    make(chan struct{}, 1),
+		loginLinkQueue: make(chan loginLinkRequest, 64),
+		cspReports:     csp.NewDeduplicator(cfg.Headers.CSPReportWindow),
+	}
+	return app, nil
+}
+
+// derivedKey returns the key for one use of the session secret, such as
+// pseudonymizing deleted users, so that the secret itself only ever signs
+// session cookies and a value made for one use is worthless for another
+func (app *application) derivedKey(purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(app.config.Session.Secret))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
 
 // main is the entry point of the application.
 // It performs the following tasks:
-// 1. Initializes the database connection and configuration
+// 1. Loads the configuration and opens the database
 // 2. Creates an application instance
-// 3. Starts the HTTP server
+// 3. Starts the HTTP server and blocks until it has shut down
+//
+// Running the binary as `gratitude-jar [flags] migrate ...` applies database
+// migrations instead of starting the server.
 func main() {
-	// Load configuration
-	cfg, err := config.Load()
+	// Load configuration from defaults, config file, environment and flags
+	cfg, err := config.Load(os.Args[1:])
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
+	for _, warning := range cfg.Warnings() {
+		log.Printf("WARNING: %s", warning)
+	}
 
 	// Initialize database
-	if err := config.InitDB(); err != nil {
+	db, err := config.OpenDB(cfg.DB)
+	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 
+	// Handle the migrate subcommand
+	if len(cfg.Args) > 0 && cfg.Args[0] == "migrate" {
+		err := runMigrate(db, cfg.Args[1:])
+		db.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Optionally bring the schema up to date before serving
+	if cfg.DB.AutoMigrate {
+		runner, err := newMigrationRunner(db)
+		if err != nil {
+			log.Fatalf("Failed to load migrations: %v", err)
+		}
+		if err := runner.Up(context.Background()); err != nil {
+			log.Fatalf("Failed to apply migrations: %v", err)
+		}
+		log.Println("Database migrations are up to date")
+	}
+
 	// Create application instance
-	app = &application{
-		config: cfg,
-		models: data.NewModels(config.DB),
-		DB:     config.DB,
+	app, err := newApplication(cfg, db)
+	if err != nil {
+		log.Fatalf("Failed to initialize application: %v", err)
+	}
+	if cfg.UIFromDisk() {
+		log.Printf("Serving templates and static files from %s with live reload", cfg.UI.Dir)
+	} else {
+		log.Println("Serving embedded templates and static files")
 	}
 
 	// Start the server
-	startServer()
+	if err := app.serve(); err != nil {
+		log.Fatalf("Server error: %v", err)
+	}
 }
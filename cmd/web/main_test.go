@@ -1,59 +1,100 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/darynforman/gratitude-jar1/internal/breach"
+	"github.com/darynforman/gratitude-jar1/internal/config"
+	"github.com/darynforman/gratitude-jar1/internal/data"
+	"github.com/darynforman/gratitude-jar1/internal/oidc/oidctest"
+	"github.com/darynforman/gratitude-jar1/internal/validator"
+	"github.com/darynforman/gratitude-jar1/ui"
+	_ "github.com/lib/pq"
 )
 
-// SetTemplateDir is a test helper to set the template directory
-func SetTemplateDir(dir string) {
-	testTemplateDir = dir
+// newTestApplication builds an application with the development defaults,
+// the real templates and no database
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+	return newTestApplicationWithConfig(t, config.Default())
 }
 
-// GetTestTemplateDir is a test helper to get the current template directory
-func GetTestTemplateDir() string {
-	return testTemplateDir
+// newTestApplicationWithConfig builds an application for cfg with the real
+// templates and no database
+func newTestApplicationWithConfig(t *testing.T, cfg *config.Config) *application {
+	t.Helper()
+	return newTestApplicationWithDB(t, cfg, nil)
 }
 
-// setupTestEnvironment sets up the test environment
-func setupTestEnvironment(t *testing.T) {
-	// Get the absolute path to the project root
+// newTestApplicationWithDB builds an application for cfg with the real
+// templates and db
+func newTestApplicationWithDB(t *testing.T, cfg *config.Config, db *sql.DB) *application {
+	t.Helper()
+
+	// Read the templates from the project's ui directory, as in development
 	projectRoot, err := filepath.Abs("../..")
 	if err != nil {
 		t.Fatalf("Failed to get project root: %v", err)
 	}
+	cfg.UI.Dir = filepath.Join(projectRoot, "ui")
 
-	// Set the template directory relative to the project root
-	SetTemplateDir(filepath.Join(projectRoot, "ui/html"))
+	app, err := newApplication(cfg, db)
+	if err != nil {
+		t.Fatalf("Failed to create application: %v", err)
+	}
+	app.logger = log.New(io.Discard, "", 0)
+	return app
 }
 
-func TestMain(m *testing.M) {
-	// Setup code
-	setupTestEnvironment(nil)
-
-	// Run tests
-	code := m.Run()
-
-	os.Exit(code)
+// testDB connects to the migrated database TEST_DATABASE_DSN points at, or
+// skips the test without one
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("opening test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Ping(); err != nil {
+		t.Fatalf("connecting to test database: %v", err)
+	}
+	return db
 }
 
 // TestHomeHandler tests the home page handler
 func TestHomeHandler(t *testing.T) {
+	app := newTestApplication(t)
+
 	// Create a test request
 	req := httptest.NewRequest("GET", "/", nil)
 
 	// Create a response recorder
 	rr := httptest.NewRecorder()
 
-	// Create the handler
-	handler := http.HandlerFunc(home)
-
-	// Serve the request
-	handler.ServeHTTP(rr, req)
+	// Serve the request through the full middleware chain
+	app.routes().ServeHTTP(rr, req)
 
 	// Check the status code
 	status := rr.Code
@@ -67,3 +108,944 @@ func TestHomeHandler(t *testing.T) {
 		t.Errorf("got %q, expected to contain %q", rr.Body.String(), expected)
 	}
 }
+
+// TestIndependentInstances checks that two applications in one process keep
+// their own session managers and limiters
+func TestIndependentInstances(t *testing.T) {
+	first := newTestApplication(t)
+
+	cfg := config.Default()
+	cfg.Session.Secret = strings.Repeat("s", 32)
+	second := newTestApplicationWithConfig(t, cfg)
+
+	if first.sessions == second.sessions || first.limiter == second.limiter {
+		t.Fatal("instances share dependencies")
+	}
+
+	// Log in on the first instance only
+	login := first.sessions.Enable(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		first.sessions.Put(r, "userID", 42)
+		first.sessions.Put(r, "role", "user")
+	}))
+	rr := httptest.NewRecorder()
+	login.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	cookies := rr.Result().Cookies()
+
+	loggedInUser := func(app *application) int {
+		var userID int
+		h := app.sessions.Enable(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, _ = app.sessions.GetLoggedInUser(r)
+		}))
+		req := httptest.NewRequest("GET", "/", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		return userID
+	}
+
+	if got := loggedInUser(first); got != 42 {
+		t.Errorf("first instance: got user %d, expected 42", got)
+	}
+	if got := loggedInUser(second); got != 0 {
+		t.Errorf("second instance accepted the first instance's session: got user %d", got)
+	}
+}
+
+// TestContentSecurityPolicy checks that every script on a page carries the
+// nonce from the response's Content-Security-Policy
+func TestContentSecurityPolicy(t *testing.T) {
+	app := newTestApplication(t)
+
+	nonces := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		app.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/user/login", nil))
+
+		policy := rr.Header().Get("Content-Security-Policy")
+		_, rest, ok := strings.Cut(policy, "'nonce-")
+		if !ok {
+			t.Fatalf("no nonce in policy %q", policy)
+		}
+		nonce, _, _ := strings.Cut(rest, "'")
+		nonces[nonce] = true
+
+		body := rr.Body.String()
+		if scripts, withNonce := strings.Count(body, "<script"), strings.Count(body, `<script nonce="`+nonce+`"`); scripts == 0 || scripts != withNonce {
+			t.Errorf("%d of %d scripts carry the nonce", withNonce, scripts)
+		}
+		if strings.Contains(body, "onclick=") {
+			t.Error("page contains an inline event handler")
+		}
+		for _, header := range []string{"Strict-Transport-Security", "Permissions-Policy", "Cross-Origin-Opener-Policy", "Cross-Origin-Embedder-Policy"} {
+			if rr.Header().Get(header) == "" {
+				t.Errorf("missing %s header", header)
+			}
+		}
+	}
+	if len(nonces) != 2 {
+		t.Error("nonce was reused across requests")
+	}
+}
+
+// TestCSRFFailure checks that forged form posts are refused and that HTMX
+// requests get a fragment aimed at the page's error container
+func TestCSRFFailure(t *testing.T) {
+	app := newTestApplication(t)
+
+	for _, htmx := range []bool{false, true} {
+		req := httptest.NewRequest("POST", "/user/login", strings.NewReader("username=a&password=b"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if htmx {
+			req.Header.Set("HX-Request", "true")
+		}
+		rr := httptest.NewRecorder()
+		app.routes().ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("htmx=%v: got status %d, expected 403", htmx, rr.Code)
+		}
+		if got := rr.Header().Get("HX-Retarget"); htmx != (got == "#error-container") {
+			t.Errorf("htmx=%v: HX-Retarget = %q", htmx, got)
+		}
+	}
+}
+
+// TestCSRFChecks checks which unsafe requests need a token: altered tokens
+// are refused, while bearer-authenticated requests and exempt paths,
+// built-in or configured, skip the check
+func TestCSRFChecks(t *testing.T) {
+	cfg := config.Default()
+	cfg.CSRF.ExemptPaths = []string{"/hooks/", "/ping"}
+	app := newTestApplicationWithConfig(t, cfg)
+	handler := app.routes()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/user/login", nil))
+	token := formToken(t, rr.Body.String())
+	cookies := rr.Result().Cookies()
+	var csrfCookie *http.Cookie
+	for _, c := range cookies {
+		if c.Name == cfg.CSRF.CookieName {
+			csrfCookie = c
+		}
+	}
+	if csrfCookie == nil || !csrfCookie.HttpOnly || csrfCookie.SameSite != http.SameSiteStrictMode {
+		t.Fatalf("CSRF cookie not set as configured: %+v", csrfCookie)
+	}
+
+	// Changing any character of the token invalidates it
+	tampered := []byte(token)
+	if tampered[0] == 'A' {
+		tampered[0] = 'B'
+	} else {
+		tampered[0] = 'A'
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		token   string
+		bearer  bool
+		refused bool
+	}{
+		{"valid token", "/user/login", token, false, false},
+		{"tampered token", "/user/login", string(tampered), false, true},
+		{"no token", "/user/login", "", false, true},
+		{"bearer token", "/api/notes", "", true, false},
+		{"bearer token for SCIM", "/scim/v2/Users", "", true, false},
+		{"bearer token on a session route", "/user/login", "", true, true},
+		{"CSP report", "/csp-report", "", false, false},
+		{"OAuth token endpoint", "/oauth/token", "", false, false},
+		{"configured path", "/ping", "", false, false},
+		{"configured subtree", "/hooks/deploy", "", false, false},
+		{"outside configured path", "/ping/more", "", false, true},
+	}
+	for _, tt := range tests {
+		form := url.Values{"username": {""}, "password": {""}}
+		if tt.token != "" {
+			form.Set("csrf_token", tt.token)
+		}
+		req := httptest.NewRequest("POST", tt.path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		if tt.bearer {
+			req.Header.Set("Authorization", "Bearer not-a-real-token")
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if refused := rr.Code == http.StatusForbidden; refused != tt.refused {
+			t.Errorf("%s: got status %d, expected refused=%v", tt.name, rr.Code, tt.refused)
+		}
+	}
+}
+
+// formToken returns the CSRF token from the hidden field of a rendered form
+func formToken(t *testing.T, body string) string {
+	t.Helper()
+	m := regexp.MustCompile(`name="csrf_token" value="([^"]+)"`).FindStringSubmatch(body)
+	if m == nil {
+		t.Fatal("no CSRF token in the form")
+	}
+	return html.UnescapeString(m[1])
+}
+
+// TestRateLimitedPage checks that clients refused by the rate limiter, which
+// runs before the locale and preferences are loaded, still get the themed
+// error page in their language with the security headers
+func TestRateLimitedPage(t *testing.T) {
+	cfg := config.Default()
+	cfg.RateLimit.Rate, cfg.RateLimit.Burst = 0.01, 1
+	handler := newTestApplicationWithConfig(t, cfg).routes()
+
+	var rr *httptest.ResponseRecorder
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Language", "es")
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+	}
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, expected 429", rr.Code)
+	}
+	if rr.Header().Get("Content-Security-Policy") == "" || rr.Header().Get("X-Request-ID") == "" {
+		t.Errorf("missing security headers or request ID: %v", rr.Header())
+	}
+	if !strings.Contains(rr.Body.String(), "Demasiadas solicitudes") {
+		t.Errorf("error page is not in Spanish:\n%s", rr.Body)
+	}
+}
+
+// TestEmbeddedTemplates checks that the templates compiled into the binary
+// parse and validate, and that dev mode picks up edits without a restart
+func TestEmbeddedTemplates(t *testing.T) {
+	htmlFS, err := fs.Sub(ui.Files, "html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newTemplateEngine(htmlFS, false); err != nil {
+		t.Fatalf("embedded templates: %v", err)
+	}
+
+	dir := t.TempDir()
+	write := func(name, content string, mod time.Time) {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	write("base.tmpl", `{{define "base"}}{{template "title" .}}{{template "content" .}}{{end}}`, start)
+	write("page.tmpl", `{{define "title"}}T{{end}}{{define "content"}}old{{end}}`, start)
+
+	engine, err := newTemplateEngine(os.DirFS(dir), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	render := func() string {
+		ts, err := engine.get("page.tmpl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sb strings.Builder
+		if err := ts.ExecuteTemplate(&sb, "base", nil); err != nil {
+			t.Fatal(err)
+		}
+		return sb.String()
+	}
+	if got := render(); got != "Told" {
+		t.Fatalf("got %q", got)
+	}
+
+	write("page.tmpl", `{{define "title"}}T{{end}}{{define "content"}}new{{end}}`, start.Add(time.Minute))
+	if got := render(); got != "Tnew" {
+		t.Errorf("after edit got %q, want reloaded template", got)
+	}
+
+	// A page calling an undefined template is rejected
+	write("page.tmpl", `{{define "title"}}T{{end}}{{define "content"}}{{template "missing"}}{{end}}`, start.Add(2*time.Minute))
+	if _, err := engine.get("page.tmpl"); err == nil {
+		t.Error("expected an error for a call to an undefined template")
+	}
+}
+
+// TestLoginFragment checks that a failed HTMX login gets only the error
+// message fragment while a normal post gets the whole page
+func TestLoginFragment(t *testing.T) {
+	app := newTestApplication(t)
+	handler := app.routes()
+
+	// Fetch the form for a CSRF cookie and token
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/user/login", nil))
+	token := formToken(t, rr.Body.String())
+	cookies := rr.Result().Cookies()
+
+	for _, htmx := range []bool{false, true} {
+		form := url.Values{"username": {""}, "password": {""}, "csrf_token": {token}}
+		req := httptest.NewRequest("POST", "/user/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		if htmx {
+			req.Header.Set("HX-Request", "true")
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("htmx=%v: got status %d, expected 422", htmx, rr.Code)
+		}
+		body := rr.Body.String()
+		if !strings.Contains(body, "Please check your username and password format") {
+			t.Errorf("htmx=%v: error message missing", htmx)
+		}
+		if isPage := strings.Contains(body, "<html"); isPage == htmx {
+			t.Errorf("htmx=%v: got full page = %v", htmx, isPage)
+		}
+	}
+}
+
+// TestErrorResponses checks that errors are sent as the themed page, an
+// HTMX toast or problem+json depending on the request, and that panics are
+// logged with a stack trace and the request ID
+func TestErrorResponses(t *testing.T) {
+	app := newTestApplication(t)
+	handler := app.routes()
+
+	tests := []struct {
+		name        string
+		header      map[string]string
+		contentType string
+		body        string
+	}{
+		{"page", nil, "text/html", "find that page"},
+		{"htmx", map[string]string{"HX-Request": "true"}, "text/html", `role="alert"`},
+		{"json", map[string]string{"Accept": "application/json"}, "application/problem+json", `"status":404`},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/no-such-page", nil)
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("%s: got status %d, expected 404", tt.name, rr.Code)
+		}
+		if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.contentType) {
+			t.Errorf("%s: got Content-Type %q", tt.name, ct)
+		}
+		if !strings.Contains(rr.Body.String(), tt.body) {
+			t.Errorf("%s: body does not contain %q:\n%s", tt.name, tt.body, rr.Body.String())
+		}
+	}
+
+	var logs strings.Builder
+	app.logger = log.New(&logs, "", 0)
+	panicking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { panic("boom") })
+	h := app.RequestIDMiddleware(app.sessions.Enable(app.SecureHeadersMiddleware(app.RecoverPanicMiddleware(panicking))))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+	id := rr.Header().Get("X-Request-ID")
+	if rr.Code != http.StatusInternalServerError || id == "" {
+		t.Fatalf("got status %d and request ID %q", rr.Code, id)
+	}
+	if !strings.Contains(rr.Body.String(), id) {
+		t.Error("500 page does not show the request ID")
+	}
+	if !strings.Contains(logs.String(), id) || !strings.Contains(logs.String(), "goroutine") {
+		t.Errorf("panic not logged with request ID and stack:\n%s", logs.String())
+	}
+
+	// A page whose template is missing gets the same error responses
+	missing := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.renderView(w, r, view{Page: "no-such-page.tmpl", Block: "content"}, PageData{})
+	})
+	h = app.RequestIDMiddleware(app.sessions.Enable(app.SecureHeadersMiddleware(missing)))
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/broken", nil)
+		if tt.name != "json" {
+			req.URL.Path = "/broken"
+		}
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusInternalServerError {
+			t.Errorf("missing template, %s: got status %d, expected 500", tt.name, rr.Code)
+		}
+		if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.contentType) {
+			t.Errorf("missing template, %s: got Content-Type %q", tt.name, ct)
+		}
+	}
+	if !strings.Contains(logs.String(), "no-such-page.tmpl") {
+		t.Errorf("missing template not logged:\n%s", logs.String())
+	}
+}
+
+// TestTranslations checks that every message key used in the templates is in
+// the catalogs and that pages follow Accept-Language
+func TestTranslations(t *testing.T) {
+	app := newTestApplication(t)
+	tr := app.i18n.Translator("en")
+
+	key := regexp.MustCompile(`\.T "([a-z0-9_.]+)"`)
+	err := fs.WalkDir(ui.Files, "html", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := fs.ReadFile(ui.Files, path)
+		if err != nil {
+			return err
+		}
+		for _, m := range key.FindAllStringSubmatch(string(b), -1) {
+			if !tr.Has(m[1]) {
+				t.Errorf("%s: no message for %s", path, m[1])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := app.routes()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Language", "es-ES,es;q=0.9,en;q=0.5")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if got := rr.Header().Get("Content-Language"); got != "es" {
+		t.Errorf("got Content-Language %q, expected es", got)
+	}
+	for _, want := range []string{`<html lang="es">`, "Tu viaje diario", "Iniciar sesión"} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("Spanish home page does not contain %q", want)
+		}
+	}
+}
+
+// TestPreferences checks that the user's preferences reach the pages: their
+// language, theme and form values, and dates in their time zone
+func TestPreferences(t *testing.T) {
+	app := newTestApplication(t)
+
+	prefs := data.DefaultPreferences(1)
+	prefs.Locale, prefs.Timezone, prefs.Theme = "es", "America/Belize", data.ThemeDark
+	handler := app.sessions.Enable(app.LocaleMiddleware(http.HandlerFunc(app.settings)))
+	req := httptest.NewRequest("GET", "/settings", nil)
+	req = req.WithContext(context.WithValue(req.Context(), preferencesKey{}, prefs))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d:\n%s", rr.Code, rr.Body.String())
+	}
+	for _, want := range []string{`<html lang="es" class="dark">`, `value="America/Belize"`, "Zona horaria"} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("settings page does not contain %q", want)
+		}
+	}
+
+	// Just after midnight UTC it is still the day before in Belize
+	td := templateData{Translator: app.i18n.Translator("en"), Prefs: prefs}
+	created := time.Date(2024, time.March, 29, 1, 0, 0, 0, time.UTC)
+	if got := td.Date(created); got != "Mar 28, 2024" {
+		t.Errorf("got date %q, expected Mar 28, 2024", got)
+	}
+	if got := td.Card(data.GratitudeNote{CreatedAt: created}).Date(created); got != "Mar 28, 2024" {
+		t.Errorf("got note card date %q, expected Mar 28, 2024", got)
+	}
+}
+
+// TestAccountPage renders the account forms with an error, and checks the
+// links put in confirmation mail and the pseudonyms of deleted users
+func TestAccountPage(t *testing.T) {
+	app := newTestApplication(t)
+
+	user := &data.User{ID: 1, Username: "ana", Email: "ana@example.com"}
+	handler := app.sessions.Enable(app.LocaleMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.renderAccount(w, r, http.StatusUnprocessableEntity, user, PageData{
+			Errors: map[string]string{"current_password": "validation.current_password.incorrect"},
+		})
+	})))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/account/password", nil))
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d:\n%s", rr.Code, rr.Body.String())
+	}
+	for _, want := range []string{
+		`action="/account/username"`, `action="/account/email"`, `action="/account/password"`,
+		`value="ana"`, "ana@example.com", "Your current password is incorrect",
+		`action="/account/delete"`, "erased 14 days after you confirm", `action="/account/export"`,
+	} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("account page does not contain %q", want)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/account", nil)
+	req.Host = "localhost:4000"
+	if got := app.absoluteURL(req, "/account/email/confirm?token=abc"); got != "http://localhost:4000/account/email/confirm?token=abc" {
+		t.Errorf("got %q", got)
+	}
+	// Deleted users' audit records are kept under a stable pseudonym
+	if p := app.pseudonym(1); p != app.pseudonym(1) || p == app.pseudonym(2) || !regexp.MustCompile(`^deleted-[0-9a-f]{16}$`).MatchString(p) {
+		t.Errorf("got pseudonyms %q and %q", p, app.pseudonym(2))
+	}
+
+	app.config.Server.BaseURL = "https://gratitude.example.com/"
+	if got := app.absoluteURL(req, "/account/email/confirm?token=abc"); got != "https://gratitude.example.com/account/email/confirm?token=abc" {
+		t.Errorf("got %q with a base URL", got)
+	}
+}
+
+func TestExportLink(t *testing.T) {
+	app := newTestApplication(t)
+
+	completed := time.Now()
+	expires := completed.Add(48 * time.Hour)
+	export := &data.DataExport{ID: 42, UserID: 1, Status: data.ExportReady, CompletedAt: &completed, ExpiresAt: &expires}
+	link := app.exportURL(export)
+
+	handler := app.sessions.Enable(app.LocaleMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.renderAccount(w, r, http.StatusOK, &data.User{ID: 1, Username: "ana"}, PageData{Export: export, ExportURL: link})
+	})))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/account", nil))
+	if body := rr.Body.String(); !strings.Contains(body, "Download archive") || !strings.Contains(body, "sig=") {
+		t.Errorf("account page does not link to the ready export:\n%s", body)
+	}
+
+	// Links with a tampered id, expiry or signature, or that have expired,
+	// are refused before the database is touched
+	u, _ := url.Parse(link)
+	q := u.Query()
+	past := time.Now().Add(-time.Hour).Unix()
+	for name, change := range map[string]func(url.Values){
+		"id":        func(v url.Values) { v.Set("id", "43") },
+		"expires":   func(v url.Values) { v.Set("expires", strconv.FormatInt(expires.Unix()+3600, 10)) },
+		"signature": func(v url.Values) { v.Set("sig", strings.Repeat("0", 64)) },
+		"expired": func(v url.Values) {
+			v.Set("expires", strconv.FormatInt(past, 10))
+			v.Set("sig", app.exportSignature(42, past))
+		},
+	} {
+		v := url.Values{}
+		for k := range q {
+			v.Set(k, q.Get(k))
+		}
+		change(v)
+		rr := httptest.NewRecorder()
+		app.sessions.Enable(app.LocaleMiddleware(http.HandlerFunc(app.downloadExport))).ServeHTTP(rr, httptest.NewRequest("GET", "/account/export/download?"+v.Encode(), nil))
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("%s: got status %d", name, rr.Code)
+		}
+	}
+}
+
+func TestPasswordScreening(t *testing.T) {
+	// A strong password that has nonetheless leaked
+	const leaked = "mapleSunrise47?"
+	corpus := filepath.Join(t.TempDir(), "pwned.txt")
+	if err := os.WriteFile(corpus, []byte(breach.Hash(leaked)+":42\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.Password.BreachedCorpus = corpus
+	app := newTestApplicationWithConfig(t, cfg)
+
+	hash, err := app.passwords.Hash(leaked)
+	if err != nil || !strings.HasPrefix(hash, "$argon2id$") {
+		t.Fatalf("got hash %q, %v", hash, err)
+	}
+
+	tests := []struct {
+		password string
+		key      string
+	}{
+		{"Password1!", "validation.password.weak.common"},
+		{"Ana.Jar.1!", "validation.password.weak.personal"},
+		{leaked, "validation.password.breached"},
+		{"Quiet-Maple-Harbor-92", ""},
+	}
+	for _, tt := range tests {
+		v := validator.NewValidator()
+		app.screenPassword(v, "password", tt.password, "ana", "ana@example.com")
+		if v.Errors["password"] != tt.key {
+			t.Errorf("%q: got %q, want %q", tt.password, v.Errors["password"], tt.key)
+		}
+	}
+
+	// The meter shows the same verdict while the password is typed
+	handler := app.sessions.Enable(app.LocaleMiddleware(http.HandlerFunc(app.passwordStrength)))
+	form := url.Values{"password": {leaked}, "username": {"ana"}}
+	req := httptest.NewRequest("POST", "/password-strength", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("HX-Request", "true")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	body := rr.Body.String()
+	for _, want := range []string{`id="password-strength"`, `aria-valuenow="0"`, "Very weak", "data breaches 42 times"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("meter does not contain %q:\n%s", want, body)
+		}
+	}
+}
+
+// TestLoginLinkPages checks the sign-in link pages that need no database:
+// the request form, the confirmation button, the per-address rate limit and
+// switching the feature off
+func TestLoginLinkPages(t *testing.T) {
+	app := newTestApplication(t)
+	handler := app.routes()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/user/login", nil))
+	if !strings.Contains(rr.Body.String(), `href="/user/login/link"`) {
+		t.Error("login page does not offer a sign-in link")
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/user/login/link", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d", rr.Code)
+	}
+	token := formToken(t, rr.Body.String())
+	cookies := rr.Result().Cookies()
+
+	// Opening the link from the mail must not use it up, only offer to
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/user/login/link/confirm?token=abc", nil))
+	body := rr.Body.String()
+	if !strings.Contains(body, `action="/user/login/link/confirm"`) || !strings.Contains(body, `name="token" value="abc"`) {
+		t.Errorf("confirmation page does not post the token back:\n%s", body)
+	}
+
+	// Each address has its own budget on top of the per-IP one
+	for i := 0; i < 3; i++ {
+		app.limiter.AllowEmail(context.Background(), "POST", "/user/login/link", "ana@example.com")
+	}
+	form := url.Values{"email": {"ana@example.com"}, "csrf_token": {token}}
+	req := httptest.NewRequest("POST", "/user/login/link", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("got status %d with Retry-After %q, expected 429", rr.Code, rr.Header().Get("Retry-After"))
+	}
+
+	// The address is only looked up by the mail worker, so the response is
+	// the same, and as quick, whether or not it has an account
+	form.Set("email", "bo@example.com")
+	req = httptest.NewRequest("POST", "/user/login/link", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	var nonce string
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == loginLinkCookie {
+			nonce = c.Value
+		}
+	}
+	if rr.Code != http.StatusOK || nonce == "" {
+		t.Fatalf("got status %d and nonce %q", rr.Code, nonce)
+	}
+	select {
+	case queued := <-app.loginLinkQueue:
+		if queued.email != "bo@example.com" || queued.nonce != nonce || !strings.HasSuffix(queued.confirm, "/user/login/link/confirm?token=") {
+			t.Errorf("queued %+v", queued)
+		}
+	default:
+		t.Error("the sign-in link was not queued")
+	}
+
+	cfg := config.Default()
+	cfg.Account.LoginLinks = false
+	off := newTestApplicationWithConfig(t, cfg).routes()
+	rr = httptest.NewRecorder()
+	off.ServeHTTP(rr, httptest.NewRequest("GET", "/user/login/link", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("disabled sign-in links: got status %d, expected 404", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	off.ServeHTTP(rr, httptest.NewRequest("GET", "/user/login", nil))
+	if strings.Contains(rr.Body.String(), `href="/user/login/link"`) {
+		t.Error("login page offers sign-in links while they are disabled")
+	}
+}
+
+// TestSSO runs the sign-in flow against a fake identity provider up to the
+// account lookup, which needs a database: the redirect with PKCE, the hop
+// back to our own site and the state and ID token checks
+func TestSSO(t *testing.T) {
+	idp := oidctest.NewServer("jar", "s3cret")
+	defer idp.Close()
+
+	cfg := config.Default()
+	cfg.SSO.Providers = []config.SSOProvider{{Name: "corp", Label: "Corp SSO", Issuer: idp.URL, ClientID: "jar", ClientSecret: "s3cret"}}
+	handler := newTestApplicationWithConfig(t, cfg).routes()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/user/login", nil))
+	if !strings.Contains(rr.Body.String(), `href="/sso/login?provider=corp"`) || !strings.Contains(rr.Body.String(), "Corp SSO") {
+		t.Error("login page has no button for the provider")
+	}
+
+	// start signs in at the provider and returns the query it sends back
+	// to the callback, with the flow cookie
+	start := func() (url.Values, []*http.Cookie) {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/sso/login?provider=corp", nil))
+		authURL := rr.Header().Get("Location")
+		if rr.Code != http.StatusFound || !strings.HasPrefix(authURL, idp.URL+"/authorize?") || !strings.Contains(authURL, "code_challenge_method=S256") {
+			t.Fatalf("got status %d redirecting to %q", rr.Code, authURL)
+		}
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		resp, err := client.Get(authURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		back, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil || back.Path != "/sso/callback" {
+			t.Fatalf("provider redirected to %q", resp.Header.Get("Location"))
+		}
+		return back.Query(), rr.Result().Cookies()
+	}
+	complete := func(query url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/sso/complete?"+query.Encode(), nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	query, cookies := start()
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/sso/callback?"+query.Encode(), nil))
+	if !strings.Contains(rr.Body.String(), `http-equiv="refresh"`) || !strings.Contains(rr.Body.String(), "/sso/complete?") {
+		t.Errorf("callback does not move on to /sso/complete:\n%s", rr.Body.String())
+	}
+
+	if rr := complete(query, nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("without the flow cookie: got status %d, expected 400", rr.Code)
+	}
+	forged := url.Values{"code": query["code"], "state": {"forged"}}
+	if rr := complete(forged, cookies); rr.Code != http.StatusBadRequest {
+		t.Errorf("with another state: got status %d, expected 400", rr.Code)
+	}
+	denied := url.Values{"error": {"access_denied"}, "state": query["state"]}
+	if rr := complete(denied, cookies); rr.Code != http.StatusUnauthorized {
+		t.Errorf("denied by the provider: got status %d, expected 401", rr.Code)
+	}
+
+	// An ID token for another client is refused before any account is looked up
+	idp.SetClaims(func(claims map[string]any) { claims["aud"] = "someone-else" })
+	query, cookies = start()
+	if rr := complete(query, cookies); rr.Code != http.StatusUnauthorized {
+		t.Errorf("ID token for another client: got status %d, expected 401", rr.Code)
+	}
+}
+
+func TestOAuth(t *testing.T) {
+	app := newTestApplication(t)
+	handler := app.routes()
+
+	// The consent page names the app and what it asks for, and posts the
+	// request back with the decision
+	consent := app.sessions.Enable(app.LocaleMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.renderPage(w, r, http.StatusOK, "oauth-consent.tmpl", PageData{
+			Title:       "Authorize",
+			OAuthClient: &data.OAuthClient{ID: "abc", Name: "Jar Sync"},
+			OAuthScopes: []string{"notes:read", "notes:write"},
+			Form:        map[string]string{"client_id": "abc", "state": "xyz"},
+		})
+	})))
+	rr := httptest.NewRecorder()
+	consent.ServeHTTP(rr, httptest.NewRequest("GET", "/oauth/consent", nil))
+	body := rr.Body.String()
+	for _, want := range []string{"Jar Sync", "Read your notes", "Add notes for you", `name="state" value="xyz"`, `value="allow"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("consent page lacks %q:\n%s", want, body)
+		}
+	}
+
+	// API calls without a token are challenged with problem details
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/notes", nil))
+	if rr.Code != http.StatusUnauthorized || !strings.HasPrefix(rr.Header().Get("WWW-Authenticate"), "Bearer") {
+		t.Errorf("got status %d with WWW-Authenticate %q", rr.Code, rr.Header().Get("WWW-Authenticate"))
+	}
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/problem+json") {
+		t.Errorf("got Content-Type %q", ct)
+	}
+
+	// The token endpoint needs no CSRF token but does need a client
+	req := httptest.NewRequest("POST", "/oauth/token", strings.NewReader("grant_type=authorization_code&code=x"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), `"invalid_client"`) {
+		t.Errorf("token without a client: got status %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/oauth/token", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /oauth/token: got status %d", rr.Code)
+	}
+
+	// Without a client there is nowhere safe to send errors back to
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/oauth/authorize?response_type=code", nil))
+	if rr.Code != http.StatusBadRequest || rr.Header().Get("Location") != "" {
+		t.Errorf("authorize without a client: got status %d redirecting to %q", rr.Code, rr.Header().Get("Location"))
+	}
+}
+
+func TestSCIM(t *testing.T) {
+	rr := httptest.NewRecorder()
+	newTestApplication(t).routes().ServeHTTP(rr, httptest.NewRequest("GET", "/scim/v2/Users", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("without a token configured: got status %d, expected 404", rr.Code)
+	}
+
+	const token = "scim-token-0123456789-0123456789-0123456789"
+	cfg := config.Default()
+	cfg.SCIM.Token = token
+	app := newTestApplicationWithConfig(t, cfg)
+	handler := app.routes()
+	do := func(method, target, auth, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/scim+json")
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for _, auth := range []string{"", "wrong"} {
+		rr := do("GET", "/scim/v2/Users", auth, "")
+		if rr.Code != http.StatusUnauthorized || rr.Header().Get("WWW-Authenticate") == "" || rr.Header().Get("Content-Type") != "application/scim+json" {
+			t.Errorf("token %q: got status %d, WWW-Authenticate %q, Content-Type %q", auth, rr.Code, rr.Header().Get("WWW-Authenticate"), rr.Header().Get("Content-Type"))
+		}
+	}
+
+	// Bad requests are refused with SCIM errors before the database is used
+	tests := []struct {
+		name, method, target, body string
+		status                     int
+		scimType                   string
+	}{
+		{"unsupported filter", "GET", "/scim/v2/Users?filter=" + url.QueryEscape(`userName sw "a"`), "", http.StatusBadRequest, "invalidFilter"},
+		{"malformed body", "POST", "/scim/v2/Users", "{", http.StatusBadRequest, "invalidSyntax"},
+		{"short userName", "POST", "/scim/v2/Users", `{"userName": "a", "emails": [{"value": "a@example.com"}]}`, http.StatusBadRequest, "invalidValue"},
+		{"no email", "POST", "/scim/v2/Users", `{"userName": "ana"}`, http.StatusBadRequest, "invalidValue"},
+		{"unknown ID", "GET", "/scim/v2/Users/ana", "", http.StatusNotFound, ""},
+		{"PUT", "PUT", "/scim/v2/Users", "{}", http.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		rr := do(tt.method, tt.target, token, tt.body)
+		var body struct {
+			Schemas  []string `json:"schemas"`
+			Status   string   `json:"status"`
+			ScimType string   `json:"scimType"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s: %v in %q", tt.name, err, rr.Body.String())
+			continue
+		}
+		if rr.Code != tt.status || body.Status != strconv.Itoa(tt.status) || body.ScimType != tt.scimType || len(body.Schemas) != 1 {
+			t.Errorf("%s: got status %d with %+v", tt.name, rr.Code, body)
+		}
+	}
+
+	// Deactivated users cannot log in, however they sign in
+	deactivated := time.Now()
+	var err error
+	login := app.sessions.Enable(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err = app.logIn(r, &data.User{ID: 7, Username: "ana", DeactivatedAt: &deactivated}, "password login")
+	}))
+	login.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/user/login", nil))
+	if !errors.Is(err, errAccountDeactivated) {
+		t.Errorf("logging in a deactivated user: got %v", err)
+	}
+}
+
+// TestSCIMLeavesAdministrators checks that the directory's token cannot be
+// used to read, change or deactivate an administrator
+func TestSCIMLeavesAdministrators(t *testing.T) {
+	db := testDB(t)
+	const token = "scim-token-0123456789-0123456789-0123456789"
+	cfg := config.Default()
+	cfg.SCIM.Token = token
+	app := newTestApplicationWithDB(t, cfg, db)
+	handler := app.routes()
+
+	ctx := context.Background()
+	name := fmt.Sprintf("admin%d", time.Now().UnixNano()%1e9)
+	if err := app.models.Users.Insert(ctx, name, name+"@example.com", "not-a-hash", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	admin, err := app.models.Users.GetByUsername(ctx, name)
+	if err != nil || admin == nil {
+		t.Fatalf("looking up the administrator: %v", err)
+	}
+	t.Cleanup(func() { db.Exec(`DELETE FROM users WHERE id = $1`, admin.ID) })
+
+	target := "/scim/v2/Users/" + strconv.Itoa(admin.ID)
+	patch := `{"Operations": [{"op": "replace", "value": {"userName": "` + name + `x", "password": "A new passphrase for the takeover", "active": false}}]}`
+	for _, tt := range []struct{ method, target, body string }{
+		{"GET", target, ""},
+		{"PATCH", target, patch},
+		{"DELETE", target, ""},
+	} {
+		req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("%s %s: got status %d, expected 404", tt.method, tt.target, rr.Code)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/scim/v2/Users?filter="+url.QueryEscape(`userName eq "`+name+`"`), nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"totalResults":0`) {
+		t.Errorf("listing the administrator: got status %d with %s", rr.Code, rr.Body)
+	}
+
+	after, err := app.models.Users.Get(ctx, admin.ID)
+	if err != nil || after == nil {
+		t.Fatalf("reloading the administrator: %v", err)
+	}
+	if after.Username != name || after.PasswordHash != admin.PasswordHash || after.DeactivatedAt != nil {
+		t.Errorf("the administrator was changed: %+v", after)
+	}
+}
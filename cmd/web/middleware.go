@@ -4,33 +4,23 @@
 package main
 
 import (
-	"log"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"net/http"
+	"runtime/debug"
 	"time"
 
-	"github.com/darynforman/gratitude-jar1/internal/session"
-	"github.com/justinas/nosurf"
+	"github.com/darynforman/gratitude-jar1/internal/clientip"
+	"github.com/darynforman/gratitude-jar1/internal/csp"
+	"github.com/darynforman/gratitude-jar1/internal/httperr"
 )
 
-// NoSurf adds CSRF protection to all POST requests using the nosurf package.
-// It generates a token cookie and compares it with the token in the form
-// to prevent cross-site request forgery attacks.
-func NoSurf(next http.Handler) http.Handler {
-	csrfHandler := nosurf.New(next)
-	
-	csrfHandler.SetBaseCookie(http.Cookie{
-		HttpOnly: true,
-		Path:     "/",
-		Secure:   false, // Set to true in production
-	})
-
-	return csrfHandler
-}
-
 // RequireLogin ensures the user is logged in, otherwise redirects to login
-func RequireLogin(next http.Handler) http.Handler {
+func (app *application) RequireLogin(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		userID, _ := session.GetLoggedInUser(r)
+		userID, _ := app.sessions.GetLoggedInUser(r)
 		if userID == 0 {
 			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 			return
@@ -40,24 +30,49 @@ func RequireLogin(next http.Handler) http.Handler {
 }
 
 // RequireAdmin ensures the user is an admin, otherwise returns 403
-func RequireAdmin(next http.Handler) http.Handler {
+func (app *application) RequireAdmin(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, role := session.GetLoggedInUser(r)
+		_, role := app.sessions.GetLoggedInUser(r)
 		if role != "admin" {
-			http.Error(w, "Forbidden", http.StatusForbidden)
+			app.clientError(w, r, http.StatusForbidden, "")
 			return
 		}
 		next.ServeHTTP(w, r)
 	})
 }
 
+// requestIDKey is the context key for the request ID
+type requestIDKey struct{}
+
+// RequestIDMiddleware gives every request a random ID. It is sent back in
+// the X-Request-ID header and appears in the logs and on error pages, so a
+// user's report can be matched to the log lines.
+func (app *application) RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			app.logger.Printf("Error generating request ID: %v", err)
+		}
+		id := hex.EncodeToString(b)
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestID returns the request's ID, or "" outside RequestIDMiddleware
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
 // LoggingMiddleware creates a middleware that logs information about each HTTP request.
 // It records:
 // - HTTP method (GET, POST, etc.)
 // - Request URI
 // - Client IP address
 // - Time taken to process the request
-func LoggingMiddleware(next http.Handler) http.Handler {
+// - Request ID
+func (app *application) LoggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now() // Record the start time
 
@@ -65,49 +80,91 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 
 		// Log the request method, URI, client IP, and response time
-		log.Printf(
-			"%s %s %s %v",
-			r.Method,          // HTTP method (e.g., GET, POST)
-			r.RequestURI,      // Requested URI
-			r.RemoteAddr,      // Client's IP address
-			time.Since(start), // Time taken to process the request
+		app.logger.Printf(
+			"%s %s %s %v %s",
+			r.Method,                // HTTP method (e.g., GET, POST)
+			r.RequestURI,            // Requested URI
+			clientip.FromRequest(r), // Client's IP address
+			time.Since(start),       // Time taken to process the request
+			requestID(r),            // Request ID
 		)
 	})
 }
 
 // SecureHeadersMiddleware adds security-related headers to all HTTP responses.
 // These headers help protect against common web vulnerabilities:
+// - Content-Security-Policy: Only scripts carrying this request's nonce may run
+// - Strict-Transport-Security: Keeps browsers on HTTPS once they have seen it
+// - Permissions-Policy: Turns off browser features the app never uses
+// - Cross-Origin-Opener/Embedder/Resource-Policy: Isolates the page from other origins
 // - X-Content-Type-Options: Prevents MIME type sniffing
-// - X-Frame-Options: Prevents clickjacking attacks
-// - X-XSS-Protection: Enables basic XSS protection
+// - X-Frame-Options: Prevents clickjacking attacks in older browsers
 // - Referrer-Policy: Controls referrer information exposure
-func SecureHeadersMiddleware(next http.Handler) http.Handler {
+//
+// The nonce is stored in the request context for render to pass to templates.
+func (app *application) SecureHeadersMiddleware(next http.Handler) http.Handler {
+	cfg := app.config.Headers
+	hsts := ""
+	// A self-signed development certificate should not pin localhost to HTTPS
+	if cfg.HSTSMaxAge > 0 && !app.config.TLS.SelfSigned {
+		hsts = fmt.Sprintf("max-age=%d", int(cfg.HSTSMaxAge.Seconds()))
+		if cfg.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Add security headers to enhance protection against common attacks
-		w.Header().Set("X-Content-Type-Options", "nosniff")                  // Prevent MIME type sniffing
-		w.Header().Set("X-Frame-Options", "deny")                            // Prevent clickjacking attacks
-		w.Header().Set("X-XSS-Protection", "1; mode=block")                  // Enable basic XSS protection
-		w.Header().Set("Referrer-Policy", "strict-origin-when-cross-origin") // Control referrer information exposure
+		nonce, err := csp.NewNonce()
+		if err != nil {
+			app.serverError(w, r, fmt.Errorf("generating CSP nonce: %w", err))
+			return
+		}
+
+		h := w.Header()
+		h.Set(app.csp.HeaderName(), app.csp.String(nonce))
+		h.Set("Reporting-Endpoints", csp.ReportGroup+`="/csp-report"`)
+		if hsts != "" {
+			h.Set("Strict-Transport-Security", hsts)
+		}
+		if cfg.PermissionsPolicy != "" {
+			h.Set("Permissions-Policy", cfg.PermissionsPolicy)
+		}
+		if cfg.COOP != "" {
+			h.Set("Cross-Origin-Opener-Policy", cfg.COOP)
+		}
+		if cfg.COEP != "" {
+			h.Set("Cross-Origin-Embedder-Policy", cfg.COEP)
+		}
+		h.Set("Cross-Origin-Resource-Policy", "same-origin")
+		h.Set("X-Content-Type-Options", "nosniff")                  // Prevent MIME type sniffing
+		h.Set("X-Frame-Options", "deny")                            // Prevent clickjacking attacks
+		h.Set("X-XSS-Protection", "0")                              // The legacy XSS auditor is superseded by CSP
+		h.Set("Referrer-Policy", "strict-origin-when-cross-origin") // Control referrer information exposure
 
 		// Pass request to the next handler
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(csp.WithNonce(r.Context(), nonce)))
 	})
 }
 
 // RecoverPanicMiddleware recovers from any panics that occur during request handling.
 // If a panic occurs:
-// 1. The error is logged
-// 2. A 500 Internal Server Error response is sent to the client
+// 1. The panic is logged with its stack trace and the request ID
+// 2. The 500 error page is sent to the client
 // 3. The application continues running
-func RecoverPanicMiddleware(next http.Handler) http.Handler {
+func (app *application) RecoverPanicMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
-			// Recover from panic and log the error
-			if err := recover(); err != nil {
-				log.Printf("Panic recovered: %v", err)
-				// Send a generic 500 error response
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			err := recover()
+			if err == nil {
+				return
+			}
+			// http.ErrAbortHandler deliberately aborts the response
+			if err == http.ErrAbortHandler {
+				panic(err)
 			}
+			app.logger.Printf("Panic recovered (request %s): %v\n%s", requestID(r), err, debug.Stack())
+			w.Header().Set("Connection", "close")
+			app.errorResponse(w, r, httperr.New(http.StatusInternalServerError, ""))
 		}()
 
 		// Call the next handler
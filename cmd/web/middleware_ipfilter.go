@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/darynforman/gratitude-jar1/internal/clientip"
+	"github.com/darynforman/gratitude-jar1/internal/config"
+	"github.com/darynforman/gratitude-jar1/internal/data"
+	"github.com/darynforman/gratitude-jar1/internal/ipfilter"
+	"github.com/darynforman/gratitude-jar1/internal/security"
+)
+
+// newIPFilter builds the IP filter from configuration. Runtime rules and bans
+// live in the database; without one they are kept in memory.
+func newIPFilter(cfg config.IPFilterConfig, db *sql.DB) (*ipfilter.Filter, error) {
+	var store ipfilter.Store = ipfilter.NewMemoryStore()
+	if db != nil {
+		store = ipfilter.NewPostgresStore(db)
+	}
+	return ipfilter.New(context.Background(), store, ipfilter.Options{
+		Allow:        cfg.Allow,
+		Deny:         cfg.Deny,
+		BanThreshold: cfg.BanThreshold,
+		BanWindow:    cfg.BanWindow,
+		BanDuration:  cfg.BanDuration,
+	})
+}
+
+// IPFilterMiddleware refuses requests from denied or banned addresses
+func (app *application) IPFilterMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rule, blocked := app.ipFilter.Blocked(clientip.FromRequest(r)); blocked {
+			if !rule.ExpiresAt.IsZero() {
+				w.Header().Set("Retry-After", fmt.Sprint(ceilSeconds(time.Until(rule.ExpiresAt))))
+			}
+			app.clientError(w, r, http.StatusForbidden, "error.ip_blocked")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// strike counts an offence against the client and audits the ban when the
+// client crosses the threshold
+func (app *application) strike(r *http.Request, reason string) {
+	ban, err := app.ipFilter.Strike(r.Context(), clientip.FromRequest(r), reason)
+	if err != nil {
+		app.logger.Printf("Error recording strike: %v", err)
+		return
+	}
+	if ban != nil {
+		app.audit(r, security.EventIPBan, 0, ban.CreatedBy, describeRule(*ban), true)
+	}
+}
+
+// maintainIPFilter lifts expired bans and picks up rules changed by other
+// instances until ctx is cancelled. Expired rules are audited.
+func (app *application) maintainIPFilter(ctx context.Context, interval time.Duration) {
+	app.ipFilter.RunMaintenance(ctx, interval,
+		func(rule ipfilter.Rule) {
+			app.record(ctx, &data.SecurityEvent{
+				EventType: string(ruleRemovedEvent(rule)),
+				Username:  "system",
+				Details:   describeRule(rule) + " expired",
+				Success:   true,
+			})
+		},
+		func(err error) {
+			app.logger.Printf("IP filter maintenance error: %v", err)
+		},
+	)
+}
+
+// ruleAddedEvent is the audit event for creating rule
+func ruleAddedEvent(rule ipfilter.Rule) security.EventType {
+	if rule.Action == ipfilter.Allow {
+		return security.EventIPAllow
+	}
+	return security.EventIPBan
+}
+
+// ruleRemovedEvent is the audit event for removing or expiring rule
+func ruleRemovedEvent(rule ipfilter.Rule) security.EventType {
+	if rule.Action == ipfilter.Allow {
+		return security.EventIPAllowRemoved
+	}
+	return security.EventIPUnban
+}
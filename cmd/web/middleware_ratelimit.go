@@ -1,35 +1,44 @@
 package main
 
 import (
+	"database/sql"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/darynforman/gratitude-jar1/internal/clientip"
+	"github.com/darynforman/gratitude-jar1/internal/config"
 	"github.com/darynforman/gratitude-jar1/internal/ratelimit"
+	"github.com/darynforman/gratitude-jar1/internal/security"
 )
 
-var (
-	// Global rate limiter instance
-	globalLimiter = ratelimit.NewRateLimiter(10, 20) // 10 requests per second, burst of 20
-
-	// Cleanup old rate limiters every hour
-	cleanupInterval = 1 * time.Hour
-)
-
-func init() {
-	// Start cleanup goroutine
-	go func() {
-		ticker := time.NewTicker(cleanupInterval)
-		defer ticker.Stop()
+// newRateLimitPolicy builds the rate limit policy from configuration. The
+// postgres store shares buckets between instances through db.
+func newRateLimitPolicy(cfg config.RateLimitConfig, db *sql.DB) *ratelimit.Policy {
+	var store ratelimit.Store = ratelimit.NewMemoryStore()
+	if cfg.Store == "postgres" {
+		store = ratelimit.NewPostgresStore(db)
+	}
 
-		for range ticker.C {
-			globalLimiter.Cleanup(cleanupInterval)
-		}
-	}()
+	rules := make([]ratelimit.Rule, 0, len(cfg.Rules))
+	for _, r := range cfg.Rules {
+		rules = append(rules, ratelimit.Rule{
+			Name:       r.Name,
+			PathPrefix: r.PathPrefix,
+			Methods:    r.Methods,
+			Identity:   ratelimit.IdentityKind(r.Identity),
+			Rate:       r.Rate,
+			Burst:      r.Burst,
+		})
+	}
+	return ratelimit.NewPolicy(store, rules, ratelimit.Rule{Name: "default", Rate: cfg.Rate, Burst: cfg.Burst})
 }
 
-// RateLimitMiddleware limits the number of requests from each IP address
-func RateLimitMiddleware(next http.Handler) http.Handler {
+// RateLimitMiddleware limits requests according to the configured policy.
+// Every response carries RateLimit-* headers; rejected requests also get Retry-After.
+func (app *application) RateLimitMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Skip rate limiting for static files
 		if strings.HasPrefix(r.URL.Path, "/static/") {
@@ -37,14 +46,29 @@ func RateLimitMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		// Get client IP
-		ip := getClientIP(r)
-		
-		// Get rate limiter for this IP
-		limiter := globalLimiter.GetLimiter(ip)
-		
-		if !limiter.Allow() {
-			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		userID, _ := app.sessions.GetLoggedInUser(r)
+		id := ratelimit.Identity{
+			IP:     clientip.FromRequest(r),
+			UserID: userID,
+			Token:  bearerToken(r),
+		}
+
+		decision, err := app.limiter.Allow(r.Context(), r.Method, r.URL.Path, id)
+		if err != nil {
+			// Fail open: a broken store should not take the site down
+			app.logger.Printf("Rate limit store error: %v", err)
+		}
+
+		h := w.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(decision.Limit))
+		h.Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+		h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.Reset)))
+
+		if !decision.Allowed {
+			app.audit(r, security.EventRateLimitExceeded, userID, "", "rule "+decision.Rule+" on "+r.Method+" "+r.URL.Path, false)
+			app.strike(r, "rate limit "+decision.Rule)
+			h.Set("Retry-After", strconv.Itoa(ceilSeconds(decision.RetryAfter)))
+			app.clientError(w, r, http.StatusTooManyRequests, "")
 			return
 		}
 
@@ -52,24 +76,16 @@ func RateLimitMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// getClientIP gets the client's real IP address, taking into account proxy headers
-func getClientIP(r *http.Request) string {
-	// Check X-Real-IP header
-	ip := r.Header.Get("X-Real-IP")
-	if ip != "" {
-		return ip
-	}
-
-	// Check X-Forwarded-For header
-	ip = r.Header.Get("X-Forwarded-For")
-	if ip != "" {
-		// X-Forwarded-For can contain multiple IPs, use the first one
-		ips := strings.Split(ip, ",")
-		if len(ips) > 0 {
-			return strings.TrimSpace(ips[0])
-		}
+// bearerToken returns the token from an "Authorization: Bearer" header, if any
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
 	}
+	return strings.TrimSpace(token)
+}
 
-	// Fall back to RemoteAddr
-	return strings.Split(r.RemoteAddr, ":")[0]
+// ceilSeconds rounds d up to whole seconds, as used by Retry-After and RateLimit-Reset
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
 }
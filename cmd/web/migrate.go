@@ -0,0 +1,93 @@
+// Package main contains the `migrate` subcommand, which applies the embedded
+// database migrations.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/darynforman/gratitude-jar1/internal/migrate"
+	"github.com/darynforman/gratitude-jar1/migrations"
+)
+
+const migrateUsage = `usage: gratitude-jar migrate <command>
+
+commands:
+  up            apply all pending migrations
+  down          revert the most recently applied migration
+  to <version>  migrate up or down to version (0 reverts everything)
+  force <version>
+                mark version as applied without running SQL (recovers a dirty state)
+  status        list migrations and whether they are applied`
+
+// newMigrationRunner returns a runner for the embedded migrations on db
+func newMigrationRunner(db *sql.DB) (*migrate.Runner, error) {
+	return migrate.New(db, migrations.FS)
+}
+
+// runMigrate executes the migrate subcommand with the given arguments against db
+func runMigrate(db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	runner, err := newMigrationRunner(db)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		return runner.Up(ctx)
+	case "down":
+		return runner.Down(ctx)
+	case "to", "force":
+		if len(args) != 2 {
+			return errors.New(migrateUsage)
+		}
+		version, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		if args[0] == "force" {
+			return runner.Force(ctx, version)
+		}
+		return runner.To(ctx, version)
+	case "status":
+		return printMigrationStatus(ctx, runner)
+	default:
+		return errors.New(migrateUsage)
+	}
+}
+
+// printMigrationStatus writes a table of migrations and their state to stdout
+func printMigrationStatus(ctx context.Context, runner *migrate.Runner) error {
+	statuses, err := runner.Status(ctx)
+	if err != nil {
+		return err
+	}
+	version, dirty, err := runner.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tSTATE")
+	for _, s := range statuses {
+		state := "pending"
+		if s.Applied {
+			state = "applied"
+		}
+		if dirty && s.Version == version {
+			state = "dirty"
+		}
+		fmt.Fprintf(tw, "%06d\t%s\t%s\n", s.Version, s.Name, state)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,452 @@
+// Package main contains the OAuth 2.0 authorization server that lets
+// third-party apps act on a user's notes, for the Gratitude Jar application.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/darynforman/gratitude-jar1/internal/data"
+	"github.com/darynforman/gratitude-jar1/internal/oauth"
+	"github.com/darynforman/gratitude-jar1/internal/security"
+)
+
+// oauthCodeTTL is how long an app has to redeem an authorization code
+const oauthCodeTTL = time.Minute
+
+// authRequest is a checked authorization request from an app
+type authRequest struct {
+	Client      *data.OAuthClient
+	RedirectURI string
+	State       string
+	Scope       []string
+	Challenge   string
+	// params are the request's parameters, carried through the consent form
+	// and the login page
+	params url.Values
+}
+
+// authRequest checks the parameters of an authorization request. Problems
+// with the client or redirect URI are shown to the user, since the app
+// cannot be trusted to receive them; the others are sent back to the app.
+// PKCE with S256 is required of every app. If the request is refused, the
+// response has been written.
+func (app *application) authRequest(w http.ResponseWriter, r *http.Request, params url.Values) (*authRequest, bool) {
+	clientID := params.Get("client_id")
+	if clientID == "" {
+		app.clientError(w, r, http.StatusBadRequest, "error.oauth_client")
+		return nil, false
+	}
+	client, err := app.models.OAuth.Client(r.Context(), clientID)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		app.clientError(w, r, http.StatusBadRequest, "error.oauth_client")
+		return nil, false
+	}
+	if err != nil {
+		app.serverError(w, r, fmt.Errorf("looking up OAuth client: %w", err))
+		return nil, false
+	}
+	redirectURI := params.Get("redirect_uri")
+	if !oauth.MatchRedirectURI(client.RedirectURIs, redirectURI) {
+		app.clientError(w, r, http.StatusBadRequest, "error.oauth_redirect_uri")
+		return nil, false
+	}
+
+	req := &authRequest{
+		Client:      client,
+		RedirectURI: redirectURI,
+		State:       params.Get("state"),
+		Challenge:   params.Get("code_challenge"),
+		params:      url.Values{},
+	}
+	for _, name := range []string{"response_type", "client_id", "redirect_uri", "scope", "state", "code_challenge", "code_challenge_method"} {
+		if value := params.Get(name); value != "" {
+			req.params.Set(name, value)
+		}
+	}
+
+	switch {
+	case params.Get("response_type") != "code":
+		app.oauthRedirect(w, r, req, url.Values{"error": {"unsupported_response_type"}})
+		return nil, false
+	case params.Get("code_challenge_method") != "S256" || !oauth.ValidChallenge(req.Challenge):
+		app.oauthRedirect(w, r, req, url.Values{"error": {"invalid_request"}, "error_description": {"PKCE with code_challenge_method S256 is required"}})
+		return nil, false
+	}
+	if req.Scope, err = oauth.ParseScope(params.Get("scope")); err != nil {
+		app.oauthRedirect(w, r, req, url.Values{"error": {"invalid_scope"}})
+		return nil, false
+	}
+	return req, true
+}
+
+// oauthAuthorize is where apps send users to authorize them. Coming from the
+// app's site, the request does not carry the SameSite=Strict session cookie,
+// so users are moved on to /oauth/consent from our own site first unless
+// they are known to be logged in.
+func (app *application) oauthAuthorize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		app.methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	req, ok := app.authRequest(w, r, r.URL.Query())
+	if !ok {
+		return
+	}
+	if userID, _ := app.sessions.GetLoggedInUser(r); userID == 0 {
+		app.render(w, r, "continue.tmpl", PageData{Title: "Authorize", ContinueURL: "/oauth/consent?" + req.params.Encode()})
+		return
+	}
+	app.consent(w, r, req)
+}
+
+// oauthConsent asks the logged-in user whether to authorize the app (GET)
+// and sends them back to it with a code or a refusal (POST). Users who are
+// not logged in are sent to the login page and come back here.
+func (app *application) oauthConsent(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			app.clientError(w, r, http.StatusBadRequest, "")
+			return
+		}
+		params = r.PostForm
+	default:
+		app.methodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+		return
+	}
+
+	req, ok := app.authRequest(w, r, params)
+	if !ok {
+		return
+	}
+	userID, _ := app.sessions.GetLoggedInUser(r)
+	if userID == 0 {
+		app.requireLoginFor(w, r, "/oauth/consent?"+req.params.Encode())
+		return
+	}
+	if r.Method == http.MethodGet {
+		app.consent(w, r, req)
+		return
+	}
+
+	if r.PostForm.Get("decision") != "allow" {
+		app.oauthRedirect(w, r, req, url.Values{"error": {"access_denied"}})
+		return
+	}
+	scope := req.Scope
+	grant, err := app.models.OAuth.Grant(r.Context(), userID, req.Client.ID)
+	if err == nil {
+		granted, _ := oauth.ParseScope(grant.Scope)
+		scope = oauth.Union(granted, req.Scope)
+	} else if !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverError(w, r, fmt.Errorf("looking up OAuth grant: %w", err))
+		return
+	}
+	grantID, err := app.models.OAuth.SaveGrant(r.Context(), userID, req.Client.ID, oauth.FormatScope(scope))
+	if err != nil {
+		app.serverError(w, r, fmt.Errorf("saving OAuth grant: %w", err))
+		return
+	}
+	app.audit(r, security.EventOAuthGrant, userID, app.username(r, userID),
+		fmt.Sprintf("authorized %s (%s) for %s", req.Client.Name, req.Client.ID, oauth.FormatScope(req.Scope)), true)
+	app.issueCode(w, r, req, grantID)
+}
+
+// consent shows the consent screen, or sends the user straight back to the
+// app with a code if they have already granted everything it asks for
+func (app *application) consent(w http.ResponseWriter, r *http.Request, req *authRequest) {
+	userID, _ := app.sessions.GetLoggedInUser(r)
+	grant, err := app.models.OAuth.Grant(r.Context(), userID, req.Client.ID)
+	if err == nil {
+		if granted, _ := oauth.ParseScope(grant.Scope); oauth.Covers(granted, req.Scope) {
+			app.issueCode(w, r, req, grant.ID)
+			return
+		}
+	} else if !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverError(w, r, fmt.Errorf("looking up OAuth grant: %w", err))
+		return
+	}
+
+	form := map[string]string{}
+	for name := range req.params {
+		form[name] = req.params.Get(name)
+	}
+	app.render(w, r, "oauth-consent.tmpl", PageData{
+		Title:       "Authorize",
+		OAuthClient: req.Client,
+		OAuthScopes: req.Scope,
+		Form:        form,
+	})
+}
+
+// issueCode sends the user back to the app with an authorization code
+// under the grant
+func (app *application) issueCode(w http.ResponseWriter, r *http.Request, req *authRequest, grantID int64) {
+	code, err := app.models.OAuth.NewCode(r.Context(), grantID, oauth.FormatScope(req.Scope), req.RedirectURI, req.Challenge, oauthCodeTTL)
+	if err != nil {
+		app.serverError(w, r, fmt.Errorf("issuing authorization code: %w", err))
+		return
+	}
+	app.oauthRedirect(w, r, req, url.Values{"code": {code}})
+}
+
+// oauthRedirect sends the user back to the app's redirect URI with params
+// and the request's state
+func (app *application) oauthRedirect(w http.ResponseWriter, r *http.Request, req *authRequest, params url.Values) {
+	u, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		app.serverError(w, r, fmt.Errorf("parsing registered redirect URI: %w", err))
+		return
+	}
+	query := u.Query()
+	for name := range params {
+		query.Set(name, params.Get(name))
+	}
+	if req.State != "" {
+		query.Set("state", req.State)
+	}
+	u.RawQuery = query.Encode()
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+// oauthToken redeems authorization codes and refresh tokens for an access
+// token and a new refresh token. Refresh tokens are used up, so a stolen one
+// stops working once either party uses it.
+func (app *application) oauthToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		app.methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	client, ok := app.oauthClient(w, r)
+	if !ok {
+		return
+	}
+	ttl := app.config.OAuth
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code, err := app.models.OAuth.RedeemCode(r.Context(), r.PostForm.Get("code"))
+		if errors.Is(err, data.ErrRecordNotFound) {
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "the code is invalid, expired or already used")
+			return
+		}
+		if err != nil {
+			app.serverError(w, r, fmt.Errorf("redeeming authorization code: %w", err))
+			return
+		}
+		// The code is used up either way, so it cannot be guessed at
+		if code.ClientID != client.ID || code.RedirectURI != r.PostForm.Get("redirect_uri") ||
+			!oauth.VerifyChallenge(r.PostForm.Get("code_verifier"), code.Challenge) {
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "the code was issued for another client, redirect URI or code verifier")
+			return
+		}
+		if !app.oauthUserActive(w, r, code.UserID) {
+			return
+		}
+		access, refresh, err := app.models.OAuth.IssueTokens(r.Context(), code.GrantID, code.Scope, ttl.AccessTokenTTL, ttl.RefreshTokenTTL)
+		if err != nil {
+			app.serverError(w, r, fmt.Errorf("issuing tokens: %w", err))
+			return
+		}
+		writeTokens(w, access, refresh, code.Scope, ttl.AccessTokenTTL)
+
+	case "refresh_token":
+		token, err := app.models.OAuth.Token(r.Context(), r.PostForm.Get("refresh_token"))
+		if errors.Is(err, data.ErrRecordNotFound) || (err == nil && (token.Kind != data.TokenRefresh || token.ClientID != client.ID)) {
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "the refresh token is invalid, expired or already used")
+			return
+		}
+		if err != nil {
+			app.serverError(w, r, fmt.Errorf("looking up refresh token: %w", err))
+			return
+		}
+		// Apps may ask for an access token with fewer scopes than granted
+		scope := token.Scope
+		if requested := r.PostForm.Get("scope"); requested != "" {
+			narrowed, err := oauth.ParseScope(requested)
+			granted, _ := oauth.ParseScope(token.Scope)
+			if err != nil || !oauth.Covers(granted, narrowed) {
+				oauthError(w, http.StatusBadRequest, "invalid_scope", "")
+				return
+			}
+			scope = oauth.FormatScope(narrowed)
+		}
+		if !app.oauthUserActive(w, r, token.UserID) {
+			return
+		}
+		access, refresh, err := app.models.OAuth.RotateRefreshToken(r.Context(), r.PostForm.Get("refresh_token"), client.ID, scope, ttl.AccessTokenTTL, ttl.RefreshTokenTTL)
+		if errors.Is(err, data.ErrRecordNotFound) {
+			// Used by a concurrent request since it was looked up
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "the refresh token is invalid, expired or already used")
+			return
+		}
+		if err != nil {
+			app.serverError(w, r, fmt.Errorf("refreshing tokens: %w", err))
+			return
+		}
+		writeTokens(w, access, refresh, scope, ttl.AccessTokenTTL)
+
+	default:
+		oauthError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+	}
+}
+
+// oauthRevoke revokes an access or refresh token of the calling client
+// (RFC 7009). Unknown tokens are not an error, so the response is the same
+// either way.
+func (app *application) oauthRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		app.methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	client, ok := app.oauthClient(w, r)
+	if !ok {
+		return
+	}
+	raw := r.PostForm.Get("token")
+	if raw == "" {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "token is required")
+		return
+	}
+
+	token, err := app.models.OAuth.RevokeToken(r.Context(), raw, client.ID)
+	if err != nil {
+		app.serverError(w, r, fmt.Errorf("revoking token: %w", err))
+		return
+	}
+	if token != nil {
+		app.audit(r, security.EventOAuthRevoke, token.UserID, "", fmt.Sprintf("%s token revoked by %s (%s)", token.Kind, client.Name, client.ID), true)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// oauthIntrospect tells the calling client whether a token is active and
+// what it allows (RFC 7662). Clients can only look up their own tokens.
+func (app *application) oauthIntrospect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		app.methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	client, ok := app.oauthClient(w, r)
+	if !ok {
+		return
+	}
+	raw := r.PostForm.Get("token")
+	if raw == "" {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "token is required")
+		return
+	}
+
+	token, err := app.models.OAuth.Token(r.Context(), raw)
+	if errors.Is(err, data.ErrRecordNotFound) || (err == nil && token.ClientID != client.ID) {
+		writeJSON(w, http.StatusOK, map[string]any{"active": false})
+		return
+	}
+	if err != nil {
+		app.serverError(w, r, fmt.Errorf("looking up token: %w", err))
+		return
+	}
+	active, err := app.models.Users.Active(r.Context(), token.UserID)
+	if err != nil {
+		app.serverError(w, r, fmt.Errorf("checking account status: %w", err))
+		return
+	}
+	if !active {
+		writeJSON(w, http.StatusOK, map[string]any{"active": false})
+		return
+	}
+
+	response := map[string]any{
+		"active":    true,
+		"scope":     token.Scope,
+		"client_id": token.ClientID,
+		"sub":       strconv.Itoa(token.UserID),
+		"username":  app.username(r, token.UserID),
+		"iat":       token.CreatedAt.Unix(),
+		"exp":       token.ExpiresAt.Unix(),
+	}
+	if token.Kind == data.TokenAccess {
+		response["token_type"] = "Bearer"
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// oauthClient authenticates the client calling the token, revocation or
+// introspection endpoint, by HTTP Basic authentication or client_id and
+// client_secret in the form. Public clients send only their ID. If
+// authentication fails, the response has been written.
+func (app *application) oauthClient(w http.ResponseWriter, r *http.Request) (*data.OAuthClient, bool) {
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "")
+		return nil, false
+	}
+	id, secret, basic := r.BasicAuth()
+	if basic {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	var client *data.OAuthClient
+	if id != "" {
+		var err error
+		client, err = app.models.OAuth.Client(r.Context(), id)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			app.serverError(w, r, fmt.Errorf("looking up OAuth client: %w", err))
+			return nil, false
+		}
+	}
+	if client == nil || (client.Confidential() && !client.CheckSecret(secret)) || (!client.Confidential() && secret != "") {
+		app.strike(r, "OAuth client authentication failed")
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return nil, false
+	}
+	return client, true
+}
+
+// oauthUserActive refuses tokens for an account that has been erased or is
+// scheduled for deletion. If it is not active, the response has been
+// written.
+func (app *application) oauthUserActive(w http.ResponseWriter, r *http.Request, userID int) bool {
+	active, err := app.models.Users.Active(r.Context(), userID)
+	if err != nil {
+		app.serverError(w, r, fmt.Errorf("checking account status: %w", err))
+		return false
+	}
+	if !active {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "the account is no longer active")
+		return false
+	}
+	return true
+}
+
+// writeTokens sends a token response
+func writeTokens(w http.ResponseWriter, access, refresh, scope string, ttl time.Duration) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token":  access,
+		"token_type":    "Bearer",
+		"expires_in":    int(ttl.Seconds()),
+		"refresh_token": refresh,
+		"scope":         scope,
+	})
+}
+
+// oauthError sends an error in the form OAuth clients expect (RFC 6749
+// section 5.2) rather than as problem details
+func oauthError(w http.ResponseWriter, status int, code, description string) {
+	body := map[string]any{"error": code}
+	if description != "" {
+		body["error_description"] = description
+	}
+	writeJSON(w, status, body)
+}
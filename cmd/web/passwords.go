@@ -0,0 +1,77 @@
+// Package main contains the screening of new passwords for the Gratitude Jar
+// application: the strength policy, the breached password corpus and the
+// strength meter shown while a new password is typed.
+package main
+
+import (
+	"net/http"
+
+	"github.com/darynforman/gratitude-jar1/internal/strength"
+	"github.com/darynforman/gratitude-jar1/internal/validator"
+)
+
+// screenPassword checks a new password in field against the minimum
+// strength and the breached password corpus. userInputs are the username and
+// email the password must not resemble. If the corpus cannot be read the
+// password is let through, so a missing file does not stop sign-ups.
+func (app *application) screenPassword(v *validator.Validator, field, password string, userInputs ...string) {
+	v.PasswordStrength(field, password, app.config.Password.MinStrength, userInputs...)
+	if app.breached == nil || v.Errors[field] != "" {
+		return
+	}
+	count, err := app.breached.Count(password)
+	if err != nil {
+		app.logger.Printf("Error checking the breached password corpus: %v", err)
+		return
+	}
+	v.Check(count == 0, field, "validation.password.breached", "count", count)
+}
+
+// passwordStrength renders the strength meter for the password being typed
+// on the registration or account page, with the same checks as submitting it
+func (app *application) passwordStrength(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		app.methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		app.clientError(w, r, http.StatusBadRequest, "")
+		return
+	}
+
+	// The registration form sends password, the account page new_password
+	password := r.PostForm.Get("password")
+	if password == "" {
+		password = r.PostForm.Get("new_password")
+	}
+	userInputs := []string{r.PostForm.Get("username"), r.PostForm.Get("email")}
+	if userID := app.sessions.GetInt(r, "userID"); userID != 0 && app.db != nil {
+		if user, err := app.models.Users.Get(r.Context(), userID); err == nil && user != nil {
+			userInputs = append(userInputs, user.Username, user.Email)
+		}
+	}
+
+	data := PageData{}
+	if password != "" {
+		result := strength.Estimate(password, userInputs...)
+		v := validator.NewValidator()
+		app.screenPassword(v, "password", password, userInputs...)
+		if v.Errors["password"] == "validation.password.breached" {
+			result.Score = 0
+		}
+		data.PasswordStrength = &result
+		data.Errors, data.ErrorArgs = v.Errors, v.Args
+	}
+
+	tmpl, err := app.getTemplate("partials/password-strength.tmpl")
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	buf, err := executeBlocks(tmpl, app.newTemplateData(r, data), "password-strength")
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.writeHTML(w, http.StatusOK, buf)
+}
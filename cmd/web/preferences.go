@@ -0,0 +1,148 @@
+// Package main contains the user preferences and settings page for the Gratitude Jar application.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/darynforman/gratitude-jar1/internal/data"
+	"github.com/darynforman/gratitude-jar1/internal/validator"
+)
+
+// preferencesKey is the context key for the logged-in user's preferences
+type preferencesKey struct{}
+
+// settingsTimezones are offered as suggestions on the settings page; any
+// IANA zone name is accepted
+var settingsTimezones = []string{
+	"UTC",
+	"America/Belize",
+	"America/Mexico_City",
+	"America/New_York",
+	"America/Chicago",
+	"America/Denver",
+	"America/Los_Angeles",
+	"America/Bogota",
+	"America/Sao_Paulo",
+	"Europe/London",
+	"Europe/Madrid",
+	"Europe/Berlin",
+	"Africa/Lagos",
+	"Asia/Kolkata",
+	"Asia/Singapore",
+	"Asia/Tokyo",
+	"Australia/Sydney",
+}
+
+// PreferencesMiddleware loads the logged-in user's preferences into the
+// request context, for the locale, the templates and the handlers. If they
+// cannot be loaded the request goes ahead with the defaults.
+func (app *application) PreferencesMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := app.sessions.GetInt(r, "userID")
+		if userID == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		prefs, err := app.models.Preferences.Get(r.Context(), userID)
+		if err != nil {
+			app.logger.Printf("Error loading preferences of user %d: %v", userID, err)
+			prefs = data.DefaultPreferences(userID)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), preferencesKey{}, prefs)))
+	})
+}
+
+// preferences returns the logged-in user's preferences, or the defaults for
+// anonymous requests
+func (app *application) preferences(r *http.Request) *data.Preferences {
+	if prefs, ok := r.Context().Value(preferencesKey{}).(*data.Preferences); ok {
+		return prefs
+	}
+	return data.DefaultPreferences(0)
+}
+
+// settings shows (GET) and saves (POST) the user's preferences
+func (app *application) settings(w http.ResponseWriter, r *http.Request) {
+	prefs := app.preferences(r)
+	pageData := PageData{
+		Title:     "Settings",
+		Emojis:    noteEmojis,
+		Timezones: settingsTimezones,
+		Form:      preferencesForm(prefs),
+	}
+	status := http.StatusOK
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			app.clientError(w, r, http.StatusBadRequest, "")
+			return
+		}
+		form := map[string]string{}
+		for _, field := range []string{"timezone", "locale", "theme", "default_category", "default_emoji", "notes_per_page", "sort_order"} {
+			form[field] = strings.TrimSpace(r.PostForm.Get(field))
+		}
+		perPage, err := strconv.Atoi(form["notes_per_page"])
+		if err != nil {
+			perPage = 0
+		}
+
+		v := validator.ValidatePreferences(form["timezone"], form["theme"], form["default_category"], form["default_emoji"], perPage, form["sort_order"])
+		v.Check(form["locale"] == "" || app.i18n.Supported(form["locale"]), "locale", "validation.locale.invalid")
+
+		if v.ValidData() {
+			updated := &data.Preferences{
+				UserID:          app.sessions.GetInt(r, "userID"),
+				Timezone:        form["timezone"],
+				Locale:          form["locale"],
+				Theme:           form["theme"],
+				DefaultCategory: form["default_category"],
+				DefaultEmoji:    form["default_emoji"],
+				NotesPerPage:    perPage,
+				SortOrder:       form["sort_order"],
+			}
+			if err := app.models.Preferences.Upsert(r.Context(), updated); err != nil {
+				app.serverError(w, r, fmt.Errorf("saving preferences: %w", err))
+				return
+			}
+
+			// The flash is shown in the newly chosen language
+			locale := updated.Locale
+			if locale == "" {
+				locale = app.sessions.GetString(r, "locale")
+			}
+			tr := app.i18n.Translator(app.i18n.Negotiate(locale, r.Header.Get("Accept-Language")))
+			app.sessions.Put(r, "flash", tr.T("flash.settings_saved"))
+			http.Redirect(w, r, "/settings", http.StatusSeeOther)
+			return
+		}
+
+		pageData.Errors, pageData.ErrorArgs = v.Errors, v.Args
+		pageData.Form = form
+		status = http.StatusUnprocessableEntity
+	default:
+		app.methodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+		return
+	}
+
+	app.renderPage(w, r, status, "settings.tmpl", pageData)
+}
+
+// preferencesForm returns prefs as settings form values
+func preferencesForm(prefs *data.Preferences) map[string]string {
+	return map[string]string{
+		"timezone":         prefs.Timezone,
+		"locale":           prefs.Locale,
+		"theme":            prefs.Theme,
+		"default_category": prefs.DefaultCategory,
+		"default_emoji":    prefs.DefaultEmoji,
+		"notes_per_page":   strconv.Itoa(prefs.NotesPerPage),
+		"sort_order":       prefs.SortOrder,
+	}
+}
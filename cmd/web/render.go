@@ -3,65 +3,160 @@
 package main
 
 import (
-	"log"
+	"bytes"
+	"fmt"
+	"html/template"
 	"net/http"
-	"path/filepath"
 	"time"
 
-	"github.com/darynforman/gratitude-jar1/internal/session"
+	"github.com/darynforman/gratitude-jar1/internal/csp"
+	"github.com/darynforman/gratitude-jar1/internal/data"
+	"github.com/darynforman/gratitude-jar1/internal/i18n"
 	"github.com/justinas/nosurf"
 )
 
-// render renders a template with the given data
-func render(w http.ResponseWriter, r *http.Request, name string, data PageData) {
-	// Get the template from the cache
-	tmpl, err := getTemplate(name)
-	if err != nil {
-		log.Printf("Template %s not found in cache: %v", name, err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+// templateData is what every template receives: the handler's PageData plus
+// the session and per-request values the layout needs. The embedded
+// translator gives templates {{.T "key"}}; {{.Date .CreatedAt}} formats
+// dates in the user's time zone.
+type templateData struct {
+	PageData
+	*i18n.Translator
+	Prefs           *data.Preferences
+	Locale          string
+	Locales         []localeOption
+	RequestURI      string
+	IsAuthenticated bool
+	UserID          int
+	UserRole        string
+	Flash           string
+	CurrentYear     int
+	CSRFToken       string
+	CSPNonce        string
+	LoginLinks      bool        // Whether users can sign in with a link sent by mail
+	SSOProviders    []ssoButton // Identity providers users can sign in with
+}
+
+// newTemplateData adds the session data to data and translates its
+// validation errors. It pops the flash message, so it should be called once
+// per response.
+func (app *application) newTemplateData(r *http.Request, data PageData) templateData {
+	tr := app.translator(r)
+	if len(data.Errors) > 0 {
+		errors := make(map[string]string, len(data.Errors))
+		for field, key := range data.Errors {
+			errors[field] = tr.T(key, data.ErrorArgs[field]...)
+		}
+		data.Errors = errors
 	}
 
-	// Add session data to the template data
-	userID := session.Manager.GetInt(r, "userID")
-	role := session.Manager.GetString(r, "role")
-	flash := session.Manager.PopString(r, "flash")
-
-	// Create a new data struct that includes session data
-	templateData := struct {
-		PageData
-		IsAuthenticated bool
-		UserID          int
-		UserRole        string
-		Flash           string
-		CurrentYear     int
-		CSRFToken       string
-	}{
+	userID := app.sessions.GetInt(r, "userID")
+	return templateData{
 		PageData:        data,
+		Translator:      tr,
+		Prefs:           app.preferences(r),
+		Locale:          tr.Locale(),
+		Locales:         app.localeOptions(tr.Locale()),
+		RequestURI:      r.URL.RequestURI(),
 		IsAuthenticated: userID > 0,
 		UserID:          userID,
-		UserRole:        role,
-		Flash:           flash,
+		UserRole:        app.sessions.GetString(r, "role"),
+		Flash:           app.sessions.PopString(r, "flash"),
 		CurrentYear:     time.Now().Year(),
 		CSRFToken:       nosurf.Token(r),
+		CSPNonce:        csp.Nonce(r.Context()),
+		LoginLinks:      app.config.Account.LoginLinks,
+		SSOProviders:    app.ssoButtons(),
 	}
+}
 
-	// For partial templates, execute without base template
-	if filepath.Dir(name) == "partials" {
-		err := tmpl.Execute(w, templateData)
-		if err != nil {
-			log.Printf("Error executing partial template %s: %v", name, err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
+// render renders a full page: the named template set executed through the
+// base layout
+func (app *application) render(w http.ResponseWriter, r *http.Request, name string, data PageData) {
+	app.renderPage(w, r, http.StatusOK, name, data)
+}
+
+// renderPage renders a full page with the given status code
+func (app *application) renderPage(w http.ResponseWriter, r *http.Request, status int, name string, data PageData) {
+	buf, err := app.pageHTML(r, name, data)
+	if err != nil {
+		app.serverError(w, r, err)
 		return
 	}
+	app.writeHTML(w, status, buf)
+}
 
-	// For full pages, execute with base template
-	err = tmpl.ExecuteTemplate(w, "base", templateData)
+// pageHTML executes the named template set through the base layout
+func (app *application) pageHTML(r *http.Request, name string, data PageData) (*bytes.Buffer, error) {
+	tmpl, err := app.getTemplate(name)
 	if err != nil {
-		log.Printf("Error executing template %s: %v", name, err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("template %s: %w", name, err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := tmpl.ExecuteTemplate(buf, "base", app.newTemplateData(r, data)); err != nil {
+		return nil, fmt.Errorf("executing template %s: %w", name, err)
+	}
+	return buf, nil
+}
+
+// Date formats t as a localized date in the user's time zone
+func (td templateData) Date(t time.Time) string {
+	return td.Translator.Date(t.In(td.Prefs.Location()))
+}
+
+// Time formats t with the time of day in the user's time zone
+func (td templateData) Time(t time.Time) string {
+	t = t.In(td.Prefs.Location())
+	return td.Translator.Date(t) + t.Format(" 15:04 MST")
+}
+
+// noteCard is the data for the note-card template: the note plus what the
+// card needs from the page, since the card is rendered with the note as its
+// dot
+type noteCard struct {
+	data.GratitudeNote
+	*i18n.Translator
+	loc *time.Location
+}
+
+// Card pairs note with the translator and time zone for
+// {{template "note-card" ($.Card .)}}
+func (td templateData) Card(note data.GratitudeNote) noteCard {
+	return noteCard{GratitudeNote: note, Translator: td.Translator, loc: td.Prefs.Location()}
+}
+
+// Date formats t as a localized date in the user's time zone
+func (c noteCard) Date(t time.Time) string {
+	return c.Translator.Date(t.In(c.loc))
+}
+
+// CategoryName is the translated name of the note's category. Categories
+// without a translation are shown as stored.
+func (c noteCard) CategoryName() string {
+	if key := "category." + c.Category; c.Has(key) {
+		return c.T(key)
+	}
+	return c.Category
+}
+
+// executeBlocks executes the named templates of one set into a single buffer,
+// so a failure part way through never sends half a response
+func executeBlocks(tmpl *template.Template, data any, blocks ...string) (*bytes.Buffer, error) {
+	buf := new(bytes.Buffer)
+	for _, block := range blocks {
+		if err := tmpl.ExecuteTemplate(buf, block, data); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// writeHTML sends a rendered HTML body
+func (app *application) writeHTML(w http.ResponseWriter, status int, buf *bytes.Buffer) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if _, err := buf.WriteTo(w); err != nil {
+		app.logger.Printf("Error writing response: %v", err)
 	}
 }
@@ -5,7 +5,6 @@ import (
 	"net/http"
 
 	"github.com/darynforman/gratitude-jar1/internal/auth"
-	"github.com/justinas/nosurf"
 )
 
 // routes sets up all HTTP routes for the application and configures middleware.
@@ -16,39 +15,105 @@ import (
 // 2. Configures static file serving
 // 3. Defines all application routes
 // 4. Chains middleware in the correct order
-func routes() http.Handler {
+func (app *application) routes() http.Handler {
 	// Create a new ServeMux to handle routing
 	mux := http.NewServeMux()
 
-	// Configure static file serving from the ui/static directory
+	// Configure static file serving from ui/static, embedded or on disk
 	// All static files will be served under the /static/ URL path
-	fileServer := http.FileServer(http.Dir("ui/static"))
+	fileServer := http.FileServer(http.FS(app.static))
 	mux.Handle("/static/", http.StripPrefix("/static/", fileServer))
 
 	// Define application routes
 	// Each route is mapped to its corresponding handler function
-	mux.HandleFunc("/contact", contact) // Contact page
-	mux.HandleFunc("/about", about)     // About page
-	mux.HandleFunc("/", home)           // Home page
+	mux.HandleFunc("/contact", app.contact) // Contact page
+	mux.HandleFunc("/about", app.about)     // About page
+	mux.HandleFunc("/", app.home)           // Home page
 	// Protected routes
-	mux.Handle("/gratitude", auth.RequireLogin(http.HandlerFunc(gratitude)))
-	mux.Handle("/notes", auth.RequireLogin(http.HandlerFunc(viewNotes)))
-	mux.Handle("/gratitude/edit/", auth.RequireLogin(auth.RequireOwnership(http.HandlerFunc(getNoteForEdit))))
-	mux.Handle("/notes/", auth.RequireLogin(auth.RequireOwnership(http.HandlerFunc(updateGratitude))))
+	requireLogin := func(h http.HandlerFunc) http.HandlerFunc { return auth.RequireLogin(app.sessions, h) }
+	requireOwnership := func(h http.HandlerFunc) http.HandlerFunc {
+		return auth.RequireOwnership(app.sessions, app.models.Gratitudes, app.errorResponse, h)
+	}
+	mux.Handle("/gratitude", requireLogin(app.gratitude))
+	mux.Handle("/notes", requireLogin(app.viewNotes))
+	mux.Handle("/gratitude/edit/", requireLogin(requireOwnership(app.getNoteForEdit)))
+	mux.Handle("/notes/", requireLogin(requireOwnership(app.updateGratitude)))
+	mux.Handle("/settings", requireLogin(app.settings))
+	mux.Handle("/account", requireLogin(app.account))
+	mux.Handle("/account/username", requireLogin(app.changeUsername))
+	mux.Handle("/account/password", requireLogin(app.changePassword))
+	mux.Handle("/account/email", requireLogin(app.changeEmail))
+	mux.Handle("/account/delete", requireLogin(app.deleteAccount))
+	mux.Handle("/account/export", requireLogin(app.requestExport))
+	mux.Handle("/account/apps", requireLogin(app.accountApps))
+	mux.Handle("/account/apps/revoke", requireLogin(app.revokeApp))
+	// The confirmation link may be opened in a browser that is not logged in
+	mux.HandleFunc("/account/email/confirm", app.confirmEmail)
+	mux.HandleFunc("/account/export/download", app.downloadExport)
+	mux.HandleFunc("/password-strength", app.passwordStrength)
+
+	// Admin console
+	requireAdmin := func(h http.HandlerFunc) http.HandlerFunc { return requireLogin(app.RequireAdmin(h).ServeHTTP) }
+	mux.Handle("/admin/ip-rules", requireAdmin(app.adminIPRules))
+	mux.Handle("/admin/ip-rules/remove", requireAdmin(app.adminRemoveIPRule))
+	mux.Handle("/admin/oauth-clients", requireAdmin(app.adminOAuthClients))
+	mux.Handle("/admin/oauth-clients/remove", requireAdmin(app.adminRemoveOAuthClient))
+
+	// Browsers post Content-Security-Policy violation reports here
+	mux.HandleFunc("/csp-report", app.cspReport)
 
 	// Auth routes
-	mux.HandleFunc("/register", registerHandler)
-	mux.HandleFunc("/user/login", loginHandler)
-	mux.HandleFunc("/logout", logoutHandler)
+	mux.HandleFunc("/register", app.registerHandler)
+	mux.HandleFunc("/user/login", app.loginHandler)
+	mux.HandleFunc("/user/login/link", app.requestLoginLink)
+	mux.HandleFunc("/user/login/link/confirm", app.confirmLoginLink)
+	mux.HandleFunc("/logout", app.logoutHandler)
+
+	// Single sign-on with OpenID Connect providers
+	mux.HandleFunc("/sso/login", app.ssoLogin)
+	mux.HandleFunc("/sso/callback", app.ssoCallback)
+	mux.HandleFunc("/sso/complete", app.ssoComplete)
+
+	// OAuth authorization server for third-party apps, and the API they call
+	// with the tokens it issues
+	mux.HandleFunc("/oauth/authorize", app.oauthAuthorize)
+	mux.HandleFunc("/oauth/consent", app.oauthConsent)
+	mux.HandleFunc("/oauth/token", app.oauthToken)
+	mux.HandleFunc("/oauth/revoke", app.oauthRevoke)
+	mux.HandleFunc("/oauth/introspect", app.oauthIntrospect)
+	mux.HandleFunc("/api/notes", app.apiNotes)
+
+	// SCIM user provisioning by the company directory
+	mux.HandleFunc(scimUsersPath, app.requireSCIMToken(app.scimUsers))
+	mux.HandleFunc(scimUsersPath+"/", app.requireSCIMToken(app.scimUser))
+
+	// Language switcher
+	mux.HandleFunc("/language", app.setLanguage)
 
 	// Chain middleware in the correct order
 	// The order is important as each middleware wraps the next one
-	handler := LoggingMiddleware(mux)                // Log all requests
-	handler = RateLimitMiddleware(handler)           // Rate limiting
-	handler = SecureHeadersMiddleware(handler)       // Add security headers
-	handler = auth.SessionTimeoutMiddleware(handler) // Check session timeout
-	handler = RecoverPanicMiddleware(handler)        // Recover from panics
-	handler = nosurf.New(handler)                    // Add CSRF protection
-
-	return handler
+	handler := app.LoggingMiddleware(mux)                          // Log all requests
+	handler = auth.SessionTimeoutMiddleware(app.sessions, handler) // Check session timeout
+	handler = app.CSRFMiddleware(handler)                          // Add CSRF protection
+
+	// The pages show the navigation for the logged-in user in the language
+	// and time zone they chose, so the account's status and the user's
+	// preferences are loaded before the locale is picked. These query the
+	// database, so they only run for clients the IP filter and the rate
+	// limiter let through, and panics anywhere inside get the error page.
+	handler = app.LocaleMiddleware(handler)
+	handler = app.PreferencesMiddleware(handler)
+	handler = app.AccountStatusMiddleware(handler)
+	handler = app.RateLimitMiddleware(handler)
+	handler = app.IPFilterMiddleware(handler)
+	handler = app.RecoverPanicMiddleware(handler)
+
+	// The client IP is resolved for the filter, the limiter, logging and
+	// audit code. Outside it, security headers, the CSP nonce and the
+	// session cookie are set up without touching the database, as any error
+	// page needs them. Outermost, every request gets an ID.
+	handler = app.clientIP.Middleware(handler)
+	handler = app.SecureHeadersMiddleware(handler)
+	handler = app.sessions.Enable(handler)
+	return app.RequestIDMiddleware(handler)
 }
@@ -0,0 +1,384 @@
+// Package main contains the SCIM 2.0 endpoint the company directory uses to
+// create, update and deactivate users, for the Gratitude Jar application.
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darynforman/gratitude-jar1/internal/data"
+	"github.com/darynforman/gratitude-jar1/internal/scim"
+	"github.com/darynforman/gratitude-jar1/internal/security"
+	"github.com/darynforman/gratitude-jar1/internal/validator"
+)
+
+// scimMaxCount is the most users a list request returns
+const scimMaxCount = 200
+
+// scimUsersPath is where the users are, each under its ID
+const scimUsersPath = "/scim/v2/Users"
+
+// scimFilterFields maps the attributes users can be filtered by to the
+// fields of data.UserFilter
+var scimFilterFields = map[string]string{
+	scim.AttrUserName:   "username",
+	scim.AttrEmails:     "email",
+	scim.AttrExternalID: "external_id",
+}
+
+// requireSCIMToken lets through requests with the directory's bearer token.
+// Without a token configured the endpoint does not exist.
+func (app *application) requireSCIMToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.config.SCIM.Token == "" {
+			app.notFound(w, r)
+			return
+		}
+		raw := bearerToken(r)
+		got, want := sha256.Sum256([]byte(raw)), sha256.Sum256([]byte(app.config.SCIM.Token))
+		if subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+			if raw != "" {
+				app.strike(r, "invalid SCIM token")
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+			writeSCIMError(w, scim.Errorf(http.StatusUnauthorized, "", "a valid bearer token is required"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// scimUsers lists the users, optionally filtered (GET), or creates one
+// (POST)
+func (app *application) scimUsers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		app.scimListUsers(w, r)
+	case http.MethodPost:
+		app.scimCreateUser(w, r)
+	default:
+		scimMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// scimUser sends (GET), changes (PATCH) or deactivates (DELETE) the user
+// whose ID ends the path. Deleting only deactivates the account, so the
+// user's notes are kept. Administrators are not the directory's to manage,
+// so they are not found.
+func (app *application) scimUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, scimUsersPath+"/"))
+	var user *data.User
+	if err == nil && id > 0 {
+		if user, err = app.models.Users.GetProvisioned(r.Context(), id); err != nil {
+			app.serverError(w, r, fmt.Errorf("looking up user %d: %w", id, err))
+			return
+		}
+	}
+	if user == nil {
+		writeSCIMError(w, scim.Errorf(http.StatusNotFound, "", "no such user"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeSCIM(w, http.StatusOK, app.scimResource(r, user))
+	case http.MethodPatch:
+		app.scimPatchUser(w, r, user)
+	case http.MethodDelete:
+		if err := app.scimSetActive(r, user, false); err != nil {
+			if errors.Is(err, data.ErrRecordNotFound) {
+				writeSCIMError(w, scimSaveError(err))
+				return
+			}
+			app.serverError(w, r, fmt.Errorf("deactivating user %d: %w", user.ID, err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		scimMethodNotAllowed(w, http.MethodGet, http.MethodPatch, http.MethodDelete)
+	}
+}
+
+// scimListUsers sends a page of the users matching the filter, in the order
+// they registered
+func (app *application) scimListUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var filter data.UserFilter
+	if s := query.Get("filter"); s != "" {
+		f, err := scim.ParseFilter(s)
+		if err != nil {
+			writeSCIMError(w, err.(*scim.Error))
+			return
+		}
+		filter = data.UserFilter{Field: scimFilterFields[f.Attribute], Value: f.Value}
+	}
+	startIndex := 1
+	if n, err := strconv.Atoi(query.Get("startIndex")); err == nil && n > 1 {
+		startIndex = n
+	}
+	count := scimMaxCount
+	if n, err := strconv.Atoi(query.Get("count")); err == nil {
+		count = max(0, min(n, scimMaxCount))
+	}
+
+	users, total, err := app.models.Users.List(r.Context(), filter, startIndex-1, count)
+	if err != nil {
+		app.serverError(w, r, fmt.Errorf("listing users: %w", err))
+		return
+	}
+	list := scim.ListResponse{
+		Schemas:      []string{scim.SchemaList},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: len(users),
+		Resources:    make([]scim.User, 0, len(users)),
+	}
+	for _, user := range users {
+		list.Resources = append(list.Resources, app.scimResource(r, &user))
+	}
+	writeSCIM(w, http.StatusOK, list)
+}
+
+// scimCreateUser creates a user from the directory. Users without a password
+// get a random one they never learn, and sign in with a link or single
+// sign-on.
+func (app *application) scimCreateUser(w http.ResponseWriter, r *http.Request) {
+	var input scim.User
+	if !readSCIM(w, r, &input) {
+		return
+	}
+	user := &data.User{
+		Username:   input.UserName,
+		Email:      input.Email(),
+		Role:       "user",
+		ExternalID: input.ExternalID,
+	}
+	if !app.checkSCIMUser(w, r, user, input.Password) {
+		return
+	}
+
+	password := input.Password
+	if password == "" {
+		var err error
+		if password, err = randomToken(); err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+	hash, err := app.passwords.Hash(password)
+	if err != nil {
+		app.serverError(w, r, fmt.Errorf("hashing password: %w", err))
+		return
+	}
+	user.PasswordHash = hash
+	if !input.IsActive() {
+		now := time.Now()
+		user.DeactivatedAt = &now
+	}
+
+	if err := app.models.Users.Provision(r.Context(), user); err != nil {
+		if scimErr := scimSaveError(err); scimErr != nil {
+			writeSCIMError(w, scimErr)
+			return
+		}
+		app.serverError(w, r, fmt.Errorf("provisioning user: %w", err))
+		return
+	}
+	app.audit(r, security.EventUserProvision, user.ID, user.Username, describeProvisioned(user, "created"), true)
+
+	resource := app.scimResource(r, user)
+	w.Header().Set("Location", resource.Meta.Location)
+	writeSCIM(w, http.StatusCreated, resource)
+}
+
+// scimPatchUser applies the directory's changes to user: their username,
+// email address, external ID, password and whether they are active
+func (app *application) scimPatchUser(w http.ResponseWriter, r *http.Request, user *data.User) {
+	var patch scim.PatchRequest
+	if !readSCIM(w, r, &patch) {
+		return
+	}
+	resource := app.scimResource(r, user)
+	if err := resource.Apply(patch.Operations); err != nil {
+		writeSCIMError(w, err.(*scim.Error))
+		return
+	}
+
+	changed := *user
+	changed.Username, changed.Email, changed.ExternalID = resource.UserName, resource.Email(), resource.ExternalID
+	if !app.checkSCIMUser(w, r, &changed, resource.Password) {
+		return
+	}
+	var hash string
+	if resource.Password != "" {
+		var err error
+		if hash, err = app.passwords.Hash(resource.Password); err != nil {
+			app.serverError(w, r, fmt.Errorf("hashing password: %w", err))
+			return
+		}
+	}
+	profileChanged := changed.Username != user.Username || changed.Email != user.Email || changed.ExternalID != user.ExternalID
+	if profileChanged || hash != "" {
+		if err := app.models.Users.UpdateProfile(r.Context(), &changed, hash); err != nil {
+			if scimErr := scimSaveError(err); scimErr != nil {
+				writeSCIMError(w, scimErr)
+				return
+			}
+			app.serverError(w, r, fmt.Errorf("updating user %d: %w", user.ID, err))
+			return
+		}
+	}
+	if profileChanged {
+		app.audit(r, security.EventUserProvision, user.ID, changed.Username, describeProvisioned(&changed, "updated"), true)
+	}
+	if hash != "" {
+		app.audit(r, security.EventPasswordChange, user.ID, changed.Username, "set by SCIM", true)
+	}
+	if err := app.scimSetActive(r, &changed, resource.IsActive()); err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			writeSCIMError(w, scimSaveError(err))
+			return
+		}
+		app.serverError(w, r, fmt.Errorf("changing status of user %d: %w", user.ID, err))
+		return
+	}
+
+	updated, err := app.models.Users.GetProvisioned(r.Context(), user.ID)
+	if err != nil {
+		app.serverError(w, r, fmt.Errorf("reloading user %d: %w", user.ID, err))
+		return
+	}
+	if updated == nil {
+		writeSCIMError(w, scim.Errorf(http.StatusNotFound, "", "no such user"))
+		return
+	}
+	writeSCIM(w, http.StatusOK, app.scimResource(r, updated))
+}
+
+// scimSetActive deactivates or reactivates user if needed. Deactivation
+// revokes the user's sessions, sign-in links and app access but keeps their
+// notes.
+func (app *application) scimSetActive(r *http.Request, user *data.User, active bool) error {
+	if active == (user.DeactivatedAt == nil) {
+		return nil
+	}
+	event := security.EventAccountDeactivated
+	var err error
+	if active {
+		event = security.EventAccountReactivated
+		err = app.models.Users.Reactivate(r.Context(), user.ID)
+	} else {
+		err = app.models.Users.Deactivate(r.Context(), user.ID)
+	}
+	if err != nil {
+		return err
+	}
+	app.audit(r, event, user.ID, user.Username, "by SCIM", true)
+	return nil
+}
+
+// checkSCIMUser checks a user's attributes with the same rules as
+// registration, and sends an invalidValue error if they break one
+func (app *application) checkSCIMUser(w http.ResponseWriter, r *http.Request, user *data.User, password string) bool {
+	v := validator.ValidateUsername(user.Username)
+	v.Merge(validator.ValidateEmail(user.Email))
+	if password != "" {
+		v.Merge(validator.ValidatePassword(password))
+	}
+	if v.ValidData() {
+		return true
+	}
+
+	tr := app.translator(r)
+	var problems []string
+	for _, field := range slices.Sorted(maps.Keys(v.Errors)) {
+		problems = append(problems, tr.T(v.Errors[field], v.Args[field]...))
+	}
+	writeSCIMError(w, scim.Errorf(http.StatusBadRequest, "invalidValue", "%s", strings.Join(problems, "; ")))
+	return false
+}
+
+// scimResource converts user to the resource the directory sees
+func (app *application) scimResource(r *http.Request, user *data.User) scim.User {
+	id := strconv.Itoa(user.ID)
+	active := user.DeactivatedAt == nil
+	return scim.User{
+		Schemas:    []string{scim.SchemaUser},
+		ID:         id,
+		ExternalID: user.ExternalID,
+		UserName:   user.Username,
+		Emails:     []scim.Email{{Value: user.Email, Type: "work", Primary: true}},
+		Active:     &active,
+		Meta: &scim.Meta{
+			ResourceType: "User",
+			Created:      user.CreatedAt,
+			LastModified: user.UpdatedAt,
+			Location:     app.absoluteURL(r, scimUsersPath+"/"+id),
+		},
+	}
+}
+
+// scimSaveError maps the conflicts of saving a user to SCIM errors, or
+// returns nil for other errors
+func scimSaveError(err error) *scim.Error {
+	switch {
+	case errors.Is(err, data.ErrDuplicateUsername):
+		return scim.Errorf(http.StatusConflict, "uniqueness", "userName is already taken")
+	case errors.Is(err, data.ErrDuplicateEmail):
+		return scim.Errorf(http.StatusConflict, "uniqueness", "the email address is already used by another user")
+	case errors.Is(err, data.ErrDuplicateExternalID):
+		return scim.Errorf(http.StatusConflict, "uniqueness", "externalId is already used by another user")
+	case errors.Is(err, data.ErrRecordNotFound):
+		return scim.Errorf(http.StatusNotFound, "", "no such user")
+	}
+	return nil
+}
+
+// describeProvisioned summarises a user the directory created or updated
+// for the audit log
+func describeProvisioned(user *data.User, action string) string {
+	s := fmt.Sprintf("%s by SCIM with email %s", action, user.Email)
+	if user.ExternalID != "" {
+		s += " and external ID " + user.ExternalID
+	}
+	return s
+}
+
+// readSCIM decodes a JSON request body into v, sending an invalidSyntax
+// error if it cannot
+func readSCIM(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(v); err != nil {
+		writeSCIMError(w, scim.Errorf(http.StatusBadRequest, "invalidSyntax", "the body must be a JSON object"))
+		return false
+	}
+	return true
+}
+
+// scimMethodNotAllowed refuses a method the resource does not support
+func scimMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeSCIMError(w, scim.Errorf(http.StatusMethodNotAllowed, "", "method not allowed"))
+}
+
+// writeSCIMError sends a SCIM error
+func writeSCIMError(w http.ResponseWriter, err *scim.Error) {
+	writeSCIM(w, err.Status, err)
+}
+
+// writeSCIM sends v as a SCIM response. Users' details are private, so it
+// must not be cached.
+func writeSCIM(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", scim.ContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -2,40 +2,201 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
-	"github.com/darynforman/gratitude-jar1/internal/session"
+	"github.com/darynforman/gratitude-jar1/internal/certs"
 )
 
-// startServer initializes and starts the HTTP server for the Gratitude Jar application.
+// serve runs the HTTP server for the Gratitude Jar application.
 // It performs the following tasks:
-// 1. Initializes the template cache
-// 2. Sets up the HTTP router with all application routes
-// 3. Configures the server to listen on port 4000
-// 4. Handles server startup errors
-//
-// Note: This function is currently not used as the server initialization
-// is handled directly in main.go. It's kept here for reference and potential
-// future use if server configuration becomes more complex.
-func startServer() {
-	// Initialize the template cache
-	if err := initTemplateCache(); err != nil {
-		log.Fatalf("Failed to initialize template cache: %v", err)
-	}
-	log.Println("Template cache initialized")
+//  1. Sets up the HTTP router with all application routes
+//  2. Configures an http.Server with the timeouts from config, serving
+//     HTTPS when a certificate is configured
+//  3. Starts background goroutines such as the rate limiter cleanup loop
+//     and the certificate reloader
+//  4. On SIGINT/SIGTERM, drains in-flight requests, stops background
+//     goroutines and closes the database pool
+func (app *application) serve() error {
+	cfg := app.config
 
 	// Initialize the HTTP router with all application routes
-	mux := routes()
+	srv := app.newHTTPServer(cfg.Server.Addr, app.routes())
+
+	// Background goroutines run until bgCtx is cancelled during shutdown
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		app.limiter.RunCleanup(bgCtx, cfg.RateLimit.CleanupInterval)
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		app.maintainIPFilter(bgCtx, cfg.IPFilter.RefreshInterval)
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		app.purgeDeletedAccounts(bgCtx, cfg.Account.PurgeInterval)
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		app.runExports(bgCtx, cfg.Account.ExportPollInterval)
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		app.sendLoginLinks(bgCtx)
+	}()
+
+	// Listen for shutdown signals
+	sigCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	servers := []*http.Server{srv}
+	serverErr := make(chan error, 2)
+
+	if cfg.TLS.Enabled() {
+		if cfg.TLS.SelfSigned {
+			if err := certs.EnsureSelfSigned(cfg.TLS.CertFile, cfg.TLS.KeyFile, []string{"localhost", "127.0.0.1", "::1"}); err != nil {
+				return err
+			}
+		}
+
+		reloader, err := certs.NewReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = certs.ServerConfig(reloader.GetCertificate)
+
+		// Reload the certificate when the files change or on SIGHUP
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			reloader.Watch(bgCtx, cfg.TLS.ReloadInterval)
+		}()
+		go func() {
+			defer wg.Done()
+			app.reloadOnSIGHUP(bgCtx, reloader)
+		}()
+
+		if cfg.TLS.RedirectAddr != "" {
+			redirect := app.newHTTPServer(cfg.TLS.RedirectAddr, redirectToHTTPS(cfg.Server.Addr))
+			servers = append(servers, redirect)
+			go func() {
+				app.logger.Printf("Starting HTTP->HTTPS redirect on %s...", redirect.Addr)
+				serverErr <- redirect.ListenAndServe()
+			}()
+		}
+
+		go func() {
+			app.logger.Printf("Starting server on %s (HTTPS)...", srv.Addr)
+			serverErr <- srv.ListenAndServeTLS("", "")
+		}()
+	} else {
+		go func() {
+			app.logger.Printf("Starting server on %s...", srv.Addr)
+			serverErr <- srv.ListenAndServe()
+		}()
+	}
+
+	var err error
+	select {
+	case err = <-serverErr:
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+	case <-sigCtx.Done():
+		app.logger.Println("Shutdown signal received, draining connections...")
+	}
+
+	// Drain in-flight requests on every listener
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	for _, s := range servers {
+		if shutdownErr := s.Shutdown(shutdownCtx); shutdownErr != nil && err == nil {
+			err = shutdownErr
+		}
+	}
+
+	// Stop background goroutines and wait for them to exit
+	stopBackground()
+	wg.Wait()
 
-	// Wrap mux with SCS session middleware
-	handler := session.Manager.Enable(mux)
+	if app.db != nil {
+		if dbErr := app.db.Close(); dbErr != nil {
+			app.logger.Printf("Error closing database: %v", dbErr)
+		}
+	}
 
-	// Start the HTTP server on port 4000
-	log.Println("Starting server on :4000...")
-	err := http.ListenAndServe(":4000", handler)
 	if err != nil {
-		log.Printf("Server error: %v", err)
-		log.Fatal(err)
+		return err
+	}
+	app.logger.Println("Server stopped")
+	return nil
+}
+
+// newHTTPServer returns an http.Server listening on addr with the configured timeouts
+func (app *application) newHTTPServer(addr string, handler http.Handler) *http.Server {
+	cfg := app.config
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+		MaxHeaderBytes:    cfg.Server.MaxHeaderBytes,
+		ErrorLog:          app.logger,
+	}
+}
+
+// reloadOnSIGHUP reloads the TLS certificate whenever the process receives SIGHUP
+func (app *application) reloadOnSIGHUP(ctx context.Context, reloader *certs.Reloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := reloader.Reload(); err != nil {
+				app.logger.Printf("TLS certificate reload failed: %v", err)
+				continue
+			}
+			app.logger.Println("TLS certificate reloaded on SIGHUP")
+		}
 	}
 }
+
+// redirectToHTTPS returns a handler that permanently redirects every request
+// to the same host and path on the HTTPS listener at tlsAddr
+func redirectToHTTPS(tlsAddr string) http.Handler {
+	_, tlsPort, _ := net.SplitHostPort(tlsAddr)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if tlsPort != "" && tlsPort != "443" {
+			host = net.JoinHostPort(host, tlsPort)
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
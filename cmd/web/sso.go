@@ -0,0 +1,225 @@
+// Package main contains single sign-on with OpenID Connect identity
+// providers for the Gratitude Jar application.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/darynforman/gratitude-jar1/internal/config"
+	"github.com/darynforman/gratitude-jar1/internal/data"
+	"github.com/darynforman/gratitude-jar1/internal/httperr"
+	"github.com/darynforman/gratitude-jar1/internal/oidc"
+	"github.com/darynforman/gratitude-jar1/internal/security"
+)
+
+// ssoCookie remembers which provider a sign-in went to and its state. It is
+// SameSite=Lax, unlike the session cookie, so it comes back with the
+// redirect from the provider.
+const ssoCookie = "sso_flow"
+
+// errNoSSOAccount means the provider's user matches no account
+var errNoSSOAccount = errors.New("no account for the identity")
+
+// ssoButton is a provider shown on the login page
+type ssoButton struct {
+	Name  string
+	Label string
+}
+
+// newSSOProviders creates a client for every configured provider, by name
+func newSSOProviders(providers []config.SSOProvider) map[string]*oidc.Provider {
+	clients := make(map[string]*oidc.Provider, len(providers))
+	for _, p := range providers {
+		clients[p.Name] = oidc.New(oidc.Config{
+			Issuer:       p.Issuer,
+			ClientID:     p.ClientID,
+			ClientSecret: p.ClientSecret,
+			Scopes:       p.Scopes,
+		})
+	}
+	return clients
+}
+
+// ssoButtons lists the providers in the configured order
+func (app *application) ssoButtons() []ssoButton {
+	buttons := make([]ssoButton, 0, len(app.config.SSO.Providers))
+	for _, p := range app.config.SSO.Providers {
+		buttons = append(buttons, ssoButton{Name: p.Name, Label: p.Label})
+	}
+	return buttons
+}
+
+// ssoLogin sends the user to sign in with the provider named in the query.
+// The state, nonce and PKCE verifier are derived from a random value kept in
+// a signed cookie, so nothing needs to be stored on the server.
+func (app *application) ssoLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		app.methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	name := r.URL.Query().Get("provider")
+	provider, ok := app.sso[name]
+	if !ok {
+		app.notFound(w, r)
+		return
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	verifier := app.ssoSecret("pkce", state)
+	authURL, err := provider.AuthCodeURL(r.Context(), app.absoluteURL(r, "/sso/callback"), state, app.ssoSecret("nonce", state), oidc.Challenge(verifier))
+	if err != nil {
+		app.errorResponse(w, r, httperr.Wrap(http.StatusBadGateway, "error.sso_unavailable", fmt.Errorf("provider %s: %w", name, err)))
+		return
+	}
+
+	app.setSSOCookie(w, name+"."+state+"."+app.ssoSecret("flow", name+"."+state), 600)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// ssoCallback is where providers send the user back. That request comes from
+// the provider's site, so the SameSite=Strict session cookie is not sent
+// with it. The page shown moves on to /sso/complete from our own site, where
+// the session is available again.
+func (app *application) ssoCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		app.methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	app.render(w, r, "continue.tmpl", PageData{Title: "Login", ContinueURL: "/sso/complete?" + r.URL.RawQuery})
+}
+
+// ssoComplete checks the state, redeems the code for a verified ID token and
+// signs in the account linked to the provider's user. The first time, the
+// account is found by the email address the provider has verified.
+func (app *application) ssoComplete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		app.methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	// The cookie is used up whatever happens next
+	name, state, ok := app.ssoFlow(r)
+	app.setSSOCookie(w, "", -1)
+	query := r.URL.Query()
+	provider := app.sso[name]
+	if !ok || provider == nil {
+		app.audit(r, security.EventLogin, 0, "", "sso: flow cookie missing or invalid", false)
+		app.clientError(w, r, http.StatusBadRequest, "error.sso_state")
+		return
+	}
+	if !hmac.Equal([]byte(query.Get("state")), []byte(state)) {
+		app.audit(r, security.EventLogin, 0, "", "sso "+name+": state does not match", false)
+		app.clientError(w, r, http.StatusBadRequest, "error.sso_state")
+		return
+	}
+	if reason := query.Get("error"); reason != "" {
+		app.audit(r, security.EventLogin, 0, "", "sso "+name+": provider returned "+reason, false)
+		app.clientError(w, r, http.StatusUnauthorized, "error.sso_denied")
+		return
+	}
+
+	claims, err := provider.Exchange(r.Context(), query.Get("code"), app.absoluteURL(r, "/sso/callback"), app.ssoSecret("pkce", state), app.ssoSecret("nonce", state))
+	if errors.Is(err, oidc.ErrInvalidToken) {
+		app.audit(r, security.EventLogin, 0, "", "sso "+name+": "+err.Error(), false)
+		app.strike(r, "invalid ID token")
+		app.errorResponse(w, r, httperr.Wrap(http.StatusUnauthorized, "error.sso_failed", err))
+		return
+	}
+	if err != nil {
+		app.errorResponse(w, r, httperr.Wrap(http.StatusBadGateway, "error.sso_unavailable", fmt.Errorf("provider %s: %w", name, err)))
+		return
+	}
+
+	user, err := app.ssoUser(r, name, claims)
+	if err == nil {
+		err = app.logIn(r, user, "sso "+name)
+	}
+	if errors.Is(err, errNoSSOAccount) || errors.Is(err, data.ErrRecordNotFound) {
+		app.audit(r, security.EventLogin, 0, claims.Email, "sso "+name+": no account for subject "+claims.Subject, false)
+		app.clientError(w, r, http.StatusForbidden, "error.sso_no_account")
+		return
+	}
+	if errors.Is(err, errAccountDeactivated) {
+		app.clientError(w, r, http.StatusForbidden, "error.account_deactivated")
+		return
+	}
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, app.loginRedirect(r), http.StatusSeeOther)
+}
+
+// ssoUser finds the account of the provider's user: the one linked to them,
+// or else the one with the email address the provider has verified, which is
+// then linked. Unverified addresses are never trusted, or anyone could claim
+// an account by putting its address on their profile at the provider.
+func (app *application) ssoUser(r *http.Request, name string, claims *oidc.Claims) (*data.User, error) {
+	user, err := app.models.Identities.User(r.Context(), claims.Issuer, claims.Subject)
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		return user, err
+	}
+	if !claims.EmailVerified || claims.Email == "" {
+		return nil, errNoSSOAccount
+	}
+
+	user, err = app.models.Users.GetByEmail(r.Context(), claims.Email)
+	if err != nil {
+		return nil, fmt.Errorf("looking up user by email: %w", err)
+	}
+	if user == nil {
+		return nil, errNoSSOAccount
+	}
+	if err := app.models.Identities.Link(r.Context(), user.ID, claims.Issuer, claims.Subject, claims.Email); err != nil {
+		return nil, fmt.Errorf("linking identity: %w", err)
+	}
+	app.audit(r, security.EventSSOLink, user.ID, user.Username, fmt.Sprintf("linked %s subject %s by email %s", name, claims.Subject, claims.Email), true)
+	return user, nil
+}
+
+// ssoFlow reads the provider name and state from the signed cookie
+func (app *application) ssoFlow(r *http.Request) (name, state string, ok bool) {
+	cookie, err := r.Cookie(ssoCookie)
+	if err != nil {
+		return "", "", false
+	}
+	name, rest, _ := strings.Cut(cookie.Value, ".")
+	state, sig, _ := strings.Cut(rest, ".")
+	if !hmac.Equal([]byte(sig), []byte(app.ssoSecret("flow", name+"."+state))) {
+		return "", "", false
+	}
+	return name, state, true
+}
+
+// setSSOCookie sets or, with maxAge -1, clears the flow cookie
+func (app *application) setSSOCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoCookie,
+		Value:    value,
+		Path:     "/sso/",
+		MaxAge:   maxAge,
+		Secure:   app.config.SecureCookies(),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ssoSecret derives a value for purpose from a sign-in's state, keyed with a
+// key derived from the session secret for single sign-on. Only someone with
+// the secret can work out the nonce or PKCE verifier of a state seen in a
+// URL.
+func (app *application) ssoSecret(purpose, state string) string {
+	mac := hmac.New(sha256.New, app.derivedKey("sso"))
+	fmt.Fprintf(mac, "sso-%s:%s", purpose, state)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -2,68 +2,135 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"html/template"
-	"path/filepath"
+	"io/fs"
+	"path"
 	"sync"
+	"text/template/parse"
+	"time"
 )
 
 // ErrTemplateNotFound is returned when a template is not found in the cache
 var ErrTemplateNotFound = errors.New("template not found")
 
-// templateCache holds the parsed templates
-var templateCache map[string]*template.Template
-var templateMutex sync.RWMutex
+// templateEngine holds the parsed templates. Templates come from a file
+// system: the copy embedded in the binary in production, or the ui/html
+// directory on disk in development, where they are re-parsed whenever a file
+// changes so edits show up on the next request.
+type templateEngine struct {
+	fsys   fs.FS
+	reload bool
+
+	mu      sync.Mutex
+	cache   map[string]*template.Template
+	version string // file count and latest modification time at the last parse
+}
+
+// newTemplateEngine parses and validates every template in fsys. With reload
+// set, templates are re-parsed when the files change.
+func newTemplateEngine(fsys fs.FS, reload bool) (*templateEngine, error) {
+	e := &templateEngine{fsys: fsys, reload: reload}
+	version, err := e.currentVersion()
+	if err != nil {
+		return nil, err
+	}
+	cache, err := newTemplateCache(fsys)
+	if err != nil {
+		return nil, err
+	}
+	e.cache, e.version = cache, version
+	return e, nil
+}
 
-// testTemplateDir is used in tests to override the default template directory
-var testTemplateDir string
+// get returns the named template set, re-parsing first in development when
+// the files have changed. A broken edit is reported on every request until it
+// is fixed; the previous templates are kept meanwhile.
+func (e *templateEngine) get(name string) (*template.Template, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 
-// getTemplatePath returns the path to the template directory
-func getTemplatePath(name string) string {
-	if testTemplateDir != "" {
-		return filepath.Join(testTemplateDir, name)
+	if e.reload {
+		version, err := e.currentVersion()
+		if err != nil {
+			return nil, err
+		}
+		if version != e.version {
+			cache, err := newTemplateCache(e.fsys)
+			if err != nil {
+				return nil, err
+			}
+			e.cache, e.version = cache, version
+		}
+	}
+
+	tmpl, ok := e.cache[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTemplateNotFound, name)
 	}
-	return filepath.Join("ui/html", name)
+	return tmpl, nil
+}
+
+// currentVersion summarises the template files so changes can be detected
+func (e *templateEngine) currentVersion() (string, error) {
+	var (
+		files  int
+		latest time.Time
+	)
+	err := fs.WalkDir(e.fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files++
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d@%d", files, latest.UnixNano()), nil
 }
 
-// initTemplateCache initializes the template cache
-func initTemplateCache() error {
+// newTemplateCache parses every page and partial template in fsys.
+// Pages are parsed together with base.tmpl and all partials; partials are
+// also cached individually under "partials/<name>". Every set is validated.
+func newTemplateCache(fsys fs.FS) (map[string]*template.Template, error) {
 	cache := map[string]*template.Template{}
 
 	// Get all page and partial templates
-	pages, err := filepath.Glob(getTemplatePath("*.tmpl"))
+	pages, err := fs.Glob(fsys, "*.tmpl")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	partials, err := filepath.Glob(getTemplatePath("partials/*.tmpl"))
+	partials, err := fs.Glob(fsys, "partials/*.tmpl")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Loop through page templates
 	for _, page := range pages {
-		name := filepath.Base(page)
+		name := path.Base(page)
 
 		// Skip base template
 		if name == "base.tmpl" {
 			continue
 		}
 
-		// Parse the base template first
-		ts, err := template.New(name).ParseFiles(getTemplatePath("base.tmpl"))
+		// Parse the base template, all partials and then the page, so the
+		// page's blocks take precedence
+		patterns := append(append([]string{"base.tmpl"}, partials...), page)
+		ts, err := template.New(name).ParseFS(fsys, patterns...)
 		if err != nil {
-			return err
+			return nil, err
 		}
-
-		// Parse all partial templates
-		ts, err = ts.ParseFiles(partials...)
-		if err != nil {
-			return err
-		}
-
-		// Parse the page template
-		ts, err = ts.ParseFiles(page)
-		if err != nil {
-			return err
+		if err := validateTemplateSet(ts, "base", "title", "content"); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
 		}
 
 		// Add to cache
@@ -72,27 +139,71 @@ func initTemplateCache() error {
 
 	// Also cache partial templates individually
 	for _, partial := range partials {
-		name := filepath.Base(partial)
-		ts, err := template.ParseFiles(partial)
+		name := "partials/" + path.Base(partial)
+		ts, err := template.ParseFS(fsys, partial)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if err := validateTemplateSet(ts); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
 		}
-		cache["partials/"+name] = ts
+		cache[name] = ts
 	}
 
-	templateCache = cache
-	return nil
+	return cache, nil
 }
 
-// getTemplate returns a template from the cache
-func getTemplate(name string) (*template.Template, error) {
-	templateMutex.RLock()
-	defer templateMutex.RUnlock()
+// validateTemplateSet checks that ts defines the required templates and that
+// every {{template "name"}} call refers to a template in the set, which
+// html/template would otherwise only report when the page is rendered
+func validateTemplateSet(ts *template.Template, required ...string) error {
+	for _, name := range required {
+		if ts.Lookup(name) == nil {
+			return fmt.Errorf("missing {{define %q}}", name)
+		}
+	}
+	for _, t := range ts.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		var missing error
+		walkTemplateCalls(t.Tree.Root, func(called string) {
+			if missing == nil && ts.Lookup(called) == nil {
+				missing = fmt.Errorf("template %q calls undefined template %q", t.Name(), called)
+			}
+		})
+		if missing != nil {
+			return missing
+		}
+	}
+	return nil
+}
 
-	tmpl, ok := templateCache[name]
-	if !ok {
-		return nil, ErrTemplateNotFound
+// walkTemplateCalls calls fn with the name of every template invoked under node
+func walkTemplateCalls(node parse.Node, fn func(name string)) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			walkTemplateCalls(child, fn)
+		}
+	case *parse.TemplateNode:
+		fn(n.Name)
+	case *parse.IfNode:
+		walkTemplateCalls(n.List, fn)
+		walkTemplateCalls(n.ElseList, fn)
+	case *parse.RangeNode:
+		walkTemplateCalls(n.List, fn)
+		walkTemplateCalls(n.ElseList, fn)
+	case *parse.WithNode:
+		walkTemplateCalls(n.List, fn)
+		walkTemplateCalls(n.ElseList, fn)
 	}
+}
 
-	return tmpl, nil
+// getTemplate returns a template set from the engine
+func (app *application) getTemplate(name string) (*template.Template, error) {
+	return app.templates.get(name)
 }
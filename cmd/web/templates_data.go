@@ -2,20 +2,62 @@
 // This package defines the data models used in HTML templates and provides functions for managing gratitude notes.
 package main
 
-import "github.com/darynforman/gratitude-jar1/internal/data"
+import (
+	"github.com/darynforman/gratitude-jar1/internal/data"
+	"github.com/darynforman/gratitude-jar1/internal/httperr"
+	"github.com/darynforman/gratitude-jar1/internal/ipfilter"
+	"github.com/darynforman/gratitude-jar1/internal/strength"
+)
 
 // PageData holds data passed to templates
 type PageData struct {
-	Title           string               // The title of the page to be displayed in the template
-	Notes           []data.GratitudeNote // A slice of GratitudeNote that will be displayed in the template
-	Note            *data.GratitudeNote  // A single gratitude note for editing/viewing
-	Errors          map[string]string    // Validation errors for form fields
-	Emojis          []string             // Available emojis for gratitude note creation
-	Form            map[string]string    // Form values for re-populating registration/login
-	IsAuthenticated bool                 // Indicates whether the user is authenticated
-	UserRole        string               // The role of the authenticated user
-	Flash           string               // Flash messages for user feedback
-	SuccessMessage  string               // Success message for form submissions
+	Title             string               // The title of the page to be displayed in the template
+	Notes             []data.GratitudeNote // A slice of GratitudeNote that will be displayed in the template
+	Note              *data.GratitudeNote  // A single gratitude note for editing/viewing
+	Errors            map[string]string    // Validation errors for form fields, as message keys
+	ErrorArgs         map[string][]any     // Arguments for the validation error messages
+	Emojis            []string             // Available emojis for gratitude note creation
+	Form              map[string]string    // Form values for re-populating registration/login
+	IsAuthenticated   bool                 // Indicates whether the user is authenticated
+	UserRole          string               // The role of the authenticated user
+	Flash             string               // Flash messages for user feedback
+	SuccessMessage    string               // Success message for form submissions
+	IPRules           []ipfilter.Rule      // IP allow/deny rules shown in the admin console
+	Error             *httperr.Error       // The error shown on an error page
+	RequestID         string               // Request ID shown on error pages for support
+	Timezones         []string             // Time zones suggested on the settings page
+	NoteCount         int                  // Total number of the user's notes
+	Page              int                  // Current page of notes, from 1
+	PageCount         int                  // Number of pages of notes
+	Account           *data.User           // The logged-in user on the account page
+	DeletionGraceDays int                  // Days before a deleted account is erased
+	Export            *data.DataExport     // The user's latest data export, if any
+	ExportURL         string               // Signed download link of a ready export
+	PasswordStrength  *strength.Result     // Strength of the new password being typed, for the meter
+	LoginLinkSent     bool                 // A sign-in link was requested, so tell the user to check their mail
+	LoginLinkToken    string               // Token of the sign-in link being confirmed
+	ContinueURL       string               // Where a page that moves on by itself goes next
+	OAuthClient       *data.OAuthClient    // The app asking for consent, or the one just registered
+	OAuthScopes       []string             // The scopes the app asks for on the consent screen
+	ClientSecret      string               // Secret of the app just registered, shown once
+	OAuthClients      []data.OAuthClient   // Apps registered in the admin console
+	OAuthGrants       []data.OAuthGrant    // Apps the user has authorized
+}
+
+// PrevPage returns the number of the previous page of notes, or 0 on the first
+func (d PageData) PrevPage() int {
+	if d.Page > 1 {
+		return d.Page - 1
+	}
+	return 0
+}
+
+// NextPage returns the number of the next page of notes, or 0 on the last
+func (d PageData) NextPage() int {
+	if d.Page < d.PageCount {
+		return d.Page + 1
+	}
+	return 0
 }
 
 // GratitudeNote represents a single gratitude note in the templates.
@@ -3,10 +3,12 @@ module github.com/darynforman/gratitude-jar1
 go 1.24.1
 
 require (
+	github.com/BurntSushi/toml v1.5.0
 	github.com/golangcollege/sessions v1.2.0
 	github.com/justinas/nosurf v1.1.1
 	github.com/lib/pq v1.10.9
 	golang.org/x/crypto v0.37.0
+	golang.org/x/text v0.24.0
 )
 
 require golang.org/x/sys v0.32.0 // indirect
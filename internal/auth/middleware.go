@@ -7,7 +7,7 @@ import (
 )
 
 // RequireLogin is middleware that ensures a user is logged in
-func RequireLogin(next http.HandlerFunc) http.HandlerFunc {
+func RequireLogin(sm *session.Manager, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Check if session cookie exists
 		_, err := r.Cookie("session")
@@ -17,7 +17,7 @@ func RequireLogin(next http.HandlerFunc) http.HandlerFunc {
 		}
 
 		// Check if user ID exists in session
-		userID := GetUserIDFromSession(r)
+		userID := GetUserIDFromSession(sm, r)
 		if userID == 0 {
 			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 			return
@@ -28,7 +28,7 @@ func RequireLogin(next http.HandlerFunc) http.HandlerFunc {
 }
 
 // GetUserIDFromSession retrieves the user ID from the session
-func GetUserIDFromSession(r *http.Request) int {
-	userID, _ := session.GetLoggedInUser(r)
+func GetUserIDFromSession(sm *session.Manager, r *http.Request) int {
+	userID, _ := sm.GetLoggedInUser(r)
 	return userID
 }
@@ -5,16 +5,18 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/darynforman/gratitude-jar1/internal/config"
 	"github.com/darynforman/gratitude-jar1/internal/data"
+	"github.com/darynforman/gratitude-jar1/internal/httperr"
 	"github.com/darynforman/gratitude-jar1/internal/session"
 )
 
-// RequireOwnership ensures the user owns the requested resource
-func RequireOwnership(next http.HandlerFunc) http.HandlerFunc {
+// RequireOwnership ensures the user owns the requested resource.
+// Gratitude notes are looked up through notes; missing notes and notes owned
+// by someone else are reported through fail as 404 and 403 *httperr.Errors.
+func RequireOwnership(sm *session.Manager, notes *data.GratitudeModel, fail func(http.ResponseWriter, *http.Request, error), next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get user ID from session
-		userID := session.Manager.GetInt(r, "userID")
+		userID := sm.GetInt(r, "userID")
 		if userID == 0 {
 			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 			return
@@ -39,16 +41,15 @@ func RequireOwnership(next http.HandlerFunc) http.HandlerFunc {
 		// Check if this is a gratitude note
 		if strings.Contains(r.URL.Path, "/gratitude/") || strings.Contains(r.URL.Path, "/notes/") {
 			// Get the note with context
-			gratitudeModel := data.NewGratitudeModel(config.DB)
-			note, err := gratitudeModel.Get(r.Context(), resourceID)
+			note, err := notes.Get(r.Context(), resourceID)
 			if err != nil || note == nil {
-				http.NotFound(w, r)
+				fail(w, r, httperr.NotFound())
 				return
 			}
 
 			// Check ownership
 			if note.UserID != userID {
-				http.Error(w, "Forbidden", http.StatusForbidden)
+				fail(w, r, httperr.Forbidden("error.not_owner"))
 				return
 			}
 		}
@@ -1,19 +1,156 @@
 package auth
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// HashPassword creates a bcrypt hash from a password string
-func HashPassword(password string) (string, error) {
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
+// Password hashing algorithms
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+)
+
+// ErrMismatchedPassword is returned by Verify when the password is wrong
+var ErrMismatchedPassword = errors.New("auth: password does not match hash")
+
+// ErrUnknownHash is returned by Verify for hashes it cannot read
+var ErrUnknownHash = errors.New("auth: unrecognized password hash")
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// Hasher hashes passwords for storage and verifies them. New hashes use
+// Algorithm; hashes made with another algorithm or other parameters still
+// verify, and are reported as needing a rehash.
+//
+// Argon2id hashes are stored in the PHC string format,
+// $argon2id$v=19$m=<KiB>,t=<passes>,p=<threads>$<salt>$<key>, with k=1 added
+// to the parameters when the password was peppered. bcrypt hashes are the
+// usual $2a$<cost>$ strings and are never peppered.
+type Hasher struct {
+	Algorithm     string // Argon2id or Bcrypt
+	Argon2Memory  uint32 // Memory in KiB
+	Argon2Time    uint32 // Passes over the memory
+	Argon2Threads uint8  // Degree of parallelism
+	BcryptCost    int
+	// Pepper is an optional server-side secret mixed into Argon2id hashes
+	// so a leaked database alone is not enough to guess passwords
+	Pepper []byte
+}
+
+// Hash hashes password with the configured algorithm and a random salt
+func (h *Hasher) Hash(password string) (string, error) {
+	if h.Algorithm == Bcrypt {
+		b, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
 		return "", err
 	}
-	return string(hashedBytes), nil
+	p := argon2Params{memory: h.Argon2Memory, time: h.Argon2Time, threads: h.Argon2Threads, peppered: len(h.Pepper) > 0}
+	key := argon2.IDKey(h.pepper(password, p.peppered), salt, p.time, p.memory, p.threads, argon2KeyLen)
+	return fmt.Sprintf("$%s$v=%d$%s$%s$%s", Argon2id, argon2.Version, p,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
 }
 
-// CheckPassword compares a plaintext password against a bcrypt hash
-func CheckPassword(password, hash string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+// Verify checks password against hash. It returns ErrMismatchedPassword if
+// the password is wrong. When it is right, rehash reports whether hash was
+// made with another algorithm, other parameters or another pepper setting,
+// so the caller can store a fresh Hash.
+func (h *Hasher) Verify(password, hash string) (rehash bool, err error) {
+	if strings.HasPrefix(hash, "$2") {
+		if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+			if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+				return false, ErrMismatchedPassword
+			}
+			return false, fmt.Errorf("%w: %v", ErrUnknownHash, err)
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return false, fmt.Errorf("%w: %v", ErrUnknownHash, err)
+		}
+		return h.Algorithm != Bcrypt || cost != h.BcryptCost, nil
+	}
+
+	p, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+	if p.peppered && len(h.Pepper) == 0 {
+		return false, fmt.Errorf("%w: peppered hash but no pepper is configured", ErrUnknownHash)
+	}
+	got := argon2.IDKey(h.pepper(password, p.peppered), salt, p.time, p.memory, p.threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(got, key) != 1 {
+		return false, ErrMismatchedPassword
+	}
+	return h.Algorithm != Argon2id ||
+		p.memory != h.Argon2Memory || p.time != h.Argon2Time || p.threads != h.Argon2Threads ||
+		p.peppered != (len(h.Pepper) > 0), nil
+}
+
+// pepper mixes the pepper into password, if peppered
+func (h *Hasher) pepper(password string, peppered bool) []byte {
+	if !peppered {
+		return []byte(password)
+	}
+	mac := hmac.New(sha256.New, h.Pepper)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+// argon2Params are the parameters encoded in an Argon2id hash
+type argon2Params struct {
+	memory   uint32
+	time     uint32
+	threads  uint8
+	peppered bool
+}
+
+func (p argon2Params) String() string {
+	s := fmt.Sprintf("m=%d,t=%d,p=%d", p.memory, p.time, p.threads)
+	if p.peppered {
+		s += ",k=1"
+	}
+	return s
+}
+
+// parseArgon2id reads a PHC format Argon2id hash
+func parseArgon2id(hash string) (p argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != Argon2id {
+		return p, nil, nil, ErrUnknownHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("%w: unsupported argon2 version %q", ErrUnknownHash, parts[2])
+	}
+	params, peppered := strings.CutSuffix(parts[3], ",k=1")
+	if _, err := fmt.Sscanf(params, "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil || p.time == 0 || p.threads == 0 {
+		return p, nil, nil, fmt.Errorf("%w: bad argon2 parameters %q", ErrUnknownHash, parts[3])
+	}
+	p.peppered = peppered
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return p, nil, nil, fmt.Errorf("%w: bad salt: %v", ErrUnknownHash, err)
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return p, nil, nil, fmt.Errorf("%w: bad key", ErrUnknownHash)
+	}
+	return p, salt, key, nil
 }
@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testHasher is cheap enough for tests
+func testHasher() *Hasher {
+	return &Hasher{Algorithm: Argon2id, Argon2Memory: 64, Argon2Time: 1, Argon2Threads: 1, BcryptCost: bcrypt.MinCost}
+}
+
+func TestHasherArgon2id(t *testing.T) {
+	h := testHasher()
+	hash, err := h.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^\$argon2id\$v=19\$m=64,t=1,p=1\$[A-Za-z0-9+/]{22}\$[A-Za-z0-9+/]{43}$`).MatchString(hash) {
+		t.Fatalf("got hash %q", hash)
+	}
+	if other, _ := h.Hash("correct horse"); other == hash {
+		t.Error("two hashes of the same password are equal; the salt is not random")
+	}
+
+	if rehash, err := h.Verify("correct horse", hash); err != nil || rehash {
+		t.Errorf("Verify = %v, %v; want a match without rehash", rehash, err)
+	}
+	if _, err := h.Verify("wrong horse", hash); !errors.Is(err, ErrMismatchedPassword) {
+		t.Errorf("wrong password: got %v", err)
+	}
+
+	// Hashes made with other parameters still verify but are upgraded
+	h.Argon2Time = 2
+	if rehash, err := h.Verify("correct horse", hash); err != nil || !rehash {
+		t.Errorf("after changing parameters, Verify = %v, %v; want a rehash", rehash, err)
+	}
+}
+
+func TestHasherBcrypt(t *testing.T) {
+	legacy, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := testHasher()
+	if rehash, err := h.Verify("correct horse", string(legacy)); err != nil || !rehash {
+		t.Errorf("bcrypt hash with argon2id configured: Verify = %v, %v; want a rehash", rehash, err)
+	}
+	if _, err := h.Verify("wrong horse", string(legacy)); !errors.Is(err, ErrMismatchedPassword) {
+		t.Errorf("wrong password: got %v", err)
+	}
+
+	h.Algorithm = Bcrypt
+	if rehash, err := h.Verify("correct horse", string(legacy)); err != nil || rehash {
+		t.Errorf("bcrypt hash at the configured cost: Verify = %v, %v; want no rehash", rehash, err)
+	}
+	h.BcryptCost = bcrypt.MinCost + 1
+	if rehash, _ := h.Verify("correct horse", string(legacy)); !rehash {
+		t.Error("bcrypt hash at an old cost is not rehashed")
+	}
+	hash, err := h.Hash("correct horse")
+	if err != nil || !strings.HasPrefix(hash, "$2a$05$") {
+		t.Errorf("got bcrypt hash %q, %v", hash, err)
+	}
+}
+
+func TestHasherPepper(t *testing.T) {
+	plain := testHasher()
+	unpeppered, _ := plain.Hash("correct horse")
+
+	peppered := testHasher()
+	peppered.Pepper = []byte(strings.Repeat("p", 32))
+	hash, err := peppered.Hash("correct horse")
+	if err != nil || !strings.Contains(hash, ",k=1$") {
+		t.Fatalf("got peppered hash %q, %v", hash, err)
+	}
+	if rehash, err := peppered.Verify("correct horse", hash); err != nil || rehash {
+		t.Errorf("Verify = %v, %v; want a match without rehash", rehash, err)
+	}
+
+	// The hash is useless without the pepper
+	if _, err := plain.Verify("correct horse", hash); !errors.Is(err, ErrUnknownHash) {
+		t.Errorf("peppered hash without a pepper: got %v", err)
+	}
+	other := testHasher()
+	other.Pepper = []byte(strings.Repeat("q", 32))
+	if _, err := other.Verify("correct horse", hash); !errors.Is(err, ErrMismatchedPassword) {
+		t.Errorf("peppered hash with another pepper: got %v", err)
+	}
+
+	// Hashes from before the pepper was configured are upgraded
+	if rehash, err := peppered.Verify("correct horse", unpeppered); err != nil || !rehash {
+		t.Errorf("unpeppered hash: Verify = %v, %v; want a rehash", rehash, err)
+	}
+}
+
+func TestHasherUnknownHash(t *testing.T) {
+	h := testHasher()
+	for _, hash := range []string{
+		"",
+		"plaintext",
+		"$argon2i$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5",
+		"$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5",
+		"$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$not base64!$a2V5",
+	} {
+		if _, err := h.Verify("correct horse", hash); !errors.Is(err, ErrUnknownHash) {
+			t.Errorf("Verify(%q) = %v; want ErrUnknownHash", hash, err)
+		}
+	}
+}
@@ -8,17 +8,17 @@ import (
 )
 
 // SessionTimeoutMiddleware checks if the session has timed out due to inactivity
-func SessionTimeoutMiddleware(next http.Handler) http.Handler {
+func SessionTimeoutMiddleware(sm *session.Manager, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Skip for unauthenticated users
-		userID := session.Manager.GetInt(r, "userID")
+		userID := sm.GetInt(r, "userID")
 		if userID == 0 {
 			next.ServeHTTP(w, r)
 			return
 		}
 
 		// Get last activity time from session
-		lastActivityVal := session.Manager.Get(r, "last_activity")
+		lastActivityVal := sm.Get(r, "last_activity")
 		
 		// Check if last_activity exists and is a valid time
 		var lastActivity time.Time
@@ -30,15 +30,15 @@ func SessionTimeoutMiddleware(next http.Handler) http.Handler {
 
 		now := time.Now()
 		
-		// If session has been inactive for too long (30 minutes), log out
-		if !lastActivity.IsZero() && now.Sub(lastActivity) > 30*time.Minute {
-			session.LogoutUser(w, r)
+		// If session has been inactive for too long, log out
+		if !lastActivity.IsZero() && now.Sub(lastActivity) > sm.IdleTimeout {
+			sm.LogoutUser(w, r)
 			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 			return
 		}
 		
 		// Update last activity time
-		session.Manager.Put(r, "last_activity", now)
+		sm.Put(r, "last_activity", now)
 		
 		next.ServeHTTP(w, r)
 	})
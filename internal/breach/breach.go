@@ -0,0 +1,187 @@
+// Package breach checks passwords against a local corpus of passwords known
+// from data breaches, so no password or hash ever leaves the server.
+//
+// The corpus is a text file in the format of the Pwned Passwords downloads:
+// one uppercase SHA-1 hash per line, optionally followed by ":" and the
+// number of times it was seen, sorted by hash. Because it is sorted, the
+// lines that share a hash's 5-character prefix (the partition the Pwned
+// Passwords range API would return) are found by binary search over the
+// file and scanned, without reading the rest of it into memory.
+package breach
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PrefixLen is the length of the hash prefix that partitions the corpus
+const PrefixLen = 5
+
+// hashLen is the length of a hex SHA-1 hash
+const hashLen = 40
+
+// Corpus is an open breached-password corpus. It is safe for concurrent use.
+type Corpus struct {
+	mu   sync.Mutex // Guards seeking in f
+	f    *os.File
+	size int64
+}
+
+// Open opens the corpus at path
+func Open(path string) (*Corpus, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Corpus{f: f, size: info.Size()}, nil
+}
+
+// Close closes the corpus file
+func (c *Corpus) Close() error {
+	return c.f.Close()
+}
+
+// Hash returns the uppercase hex SHA-1 of password, as stored in the corpus
+func Hash(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// Count returns how many times password was seen in breaches, or 0 if it is
+// not in the corpus. Corpora without counts report 1 for every entry.
+func (c *Corpus) Count(password string) (int, error) {
+	hash := Hash(password)
+	lines, err := c.Range(hash[:PrefixLen])
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range lines {
+		if line.Suffix == hash[PrefixLen:] {
+			return line.Count, nil
+		}
+	}
+	return 0, nil
+}
+
+// Line is one hash in a partition: the hash without the prefix, and how many
+// times it was seen
+type Line struct {
+	Suffix string
+	Count  int
+}
+
+// Range returns the partition of hashes that start with prefix
+func (c *Corpus) Range(prefix string) ([]Line, error) {
+	prefix = strings.ToUpper(prefix)
+	if len(prefix) != PrefixLen {
+		return nil, fmt.Errorf("breach: prefix must be %d hex characters", PrefixLen)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Find the smallest offset whose next line is at or after prefix; that
+	// line is the first of the partition, if there is one
+	lo, hi := int64(0), c.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		_, line, err := c.lineAfter(mid)
+		if err != nil {
+			return nil, err
+		}
+		if line == nil || string(line[:min(len(line), PrefixLen)]) >= prefix {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+
+	start, _, err := c.lineAfter(lo)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.f.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var lines []Line
+	s := bufio.NewScanner(io.LimitReader(c.f, c.size-start))
+	for s.Scan() {
+		text := strings.TrimSpace(s.Text())
+		if text == "" {
+			continue
+		}
+		if !strings.HasPrefix(strings.ToUpper(text), prefix) {
+			break
+		}
+		line, err := parseLine(text)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	return lines, s.Err()
+}
+
+// lineAfter returns the first full line starting at or after offset, and
+// where it starts. The line is nil at the end of the file.
+func (c *Corpus) lineAfter(offset int64) (int64, []byte, error) {
+	start := offset
+	if offset > 0 {
+		// offset may be in the middle of a line; skip to the next one
+		// unless it is right after a newline
+		start = offset - 1
+	}
+	if _, err := c.f.Seek(start, io.SeekStart); err != nil {
+		return 0, nil, err
+	}
+	r := bufio.NewReader(io.LimitReader(c.f, c.size-start))
+	if offset > 0 {
+		skipped, err := r.ReadSlice('\n')
+		if errors.Is(err, io.EOF) {
+			return c.size, nil, nil
+		}
+		if err != nil {
+			return 0, nil, fmt.Errorf("breach: reading corpus: %w", err)
+		}
+		start += int64(len(skipped))
+	}
+	line, err := r.ReadBytes('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, nil, err
+	}
+	if len(line) == 0 {
+		return c.size, nil, nil
+	}
+	return start, bytes.ToUpper(bytes.TrimRight(line, "\r\n")), nil
+}
+
+// parseLine reads a HASH[:COUNT] line
+func parseLine(text string) (Line, error) {
+	hash, count, hasCount := strings.Cut(text, ":")
+	if len(hash) != hashLen {
+		return Line{}, fmt.Errorf("breach: malformed corpus line %q", text)
+	}
+	line := Line{Suffix: strings.ToUpper(hash[PrefixLen:]), Count: 1}
+	if hasCount {
+		n, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil {
+			return Line{}, fmt.Errorf("breach: malformed count in corpus line %q", text)
+		}
+		line.Count = n
+	}
+	return line, nil
+}
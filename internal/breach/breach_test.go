@@ -0,0 +1,96 @@
+package breach
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeCorpus writes a sorted corpus of the given passwords, each seen as
+// many times as its position in the list, plus filler hashes
+func writeCorpus(t *testing.T, passwords []string, withCounts bool) string {
+	t.Helper()
+	var lines []string
+	for i, p := range passwords {
+		lines = append(lines, fmt.Sprintf("%s:%d", Hash(p), i+1))
+	}
+	for i := 0; i < 2000; i++ {
+		lines = append(lines, fmt.Sprintf("%s:%d", Hash(fmt.Sprintf("filler-%d", i)), 1))
+	}
+	slices.Sort(lines)
+	if !withCounts {
+		for i, l := range lines {
+			lines[i], _, _ = strings.Cut(l, ":")
+		}
+	}
+	path := filepath.Join(t.TempDir(), "pwned-passwords.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\r\n")+"\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCount(t *testing.T) {
+	breached := []string{"Password1!", "123456", "letmein", "correct horse battery staple"}
+	for _, withCounts := range []bool{true, false} {
+		c, err := Open(writeCorpus(t, breached, withCounts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		for i, p := range breached {
+			want := 1
+			if withCounts {
+				want = i + 1
+			}
+			if got, err := c.Count(p); err != nil || got != want {
+				t.Errorf("Count(%q) with counts %v = %d, %v; want %d", p, withCounts, got, err, want)
+			}
+		}
+		// Every line is found, including the first and last of the file
+		for i := 0; i < 2000; i++ {
+			if got, err := c.Count(fmt.Sprintf("filler-%d", i)); err != nil || got != 1 {
+				t.Fatalf("Count(filler-%d) = %d, %v; want 1", i, got, err)
+			}
+		}
+		for _, p := range []string{"", "Password1", "kT9#vq2!Lm", "filler-2000"} {
+			if got, err := c.Count(p); err != nil || got != 0 {
+				t.Errorf("Count(%q) = %d, %v; want 0", p, got, err)
+			}
+		}
+	}
+}
+
+// TestRange checks partitions outside the corpus and prefix handling
+func TestRange(t *testing.T) {
+	c, err := Open(writeCorpus(t, nil, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	total := 0
+	for _, prefix := range []string{"00000", "FFFFF"} {
+		lines, err := c.Range(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += len(lines)
+	}
+	if total != 0 {
+		t.Errorf("got %d lines for prefixes outside the corpus", total)
+	}
+
+	first := Hash("filler-0")
+	lines, err := c.Range(strings.ToLower(first[:PrefixLen]))
+	if err != nil || !slices.Contains(lines, Line{Suffix: first[PrefixLen:], Count: 1}) {
+		t.Errorf("Range(%s) = %v, %v", first[:PrefixLen], lines, err)
+	}
+	if _, err := c.Range("ABC"); err == nil {
+		t.Error("expected an error for a short prefix")
+	}
+}
@@ -0,0 +1,177 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newPair generates a self-signed certificate and key in a fresh directory
+// and returns their paths
+func newPair(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := EnsureSelfSigned(certFile, keyFile, []string{"localhost", "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// serial returns the serial number of the leaf certificate r serves
+func serial(t *testing.T, r *Reloader) string {
+	t.Helper()
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber.String()
+}
+
+// copyPair overwrites the files at certFile and keyFile with another pair
+func copyPair(t *testing.T, certFile, keyFile, fromCert, fromKey string) {
+	t.Helper()
+	for dst, src := range map[string]string{certFile: fromCert, keyFile: fromKey} {
+		b, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dst, b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEnsureSelfSigned(t *testing.T) {
+	certFile, keyFile := newPair(t)
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("generated pair does not load: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.VerifyHostname("localhost"); err != nil {
+		t.Error(err)
+	}
+	if err := leaf.VerifyHostname("127.0.0.1"); err != nil {
+		t.Error(err)
+	}
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("key file mode = %v (%v), expected 0600", info.Mode().Perm(), err)
+	}
+
+	// An existing pair is kept
+	before, _ := os.ReadFile(certFile)
+	if err := EnsureSelfSigned(certFile, keyFile, []string{"localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.ReadFile(certFile); !bytes.Equal(before, after) {
+		t.Error("existing certificate was replaced")
+	}
+
+	// With only one of the files present nothing is written
+	if err := os.Remove(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := EnsureSelfSigned(certFile, keyFile, []string{"localhost"}); err == nil {
+		t.Error("expected an error for a certificate without its key")
+	}
+	if after, _ := os.ReadFile(certFile); !bytes.Equal(before, after) {
+		t.Error("certificate was overwritten")
+	}
+	if _, err := os.Stat(keyFile); !os.IsNotExist(err) {
+		t.Error("a key was written for the existing certificate")
+	}
+
+	certOnly, keyOnly := newPair(t)
+	if err := os.Remove(certOnly); err != nil {
+		t.Fatal(err)
+	}
+	if err := EnsureSelfSigned(certOnly, keyOnly, []string{"localhost"}); err == nil {
+		t.Error("expected an error for a key without its certificate")
+	}
+
+	// Errors other than a missing file are returned
+	notDir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notDir, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := EnsureSelfSigned(filepath.Join(notDir, "cert.pem"), filepath.Join(notDir, "key.pem"), nil); err == nil {
+		t.Error("expected an error for a path below a file")
+	}
+}
+
+func TestReloader(t *testing.T) {
+	if _, err := NewReloader("missing-cert.pem", "missing-key.pem"); err == nil {
+		t.Error("expected an error for missing files")
+	}
+
+	certFile, keyFile := newPair(t)
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := serial(t, r)
+
+	// Reload picks up a new pair
+	otherCert, otherKey := newPair(t)
+	copyPair(t, certFile, keyFile, otherCert, otherKey)
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	second := serial(t, r)
+	if second == first {
+		t.Fatal("Reload kept the old certificate")
+	}
+
+	// A broken file leaves the current certificate in use
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Error("expected an error for a broken certificate")
+	}
+	if serial(t, r) != second {
+		t.Error("a failed reload replaced the certificate")
+	}
+
+	// Watch reloads once the files change
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Watch(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	thirdCert, thirdKey := newPair(t)
+	copyPair(t, certFile, keyFile, thirdCert, thirdKey)
+	later := time.Now().Add(time.Minute)
+	for _, name := range []string{certFile, keyFile} {
+		if err := os.Chtimes(name, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for serial(t, r) == second {
+		if time.Now().After(deadline) {
+			t.Fatal("Watch did not reload the changed certificate")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,186 @@
+// Package clientip resolves the address of the client that made a request.
+//
+// Forwarding headers are only believed when the request arrives from a
+// trusted proxy. The chain of addresses in the RFC 7239 Forwarded header (or,
+// when it is absent, X-Forwarded-For) is walked from the nearest hop
+// outwards, skipping trusted proxies; the first untrusted address is the
+// client. Anything a client puts in these headers itself ends up to the left
+// of the first untrusted hop and is ignored.
+package clientip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type contextKey struct{}
+
+// Resolver finds the client IP of requests that may have passed through proxies
+type Resolver struct {
+	trusted []netip.Prefix
+}
+
+// NewResolver creates a resolver that trusts forwarding headers from the
+// given proxies, written as CIDRs ("10.0.0.0/8") or single addresses
+func NewResolver(trustedProxies []string) (*Resolver, error) {
+	r := &Resolver{}
+	for _, s := range trustedProxies {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %v", s, err)
+			}
+			r.trusted = append(r.trusted, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", s, err)
+		}
+		r.trusted = append(r.trusted, prefix.Masked())
+	}
+	return r, nil
+}
+
+// ClientIP returns the client address of r as a string
+func (res *Resolver) ClientIP(r *http.Request) string {
+	remote, ok := parseHost(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !res.isTrusted(remote) {
+		return remote.String()
+	}
+
+	// The direct peer is one of our proxies; walk the forwarded chain
+	chain := forwardedChain(r.Header)
+	if len(chain) == 0 {
+		if real, ok := parseHost(r.Header.Get("X-Real-IP")); ok {
+			return real.String()
+		}
+		return remote.String()
+	}
+
+	client := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop, ok := parseHost(chain[i])
+		if !ok {
+			// Obfuscated or garbled hop: the nearest proxy is the best we know
+			break
+		}
+		client = hop
+		if !res.isTrusted(hop) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// Middleware resolves the client IP once and stores it in the request context
+func (res *Resolver) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), contextKey{}, res.ClientIP(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// FromRequest returns the client IP stored by Middleware. Without the
+// middleware it falls back to the host part of RemoteAddr.
+func FromRequest(r *http.Request) string {
+	if ip, ok := r.Context().Value(contextKey{}).(string); ok {
+		return ip
+	}
+	if addr, ok := parseHost(r.RemoteAddr); ok {
+		return addr.String()
+	}
+	return r.RemoteAddr
+}
+
+// isTrusted reports whether addr belongs to a trusted proxy
+func (res *Resolver) isTrusted(addr netip.Addr) bool {
+	for _, p := range res.trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedChain returns the hop addresses from the Forwarded header, or from
+// X-Forwarded-For when Forwarded is absent, ordered client first
+func forwardedChain(h http.Header) []string {
+	var chain []string
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		for _, v := range values {
+			for _, element := range splitQuoted(v, ',') {
+				chain = append(chain, forwardedFor(element))
+			}
+		}
+		return chain
+	}
+
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, part := range strings.Split(v, ",") {
+			chain = append(chain, strings.TrimSpace(part))
+		}
+	}
+	return chain
+}
+
+// forwardedFor returns the for= parameter of one Forwarded element, or ""
+func forwardedFor(element string) string {
+	for _, pair := range splitQuoted(element, ';') {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "for") {
+			return strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return ""
+}
+
+// splitQuoted splits s on sep, ignoring separators inside double quotes
+func splitQuoted(s string, sep rune) []string {
+	var parts []string
+	inQuotes := false
+	start := 0
+	for i, c := range s {
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == sep && !inQuotes:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseHost parses an address that may carry a port and IPv6 brackets:
+// "192.0.2.1", "192.0.2.1:80", "2001:db8::1", "[2001:db8::1]:443"
+func parseHost(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return netip.Addr{}, false
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	// Drop an IPv6 zone such as %eth0
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		s = s[:i]
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
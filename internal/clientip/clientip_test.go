@@ -0,0 +1,52 @@
+package clientip
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	res, err := NewResolver([]string{"10.0.0.0/8", "2001:db8:ffff::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"direct client ignores spoofed headers", "203.0.113.9:5555",
+			map[string]string{"X-Forwarded-For": "1.1.1.1", "X-Real-IP": "2.2.2.2"}, "203.0.113.9"},
+		{"ipv6 remote addr", "[2001:db8::5]:443", nil, "2001:db8::5"},
+		{"trusted proxy, single hop", "10.0.0.2:80",
+			map[string]string{"X-Forwarded-For": "198.51.100.7"}, "198.51.100.7"},
+		{"client-supplied prefix is skipped", "10.0.0.2:80",
+			map[string]string{"X-Forwarded-For": "6.6.6.6, 198.51.100.7, 10.1.1.1"}, "198.51.100.7"},
+		{"forwarded header wins", "10.0.0.2:80",
+			map[string]string{
+				"Forwarded":       `for=192.0.2.60;proto=https, for="[2001:db8:cafe::17]:4711"`,
+				"X-Forwarded-For": "6.6.6.6",
+			}, "2001:db8:cafe::17"},
+		{"obfuscated hop stops the walk", "10.0.0.2:80",
+			map[string]string{"Forwarded": `for=192.0.2.60, for=_hidden`}, "10.0.0.2"},
+		{"x-real-ip from trusted proxy", "10.0.0.2:80",
+			map[string]string{"X-Real-IP": "198.51.100.8"}, "198.51.100.8"},
+		{"single trusted ipv6 proxy", "[2001:db8:ffff::1]:80",
+			map[string]string{"X-Forwarded-For": "198.51.100.9"}, "198.51.100.9"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := res.ClientIP(r); got != tt.want {
+				t.Errorf("got %q, expected %q", got, tt.want)
+			}
+		})
+	}
+}
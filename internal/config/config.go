@@ -1,93 +1,421 @@
+// Package config loads the application configuration.
+//
+// Settings are layered: built-in defaults are overridden by an optional JSON or
+// TOML config file, which is overridden by environment variables, which are
+// overridden by command-line flags. Every setting has a dotted key (e.g.
+// "db.host") used in the config file; the environment variable is the key in
+// upper case with dots replaced by underscores (DB_HOST) unless an explicit
+// env tag says otherwise, and the flag is the key with dots and underscores
+// replaced by dashes (-db-host).
 package config
 
 import (
 	"database/sql"
 	"fmt"
 	"log"
-	"os"
+	"time"
 
 	_ "github.com/lib/pq"
 )
 
+// Development defaults for secrets. Validate refuses to run with these when
+// the environment is production.
+const (
+	devSessionSecret = "dev-session-secret-replace-in-production"
+	devDBPassword    = "gratitude123"
+)
+
 // Config holds application configuration
 type Config struct {
-	Port     string
-	DBConfig *DBConfig
+	Environment string          `cfg:"environment" help:"deployment environment (development or production)"`
+	Server      ServerConfig    `cfg:"server"`
+	TLS         TLSConfig       `cfg:"tls"`
+	DB          DBConfig        `cfg:"db"`
+	Session     SessionConfig   `cfg:"session"`
+	CSRF        CSRFConfig      `cfg:"csrf"`
+	RateLimit   RateLimitConfig `cfg:"rate_limit"`
+	IPFilter    IPFilterConfig  `cfg:"ip_filter"`
+	Headers     HeadersConfig   `cfg:"headers"`
+	UI          UIConfig        `cfg:"ui"`
+	Mail        MailConfig      `cfg:"mail"`
+	Account     AccountConfig   `cfg:"account"`
+	Password    PasswordConfig  `cfg:"password"`
+	SSO         SSOConfig       `cfg:"sso"`
+	OAuth       OAuthConfig     `cfg:"oauth"`
+	SCIM        SCIMConfig      `cfg:"scim"`
+
+	// File is the config file that was loaded, if any
+	File string `cfg:"-"`
+	// Args holds the positional arguments left after flags, e.g. ["migrate", "up"]
+	Args []string `cfg:"-"`
+}
+
+// ServerConfig holds the listen address and HTTP server timeouts and limits
+type ServerConfig struct {
+	Addr              string        `cfg:"addr" env:"PORT" help:"listen address or port"`
+	ReadTimeout       time.Duration `cfg:"read_timeout" help:"maximum duration for reading a request"`
+	ReadHeaderTimeout time.Duration `cfg:"read_header_timeout" help:"maximum duration for reading request headers"`
+	WriteTimeout      time.Duration `cfg:"write_timeout" help:"maximum duration before timing out writes of a response"`
+	IdleTimeout       time.Duration `cfg:"idle_timeout" help:"maximum keep-alive idle time"`
+	ShutdownTimeout   time.Duration `cfg:"shutdown_timeout" help:"how long to wait for in-flight requests on shutdown"`
+	MaxHeaderBytes    int           `cfg:"max_header_bytes" help:"maximum size of request headers"`
+
+	// BaseURL is the public address of the site, used for links in mail.
+	// When empty, links are built from the request's Host header.
+	BaseURL string `cfg:"base_url" env:"BASE_URL" help:"public URL of the site used for links in mail, e.g. https://gratitude.example.com"`
+
+	// TrustedProxies lists the reverse proxies whose Forwarded and
+	// X-Forwarded-For headers are believed when resolving the client IP
+	TrustedProxies []string `cfg:"trusted_proxies" env:"TRUSTED_PROXIES" help:"comma-separated CIDRs or IPs of trusted reverse proxies"`
+}
+
+// TLSConfig holds HTTPS settings. TLS is enabled when a certificate and key
+// are configured or when SelfSigned is set for development.
+type TLSConfig struct {
+	CertFile       string        `cfg:"cert_file" help:"TLS certificate file"`
+	KeyFile        string        `cfg:"key_file" help:"TLS private key file"`
+	SelfSigned     bool          `cfg:"self_signed" help:"generate a self-signed certificate on first run (development only)"`
+	RedirectAddr   string        `cfg:"redirect_addr" help:"optional plain HTTP listener that redirects to HTTPS"`
+	ReloadInterval time.Duration `cfg:"reload_interval" help:"how often to check the certificate files for changes"`
+}
+
+// Enabled reports whether the server should speak HTTPS
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
 }
 
 // DBConfig holds database configuration
 type DBConfig struct {
-	Host     string
-	Port     string
-	User     string
-	Password string
-	DBName   string
+	Host     string `cfg:"host" help:"database host"`
+	Port     string `cfg:"port" help:"database port"`
+	User     string `cfg:"user" help:"database user"`
+	Password string `cfg:"password" help:"database password"`
+	DBName   string `cfg:"name" help:"database name"`
+	SSLMode  string `cfg:"sslmode" help:"Postgres sslmode (disable, require, verify-full, ...)"`
+
+	MaxOpenConns    int           `cfg:"max_open_conns" help:"maximum open connections in the pool"`
+	MaxIdleConns    int           `cfg:"max_idle_conns" help:"maximum idle connections in the pool"`
+	ConnMaxIdleTime time.Duration `cfg:"conn_max_idle_time" help:"maximum time a connection may sit idle"`
+
+	// AutoMigrate applies pending migrations on startup
+	AutoMigrate bool `cfg:"auto_migrate" env:"AUTO_MIGRATE" help:"apply pending migrations on startup"`
 }
 
-var (
-	// DB is the global database connection pool
-	DB *sql.DB
-)
+// DSN returns the lib/pq connection string for the database
+func (c DBConfig) DSN() string {
+	return fmt.Sprintf(
+		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+		c.Host, c.Port, c.User, c.Password, c.DBName, c.SSLMode,
+	)
+}
 
-// Load returns application configuration
-func Load() (*Config, error) {
-	dbConfig := &DBConfig{
-		Host:     getEnvOrDefault("DB_HOST", "localhost"),
-		Port:     getEnvOrDefault("DB_PORT", "5432"),
-		User:     getEnvOrDefault("DB_USER", "gratitude_user"),
-		Password: getEnvOrDefault("DB_PASSWORD", "gratitude123"),
-		DBName:   getEnvOrDefault("DB_NAME", "gratitude_jar"),
+// SessionConfig holds session cookie settings
+type SessionConfig struct {
+	Secret        string        `cfg:"secret" help:"32+ byte key used to authenticate and encrypt session cookies"`
+	Lifetime      time.Duration `cfg:"lifetime" help:"absolute session lifetime"`
+	IdleTimeout   time.Duration `cfg:"idle_timeout" help:"log users out after this much inactivity"`
+	SecureCookies bool          `cfg:"secure_cookies" env:"SECURE_COOKIES" help:"mark cookies Secure even without built-in TLS (e.g. behind a TLS proxy)"`
+}
+
+// CSRFConfig holds CSRF protection settings
+type CSRFConfig struct {
+	CookieName  string        `cfg:"cookie_name" help:"name of the CSRF token cookie"`
+	SameSite    string        `cfg:"same_site" help:"SameSite mode of the CSRF cookie: strict, lax or none"`
+	MaxAge      time.Duration `cfg:"max_age" help:"lifetime of the CSRF cookie"`
+	ExemptPaths []string      `cfg:"exempt_paths" help:"comma-separated paths that skip CSRF checks; a trailing / matches a subtree"`
+}
+
+// RateLimitConfig holds the default request rate limit and the per-route rules
+// that take precedence over it
+type RateLimitConfig struct {
+	Rate            float64         `cfg:"rate" help:"requests per second allowed per client"`
+	Burst           int             `cfg:"burst" help:"maximum burst of requests per client"`
+	CleanupInterval time.Duration   `cfg:"cleanup_interval" help:"how often idle client limiters are dropped"`
+	Store           string          `cfg:"store" help:"where buckets are kept: memory (per process) or postgres (shared by all instances)"`
+	Rules           []RateLimitRule `cfg:"rules" help:"per-route rules as a JSON array; the first match wins"`
+}
+
+// RateLimitRule limits requests matching a path prefix and methods, keyed by
+// an identity: "ip", "user" (logged-in user ID), "token" (bearer API token,
+// also counted per IP address) or "email" (the address a sign-in link is
+// requested for)
+type RateLimitRule struct {
+	Name       string   `cfg:"name"`
+	PathPrefix string   `cfg:"path_prefix"`
+	Methods    []string `cfg:"methods"`
+	Identity   string   `cfg:"identity"`
+	Rate       float64  `cfg:"rate"`
+	Burst      int      `cfg:"burst"`
+}
+
+// IPFilterConfig holds the static allow and deny lists and the automatic ban
+// policy. Rules added from the admin console are stored in the database.
+type IPFilterConfig struct {
+	Allow           []string      `cfg:"allow" help:"comma-separated CIDRs or IPs that are never denied or banned"`
+	Deny            []string      `cfg:"deny" help:"comma-separated CIDRs or IPs that are always refused"`
+	BanThreshold    int           `cfg:"ban_threshold" help:"strikes (rate limit, CSRF or login failures) that trigger a temporary ban; 0 disables bans"`
+	BanWindow       time.Duration `cfg:"ban_window" help:"how long strikes are counted"`
+	BanDuration     time.Duration `cfg:"ban_duration" help:"how long an automatic ban lasts"`
+	RefreshInterval time.Duration `cfg:"refresh_interval" help:"how often rules are reloaded from the database and expired bans lifted"`
+}
+
+// HeadersConfig holds the security response headers: Content-Security-Policy,
+// HSTS, Permissions-Policy and the cross-origin isolation headers
+type HeadersConfig struct {
+	CSPReportOnly         bool          `cfg:"csp_report_only" help:"report CSP violations without blocking anything"`
+	CSPReportWindow       time.Duration `cfg:"csp_report_window" help:"how long repeats of a CSP violation from one client are not recorded again"`
+	HSTSMaxAge            time.Duration `cfg:"hsts_max_age" help:"Strict-Transport-Security max-age; 0 disables HSTS"`
+	HSTSIncludeSubdomains bool          `cfg:"hsts_include_subdomains" help:"apply HSTS to all subdomains"`
+	PermissionsPolicy     string        `cfg:"permissions_policy" help:"Permissions-Policy header value"`
+	COOP                  string        `cfg:"coop" help:"Cross-Origin-Opener-Policy header value"`
+	COEP                  string        `cfg:"coep" help:"Cross-Origin-Embedder-Policy: require-corp, credentialless or empty to omit"`
+}
+
+// UIConfig selects where templates and static files are read from
+type UIConfig struct {
+	Source string `cfg:"source" help:"where templates and static files come from: embed, disk, or auto (disk in development, embed otherwise)"`
+	Dir    string `cfg:"dir" help:"ui directory used when reading from disk"`
+}
+
+// UIFromDisk reports whether templates and static files are read from Dir and
+// templates re-parsed when they change, rather than taken from the binary
+func (c *Config) UIFromDisk() bool {
+	switch c.UI.Source {
+	case "disk":
+		return true
+	case "embed":
+		return false
 	}
+	return !c.IsProduction()
+}
 
-	return &Config{
-		Port:     getEnvOrDefault("PORT", ":4000"),
-		DBConfig: dbConfig,
-	}, nil
+// MailConfig holds outgoing mail (SMTP) settings
+type MailConfig struct {
+	Host     string `cfg:"host" help:"SMTP host; empty logs mail instead of sending it"`
+	Port     int    `cfg:"port" help:"SMTP port"`
+	Username string `cfg:"username" help:"SMTP username"`
+	Password string `cfg:"password" help:"SMTP password"`
+	Sender   string `cfg:"sender" help:"From address for outgoing mail"`
+
+	// LinkTTL is how long confirmation links sent by mail stay valid
+	LinkTTL time.Duration `cfg:"link_ttl" help:"how long confirmation links sent by mail stay valid"`
 }
 
-// InitDB initializes the database connection
-func InitDB() error {
-	cfg, err := Load()
-	if err != nil {
-		return fmt.Errorf("error loading config: %v", err)
+// AccountConfig holds the account deletion, data export and sign-in link
+// policies
+type AccountConfig struct {
+	// DeletionGracePeriod is how long a deleted account can still be
+	// recovered by logging in before its data is erased
+	DeletionGracePeriod time.Duration `cfg:"deletion_grace_period" help:"how long after a user deletes their account it is erased; logging in before then cancels the deletion"`
+	PurgeInterval       time.Duration `cfg:"purge_interval" help:"how often accounts due for deletion are erased and expired data exports and OAuth tokens removed"`
+
+	// ExportTTL is how long a data export can be downloaded once it is ready
+	ExportTTL time.Duration `cfg:"export_ttl" help:"how long a personal data export can be downloaded"`
+	// ExportPollInterval is how often the export worker looks for exports
+	// requested on other instances; requests on this one wake it at once
+	ExportPollInterval time.Duration `cfg:"export_poll_interval" help:"how often exports requested on other instances are picked up"`
+
+	// LoginLinks lets users sign in with a single-use link sent by mail
+	// instead of their password
+	LoginLinks   bool          `cfg:"login_links" help:"allow signing in with a single-use link sent by mail"`
+	LoginLinkTTL time.Duration `cfg:"login_link_ttl" help:"how long a sign-in link stays valid"`
+}
+
+// PasswordConfig holds how passwords are hashed. Hashes made with other
+// settings keep working and are upgraded when their owner logs in.
+type PasswordConfig struct {
+	Algorithm     string `cfg:"algorithm" help:"hash for new passwords: argon2id or bcrypt"`
+	Argon2Memory  int    `cfg:"argon2_memory" help:"Argon2id memory in KiB"`
+	Argon2Time    int    `cfg:"argon2_time" help:"Argon2id passes over the memory"`
+	Argon2Threads int    `cfg:"argon2_threads" help:"Argon2id parallelism"`
+	BcryptCost    int    `cfg:"bcrypt_cost" help:"bcrypt cost when algorithm is bcrypt"`
+
+	// MinStrength is the strength score, from 0 to 4, new passwords need
+	MinStrength int `cfg:"min_strength" help:"minimum strength score (0-4) of new passwords"`
+	// BreachedCorpus is a sorted file of SHA-1 hashes of breached passwords
+	BreachedCorpus string `cfg:"breached_corpus" help:"path to a Pwned Passwords style file of SHA-1 hashes sorted by hash; new passwords in it are refused"`
+
+	// Pepper is a secret kept out of the database and mixed into Argon2id
+	// hashes. Changing or removing it locks out users whose hashes use it.
+	Pepper string `cfg:"pepper" help:"optional secret mixed into Argon2id password hashes; must not change once set"`
+}
+
+// SSOConfig lists the OpenID Connect identity providers users can sign in
+// with, shown as buttons on the login page
+type SSOConfig struct {
+	Providers []SSOProvider `cfg:"providers" help:"OpenID Connect providers as a JSON array"`
+}
+
+// SSOProvider is an OpenID Connect identity provider the app is registered
+// with as a client. Its redirect URI is <base URL>/sso/callback.
+type SSOProvider struct {
+	Name         string   `cfg:"name"`  // short identifier used in URLs, e.g. "corp"
+	Label        string   `cfg:"label"` // button text, e.g. "Acme SSO"
+	Issuer       string   `cfg:"issuer"`
+	ClientID     string   `cfg:"client_id"`
+	ClientSecret string   `cfg:"client_secret"`
+	Scopes       []string `cfg:"scopes"` // requested besides "openid"; "email" is needed to link accounts
+}
+
+// OAuthConfig holds the lifetimes of the tokens issued to third-party apps.
+// Apps are registered in the admin console.
+type OAuthConfig struct {
+	AccessTokenTTL  time.Duration `cfg:"access_token_ttl" help:"how long an access token issued to an app is valid"`
+	RefreshTokenTTL time.Duration `cfg:"refresh_token_ttl" help:"how long an app can go without using its refresh token before the user has to authorize it again"`
+}
+
+// SCIMConfig holds the bearer token the directory uses to provision users at
+// /scim/v2/Users. Without a token the endpoint is off.
+type SCIMConfig struct {
+	Token string `cfg:"token" help:"32+ byte bearer token for the SCIM provisioning endpoint; empty turns it off"`
+}
+
+// IsProduction reports whether the app runs in the production environment
+func (c *Config) IsProduction() bool {
+	return c.Environment == "production"
+}
+
+// SecureCookies reports whether session and CSRF cookies must be marked
+// Secure: always in production, and whenever HTTPS is served or sits in front
+func (c *Config) SecureCookies() bool {
+	return c.IsProduction() || c.TLS.Enabled() || c.Session.SecureCookies
+}
+
+// Default returns the built-in configuration used before any file,
+// environment variable or flag is applied
+func Default() *Config {
+	return &Config{
+		Environment: "development",
+		Server: ServerConfig{
+			Addr:              ":4000",
+			ReadTimeout:       5 * time.Second,
+			ReadHeaderTimeout: 2 * time.Second,
+			WriteTimeout:      10 * time.Second,
+			IdleTimeout:       time.Minute,
+			ShutdownTimeout:   30 * time.Second,
+			MaxHeaderBytes:    1 << 20,
+		},
+		TLS: TLSConfig{
+			ReloadInterval: 30 * time.Second,
+		},
+		DB: DBConfig{
+			Host:            "localhost",
+			Port:            "5432",
+			User:            "gratitude_user",
+			Password:        devDBPassword,
+			DBName:          "gratitude_jar",
+			SSLMode:         "disable",
+			MaxOpenConns:    25,
+			MaxIdleConns:    5,
+			ConnMaxIdleTime: 15 * time.Minute,
+		},
+		Session: SessionConfig{
+			Secret:      devSessionSecret,
+			Lifetime:    24 * time.Hour,
+			IdleTimeout: 30 * time.Minute,
+		},
+		CSRF: CSRFConfig{
+			CookieName: "csrf_token",
+			SameSite:   "strict",
+			MaxAge:     24 * time.Hour,
+		},
+		RateLimit: RateLimitConfig{
+			Rate:            10,
+			Burst:           20,
+			CleanupInterval: time.Hour,
+			Store:           "memory",
+			Rules: []RateLimitRule{
+				// Slow down credential stuffing and sign-up spam
+				// Sign-in links send mail, so they are limited per address as well
+				{Name: "login-link", PathPrefix: "/user/login/link", Methods: []string{"POST"}, Identity: "ip", Rate: 0.02, Burst: 5},
+				{Name: "login-link-email", PathPrefix: "/user/login/link", Methods: []string{"POST"}, Identity: "email", Rate: 0.005, Burst: 3},
+				{Name: "login", PathPrefix: "/user/login", Methods: []string{"POST"}, Identity: "ip", Rate: 0.1, Burst: 5},
+				{Name: "register", PathPrefix: "/register", Methods: []string{"POST"}, Identity: "ip", Rate: 0.05, Burst: 3},
+				// Account changes check the current password, so they get the same care
+				{Name: "account", PathPrefix: "/account/", Methods: []string{"POST"}, Identity: "user", Rate: 0.1, Burst: 5},
+				// Logged-in users browsing their notes get a looser, per-user budget
+				{Name: "notes-read", PathPrefix: "/notes", Methods: []string{"GET"}, Identity: "user", Rate: 20, Burst: 40},
+				// Apps get a budget per access token (and per address, which
+				// made-up tokens cannot escape), and their servers one per
+				// address for redeeming codes and refreshing tokens
+				{Name: "api", PathPrefix: "/api/", Identity: "token", Rate: 5, Burst: 20},
+				{Name: "oauth", PathPrefix: "/oauth/", Methods: []string{"POST"}, Identity: "ip", Rate: 1, Burst: 20},
+				// The directory syncs many users at once
+				{Name: "scim", PathPrefix: "/scim/", Identity: "token", Rate: 10, Burst: 100},
+			},
+		},
+		IPFilter: IPFilterConfig{
+			BanThreshold:    10,
+			BanWindow:       10 * time.Minute,
+			BanDuration:     time.Hour,
+			RefreshInterval: time.Minute,
+		},
+		Headers: HeadersConfig{
+			CSPReportWindow:   time.Hour,
+			HSTSMaxAge:        365 * 24 * time.Hour,
+			PermissionsPolicy: "camera=(), microphone=(), geolocation=(), payment=(), usb=(), browsing-topics=()",
+			COOP:              "same-origin",
+			// credentialless still lets the page load the CDN scripts and fonts,
+			// which do not send Cross-Origin-Resource-Policy headers
+			COEP: "credentialless",
+		},
+		UI: UIConfig{
+			Source: "auto",
+			Dir:    "ui",
+		},
+		Mail: MailConfig{
+			Port:    25,
+			Sender:  "Gratitude Jar <no-reply@gratitude-jar.local>",
+			LinkTTL: 24 * time.Hour,
+		},
+		Account: AccountConfig{
+			DeletionGracePeriod: 14 * 24 * time.Hour,
+			PurgeInterval:       time.Hour,
+			ExportTTL:           48 * time.Hour,
+			ExportPollInterval:  time.Minute,
+			LoginLinks:          true,
+			LoginLinkTTL:        15 * time.Minute,
+		},
+		Password: PasswordConfig{
+			Algorithm:     "argon2id",
+			Argon2Memory:  19 * 1024,
+			Argon2Time:    2,
+			Argon2Threads: 1,
+			BcryptCost:    10,
+			MinStrength:   3,
+		},
+		OAuth: OAuthConfig{
+			AccessTokenTTL:  time.Hour,
+			RefreshTokenTTL: 30 * 24 * time.Hour,
+		},
 	}
+}
 
-	dbCfg := cfg.DBConfig
+// OpenDB opens and verifies a connection pool for the configured database
+func OpenDB(dbCfg DBConfig) (*sql.DB, error) {
 	log.Printf("Connecting to database with host=%s port=%s user=%s dbname=%s",
 		dbCfg.Host, dbCfg.Port, dbCfg.User, dbCfg.DBName)
 
-	// Construct the connection string
-	connStr := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		dbCfg.Host, dbCfg.Port, dbCfg.User, dbCfg.Password, dbCfg.DBName,
-	)
-
 	// Open the database connection
 	log.Printf("Opening database connection...")
-	DB, err = sql.Open("postgres", connStr)
+	db, err := sql.Open("postgres", dbCfg.DSN())
 	if err != nil {
-		return fmt.Errorf("error opening database: %v", err)
+		return nil, fmt.Errorf("error opening database: %v", err)
 	}
 
 	// Test the connection
 	log.Printf("Testing database connection...")
-	err = DB.Ping()
+	err = db.Ping()
 	if err != nil {
-		return fmt.Errorf("error connecting to the database: %v", err)
+		db.Close()
+		return nil, fmt.Errorf("error connecting to the database: %v", err)
 	}
 
 	// Set connection pool settings
-	DB.SetMaxOpenConns(25)
-	DB.SetMaxIdleConns(5)
+	db.SetMaxOpenConns(dbCfg.MaxOpenConns)
+	db.SetMaxIdleConns(dbCfg.MaxIdleConns)
+	db.SetConnMaxIdleTime(dbCfg.ConnMaxIdleTime)
 
 	log.Println("Successfully connected to database")
-	return nil
-}
-
-// getEnvOrDefault returns the value of an environment variable or a default value if not set
-func getEnvOrDefault(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
-	}
-	return defaultValue
+	return db, nil
 }
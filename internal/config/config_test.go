@@ -0,0 +1,102 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLoadLayering checks that flags override the environment, which
+// overrides the config file, which overrides the defaults
+func TestLoadLayering(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.toml")
+	contents := `
+[db]
+host = "file-host"
+user = "file-user"
+
+[server]
+read_timeout = "7s"
+`
+	if err := os.WriteFile(file, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("DB_USER", "env-user")
+	t.Setenv("PORT", "5000")
+
+	cfg, err := Load([]string{"-config", file, "-db-user", "flag-user", "migrate", "up"})
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+
+	if cfg.DB.Host != "file-host" {
+		t.Errorf("db.host: got %q, expected value from file", cfg.DB.Host)
+	}
+	if cfg.DB.User != "flag-user" {
+		t.Errorf("db.user: got %q, expected value from flag", cfg.DB.User)
+	}
+	if cfg.Server.Addr != ":5000" {
+		t.Errorf("server.addr: got %q, expected :5000 from PORT", cfg.Server.Addr)
+	}
+	if cfg.Server.ReadTimeout != 7*time.Second {
+		t.Errorf("server.read_timeout: got %v, expected 7s", cfg.Server.ReadTimeout)
+	}
+	if cfg.DB.DBName != "gratitude_jar" {
+		t.Errorf("db.name: got %q, expected default", cfg.DB.DBName)
+	}
+	if strings.Join(cfg.Args, " ") != "migrate up" {
+		t.Errorf("args: got %v", cfg.Args)
+	}
+}
+
+// TestProductionRefusesDefaultSecrets checks that production requires real secrets
+func TestProductionRefusesDefaultSecrets(t *testing.T) {
+	t.Setenv("ENVIRONMENT", "production")
+
+	_, err := Load(nil)
+	if err == nil {
+		t.Fatal("expected an error with default secrets in production")
+	}
+	for _, key := range []string{"session.secret", "db.password"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("error does not mention %s: %v", key, err)
+		}
+	}
+
+	t.Setenv("SESSION_SECRET", strings.Repeat("s", 32))
+	t.Setenv("DB_PASSWORD", "a-real-password")
+	if _, err := Load(nil); err != nil {
+		t.Errorf("expected production config with real secrets to load, got %v", err)
+	}
+}
+
+// TestLoadRejectsUnknownKeys checks that misspelt or misplaced settings in a
+// config file are reported instead of silently ignored, while the example
+// file, which lists every section, loads
+func TestLoadRejectsUnknownKeys(t *testing.T) {
+	tests := []struct {
+		name, contents, want string
+	}{
+		{"top level", "breached_corpus_path = \"x.txt\"\n", "breached_corpus_path"},
+		{"in a section", "[db]\nhots = \"db\"\n", "db.hots"},
+		{"in a list", "[[rate_limit.rules]]\nname = \"login\"\nidentiy = \"ip\"\nrate = 1\nburst = 1\n", "identiy"},
+	}
+	for _, tt := range tests {
+		file := filepath.Join(t.TempDir(), "config.toml")
+		if err := os.WriteFile(file, []byte(tt.contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := Load([]string{"-config", file})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, expected one naming %q", tt.name, err, tt.want)
+		}
+	}
+
+	if _, err := Load([]string{"-config", "../../config.example.toml"}); err != nil {
+		t.Errorf("config.example.toml: %v", err)
+	}
+}
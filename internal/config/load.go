@@ -0,0 +1,324 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// setting is a single leaf field of Config together with its names
+type setting struct {
+	key   string // dotted key used in config files, e.g. "db.host"
+	env   string // environment variable, e.g. "DB_HOST"
+	flag  string // command-line flag, e.g. "db-host"
+	help  string
+	value reflect.Value
+}
+
+// Load builds the configuration from defaults, the config file, the
+// environment and the command-line arguments (without the program name),
+// then validates it.
+//
+// The config file is taken from the -config flag or the CONFIG_FILE
+// environment variable; its format is chosen by extension (.json or .toml).
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+	settings := collectSettings(reflect.ValueOf(cfg).Elem(), "")
+
+	// Flags are declared up front so -config can be read before the file is
+	// applied; their values are only applied after the environment.
+	fs := flag.NewFlagSet("gratitude-jar", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a JSON or TOML config file")
+	flagValues := map[string]string{}
+	for _, s := range settings {
+		name := s.flag
+		fs.Func(name, fmt.Sprintf("%s (env %s)", s.help, s.env), func(v string) error {
+			flagValues[name] = v
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Layer 1: config file
+	if *configFile != "" {
+		values, err := readFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range settings {
+			if v, ok := values[s.key]; ok {
+				if err := setValue(s.value, v); err != nil {
+					return nil, fmt.Errorf("%s: %s: %v", *configFile, s.key, err)
+				}
+				delete(values, s.key)
+			}
+		}
+		// Whatever is left is misspelt or no longer used, and would
+		// otherwise be ignored without a word
+		if len(values) > 0 {
+			unknown := make([]string, 0, len(values))
+			for key := range values {
+				unknown = append(unknown, key)
+			}
+			sort.Strings(unknown)
+			return nil, fmt.Errorf("%s: unknown settings: %s", *configFile, strings.Join(unknown, ", "))
+		}
+		cfg.File = *configFile
+	}
+
+	// Layer 2: environment variables
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok && v != "" {
+			if err := setValue(s.value, v); err != nil {
+				return nil, fmt.Errorf("environment variable %s: %v", s.env, err)
+			}
+		}
+	}
+
+	// Layer 3: command-line flags
+	for _, s := range settings {
+		if v, ok := flagValues[s.flag]; ok {
+			if err := setValue(s.value, v); err != nil {
+				return nil, fmt.Errorf("flag -%s: %v", s.flag, err)
+			}
+		}
+	}
+
+	cfg.Args = fs.Args()
+	cfg.normalize()
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// normalize fills in derived values after all layers are applied
+func (c *Config) normalize() {
+	c.Server.Addr = listenAddr(c.Server.Addr)
+	if c.TLS.RedirectAddr != "" {
+		c.TLS.RedirectAddr = listenAddr(c.TLS.RedirectAddr)
+	}
+	if c.TLS.SelfSigned {
+		// Default locations for the generated development certificate
+		if c.TLS.CertFile == "" {
+			c.TLS.CertFile = "tls/cert.pem"
+		}
+		if c.TLS.KeyFile == "" {
+			c.TLS.KeyFile = "tls/key.pem"
+		}
+	}
+}
+
+// collectSettings walks the struct v and returns a setting for every leaf field
+func collectSettings(v reflect.Value, prefix string) []setting {
+	var settings []setting
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("cfg")
+		if name == "" || name == "-" {
+			continue
+		}
+		key := name
+		if prefix != "" {
+			key = prefix + "." + name
+		}
+
+		if field.Type.Kind() == reflect.Struct {
+			settings = append(settings, collectSettings(v.Field(i), key)...)
+			continue
+		}
+
+		env := field.Tag.Get("env")
+		if env == "" {
+			env = strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+		}
+		settings = append(settings, setting{
+			key:   key,
+			env:   env,
+			flag:  strings.NewReplacer(".", "-", "_", "-").Replace(key),
+			help:  field.Tag.Get("help"),
+			value: v.Field(i),
+		})
+	}
+	return settings
+}
+
+// readFile parses a JSON or TOML config file into a map of dotted keys
+func readFile(path string) (map[string]any, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %v", err)
+	}
+
+	raw := map[string]any{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(contents, &raw)
+	case ".toml":
+		err = toml.Unmarshal(contents, &raw)
+	default:
+		return nil, fmt.Errorf("unsupported config file format %q (use .json or .toml)", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %v", path, err)
+	}
+
+	values := map[string]any{}
+	flatten("", raw, values)
+	return values, nil
+}
+
+// flatten turns nested tables into dotted keys; other values are kept as is
+func flatten(prefix string, in map[string]any, out map[string]any) {
+	for k, v := range in {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		if nested, ok := v.(map[string]any); ok {
+			flatten(key, nested, out)
+			continue
+		}
+		out[key] = v
+	}
+}
+
+// setValue assigns raw to the field dst. raw is either a string (from the
+// environment or a flag) or a value decoded from a config file.
+func setValue(dst reflect.Value, raw any) error {
+	switch dst.Kind() {
+	case reflect.Slice:
+		return setSlice(dst, raw)
+	case reflect.Struct:
+		m, ok := raw.(map[string]any)
+		if !ok {
+			return fmt.Errorf("expected a table, got %T", raw)
+		}
+		return setStruct(dst, m)
+	}
+
+	s := fmt.Sprint(raw)
+	if f, ok := raw.(float64); ok {
+		// JSON numbers decode as float64; avoid exponent notation for integers
+		s = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+
+	switch dst.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		dst.SetInt(int64(d))
+		return nil
+	}
+
+	switch dst.Kind() {
+	case reflect.String:
+		dst.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		dst.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		dst.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		dst.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported setting type %s", dst.Type())
+	}
+	return nil
+}
+
+// setSlice assigns a list. Strings from the environment or flags are either a
+// JSON array or, for lists of scalars, a comma-separated list.
+func setSlice(dst reflect.Value, raw any) error {
+	items, ok := raw.([]any)
+	if !ok {
+		if typed, isMaps := raw.([]map[string]any); isMaps {
+			// TOML arrays of tables decode as []map[string]any
+			for _, m := range typed {
+				items = append(items, m)
+			}
+		} else {
+			s := strings.TrimSpace(fmt.Sprint(raw))
+			switch {
+			case s == "":
+				items = nil
+			case strings.HasPrefix(s, "["):
+				if err := json.Unmarshal([]byte(s), &items); err != nil {
+					return err
+				}
+			default:
+				for _, part := range strings.Split(s, ",") {
+					items = append(items, strings.TrimSpace(part))
+				}
+			}
+		}
+	}
+
+	out := reflect.MakeSlice(dst.Type(), len(items), len(items))
+	for i, item := range items {
+		if err := setValue(out.Index(i), item); err != nil {
+			return fmt.Errorf("item %d: %v", i, err)
+		}
+	}
+	dst.Set(out)
+	return nil
+}
+
+// setStruct assigns the fields of a struct inside a list from a table.
+// Keys that match no field are an error.
+func setStruct(dst reflect.Value, m map[string]any) error {
+	t := dst.Type()
+	known := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("cfg")
+		if name == "" || name == "-" {
+			continue
+		}
+		known[name] = true
+		if v, ok := m[name]; ok {
+			if err := setValue(dst.Field(i), v); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	for name := range m {
+		if !known[name] {
+			return fmt.Errorf("unknown key %q", name)
+		}
+	}
+	return nil
+}
+
+// listenAddr turns a bare port such as "4000" into a listen address (":4000")
+func listenAddr(port string) string {
+	if strings.Contains(port, ":") {
+		return port
+	}
+	return ":" + port
+}
@@ -0,0 +1,211 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/darynforman/gratitude-jar1/internal/clientip"
+	"github.com/darynforman/gratitude-jar1/internal/ipfilter"
+)
+
+// ssoNamePattern is what SSO provider names, which appear in URLs, look like
+var ssoNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// Validate checks the configuration for missing or inconsistent values.
+// In production it also refuses the built-in development secrets.
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Environment == "development" || c.Environment == "production",
+		"environment must be development or production, got %q", c.Environment)
+
+	// Server
+	check(c.Server.Addr != "" && c.Server.Addr != ":", "server.addr is required")
+	check(c.Server.ReadTimeout > 0, "server.read_timeout must be positive")
+	check(c.Server.ReadHeaderTimeout > 0, "server.read_header_timeout must be positive")
+	check(c.Server.WriteTimeout > 0, "server.write_timeout must be positive")
+	check(c.Server.IdleTimeout > 0, "server.idle_timeout must be positive")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+	check(c.Server.MaxHeaderBytes > 0, "server.max_header_bytes must be positive")
+	if c.Server.BaseURL != "" {
+		u, err := url.Parse(c.Server.BaseURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"server.base_url must be an absolute http or https URL, got %q", c.Server.BaseURL)
+	}
+	if _, err := clientip.NewResolver(c.Server.TrustedProxies); err != nil {
+		check(false, "server.trusted_proxies: %v", err)
+	}
+
+	// TLS
+	check((c.TLS.CertFile == "") == (c.TLS.KeyFile == ""), "tls.cert_file and tls.key_file must be set together")
+	check(c.TLS.RedirectAddr == "" || c.TLS.Enabled(), "tls.redirect_addr requires TLS to be enabled")
+	check(c.TLS.ReloadInterval > 0, "tls.reload_interval must be positive")
+
+	// Database
+	check(c.DB.Host != "", "db.host is required")
+	check(c.DB.User != "", "db.user is required")
+	check(c.DB.DBName != "", "db.name is required")
+	check(c.DB.MaxOpenConns > 0, "db.max_open_conns must be positive")
+	check(c.DB.MaxIdleConns >= 0, "db.max_idle_conns must not be negative")
+
+	// Session and CSRF secrets
+	check(len(c.Session.Secret) >= 32, "session.secret must be at least 32 bytes")
+	check(c.Session.Lifetime > 0, "session.lifetime must be positive")
+	check(c.Session.IdleTimeout > 0, "session.idle_timeout must be positive")
+	check(c.CSRF.CookieName != "", "csrf.cookie_name is required")
+	check(c.CSRF.CookieName != "session", "csrf.cookie_name must differ from the session cookie")
+	switch c.CSRF.SameSite {
+	case "strict", "lax":
+	case "none":
+		check(c.SecureCookies(), "csrf.same_site none requires Secure cookies (TLS or session.secure_cookies)")
+	default:
+		check(false, "csrf.same_site must be strict, lax or none")
+	}
+	check(c.CSRF.MaxAge > 0, "csrf.max_age must be positive")
+	for _, path := range c.CSRF.ExemptPaths {
+		check(strings.HasPrefix(path, "/"), "csrf.exempt_paths: %q must start with /", path)
+	}
+
+	// Rate limiting
+	check(c.RateLimit.Rate > 0, "rate_limit.rate must be positive")
+	check(c.RateLimit.Burst >= 1, "rate_limit.burst must be at least 1")
+	check(c.RateLimit.CleanupInterval > 0, "rate_limit.cleanup_interval must be positive")
+	check(c.RateLimit.Store == "memory" || c.RateLimit.Store == "postgres", "rate_limit.store must be memory or postgres")
+	for i, rule := range c.RateLimit.Rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		check(rule.Rate > 0, "rate_limit rule %s: rate must be positive", name)
+		check(rule.Burst >= 1, "rate_limit rule %s: burst must be at least 1", name)
+		check(rule.PathPrefix == "" || strings.HasPrefix(rule.PathPrefix, "/"), "rate_limit rule %s: path_prefix must start with /", name)
+		switch rule.Identity {
+		case "", "ip", "user", "token", "email":
+		default:
+			check(false, "rate_limit rule %s: identity must be ip, user, token or email", name)
+		}
+	}
+
+	// IP filter
+	for _, entry := range append(append([]string(nil), c.IPFilter.Allow...), c.IPFilter.Deny...) {
+		if _, err := ipfilter.ParsePrefix(entry); err != nil {
+			check(false, "ip_filter: %v", err)
+		}
+	}
+	check(c.IPFilter.BanThreshold >= 0, "ip_filter.ban_threshold must not be negative")
+	check(c.IPFilter.BanThreshold == 0 || c.IPFilter.BanWindow > 0, "ip_filter.ban_window must be positive")
+	check(c.IPFilter.BanThreshold == 0 || c.IPFilter.BanDuration > 0, "ip_filter.ban_duration must be positive")
+	check(c.IPFilter.RefreshInterval > 0, "ip_filter.refresh_interval must be positive")
+
+	// Security headers
+	check(c.Headers.CSPReportWindow > 0, "headers.csp_report_window must be positive")
+	check(c.Headers.HSTSMaxAge >= 0, "headers.hsts_max_age must not be negative")
+	switch c.Headers.COOP {
+	case "", "same-origin", "same-origin-allow-popups", "unsafe-none":
+	default:
+		check(false, "headers.coop must be same-origin, same-origin-allow-popups or unsafe-none")
+	}
+	switch c.Headers.COEP {
+	case "", "require-corp", "credentialless", "unsafe-none":
+	default:
+		check(false, "headers.coep must be require-corp, credentialless or unsafe-none")
+	}
+
+	// UI
+	check(c.UI.Source == "auto" || c.UI.Source == "embed" || c.UI.Source == "disk", "ui.source must be auto, embed or disk")
+	check(!c.UIFromDisk() || c.UI.Dir != "", "ui.dir is required when reading templates from disk")
+
+	// Mail
+	check(c.Mail.Host == "" || (c.Mail.Port > 0 && c.Mail.Port < 65536), "mail.port must be a valid port")
+	check(c.Mail.Host == "" || c.Mail.Sender != "", "mail.sender is required when mail.host is set")
+	check(c.Mail.LinkTTL > 0, "mail.link_ttl must be positive")
+
+	// Accounts
+	check(c.Account.DeletionGracePeriod >= 0, "account.deletion_grace_period must not be negative")
+	check(c.Account.PurgeInterval > 0, "account.purge_interval must be positive")
+	check(c.Account.ExportTTL > 0, "account.export_ttl must be positive")
+	check(c.Account.ExportPollInterval > 0, "account.export_poll_interval must be positive")
+	check(c.Account.LoginLinkTTL > 0, "account.login_link_ttl must be positive")
+
+	// Password hashing
+	check(c.Password.Algorithm == "argon2id" || c.Password.Algorithm == "bcrypt", "password.algorithm must be argon2id or bcrypt")
+	check(c.Password.Argon2Memory >= 8*c.Password.Argon2Threads && c.Password.Argon2Memory < 1<<22, "password.argon2_memory must be at least 8 KiB per thread and under 4 GiB")
+	check(c.Password.Argon2Time > 0 && c.Password.Argon2Time < 1<<16, "password.argon2_time must be positive")
+	check(c.Password.Argon2Threads > 0 && c.Password.Argon2Threads < 256, "password.argon2_threads must be between 1 and 255")
+	check(c.Password.BcryptCost >= 4 && c.Password.BcryptCost <= 31, "password.bcrypt_cost must be between 4 and 31")
+	check(c.Password.MinStrength >= 0 && c.Password.MinStrength <= 4, "password.min_strength must be between 0 and 4")
+	check(c.Password.Pepper == "" || c.Password.Algorithm == "argon2id", "password.pepper requires password.algorithm argon2id")
+	check(c.Password.Pepper == "" || len(c.Password.Pepper) >= 32, "password.pepper must be at least 32 bytes")
+
+	// OAuth
+	check(c.OAuth.AccessTokenTTL > 0, "oauth.access_token_ttl must be positive")
+	check(c.OAuth.RefreshTokenTTL > c.OAuth.AccessTokenTTL, "oauth.refresh_token_ttl must be longer than oauth.access_token_ttl")
+
+	// SCIM
+	check(c.SCIM.Token == "" || len(c.SCIM.Token) >= 32, "scim.token must be at least 32 bytes")
+
+	// Single sign-on
+	ssoNames := map[string]bool{}
+	for i, provider := range c.SSO.Providers {
+		name := provider.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		check(ssoNamePattern.MatchString(provider.Name), "sso provider %s: name must be lowercase letters, digits and dashes", name)
+		check(!ssoNames[provider.Name], "sso provider %s: name is used twice", name)
+		ssoNames[provider.Name] = true
+		check(provider.Label != "", "sso provider %s: label is required", name)
+		check(provider.ClientID != "", "sso provider %s: client_id is required", name)
+		issuer, err := url.Parse(provider.Issuer)
+		check(err == nil && issuer.Host != "" && (issuer.Scheme == "https" || (issuer.Scheme == "http" && isLoopback(issuer.Hostname()))),
+			"sso provider %s: issuer must be an https URL", name)
+	}
+
+	if c.IsProduction() {
+		check(c.Session.Secret != devSessionSecret, "session.secret must be changed from the development default in production")
+		check(c.DB.Password != devDBPassword, "db.password must be changed from the development default in production")
+		check(!c.TLS.SelfSigned, "tls.self_signed is for development only")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Warnings returns non-fatal configuration issues worth logging at startup
+func (c *Config) Warnings() []string {
+	var warnings []string
+	if c.Session.Secret == devSessionSecret {
+		warnings = append(warnings, "Using default session secret. Set SESSION_SECRET in production.")
+	}
+	if c.IsProduction() && !c.TLS.Enabled() && !c.Session.SecureCookies {
+		warnings = append(warnings, "Cookies are marked Secure in production; serve the app over HTTPS or set SECURE_COOKIES behind a TLS proxy.")
+	}
+	if c.IsProduction() && c.Server.BaseURL == "" {
+		warnings = append(warnings, "Links in mail are built from the request's Host header; set BASE_URL in production.")
+	}
+	if c.IsProduction() && c.Mail.Host == "" {
+		warnings = append(warnings, "No mail.host is set, so mail is written to the log instead of being sent.")
+	}
+	return warnings
+}
+
+// isLoopback reports whether host is this machine, where an identity
+// provider may be reached over plain HTTP in development and tests
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,72 @@
+package csp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPolicyString(t *testing.T) {
+	header := Default("/csp-report").String("abc123")
+	for _, want := range []string{
+		"default-src 'self'",
+		"script-src 'nonce-abc123' 'strict-dynamic'",
+		"object-src 'none'",
+		"frame-ancestors 'none'",
+		"report-uri /csp-report",
+	} {
+		if !strings.Contains(header, want) {
+			t.Errorf("policy %q does not contain %q", header, want)
+		}
+	}
+}
+
+func TestParseReports(t *testing.T) {
+	legacy := `{"csp-report":{"document-uri":"https://example.com/notes","blocked-uri":"inline","violated-directive":"script-src-elem","line-number":12}}`
+	v, err := ParseReports("application/csp-report", []byte(legacy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 1 || v[0].BlockedURI != "inline" || v[0].EffectiveDirective != "script-src-elem" || v[0].LineNumber != 12 {
+		t.Errorf("legacy report parsed as %+v", v)
+	}
+
+	api := `[{"type":"csp-violation","body":{"documentURL":"https://example.com/","blockedURL":"https://evil.example/x.js","effectiveDirective":"script-src-elem","disposition":"enforce"}},
+	         {"type":"deprecation","body":{}}]`
+	v, err = ParseReports("application/reports+json", []byte(api))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 1 || v[0].BlockedURI != "https://evil.example/x.js" || v[0].Disposition != "enforce" {
+		t.Errorf("reporting API report parsed as %+v", v)
+	}
+
+	if _, err := ParseReports("application/json", []byte(`{"hello":"world"}`)); err == nil {
+		t.Error("expected an error for a body that is not a report")
+	}
+}
+
+func TestDeduplicator(t *testing.T) {
+	d := NewDeduplicator(time.Hour)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	d.now = func() time.Time { return now }
+
+	inline := Violation{EffectiveDirective: "script-src-elem", BlockedURI: "inline"}
+	if !d.First("192.0.2.1", inline) {
+		t.Fatal("first report was dropped")
+	}
+	if d.First("192.0.2.1", inline) {
+		t.Error("repeat within the window was passed on")
+	}
+	if !d.First("192.0.2.2", inline) {
+		t.Error("report from another client was dropped")
+	}
+	if !d.First("192.0.2.1", Violation{EffectiveDirective: "img-src", BlockedURI: "inline"}) {
+		t.Error("report for another directive was dropped")
+	}
+
+	now = now.Add(time.Hour)
+	if !d.First("192.0.2.1", inline) {
+		t.Error("report after the window was dropped")
+	}
+}
@@ -0,0 +1,63 @@
+package csp
+
+import (
+	"sync"
+	"time"
+)
+
+// maxTracked bounds how many distinct violations a Deduplicator remembers,
+// so clients making up blocked URIs cannot grow it without limit
+const maxTracked = 10000
+
+// Deduplicator passes on the first report of a violation and drops repeats
+// of the same directive and blocked URI from the same client within a
+// window. A page that breaks the policy reports on every load, and each
+// report would otherwise become an audit event.
+type Deduplicator struct {
+	window time.Duration
+	now    func() time.Time
+
+	mu   sync.Mutex
+	seen map[dedupeKey]time.Time // when each violation was first passed on
+}
+
+// dedupeKey identifies a violation from one client
+type dedupeKey struct {
+	directive, blockedURI, ip string
+}
+
+// NewDeduplicator creates a Deduplicator that drops repeats for window
+func NewDeduplicator(window time.Duration) *Deduplicator {
+	return &Deduplicator{
+		window: window,
+		now:    time.Now,
+		seen:   make(map[dedupeKey]time.Time),
+	}
+}
+
+// First reports whether v from ip should be recorded: it has not been seen
+// within the window. While too many distinct violations are being tracked,
+// new ones are dropped until old ones expire.
+func (d *Deduplicator) First(ip string, v Violation) bool {
+	key := dedupeKey{v.EffectiveDirective, v.BlockedURI, ip}
+	now := d.now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if first, ok := d.seen[key]; ok && now.Sub(first) < d.window {
+		return false
+	}
+	if len(d.seen) >= maxTracked {
+		for k, first := range d.seen {
+			if now.Sub(first) >= d.window {
+				delete(d.seen, k)
+			}
+		}
+		if len(d.seen) >= maxTracked {
+			return false
+		}
+	}
+	d.seen[key] = now
+	return true
+}
@@ -0,0 +1,95 @@
+package csp
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// Violation is a single CSP violation report, in either the legacy
+// report-uri format or the Reporting API format
+type Violation struct {
+	DocumentURI        string
+	BlockedURI         string
+	EffectiveDirective string
+	SourceFile         string
+	LineNumber         int
+	Disposition        string // "enforce" or "report"
+	Sample             string
+}
+
+// legacyReport is the body sent to report-uri (application/csp-report)
+type legacyReport struct {
+	Report struct {
+		DocumentURI        string `json:"document-uri"`
+		BlockedURI         string `json:"blocked-uri"`
+		ViolatedDirective  string `json:"violated-directive"`
+		EffectiveDirective string `json:"effective-directive"`
+		SourceFile         string `json:"source-file"`
+		LineNumber         int    `json:"line-number"`
+		Disposition        string `json:"disposition"`
+		ScriptSample       string `json:"script-sample"`
+	} `json:"csp-report"`
+}
+
+// apiReport is one entry sent to a report-to endpoint (application/reports+json)
+type apiReport struct {
+	Type string `json:"type"`
+	Body struct {
+		DocumentURL        string `json:"documentURL"`
+		BlockedURL         string `json:"blockedURL"`
+		EffectiveDirective string `json:"effectiveDirective"`
+		SourceFile         string `json:"sourceFile"`
+		LineNumber         int    `json:"lineNumber"`
+		Disposition        string `json:"disposition"`
+		Sample             string `json:"sample"`
+	} `json:"body"`
+}
+
+// ParseReports decodes a report request body according to its content type
+func ParseReports(contentType string, body []byte) ([]Violation, error) {
+	if strings.HasPrefix(contentType, "application/reports+json") {
+		var reports []apiReport
+		if err := json.Unmarshal(body, &reports); err != nil {
+			return nil, err
+		}
+		var violations []Violation
+		for _, r := range reports {
+			if r.Type != "csp-violation" {
+				continue
+			}
+			violations = append(violations, Violation{
+				DocumentURI:        r.Body.DocumentURL,
+				BlockedURI:         r.Body.BlockedURL,
+				EffectiveDirective: r.Body.EffectiveDirective,
+				SourceFile:         r.Body.SourceFile,
+				LineNumber:         r.Body.LineNumber,
+				Disposition:        r.Body.Disposition,
+				Sample:             r.Body.Sample,
+			})
+		}
+		return violations, nil
+	}
+
+	var report legacyReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		return nil, err
+	}
+	r := report.Report
+	if r.DocumentURI == "" && r.ViolatedDirective == "" && r.EffectiveDirective == "" {
+		return nil, errors.New("not a CSP report")
+	}
+	directive := r.EffectiveDirective
+	if directive == "" {
+		directive = r.ViolatedDirective
+	}
+	return []Violation{{
+		DocumentURI:        r.DocumentURI,
+		BlockedURI:         r.BlockedURI,
+		EffectiveDirective: directive,
+		SourceFile:         r.SourceFile,
+		LineNumber:         r.LineNumber,
+		Disposition:        r.Disposition,
+		Sample:             r.ScriptSample,
+	}}, nil
+}
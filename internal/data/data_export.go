@@ -0,0 +1,166 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Data export statuses
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// DataExport is a takeout archive of everything kept about a user. It is
+// requested, built in the background and kept until ExpiresAt.
+type DataExport struct {
+	ID          int64
+	UserID      int
+	Status      string
+	Origin      string // Scheme and host the export was requested from, for links in mail
+	Size        int
+	CreatedAt   time.Time
+	CompletedAt *time.Time
+	ExpiresAt   *time.Time
+}
+
+// DataExportModel wraps a database connection pool
+type DataExportModel struct {
+	DB *sql.DB
+}
+
+// NewDataExportModel creates a new DataExportModel instance
+func NewDataExportModel(db *sql.DB) *DataExportModel {
+	return &DataExportModel{DB: db}
+}
+
+// Request queues an export for a user. If one is already waiting to be
+// built it is returned instead, with created set to false.
+func (m *DataExportModel) Request(ctx context.Context, userID int, origin string) (export *DataExport, created bool, err error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	// Serialize requests of the same user so only one export is pending
+	if _, err := tx.ExecContext(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE`, userID); err != nil {
+		return nil, false, err
+	}
+
+	export = &DataExport{UserID: userID, Status: ExportPending, Origin: origin}
+	query := `SELECT id, origin, created_at FROM data_exports WHERE user_id = $1 AND status = 'pending'`
+	err = tx.QueryRowContext(ctx, query, userID).Scan(&export.ID, &export.Origin, &export.CreatedAt)
+	if err == nil {
+		return export, false, tx.Commit()
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, false, err
+	}
+
+	query = `INSERT INTO data_exports (user_id, origin) VALUES ($1, $2) RETURNING id, created_at`
+	if err := tx.QueryRowContext(ctx, query, userID, origin).Scan(&export.ID, &export.CreatedAt); err != nil {
+		return nil, false, err
+	}
+	return export, true, tx.Commit()
+}
+
+// Latest returns a user's most recent export that has not expired, or nil
+func (m *DataExportModel) Latest(ctx context.Context, userID int) (*DataExport, error) {
+	query := `SELECT id, user_id, status, origin, COALESCE(LENGTH(archive), 0), created_at, completed_at, expires_at
+	          FROM data_exports
+	          WHERE user_id = $1 AND (expires_at IS NULL OR expires_at > NOW())
+	          ORDER BY id DESC
+	          LIMIT 1`
+	e := &DataExport{}
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&e.ID, &e.UserID, &e.Status, &e.Origin, &e.Size, &e.CreatedAt, &e.CompletedAt, &e.ExpiresAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return e, nil
+}
+
+// BuildNext builds the oldest pending export with build and stores the
+// archive for ttl. The export stays locked while it is built, so several
+// instances can work through the queue. A failed build is marked failed and
+// kept for ttl so the user can see it. It returns nil when nothing is
+// pending.
+func (m *DataExportModel) BuildNext(ctx context.Context, ttl time.Duration, build func(*DataExport) ([]byte, error)) (*DataExport, error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	e := &DataExport{}
+	query := `SELECT id, user_id, status, origin, created_at
+	          FROM data_exports
+	          WHERE status = 'pending'
+	          ORDER BY created_at
+	          LIMIT 1
+	          FOR UPDATE SKIP LOCKED`
+	err = tx.QueryRowContext(ctx, query).Scan(&e.ID, &e.UserID, &e.Status, &e.Origin, &e.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	archive, buildErr := build(e)
+	e.Status, e.Size = ExportReady, len(archive)
+	if buildErr != nil {
+		e.Status, archive = ExportFailed, nil
+	}
+	query = `UPDATE data_exports
+	         SET status = $1, archive = $2, completed_at = NOW(), expires_at = NOW() + $3 * INTERVAL '1 second'
+	         WHERE id = $4
+	         RETURNING completed_at, expires_at`
+	err = tx.QueryRowContext(ctx, query, e.Status, archive, ttl.Seconds(), e.ID).Scan(&e.CompletedAt, &e.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return e, buildErr
+}
+
+// Archive returns a ready export and its zip archive. It returns
+// ErrRecordNotFound if the export does not exist, is not ready or has
+// expired.
+func (m *DataExportModel) Archive(ctx context.Context, id int64) (*DataExport, []byte, error) {
+	query := `SELECT id, user_id, status, origin, created_at, completed_at, expires_at, archive
+	          FROM data_exports
+	          WHERE id = $1 AND status = 'ready' AND expires_at > NOW()`
+	e := &DataExport{}
+	var archive []byte
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&e.ID, &e.UserID, &e.Status, &e.Origin, &e.CreatedAt, &e.CompletedAt, &e.ExpiresAt, &archive,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, ErrRecordNotFound
+		}
+		return nil, nil, err
+	}
+	e.Size = len(archive)
+	return e, archive, nil
+}
+
+// DeleteExpired removes exports, and their archives, once they expire
+func (m *DataExportModel) DeleteExpired(ctx context.Context) (int64, error) {
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM data_exports WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
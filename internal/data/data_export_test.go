@@ -0,0 +1,128 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// buildOwn runs BuildNext until it has built one of userID's exports with
+// build, building any other pending export of a shared database as well
+func buildOwn(t *testing.T, m *Models, userID int, ttl time.Duration, build func(*DataExport) ([]byte, error)) (*DataExport, error) {
+	t.Helper()
+	for {
+		e, err := m.DataExports.BuildNext(context.Background(), ttl, func(e *DataExport) ([]byte, error) {
+			if e.UserID != userID {
+				return []byte("someone else's"), nil
+			}
+			return build(e)
+		})
+		if e == nil && err == nil {
+			t.Fatal("the export was not built")
+		}
+		if e != nil && e.UserID == userID {
+			return e, err
+		}
+		if err != nil {
+			t.Fatalf("building another export: %v", err)
+		}
+	}
+}
+
+func TestDataExportBuildAndArchive(t *testing.T) {
+	m := testModels(t)
+	user := testUser(t, m, "user")
+	ctx := context.Background()
+
+	requested, created, err := m.DataExports.Request(ctx, user.ID, "https://jar.example.com")
+	if err != nil || !created {
+		t.Fatalf("Request = %v, %v, %v", requested, created, err)
+	}
+	if again, created, err := m.DataExports.Request(ctx, user.ID, "https://jar.example.com"); err != nil || created || again.ID != requested.ID {
+		t.Errorf("a second request did not return the pending export: %v, %v, %v", again, created, err)
+	}
+	if _, _, err := m.DataExports.Archive(ctx, requested.ID); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Archive of a pending export: got %v", err)
+	}
+
+	archive := []byte("PK\x03\x04 takeout")
+	built, err := buildOwn(t, m, user.ID, time.Hour, func(*DataExport) ([]byte, error) { return archive, nil })
+	if err != nil || built.ID != requested.ID || built.Status != ExportReady || built.Size != len(archive) || built.ExpiresAt == nil {
+		t.Fatalf("BuildNext = %+v, %v", built, err)
+	}
+	e, got, err := m.DataExports.Archive(ctx, built.ID)
+	if err != nil || !bytes.Equal(got, archive) || e.UserID != user.ID || e.Size != len(archive) {
+		t.Errorf("Archive = %+v, %q, %v", e, got, err)
+	}
+
+	// A failed build is kept without an archive, so it is never served
+	requested, _, _ = m.DataExports.Request(ctx, user.ID, "")
+	buildErr := errors.New("disk full")
+	built, err = buildOwn(t, m, user.ID, time.Hour, func(*DataExport) ([]byte, error) { return archive, buildErr })
+	if !errors.Is(err, buildErr) || built.ID != requested.ID || built.Status != ExportFailed {
+		t.Errorf("failed BuildNext = %+v, %v", built, err)
+	}
+	if _, _, err := m.DataExports.Archive(ctx, built.ID); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Archive of a failed export: got %v", err)
+	}
+
+	// Nor is an expired one
+	m.DataExports.Request(ctx, user.ID, "")
+	built, err = buildOwn(t, m, user.ID, -time.Second, func(*DataExport) ([]byte, error) { return archive, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m.DataExports.Archive(ctx, built.ID); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Archive of an expired export: got %v", err)
+	}
+}
+
+// TestDataExportBuildNextLocks checks that an export being built is skipped
+// by other builders, so several instances can share the queue
+func TestDataExportBuildNextLocks(t *testing.T) {
+	m := testModels(t)
+	user := testUser(t, m, "user")
+	ctx := context.Background()
+	requested, _, err := m.DataExports.Request(ctx, user.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	building, release := make(chan struct{}), make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := m.DataExports.BuildNext(ctx, time.Hour, func(e *DataExport) ([]byte, error) {
+			if e.ID != requested.ID {
+				return nil, errors.New("another export is pending; run against an empty test database")
+			}
+			close(building)
+			<-release
+			return []byte("archive"), nil
+		})
+		done <- err
+	}()
+	select {
+	case <-building:
+	case err := <-done:
+		t.Fatal(err)
+	}
+
+	for {
+		e, err := m.DataExports.BuildNext(ctx, time.Hour, func(*DataExport) ([]byte, error) { return []byte("other"), nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e == nil {
+			break
+		}
+		if e.ID == requested.ID {
+			t.Fatal("an export being built was built again")
+		}
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
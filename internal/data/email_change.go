@@ -0,0 +1,99 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"time"
+)
+
+// EmailChange is a confirmed change of a user's email address
+type EmailChange struct {
+	UserID   int
+	Username string
+	OldEmail string
+	NewEmail string
+}
+
+// EmailChangeModel keeps pending email address changes until the link sent
+// to the new address is followed. Tokens are stored hashed, so a copy of the
+// database cannot be used to confirm a change.
+type EmailChangeModel struct {
+	DB *sql.DB
+}
+
+// NewEmailChangeModel creates a new EmailChangeModel instance
+func NewEmailChangeModel(db *sql.DB) *EmailChangeModel {
+	return &EmailChangeModel{DB: db}
+}
+
+// Request records that userID wants to change their email to newEmail and
+// returns the token for the confirmation link. Earlier pending changes of the
+// user are dropped, so only the latest link works, along with everyone's
+// expired ones.
+func (m *EmailChangeModel) Request(ctx context.Context, userID int, newEmail string, ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM email_changes WHERE user_id = $1 OR expires_at <= NOW()`, userID); err != nil {
+		return "", err
+	}
+	query := `
+		INSERT INTO email_changes (token_hash, user_id, new_email, expires_at)
+		VALUES ($1, $2, $3, $4)`
+	if _, err := tx.ExecContext(ctx, query, hashToken(token), userID, newEmail, time.Now().Add(ttl)); err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// Confirm applies the pending change for token. It returns ErrRecordNotFound
+// if the token is unknown or expired, and ErrDuplicateEmail if the address
+// was registered by someone else in the meantime.
+func (m *EmailChangeModel) Confirm(ctx context.Context, token string) (*EmailChange, error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	change := &EmailChange{}
+	query := `
+		SELECT c.user_id, u.username, u.email, c.new_email
+		FROM email_changes c JOIN users u ON u.id = c.user_id
+		WHERE c.token_hash = $1 AND c.expires_at > NOW()
+		FOR UPDATE`
+	err = tx.QueryRowContext(ctx, query, hashToken(token)).Scan(&change.UserID, &change.Username, &change.OldEmail, &change.NewEmail)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET email = $1, updated_at = NOW() WHERE id = $2`, change.NewEmail, change.UserID); err != nil {
+		return nil, uniqueViolation(err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM email_changes WHERE user_id = $1`, change.UserID); err != nil {
+		return nil, err
+	}
+	return change, tx.Commit()
+}
+
+// hashToken returns the SHA-256 hash under which a token is stored
+func hashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
@@ -5,4 +5,14 @@ import "errors"
 var (
 	// ErrRecordNotFound is returned when a requested record is not found in the database
 	ErrRecordNotFound = errors.New("record not found")
+	// ErrDuplicateUsername is returned when a username is already taken
+	ErrDuplicateUsername = errors.New("duplicate username")
+	// ErrDuplicateEmail is returned when an email address is already registered
+	ErrDuplicateEmail = errors.New("duplicate email")
+	// ErrDuplicateExternalID is returned when the directory's identifier for
+	// a user is already used by another user
+	ErrDuplicateExternalID = errors.New("duplicate external ID")
+	// ErrLoginLinkBrowser is returned when a sign-in link is followed in a
+	// browser other than the one that asked for it
+	ErrLoginLinkBrowser = errors.New("login link used in another browser")
 )
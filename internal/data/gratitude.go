@@ -52,6 +52,48 @@ func (m *GratitudeModel) GetAll(ctx context.Context, userID int) ([]GratitudeNot
 	return notes, nil
 }
 
+// GetPage returns one page of a user's notes in the given sort order
+// (SortNewest or SortOldest), and how many notes the user has in total
+func (m *GratitudeModel) GetPage(ctx context.Context, userID int, sort string, limit, offset int) ([]GratitudeNote, int, error) {
+	order := "DESC"
+	if sort == SortOldest {
+		order = "ASC"
+	}
+	query := `SELECT id, title, content, category, emoji, created_at, updated_at, COUNT(*) OVER()
+	          FROM gratitude_notes
+	          WHERE user_id = $1
+	          ORDER BY created_at ` + order + `, id ` + order + `
+	          LIMIT $2 OFFSET $3`
+	rows, err := m.DB.QueryContext(ctx, query, userID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var notes []GratitudeNote
+	total := 0
+	for rows.Next() {
+		var note GratitudeNote
+		err := rows.Scan(&note.ID, &note.Title, &note.Content, &note.Category, &note.Emoji, &note.CreatedAt, &note.UpdatedAt, &total)
+		if err != nil {
+			return nil, 0, err
+		}
+		notes = append(notes, note)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	// Past the last page there are no rows to carry the total
+	if len(notes) == 0 && offset > 0 {
+		err := m.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM gratitude_notes WHERE user_id = $1`, userID).Scan(&total)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return notes, total, nil
+}
+
 // Get returns a single gratitude note by ID
 func (m *GratitudeModel) Get(ctx context.Context, id int) (*GratitudeNote, error) {
 	query := `SELECT id, title, content, category, emoji, user_id, created_at, updated_at 
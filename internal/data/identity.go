@@ -0,0 +1,81 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Identity is a provider's user linked to an account
+type Identity struct {
+	Issuer    string
+	Subject   string
+	UserID    int
+	Email     string // the address the accounts were matched by
+	CreatedAt time.Time
+}
+
+// IdentityModel links accounts to users of OpenID Connect identity
+// providers. A provider's user is identified by the issuer and subject of
+// its ID tokens, which stay the same when their email address changes.
+type IdentityModel struct {
+	DB *sql.DB
+}
+
+// NewIdentityModel creates a new IdentityModel instance
+func NewIdentityModel(db *sql.DB) *IdentityModel {
+	return &IdentityModel{DB: db}
+}
+
+// User fetches the account linked to subject at issuer. It returns
+// ErrRecordNotFound if there is none.
+func (m *IdentityModel) User(ctx context.Context, issuer, subject string) (*User, error) {
+	query := `
+		SELECT ` + userColumns + `
+		FROM user_identities i JOIN users ON users.id = i.user_id
+		WHERE i.issuer = $1 AND i.subject = $2`
+	user, err := scanUser(m.DB.QueryRowContext(ctx, query, issuer, subject))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// Link links subject at issuer to userID, noting the email address it was
+// matched by. Linking an identity that is already linked changes nothing.
+func (m *IdentityModel) Link(ctx context.Context, userID int, issuer, subject, email string) error {
+	query := `
+		INSERT INTO user_identities (issuer, subject, user_id, email)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (issuer, subject) DO NOTHING`
+	_, err := m.DB.ExecContext(ctx, query, issuer, subject, userID, email)
+	return err
+}
+
+// ForUser lists the identities linked to userID, oldest first
+func (m *IdentityModel) ForUser(ctx context.Context, userID int) ([]Identity, error) {
+	query := `
+		SELECT issuer, subject, user_id, email, created_at
+		FROM user_identities
+		WHERE user_id = $1
+		ORDER BY created_at, issuer`
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var identities []Identity
+	for rows.Next() {
+		var i Identity
+		if err := rows.Scan(&i.Issuer, &i.Subject, &i.UserID, &i.Email, &i.CreatedAt); err != nil {
+			return nil, err
+		}
+		identities = append(identities, i)
+	}
+	return identities, rows.Err()
+}
@@ -0,0 +1,76 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"time"
+)
+
+// LoginLinkModel keeps the single-use sign-in links sent by mail. Each link
+// is bound to a nonce kept in a cookie of the browser that asked for it, so
+// a forwarded or intercepted link is useless on its own. Tokens and nonces
+// are stored hashed.
+type LoginLinkModel struct {
+	DB *sql.DB
+}
+
+// NewLoginLinkModel creates a new LoginLinkModel instance
+func NewLoginLinkModel(db *sql.DB) *LoginLinkModel {
+	return &LoginLinkModel{DB: db}
+}
+
+// Request records a sign-in link for userID bound to nonce and returns its
+// token. Earlier links of the user are dropped, so only the latest works,
+// along with everyone's expired ones.
+func (m *LoginLinkModel) Request(ctx context.Context, userID int, nonce string, ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM login_links WHERE user_id = $1 OR expires_at <= NOW()`, userID); err != nil {
+		return "", err
+	}
+	query := `
+		INSERT INTO login_links (token_hash, user_id, nonce_hash, expires_at)
+		VALUES ($1, $2, $3, $4)`
+	if _, err := tx.ExecContext(ctx, query, hashToken(token), userID, hashToken(nonce), time.Now().Add(ttl)); err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// Consume uses up the link for token and returns the user it signs in. It
+// returns ErrRecordNotFound if the token is unknown, expired or already used,
+// and ErrLoginLinkBrowser, along with the user, if nonce is not the one the
+// link was bound to. Either way the link cannot be followed again.
+func (m *LoginLinkModel) Consume(ctx context.Context, token, nonce string) (int, error) {
+	var userID int
+	var nonceHash []byte
+	query := `
+		DELETE FROM login_links
+		WHERE token_hash = $1 AND expires_at > NOW()
+		RETURNING user_id, nonce_hash`
+	err := m.DB.QueryRowContext(ctx, query, hashToken(token)).Scan(&userID, &nonceHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrRecordNotFound
+		}
+		return 0, err
+	}
+	if subtle.ConstantTimeCompare(nonceHash, hashToken(nonce)) != 1 {
+		return userID, ErrLoginLinkBrowser
+	}
+	return userID, nil
+}
@@ -4,14 +4,28 @@ import "database/sql"
 
 // Models holds the models for the application
 type Models struct {
-	Users      *UserModel
-	Gratitudes *GratitudeModel
+	Users          *UserModel
+	Gratitudes     *GratitudeModel
+	SecurityEvents *SecurityEventModel
+	Preferences    *PreferencesModel
+	EmailChanges   *EmailChangeModel
+	DataExports    *DataExportModel
+	LoginLinks     *LoginLinkModel
+	Identities     *IdentityModel
+	OAuth          *OAuthModel
 }
 
 // NewModels creates a new Models instance
 func NewModels(db *sql.DB) *Models {
 	return &Models{
-		Users:      NewUserModel(db),
-		Gratitudes: NewGratitudeModel(db),
+		Users:          NewUserModel(db),
+		Gratitudes:     NewGratitudeModel(db),
+		SecurityEvents: NewSecurityEventModel(db),
+		Preferences:    NewPreferencesModel(db),
+		EmailChanges:   NewEmailChangeModel(db),
+		DataExports:    NewDataExportModel(db),
+		LoginLinks:     NewLoginLinkModel(db),
+		Identities:     NewIdentityModel(db),
+		OAuth:          NewOAuthModel(db),
 	}
 }
@@ -0,0 +1,48 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// testModels connects to the migrated database TEST_DATABASE_DSN points at,
+// or skips the test without one
+func testModels(t *testing.T) *Models {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("opening test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Ping(); err != nil {
+		t.Fatalf("connecting to test database: %v", err)
+	}
+	return NewModels(db)
+}
+
+// testUser adds a user with role and a name no other test run uses, and
+// removes them, with everything of theirs, when the test ends
+func testUser(t *testing.T, m *Models, role string) *User {
+	t.Helper()
+	ctx := context.Background()
+	name := fmt.Sprintf("t%d", time.Now().UnixNano())
+	if err := m.Users.Insert(ctx, name, name+"@example.com", "not-a-hash", role); err != nil {
+		t.Fatalf("adding test user: %v", err)
+	}
+	user, err := m.Users.GetByUsername(ctx, name)
+	if err != nil || user == nil {
+		t.Fatalf("looking up test user: %v", err)
+	}
+	t.Cleanup(func() { m.Users.DB.Exec(`DELETE FROM users WHERE id = $1`, user.ID) })
+	return user
+}
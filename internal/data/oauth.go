@@ -0,0 +1,460 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The kinds of OAuth token
+const (
+	TokenAccess  = "access"
+	TokenRefresh = "refresh"
+)
+
+// OAuthClient is a third-party app registered to act on users' notes
+type OAuthClient struct {
+	ID           string
+	Name         string
+	RedirectURIs []string
+	CreatedBy    string
+	CreatedAt    time.Time
+	secretHash   []byte
+}
+
+// Confidential reports whether the client has a secret. Apps that cannot
+// keep one, such as mobile and browser apps, rely on PKCE alone.
+func (c *OAuthClient) Confidential() bool {
+	return c.secretHash != nil
+}
+
+// CheckSecret reports whether secret is the client's secret
+func (c *OAuthClient) CheckSecret(secret string) bool {
+	return c.secretHash != nil && subtle.ConstantTimeCompare(c.secretHash, hashToken(secret)) == 1
+}
+
+// OAuthGrant records that a user let a client act on their notes with scope
+type OAuthGrant struct {
+	ID         int64
+	ClientID   string
+	ClientName string
+	UserID     int
+	Scope      string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+// Scopes lists the scopes granted
+func (g OAuthGrant) Scopes() []string {
+	return strings.Fields(g.Scope)
+}
+
+// OAuthCode is a redeemed authorization code
+type OAuthCode struct {
+	GrantID     int64
+	ClientID    string
+	UserID      int
+	Scope       string
+	RedirectURI string
+	Challenge   string
+}
+
+// OAuthToken is an access or refresh token issued under a grant
+type OAuthToken struct {
+	GrantID   int64
+	ClientID  string
+	UserID    int
+	Kind      string
+	Scope     string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// OAuthModel keeps the registered clients and the grants, authorization
+// codes and tokens of the OAuth authorization server. Client secrets, codes
+// and tokens are random and stored hashed.
+type OAuthModel struct {
+	DB *sql.DB
+}
+
+// NewOAuthModel creates a new OAuthModel instance
+func NewOAuthModel(db *sql.DB) *OAuthModel {
+	return &OAuthModel{DB: db}
+}
+
+// CreateClient registers a client and returns it with its secret, which is
+// shown once and cannot be recovered. Public clients get no secret.
+func (m *OAuthModel) CreateClient(ctx context.Context, name string, redirectURIs []string, confidential bool, createdBy string) (*OAuthClient, string, error) {
+	id, err := newToken(16)
+	if err != nil {
+		return nil, "", err
+	}
+	client := &OAuthClient{ID: id, Name: name, RedirectURIs: redirectURIs, CreatedBy: createdBy}
+	var secret string
+	if confidential {
+		if secret, err = newToken(32); err != nil {
+			return nil, "", err
+		}
+		client.secretHash = hashToken(secret)
+	}
+
+	query := `
+		INSERT INTO oauth_clients (id, name, secret_hash, redirect_uris, created_by)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at`
+	err = m.DB.QueryRowContext(ctx, query, client.ID, name, client.secretHash, pq.Array(redirectURIs), createdBy).Scan(&client.CreatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+	return client, secret, nil
+}
+
+// Client fetches a client by ID. It returns ErrRecordNotFound if there is
+// none.
+func (m *OAuthModel) Client(ctx context.Context, id string) (*OAuthClient, error) {
+	query := `
+		SELECT id, name, secret_hash, redirect_uris, created_by, created_at
+		FROM oauth_clients
+		WHERE id = $1`
+	client := &OAuthClient{}
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&client.ID, &client.Name, &client.secretHash, pq.Array(&client.RedirectURIs), &client.CreatedBy, &client.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+	return client, nil
+}
+
+// Clients lists every registered client by name
+func (m *OAuthModel) Clients(ctx context.Context) ([]OAuthClient, error) {
+	query := `
+		SELECT id, name, secret_hash, redirect_uris, created_by, created_at
+		FROM oauth_clients
+		ORDER BY name, created_at`
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var clients []OAuthClient
+	for rows.Next() {
+		var c OAuthClient
+		if err := rows.Scan(&c.ID, &c.Name, &c.secretHash, pq.Array(&c.RedirectURIs), &c.CreatedBy, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	return clients, rows.Err()
+}
+
+// DeleteClient removes a client, revoking everything granted to it, and
+// returns it. It returns ErrRecordNotFound if there is none.
+func (m *OAuthModel) DeleteClient(ctx context.Context, id string) (*OAuthClient, error) {
+	client := &OAuthClient{}
+	query := `DELETE FROM oauth_clients WHERE id = $1 RETURNING id, name, created_by, created_at`
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&client.ID, &client.Name, &client.CreatedBy, &client.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+	return client, nil
+}
+
+// Grant fetches what userID has granted clientID. It returns
+// ErrRecordNotFound if the user has not authorized the client.
+func (m *OAuthModel) Grant(ctx context.Context, userID int, clientID string) (*OAuthGrant, error) {
+	query := `
+		SELECT g.id, g.client_id, c.name, g.user_id, g.scope, g.created_at, g.last_used_at
+		FROM oauth_grants g JOIN oauth_clients c ON c.id = g.client_id
+		WHERE g.user_id = $1 AND g.client_id = $2`
+	grant := &OAuthGrant{}
+	err := m.DB.QueryRowContext(ctx, query, userID, clientID).Scan(&grant.ID, &grant.ClientID, &grant.ClientName, &grant.UserID, &grant.Scope, &grant.CreatedAt, &grant.LastUsedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+	return grant, nil
+}
+
+// Grants lists the clients userID has authorized, oldest first
+func (m *OAuthModel) Grants(ctx context.Context, userID int) ([]OAuthGrant, error) {
+	query := `
+		SELECT g.id, g.client_id, c.name, g.user_id, g.scope, g.created_at, g.last_used_at
+		FROM oauth_grants g JOIN oauth_clients c ON c.id = g.client_id
+		WHERE g.user_id = $1
+		ORDER BY g.created_at, g.id`
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []OAuthGrant
+	for rows.Next() {
+		var g OAuthGrant
+		if err := rows.Scan(&g.ID, &g.ClientID, &g.ClientName, &g.UserID, &g.Scope, &g.CreatedAt, &g.LastUsedAt); err != nil {
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+// SaveGrant records that userID lets clientID act with scope, replacing the
+// scope of an earlier grant, and returns the grant's ID
+func (m *OAuthModel) SaveGrant(ctx context.Context, userID int, clientID, scope string) (int64, error) {
+	var id int64
+	query := `
+		INSERT INTO oauth_grants (client_id, user_id, scope)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, client_id) DO UPDATE SET scope = EXCLUDED.scope
+		RETURNING id`
+	err := m.DB.QueryRowContext(ctx, query, clientID, userID, scope).Scan(&id)
+	return id, err
+}
+
+// RevokeGrant removes a grant of userID, along with its codes and tokens,
+// and returns it. It returns ErrRecordNotFound if the user has no such grant.
+func (m *OAuthModel) RevokeGrant(ctx context.Context, userID int, grantID int64) (*OAuthGrant, error) {
+	query := `
+		DELETE FROM oauth_grants g
+		USING oauth_clients c
+		WHERE g.id = $1 AND g.user_id = $2 AND c.id = g.client_id
+		RETURNING g.id, g.client_id, c.name, g.user_id, g.scope, g.created_at, g.last_used_at`
+	grant := &OAuthGrant{}
+	err := m.DB.QueryRowContext(ctx, query, grantID, userID).Scan(&grant.ID, &grant.ClientID, &grant.ClientName, &grant.UserID, &grant.Scope, &grant.CreatedAt, &grant.LastUsedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+	return grant, nil
+}
+
+// NewCode issues an authorization code under a grant for scope, to be
+// redeemed from redirectURI with the verifier of the PKCE challenge
+func (m *OAuthModel) NewCode(ctx context.Context, grantID int64, scope, redirectURI, challenge string, ttl time.Duration) (string, error) {
+	code, err := newToken(32)
+	if err != nil {
+		return "", err
+	}
+	query := `
+		INSERT INTO oauth_codes (code_hash, grant_id, scope, redirect_uri, code_challenge, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err = m.DB.ExecContext(ctx, query, hashToken(code), grantID, scope, redirectURI, challenge, time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// RedeemCode uses up an authorization code. It returns ErrRecordNotFound if
+// the code is unknown, expired or already used.
+func (m *OAuthModel) RedeemCode(ctx context.Context, code string) (*OAuthCode, error) {
+	query := `
+		DELETE FROM oauth_codes c
+		USING oauth_grants g
+		WHERE c.code_hash = $1 AND c.expires_at > NOW() AND g.id = c.grant_id
+		RETURNING c.grant_id, g.client_id, g.user_id, c.scope, c.redirect_uri, c.code_challenge`
+	redeemed := &OAuthCode{}
+	err := m.DB.QueryRowContext(ctx, query, hashToken(code)).Scan(&redeemed.GrantID, &redeemed.ClientID, &redeemed.UserID, &redeemed.Scope, &redeemed.RedirectURI, &redeemed.Challenge)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+	return redeemed, nil
+}
+
+// IssueTokens issues an access token and a refresh token under a grant, both
+// for scope
+func (m *OAuthModel) IssueTokens(ctx context.Context, grantID int64, scope string, accessTTL, refreshTTL time.Duration) (access, refresh string, err error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	access, refresh, err = issueTokens(ctx, tx, grantID, scope, scope, accessTTL, refreshTTL)
+	if err != nil {
+		return "", "", err
+	}
+	return access, refresh, tx.Commit()
+}
+
+// RotateRefreshToken uses up a refresh token of clientID and issues a new
+// pair under the same grant. The access token gets accessScope, which may be
+// narrower than the grant's; the new refresh token keeps the old one's. It
+// returns ErrRecordNotFound if the token is unknown, expired, already used
+// or was issued to another client.
+func (m *OAuthModel) RotateRefreshToken(ctx context.Context, token, clientID, accessScope string, accessTTL, refreshTTL time.Duration) (access, refresh string, err error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	var grantID int64
+	var scope string
+	query := `
+		DELETE FROM oauth_tokens t
+		USING oauth_grants g
+		WHERE t.token_hash = $1 AND t.kind = 'refresh' AND t.expires_at > NOW()
+			AND g.id = t.grant_id AND g.client_id = $2
+		RETURNING t.grant_id, t.scope`
+	err = tx.QueryRowContext(ctx, query, hashToken(token), clientID).Scan(&grantID, &scope)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", "", ErrRecordNotFound
+		}
+		return "", "", err
+	}
+
+	access, refresh, err = issueTokens(ctx, tx, grantID, accessScope, scope, accessTTL, refreshTTL)
+	if err != nil {
+		return "", "", err
+	}
+	return access, refresh, tx.Commit()
+}
+
+// issueTokens inserts an access and a refresh token and notes that the
+// grant was used
+func issueTokens(ctx context.Context, tx *sql.Tx, grantID int64, accessScope, refreshScope string, accessTTL, refreshTTL time.Duration) (access, refresh string, err error) {
+	if access, err = newToken(32); err != nil {
+		return "", "", err
+	}
+	if refresh, err = newToken(32); err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	query := `
+		INSERT INTO oauth_tokens (token_hash, grant_id, kind, scope, expires_at)
+		VALUES ($1, $2, $3, $4, $5), ($6, $2, $7, $8, $9)`
+	_, err = tx.ExecContext(ctx, query,
+		hashToken(access), grantID, TokenAccess, accessScope, now.Add(accessTTL),
+		hashToken(refresh), TokenRefresh, refreshScope, now.Add(refreshTTL),
+	)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE oauth_grants SET last_used_at = NOW() WHERE id = $1`, grantID); err != nil {
+		return "", "", err
+	}
+	return access, refresh, nil
+}
+
+// Token looks up an unexpired access or refresh token. It returns
+// ErrRecordNotFound if there is none.
+func (m *OAuthModel) Token(ctx context.Context, token string) (*OAuthToken, error) {
+	query := `
+		SELECT t.grant_id, g.client_id, g.user_id, t.kind, t.scope, t.created_at, t.expires_at
+		FROM oauth_tokens t JOIN oauth_grants g ON g.id = t.grant_id
+		WHERE t.token_hash = $1 AND t.expires_at > NOW()`
+	t := &OAuthToken{}
+	err := m.DB.QueryRowContext(ctx, query, hashToken(token)).Scan(&t.GrantID, &t.ClientID, &t.UserID, &t.Kind, &t.Scope, &t.CreatedAt, &t.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+	return t, nil
+}
+
+// Tokens lists the unexpired access and refresh tokens issued under
+// userID's grants, oldest first
+func (m *OAuthModel) Tokens(ctx context.Context, userID int) ([]OAuthToken, error) {
+	query := `
+		SELECT t.grant_id, g.client_id, g.user_id, t.kind, t.scope, t.created_at, t.expires_at
+		FROM oauth_tokens t JOIN oauth_grants g ON g.id = t.grant_id
+		WHERE g.user_id = $1 AND t.expires_at > NOW()
+		ORDER BY t.created_at, t.kind`
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []OAuthToken
+	for rows.Next() {
+		var t OAuthToken
+		if err := rows.Scan(&t.GrantID, &t.ClientID, &t.UserID, &t.Kind, &t.Scope, &t.CreatedAt, &t.ExpiresAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeToken revokes a token issued to clientID and returns it, or nil if
+// there is no such token. Revoking a refresh token revokes every token of
+// its grant, so the app has to ask the user again; the grant itself stays
+// listed until the user removes it.
+func (m *OAuthModel) RevokeToken(ctx context.Context, token, clientID string) (*OAuthToken, error) {
+	query := `
+		DELETE FROM oauth_tokens t
+		USING oauth_grants g
+		WHERE t.token_hash = $1 AND g.id = t.grant_id AND g.client_id = $2
+		RETURNING t.grant_id, g.client_id, g.user_id, t.kind, t.scope, t.created_at, t.expires_at`
+	t := &OAuthToken{}
+	err := m.DB.QueryRowContext(ctx, query, hashToken(token), clientID).Scan(&t.GrantID, &t.ClientID, &t.UserID, &t.Kind, &t.Scope, &t.CreatedAt, &t.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if t.Kind == TokenRefresh {
+		if _, err := m.DB.ExecContext(ctx, `DELETE FROM oauth_tokens WHERE grant_id = $1`, t.GrantID); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// DeleteExpired removes expired authorization codes and tokens and returns
+// how many were removed
+func (m *OAuthModel) DeleteExpired(ctx context.Context) (int64, error) {
+	var removed int64
+	for _, query := range []string{
+		`DELETE FROM oauth_codes WHERE expires_at <= NOW()`,
+		`DELETE FROM oauth_tokens WHERE expires_at <= NOW()`,
+	} {
+		result, err := m.DB.ExecContext(ctx, query)
+		if err != nil {
+			return removed, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return removed, err
+		}
+		removed += n
+	}
+	return removed, nil
+}
+
+// newToken returns n random bytes encoded for URLs
+func newToken(n int) (string, error) {
+	raw := make([]byte, n)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
@@ -0,0 +1,179 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testGrant registers a client, removed when the test ends, and records that
+// user granted it scope
+func testGrant(t *testing.T, m *Models, user *User, scope string) (*OAuthClient, int64) {
+	t.Helper()
+	ctx := context.Background()
+	client, _, err := m.OAuth.CreateClient(ctx, "Test app", []string{"https://app.example.com/callback"}, true, "test")
+	if err != nil {
+		t.Fatalf("registering client: %v", err)
+	}
+	t.Cleanup(func() { m.OAuth.DeleteClient(context.Background(), client.ID) })
+	grantID, err := m.OAuth.SaveGrant(ctx, user.ID, client.ID, scope)
+	if err != nil {
+		t.Fatalf("saving grant: %v", err)
+	}
+	return client, grantID
+}
+
+func TestOAuthRefreshRotation(t *testing.T) {
+	m := testModels(t)
+	user := testUser(t, m, "user")
+	client, grantID := testGrant(t, m, user, "notes:read notes:write")
+	other, _ := testGrant(t, m, user, "notes:read")
+	ctx := context.Background()
+
+	access, refresh, err := m.OAuth.IssueTokens(ctx, grantID, "notes:read notes:write", time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another client cannot use the token, nor use it up
+	if _, _, err := m.OAuth.RotateRefreshToken(ctx, refresh, other.ID, "notes:read", time.Hour, 24*time.Hour); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("rotating with another client: got %v, expected ErrRecordNotFound", err)
+	}
+
+	newAccess, newRefresh, err := m.OAuth.RotateRefreshToken(ctx, refresh, client.ID, "notes:read", time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("rotating: %v", err)
+	}
+	if tok, err := m.OAuth.Token(ctx, newAccess); err != nil || tok.Kind != TokenAccess || tok.Scope != "notes:read" || tok.GrantID != grantID {
+		t.Errorf("new access token = %+v, %v; expected notes:read under the grant", tok, err)
+	}
+	if tok, err := m.OAuth.Token(ctx, newRefresh); err != nil || tok.Kind != TokenRefresh || tok.Scope != "notes:read notes:write" {
+		t.Errorf("new refresh token = %+v, %v; expected the original scope", tok, err)
+	}
+	if _, err := m.OAuth.Token(ctx, access); err != nil {
+		t.Errorf("rotation revoked the earlier access token: %v", err)
+	}
+
+	// A refresh token works once
+	if _, err := m.OAuth.Token(ctx, refresh); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("used refresh token still found: %v", err)
+	}
+	if _, _, err := m.OAuth.RotateRefreshToken(ctx, refresh, client.ID, "notes:read", time.Hour, 24*time.Hour); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("reusing a refresh token: got %v, expected ErrRecordNotFound", err)
+	}
+
+	// Even when it is presented twice at once
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _, errs[i] = m.OAuth.RotateRefreshToken(ctx, newRefresh, client.ID, "notes:read", time.Hour, 24*time.Hour)
+		}(i)
+	}
+	wg.Wait()
+	if (errs[0] == nil) == (errs[1] == nil) {
+		t.Errorf("concurrent rotations: got %v and %v, expected exactly one to succeed", errs[0], errs[1])
+	}
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("losing rotation: got %v, expected ErrRecordNotFound", err)
+		}
+	}
+
+	// Expired refresh tokens cannot be rotated
+	_, expired, err := m.OAuth.IssueTokens(ctx, grantID, "notes:read", time.Hour, -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m.OAuth.RotateRefreshToken(ctx, expired, client.ID, "notes:read", time.Hour, 24*time.Hour); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("rotating an expired token: got %v, expected ErrRecordNotFound", err)
+	}
+}
+
+func TestOAuthRevokeToken(t *testing.T) {
+	m := testModels(t)
+	user := testUser(t, m, "user")
+	client, grantID := testGrant(t, m, user, "notes:read")
+	other, _ := testGrant(t, m, user, "notes:read")
+	ctx := context.Background()
+
+	access, refresh, err := m.OAuth.IssueTokens(ctx, grantID, "notes:read", time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	laterAccess, _, err := m.OAuth.IssueTokens(ctx, grantID, "notes:read", time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the client the token was issued to can revoke it
+	if tok, err := m.OAuth.RevokeToken(ctx, refresh, other.ID); tok != nil || err != nil {
+		t.Errorf("revoking with another client: got %+v, %v; expected nothing", tok, err)
+	}
+
+	// Revoking an access token leaves the rest of the grant alone
+	tok, err := m.OAuth.RevokeToken(ctx, access, client.ID)
+	if err != nil || tok == nil || tok.Kind != TokenAccess || tok.UserID != user.ID {
+		t.Fatalf("revoking the access token: got %+v, %v", tok, err)
+	}
+	if _, err := m.OAuth.Token(ctx, access); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("revoked access token still found: %v", err)
+	}
+	if _, err := m.OAuth.Token(ctx, laterAccess); err != nil {
+		t.Errorf("revoking one access token revoked another: %v", err)
+	}
+	if tok, err := m.OAuth.RevokeToken(ctx, access, client.ID); tok != nil || err != nil {
+		t.Errorf("revoking again: got %+v, %v; expected nothing", tok, err)
+	}
+
+	// Revoking a refresh token revokes every token of the grant but keeps
+	// the grant
+	if tok, err := m.OAuth.RevokeToken(ctx, refresh, client.ID); err != nil || tok == nil || tok.Kind != TokenRefresh {
+		t.Fatalf("revoking the refresh token: got %+v, %v", tok, err)
+	}
+	if tokens, err := m.OAuth.Tokens(ctx, user.ID); err != nil || len(tokens) != 0 {
+		t.Errorf("tokens after revoking the refresh token: %+v, %v", tokens, err)
+	}
+	if _, err := m.OAuth.Grant(ctx, user.ID, client.ID); err != nil {
+		t.Errorf("grant removed with its tokens: %v", err)
+	}
+}
+
+func TestOAuthRevokeGrant(t *testing.T) {
+	m := testModels(t)
+	user := testUser(t, m, "user")
+	stranger := testUser(t, m, "user")
+	client, grantID := testGrant(t, m, user, "notes:read")
+	ctx := context.Background()
+
+	access, _, err := m.OAuth.IssueTokens(ctx, grantID, "notes:read", time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := m.OAuth.NewCode(ctx, grantID, "notes:read", "https://app.example.com/callback", "challenge", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.OAuth.RevokeGrant(ctx, stranger.ID, grantID); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("revoking another user's grant: got %v, expected ErrRecordNotFound", err)
+	}
+
+	grant, err := m.OAuth.RevokeGrant(ctx, user.ID, grantID)
+	if err != nil || grant.ClientID != client.ID || grant.ClientName != client.Name {
+		t.Fatalf("revoking the grant: got %+v, %v", grant, err)
+	}
+	if _, err := m.OAuth.Token(ctx, access); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("token outlived its grant: %v", err)
+	}
+	if _, err := m.OAuth.RedeemCode(ctx, code); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("code outlived its grant: %v", err)
+	}
+	if _, err := m.OAuth.Grant(ctx, user.ID, client.ID); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("revoked grant still found: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Theme and sort order values
+const (
+	ThemeLight = "light"
+	ThemeDark  = "dark"
+
+	SortNewest = "newest"
+	SortOldest = "oldest"
+)
+
+// Preferences are a user's settings. Users who never changed them have the
+// values from DefaultPreferences.
+type Preferences struct {
+	UserID          int
+	Timezone        string // IANA zone name, e.g. "America/Belize"
+	Locale          string // Empty to follow the browser's Accept-Language
+	Theme           string
+	DefaultCategory string // Preselected when adding a note; empty for none
+	DefaultEmoji    string // Preselected when adding a note; empty for the first
+	NotesPerPage    int
+	SortOrder       string
+	UpdatedAt       time.Time
+}
+
+// DefaultPreferences returns the settings of a user who has not changed any
+func DefaultPreferences(userID int) *Preferences {
+	return &Preferences{
+		UserID:       userID,
+		Timezone:     "UTC",
+		Theme:        ThemeLight,
+		NotesPerPage: 12,
+		SortOrder:    SortNewest,
+	}
+}
+
+// Location returns the user's time zone, or UTC if it cannot be loaded
+func (p *Preferences) Location() *time.Location {
+	loc, err := time.LoadLocation(p.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// PreferencesModel wraps a database connection pool
+type PreferencesModel struct {
+	DB *sql.DB
+}
+
+// NewPreferencesModel creates a new PreferencesModel instance
+func NewPreferencesModel(db *sql.DB) *PreferencesModel {
+	return &PreferencesModel{DB: db}
+}
+
+// Get returns the preferences of a user, or the defaults if they have none
+func (m *PreferencesModel) Get(ctx context.Context, userID int) (*Preferences, error) {
+	query := `SELECT user_id, timezone, locale, theme, default_category, default_emoji,
+	                 notes_per_page, sort_order, updated_at
+	          FROM user_preferences
+	          WHERE user_id = $1`
+	p := &Preferences{}
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&p.UserID, &p.Timezone, &p.Locale, &p.Theme, &p.DefaultCategory, &p.DefaultEmoji,
+		&p.NotesPerPage, &p.SortOrder, &p.UpdatedAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return DefaultPreferences(userID), nil
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+// Upsert saves a user's preferences
+func (m *PreferencesModel) Upsert(ctx context.Context, p *Preferences) error {
+	query := `INSERT INTO user_preferences (user_id, timezone, locale, theme, default_category,
+	                                        default_emoji, notes_per_page, sort_order, updated_at)
+	          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW())
+	          ON CONFLICT (user_id) DO UPDATE
+	          SET timezone = EXCLUDED.timezone, locale = EXCLUDED.locale, theme = EXCLUDED.theme,
+	              default_category = EXCLUDED.default_category, default_emoji = EXCLUDED.default_emoji,
+	              notes_per_page = EXCLUDED.notes_per_page, sort_order = EXCLUDED.sort_order,
+	              updated_at = EXCLUDED.updated_at
+	          RETURNING updated_at`
+	return m.DB.QueryRowContext(ctx, query,
+		p.UserID, p.Timezone, p.Locale, p.Theme, p.DefaultCategory,
+		p.DefaultEmoji, p.NotesPerPage, p.SortOrder,
+	).Scan(&p.UpdatedAt)
+}
+
+// SetLocale saves just the user's language, as chosen in the language switcher
+func (m *PreferencesModel) SetLocale(ctx context.Context, userID int, locale string) error {
+	query := `INSERT INTO user_preferences (user_id, locale) VALUES ($1, $2)
+	          ON CONFLICT (user_id) DO UPDATE SET locale = EXCLUDED.locale, updated_at = NOW()`
+	_, err := m.DB.ExecContext(ctx, query, userID, locale)
+	return err
+}
@@ -0,0 +1,87 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// SecurityEvent is an entry in the audit log
+type SecurityEvent struct {
+	ID        int64
+	EventType string
+	UserID    int // 0 when no user is involved
+	Username  string
+	IP        string
+	Details   string
+	Success   bool
+	CreatedAt time.Time
+}
+
+// SecurityEventModel wraps a database connection pool
+type SecurityEventModel struct {
+	DB *sql.DB
+}
+
+// NewSecurityEventModel creates a new SecurityEventModel instance
+func NewSecurityEventModel(db *sql.DB) *SecurityEventModel {
+	return &SecurityEventModel{DB: db}
+}
+
+// Insert appends an event to the audit log
+func (m *SecurityEventModel) Insert(ctx context.Context, event *SecurityEvent) error {
+	query := `INSERT INTO security_events (event_type, user_id, username, ip, details, success)
+	          VALUES ($1, NULLIF($2, 0), $3, $4, $5, $6)
+	          RETURNING id, created_at`
+	return m.DB.QueryRowContext(ctx, query,
+		event.EventType, event.UserID, event.Username, event.IP, event.Details, event.Success,
+	).Scan(&event.ID, &event.CreatedAt)
+}
+
+// Recent returns the latest events, newest first
+func (m *SecurityEventModel) Recent(ctx context.Context, limit int) ([]SecurityEvent, error) {
+	query := `SELECT id, event_type, COALESCE(user_id, 0), username, ip, details, success, created_at
+	          FROM security_events
+	          ORDER BY id DESC
+	          LIMIT $1`
+	rows, err := m.DB.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []SecurityEvent
+	for rows.Next() {
+		var e SecurityEvent
+		err := rows.Scan(&e.ID, &e.EventType, &e.UserID, &e.Username, &e.IP, &e.Details, &e.Success, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// ForUser returns every event recorded for a user, oldest first
+func (m *SecurityEventModel) ForUser(ctx context.Context, userID int) ([]SecurityEvent, error) {
+	query := `SELECT id, event_type, COALESCE(user_id, 0), username, ip, details, success, created_at
+	          FROM security_events
+	          WHERE user_id = $1
+	          ORDER BY id`
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []SecurityEvent
+	for rows.Next() {
+		var e SecurityEvent
+		err := rows.Scan(&e.ID, &e.EventType, &e.UserID, &e.Username, &e.IP, &e.Details, &e.Success, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
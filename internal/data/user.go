@@ -4,6 +4,11 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 // User represents a user in the system.
@@ -13,6 +18,35 @@ type User struct {
 	Email        string
 	PasswordHash string
 	Role         string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+
+	// DeletionScheduledAt is when the account will be erased, if the user
+	// asked to delete it; nil otherwise
+	DeletionScheduledAt *time.Time
+
+	// DeactivatedAt is when the directory deactivated the account; nil
+	// while it is active. Deactivated users cannot sign in.
+	DeactivatedAt *time.Time
+	// ExternalID is the directory's identifier for a provisioned user, or
+	// empty
+	ExternalID string
+}
+
+// userColumns are the columns scanUser reads, qualified so they can be
+// selected from joins
+const userColumns = `users.id, users.username, users.email, users.password_hash, users.role, users.created_at,
+	COALESCE(users.updated_at, users.created_at), users.deletion_scheduled_at, users.deactivated_at, COALESCE(users.external_id, '')`
+
+// scanUser reads a row of userColumns
+func scanUser(row interface{ Scan(...any) error }) (*User, error) {
+	user := &User{}
+	err := row.Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash, &user.Role, &user.CreatedAt,
+		&user.UpdatedAt, &user.DeletionScheduledAt, &user.DeactivatedAt, &user.ExternalID)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
 }
 
 // UserModel wraps a database connection pool.
@@ -20,11 +54,23 @@ type UserModel struct {
 	DB *sql.DB
 }
 
+// Get fetches a user by ID
+func (m *UserModel) Get(ctx context.Context, id int) (*User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = $1`
+	user, err := scanUser(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
 // GetByEmail fetches a user by email
 func (m *UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
-	query := `SELECT id, username, email, password_hash, role FROM users WHERE email = $1`
-	user := &User{}
-	err := m.DB.QueryRowContext(ctx, query, email).Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash, &user.Role)
+	query := `SELECT ` + userColumns + ` FROM users WHERE email = $1`
+	user, err := scanUser(m.DB.QueryRowContext(ctx, query, email))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -43,9 +89,141 @@ func (m *UserModel) Insert(ctx context.Context, username, email, passwordHash, r
 
 // GetByUsername fetches a user by username.
 func (m *UserModel) GetByUsername(ctx context.Context, username string) (*User, error) {
-	query := `SELECT id, username, password_hash, role FROM users WHERE username = $1`
-	user := &User{}
-	err := m.DB.QueryRowContext(ctx, query, username).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role)
+	query := `SELECT ` + userColumns + ` FROM users WHERE username = $1`
+	user, err := scanUser(m.DB.QueryRowContext(ctx, query, username))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// UpdateUsername changes a user's username. It returns ErrDuplicateUsername
+// if another user took the name first.
+func (m *UserModel) UpdateUsername(ctx context.Context, id int, username string) error {
+	query := `UPDATE users SET username = $1, updated_at = NOW() WHERE id = $2`
+	result, err := m.DB.ExecContext(ctx, query, username, id)
+	if err != nil {
+		return uniqueViolation(err)
+	}
+	return requireRow(result)
+}
+
+// UpdatePassword replaces a user's password hash
+func (m *UserModel) UpdatePassword(ctx context.Context, id int, passwordHash string) error {
+	query := `UPDATE users SET password_hash = $1, updated_at = NOW() WHERE id = $2`
+	result, err := m.DB.ExecContext(ctx, query, passwordHash, id)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
+
+// Active reports whether a user exists, has not asked to delete their
+// account and has not been deactivated. Sessions of inactive users are
+// ended.
+func (m *UserModel) Active(ctx context.Context, id int) (bool, error) {
+	query := `SELECT deletion_scheduled_at IS NULL AND deactivated_at IS NULL FROM users WHERE id = $1`
+	var active bool
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&active)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return active, err
+}
+
+// ScheduleDeletion marks a user's account to be erased at the given time
+func (m *UserModel) ScheduleDeletion(ctx context.Context, id int, at time.Time) error {
+	query := `UPDATE users SET deletion_scheduled_at = $1, updated_at = NOW() WHERE id = $2`
+	result, err := m.DB.ExecContext(ctx, query, at, id)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
+
+// CancelDeletion keeps a user's account that was scheduled for deletion
+func (m *UserModel) CancelDeletion(ctx context.Context, id int) error {
+	query := `UPDATE users SET deletion_scheduled_at = NULL, updated_at = NOW() WHERE id = $1`
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
+
+// DueForDeletion returns the IDs of users whose accounts are due to be erased
+func (m *UserModel) DueForDeletion(ctx context.Context) ([]int, error) {
+	query := `SELECT id FROM users WHERE deletion_scheduled_at <= NOW() ORDER BY deletion_scheduled_at`
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Erase deletes a user whose deletion is due, together with everything kept
+// about them: notes, preferences, pending email changes (by cascade) and
+// rate limit buckets. Their security events are kept for the audit trail
+// but pseudonymized: the user ID, IP address and details are removed and
+// the username replaced by pseudonym. It returns ErrRecordNotFound if the
+// user no longer exists or has cancelled the deletion.
+func (m *UserModel) Erase(ctx context.Context, id int, pseudonym string) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Locking the row makes a concurrent login wait, so a deletion it
+	// cancels is never erased
+	var username string
+	query := `SELECT username FROM users WHERE id = $1 AND deletion_scheduled_at <= NOW() FOR UPDATE`
+	if err := tx.QueryRowContext(ctx, query, id).Scan(&username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrRecordNotFound
+		}
+		return err
+	}
+
+	// Failed logins are recorded with the attempted username and no user ID
+	query = `UPDATE security_events SET user_id = NULL, username = $2, ip = '', details = ''
+	         WHERE user_id = $1 OR (user_id IS NULL AND username = $3)`
+	if _, err := tx.ExecContext(ctx, query, id, pseudonym, username); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM rate_limits WHERE key LIKE '%|user:' || $1`, strconv.Itoa(id)); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// provisionedRole is the only role of the users the directory manages.
+// List, GetProvisioned, UpdateProfile, Deactivate and Reactivate leave
+// other users, such as administrators, alone, so the directory's token
+// cannot be used to take over an administrator's account.
+const provisionedRole = "user"
+
+// GetProvisioned fetches a user the directory manages by ID. It returns nil
+// for administrators, as for users that do not exist.
+func (m *UserModel) GetProvisioned(ctx context.Context, id int) (*User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = $1 AND role = $2`
+	user, err := scanUser(m.DB.QueryRowContext(ctx, query, id, provisionedRole))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -55,6 +233,155 @@ func (m *UserModel) GetByUsername(ctx context.Context, username string) (*User,
 	return user, nil
 }
 
+// UserFilter selects the users List returns by one attribute. An empty
+// Field selects every user the directory manages.
+type UserFilter struct {
+	Field string // "username", "email" or "external_id"
+	Value string
+}
+
+// List returns up to limit users the directory manages matching filter in
+// the order they registered, skipping the first offset, and how many match
+// in all. Usernames and email addresses match regardless of case.
+func (m *UserModel) List(ctx context.Context, filter UserFilter, offset, limit int) ([]User, int, error) {
+	where, args := ` WHERE users.role = $1`, []any{provisionedRole}
+	switch filter.Field {
+	case "":
+	case "username", "email":
+		where, args = where+` AND lower(users.`+filter.Field+`) = lower($2)`, append(args, filter.Value)
+	case "external_id":
+		where, args = where+` AND users.external_id = $2`, append(args, filter.Value)
+	default:
+		return nil, 0, fmt.Errorf("data: users cannot be filtered by %q", filter.Field)
+	}
+
+	var total int
+	if err := m.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM users`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	if limit <= 0 || offset >= total {
+		return nil, total, nil
+	}
+
+	query := `SELECT ` + userColumns + ` FROM users` + where + fmt.Sprintf(` ORDER BY users.id LIMIT $%d OFFSET $%d`, len(args)+1, len(args)+2)
+	rows, err := m.DB.QueryContext(ctx, query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, *user)
+	}
+	return users, total, rows.Err()
+}
+
+// Provision adds a user created by the directory, setting their ID and
+// timestamps. It returns ErrDuplicateUsername, ErrDuplicateEmail or
+// ErrDuplicateExternalID if another user has the same one.
+func (m *UserModel) Provision(ctx context.Context, user *User) error {
+	query := `
+		INSERT INTO users (username, email, password_hash, role, external_id, deactivated_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6)
+		RETURNING id, created_at, updated_at`
+	err := m.DB.QueryRowContext(ctx, query, user.Username, user.Email, user.PasswordHash, user.Role, user.ExternalID, user.DeactivatedAt).
+		Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt)
+	return uniqueViolation(err)
+}
+
+// UpdateProfile saves the username, email address and external ID of a
+// user the directory manages as the directory has them, and replaces their
+// password hash unless passwordHash is empty. It returns ErrRecordNotFound
+// for administrators, and ErrDuplicateUsername, ErrDuplicateEmail or
+// ErrDuplicateExternalID if another user has the same one.
+func (m *UserModel) UpdateProfile(ctx context.Context, user *User, passwordHash string) error {
+	query := `
+		UPDATE users SET username = $1, email = $2, external_id = NULLIF($3, ''),
+			password_hash = COALESCE(NULLIF($4, ''), password_hash), updated_at = NOW()
+		WHERE id = $5 AND role = $6
+		RETURNING updated_at`
+	err := m.DB.QueryRowContext(ctx, query, user.Username, user.Email, user.ExternalID, passwordHash, user.ID, provisionedRole).
+		Scan(&user.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrRecordNotFound
+	}
+	return uniqueViolation(err)
+}
+
+// Deactivate stops a user the directory manages from signing in, keeping
+// their notes, and revokes the access they gave apps and their unused
+// sign-in links. Their sessions end on their next request. Deactivating a
+// user again keeps the original time. It returns ErrRecordNotFound for
+// administrators.
+func (m *UserModel) Deactivate(ctx context.Context, id int) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE users SET deactivated_at = COALESCE(deactivated_at, NOW()), updated_at = NOW() WHERE id = $1 AND role = $2`
+	result, err := tx.ExecContext(ctx, query, id, provisionedRole)
+	if err != nil {
+		return err
+	}
+	if err := requireRow(result); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM oauth_grants WHERE user_id = $1`, id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM login_links WHERE user_id = $1`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Reactivate lets a deactivated user the directory manages sign in again.
+// It returns ErrRecordNotFound for administrators.
+func (m *UserModel) Reactivate(ctx context.Context, id int) error {
+	query := `UPDATE users SET deactivated_at = NULL, updated_at = NOW() WHERE id = $1 AND role = $2`
+	result, err := m.DB.ExecContext(ctx, query, id, provisionedRole)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
+
+// uniqueViolation maps violations of the users' unique constraints to
+// ErrDuplicateUsername, ErrDuplicateEmail and ErrDuplicateExternalID
+func uniqueViolation(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		switch pqErr.Constraint {
+		case "users_username_key":
+			return ErrDuplicateUsername
+		case "users_email_key":
+			return ErrDuplicateEmail
+		case "users_external_id_key":
+			return ErrDuplicateExternalID
+		}
+	}
+	return err
+}
+
+// requireRow returns ErrRecordNotFound if an update touched no rows
+func requireRow(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
 // NewUserModel creates a new UserModel instance.
 func NewUserModel(db *sql.DB) *UserModel {
 	return &UserModel{DB: db}
@@ -0,0 +1,175 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testProvisioned adds a user as the directory would, with externalID, and
+// removes them when the test ends
+func testProvisioned(t *testing.T, m *Models, externalID string) *User {
+	t.Helper()
+	name := fmt.Sprintf("p%d", time.Now().UnixNano())
+	user := &User{Username: name, Email: name + "@Example.com", PasswordHash: "not-a-hash", Role: provisionedRole, ExternalID: externalID}
+	if err := m.Users.Provision(context.Background(), user); err != nil {
+		t.Fatalf("provisioning test user: %v", err)
+	}
+	t.Cleanup(func() { m.Users.DB.Exec(`DELETE FROM users WHERE id = $1`, user.ID) })
+	return user
+}
+
+func TestUserListFilters(t *testing.T) {
+	m := testModels(t)
+	ctx := context.Background()
+	user := testProvisioned(t, m, fmt.Sprintf("ext-%d", time.Now().UnixNano()))
+	admin := testUser(t, m, "admin")
+
+	tests := []struct {
+		name   string
+		filter UserFilter
+		want   int // ID of the only match, or 0 for none
+	}{
+		{"username", UserFilter{"username", user.Username}, user.ID},
+		{"username in another case", UserFilter{"username", strings.ToUpper(user.Username)}, user.ID},
+		{"email in another case", UserFilter{"email", strings.ToLower(user.Email)}, user.ID},
+		{"external ID", UserFilter{"external_id", user.ExternalID}, user.ID},
+		{"external ID in another case", UserFilter{"external_id", strings.ToUpper(user.ExternalID)}, 0},
+		{"administrator by username", UserFilter{"username", admin.Username}, 0},
+		{"administrator by email", UserFilter{"email", admin.Email}, 0},
+	}
+	for _, tt := range tests {
+		users, total, err := m.Users.List(ctx, tt.filter, 0, 10)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		switch {
+		case tt.want == 0 && (total != 0 || len(users) != 0):
+			t.Errorf("%s: got %d users (%d in all), expected none", tt.name, len(users), total)
+		case tt.want != 0 && (total != 1 || len(users) != 1 || users[0].ID != tt.want):
+			t.Errorf("%s: got %+v (%d in all), expected user %d", tt.name, users, total, tt.want)
+		}
+	}
+
+	// Paging past the end still counts the matches
+	if users, total, err := m.Users.List(ctx, UserFilter{"username", user.Username}, 1, 10); err != nil || total != 1 || users != nil {
+		t.Errorf("past the end: got %+v, %d, %v", users, total, err)
+	}
+	if _, _, err := m.Users.List(ctx, UserFilter{"role", "admin"}, 0, 10); err == nil {
+		t.Error("expected an error for an unsupported filter")
+	}
+	if got, err := m.Users.GetProvisioned(ctx, admin.ID); got != nil || err != nil {
+		t.Errorf("GetProvisioned returned an administrator: %+v, %v", got, err)
+	}
+}
+
+func TestUserProvision(t *testing.T) {
+	m := testModels(t)
+	ctx := context.Background()
+	user := testProvisioned(t, m, fmt.Sprintf("ext-%d", time.Now().UnixNano()))
+	if user.ID == 0 || user.CreatedAt.IsZero() {
+		t.Fatalf("Provision did not fill in the user: %+v", user)
+	}
+
+	name := fmt.Sprintf("q%d", time.Now().UnixNano())
+	tests := []struct {
+		name string
+		user User
+		want error
+	}{
+		{"username", User{Username: user.Username, Email: name + "@example.com", Role: provisionedRole}, ErrDuplicateUsername},
+		{"email", User{Username: name, Email: user.Email, Role: provisionedRole}, ErrDuplicateEmail},
+		{"external ID", User{Username: name, Email: name + "@example.com", Role: provisionedRole, ExternalID: user.ExternalID}, ErrDuplicateExternalID},
+	}
+	for _, tt := range tests {
+		dup := tt.user
+		dup.PasswordHash = "not-a-hash"
+		if err := m.Users.Provision(ctx, &dup); !errors.Is(err, tt.want) {
+			t.Errorf("duplicate %s: got %v, expected %v", tt.name, err, tt.want)
+			if err == nil {
+				m.Users.DB.Exec(`DELETE FROM users WHERE id = $1`, dup.ID)
+			}
+		}
+	}
+
+	// Users without an external ID do not clash with each other
+	for i := 0; i < 2; i++ {
+		testProvisioned(t, m, "")
+	}
+}
+
+func TestUserDeactivate(t *testing.T) {
+	m := testModels(t)
+	ctx := context.Background()
+	user := testProvisioned(t, m, "")
+	admin := testUser(t, m, "admin")
+
+	client, _, err := m.OAuth.CreateClient(ctx, "Test app", []string{"https://app.example.com/callback"}, true, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.OAuth.DeleteClient(context.Background(), client.ID) })
+	grantID, err := m.OAuth.SaveGrant(ctx, user.ID, client.ID, "notes:read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	access, _, err := m.OAuth.IssueTokens(ctx, grantID, "notes:read", time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := m.LoginLinks.Request(ctx, user.ID, "nonce", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Users.Deactivate(ctx, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	got, err := m.Users.GetProvisioned(ctx, user.ID)
+	if err != nil || got == nil || got.DeactivatedAt == nil {
+		t.Fatalf("after Deactivate: got %+v, %v", got, err)
+	}
+	if _, err := m.OAuth.Token(ctx, access); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("app token survived deactivation: %v", err)
+	}
+	if grants, err := m.OAuth.Grants(ctx, user.ID); err != nil || len(grants) != 0 {
+		t.Errorf("grants after deactivation: %+v, %v", grants, err)
+	}
+	if _, err := m.LoginLinks.Consume(ctx, link, "nonce"); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("sign-in link survived deactivation: %v", err)
+	}
+
+	// Deactivating again keeps the original time
+	first := *got.DeactivatedAt
+	if err := m.Users.Deactivate(ctx, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := m.Users.GetProvisioned(ctx, user.ID); again == nil || again.DeactivatedAt == nil || !again.DeactivatedAt.Equal(first) {
+		t.Errorf("deactivating again moved the time from %v to %+v", first, again)
+	}
+
+	if err := m.Users.Reactivate(ctx, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := m.Users.GetProvisioned(ctx, user.ID); got == nil || got.DeactivatedAt != nil {
+		t.Errorf("after Reactivate: got %+v", got)
+	}
+
+	// Administrators are out of the directory's reach
+	if err := m.Users.Deactivate(ctx, admin.ID); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("deactivating an administrator: got %v, expected ErrRecordNotFound", err)
+	}
+	if err := m.Users.Reactivate(ctx, admin.ID); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("reactivating an administrator: got %v, expected ErrRecordNotFound", err)
+	}
+	if err := m.Users.UpdateProfile(ctx, admin, "new-hash"); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("updating an administrator: got %v, expected ErrRecordNotFound", err)
+	}
+	if got, err := m.Users.Get(ctx, admin.ID); err != nil || got == nil || got.DeactivatedAt != nil || got.PasswordHash != admin.PasswordHash {
+		t.Errorf("administrator changed: %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,113 @@
+// Package httperr defines the error handlers use to fail a request: an HTTP
+// status, a message that is safe to show the user and the internal cause,
+// which is only ever logged.
+package httperr
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Error is a failed request
+type Error struct {
+	Status  int    // HTTP status code
+	Message string // Shown to the user; never contains internal details
+	Err     error  // Internal cause for the logs, may be nil
+}
+
+// Error describes the error for the logs, including the cause
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%d %s: %v", e.Status, e.Message, e.Err)
+	}
+	return fmt.Sprintf("%d %s", e.Status, e.Message)
+}
+
+// Unwrap returns the internal cause
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Title is the standard status text, e.g. "Not Found"
+func (e *Error) Title() string {
+	return http.StatusText(e.Status)
+}
+
+// New returns an error with status and message. An empty message is replaced
+// by the default message for the status.
+func New(status int, message string) *Error {
+	if message == "" {
+		message = DefaultMessage(status)
+	}
+	return &Error{Status: status, Message: message}
+}
+
+// Wrap returns an error with status and message caused by err
+func Wrap(status int, message string, err error) *Error {
+	e := New(status, message)
+	e.Err = err
+	return e
+}
+
+// BadRequest is a 400 error with message
+func BadRequest(message string) *Error {
+	return New(http.StatusBadRequest, message)
+}
+
+// Forbidden is a 403 error with message
+func Forbidden(message string) *Error {
+	return New(http.StatusForbidden, message)
+}
+
+// NotFound is a 404 error
+func NotFound() *Error {
+	return New(http.StatusNotFound, "")
+}
+
+// MethodNotAllowed is a 405 error
+func MethodNotAllowed() *Error {
+	return New(http.StatusMethodNotAllowed, "")
+}
+
+// Internal is a 500 error caused by err. The user only sees a generic message.
+func Internal(err error) *Error {
+	return Wrap(http.StatusInternalServerError, "", err)
+}
+
+// From returns err as an *Error. Errors that are not one, or do not wrap one,
+// become internal errors.
+func From(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return Internal(err)
+}
+
+// DefaultMessage is the message shown for status when the handler gives none
+func DefaultMessage(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "We couldn't understand that request."
+	case http.StatusUnauthorized:
+		return "Please sign in to continue."
+	case http.StatusForbidden:
+		return "You don't have permission to do that."
+	case http.StatusNotFound:
+		return "We couldn't find what you were looking for."
+	case http.StatusMethodNotAllowed:
+		return "That action isn't supported here."
+	case http.StatusRequestEntityTooLarge:
+		return "That request was too large."
+	case http.StatusTooManyRequests:
+		return "You're going a little fast. Please wait a moment and try again."
+	}
+	if status >= 500 {
+		return "Something went wrong on our side. Please try again later."
+	}
+	return http.StatusText(status)
+}
@@ -0,0 +1,34 @@
+package httperr
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestFrom(t *testing.T) {
+	if From(nil) != nil {
+		t.Error("From(nil) should be nil")
+	}
+
+	// Plain errors become 500s and keep their cause out of the message
+	cause := errors.New("pq: connection refused")
+	e := From(cause)
+	if e.Status != http.StatusInternalServerError || !errors.Is(e, cause) {
+		t.Errorf("got %v", e)
+	}
+	if e.Message != DefaultMessage(http.StatusInternalServerError) {
+		t.Errorf("internal cause leaked into message %q", e.Message)
+	}
+
+	// Wrapped *Errors are found
+	nf := NotFound()
+	if got := From(fmt.Errorf("loading note: %w", nf)); got != nf {
+		t.Errorf("got %v, want the wrapped 404", got)
+	}
+
+	if got := BadRequest("").Message; got != DefaultMessage(http.StatusBadRequest) {
+		t.Errorf("empty message not defaulted: %q", got)
+	}
+}
@@ -0,0 +1,296 @@
+// Package i18n translates the user interface. Each supported locale has a
+// message catalog in locales/<locale>.toml; the first locale loaded is the
+// default and the fallback for messages a catalog lacks.
+//
+// Catalogs map dotted keys to messages. A message is either a string or, when
+// it depends on a count, a table of CLDR plural forms (zero, one, two, few,
+// many, other) of which "other" is required:
+//
+//	[nav]
+//	home = "Home"
+//
+//	[notes.count]
+//	one = "{count} note"
+//	other = "{count} notes"
+//
+// {name} placeholders are filled from the arguments given to Translator.T.
+package i18n
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/text/feature/plural"
+	"golang.org/x/text/language"
+)
+
+//go:embed locales/*.toml
+var locales embed.FS
+
+// DefaultLocale is the locale used when nothing better matches
+const DefaultLocale = "en"
+
+// forms maps catalog table keys to plural forms
+var forms = map[string]plural.Form{
+	"zero":  plural.Zero,
+	"one":   plural.One,
+	"two":   plural.Two,
+	"few":   plural.Few,
+	"many":  plural.Many,
+	"other": plural.Other,
+}
+
+// message is one entry of a catalog. Plain messages only have Other.
+type message map[plural.Form]string
+
+// catalog holds the messages of one locale by key
+type catalog map[string]message
+
+// Bundle holds the catalogs of every supported locale
+type Bundle struct {
+	tags     []language.Tag // supported locales, the default first
+	catalogs map[string]catalog
+	matcher  language.Matcher
+}
+
+// Load reads the catalogs shipped with the application
+func Load() (*Bundle, error) {
+	return LoadFS(locales, DefaultLocale)
+}
+
+// LoadFS reads every locales/*.toml catalog in fsys. def names the default
+// locale, which must be among them.
+func LoadFS(fsys fs.FS, def string) (*Bundle, error) {
+	files, err := fs.Glob(fsys, "locales/*.toml")
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Bundle{catalogs: map[string]catalog{}}
+	for _, file := range files {
+		locale := strings.TrimSuffix(path.Base(file), ".toml")
+		tag, err := language.Parse(locale)
+		if err != nil {
+			return nil, fmt.Errorf("i18n: %s: %w", file, err)
+		}
+		var raw map[string]any
+		if _, err := toml.DecodeFS(fsys, file, &raw); err != nil {
+			return nil, fmt.Errorf("i18n: %s: %w", file, err)
+		}
+		cat := catalog{}
+		if err := flatten(cat, "", raw); err != nil {
+			return nil, fmt.Errorf("i18n: %s: %w", file, err)
+		}
+
+		b.catalogs[tag.String()] = cat
+		if tag.String() == def {
+			b.tags = append([]language.Tag{tag}, b.tags...)
+		} else {
+			b.tags = append(b.tags, tag)
+		}
+	}
+	if _, ok := b.catalogs[def]; !ok {
+		return nil, fmt.Errorf("i18n: no catalog for default locale %q", def)
+	}
+	b.matcher = language.NewMatcher(b.tags)
+	return b, nil
+}
+
+// flatten adds the messages in raw to cat with dotted keys
+func flatten(cat catalog, prefix string, raw map[string]any) error {
+	for k, v := range raw {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		switch v := v.(type) {
+		case string:
+			cat[key] = message{plural.Other: v}
+		case map[string]any:
+			if msg, ok := pluralMessage(v); ok {
+				cat[key] = msg
+				continue
+			}
+			if err := flatten(cat, key, v); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s: message must be a string or a table, not %T", key, v)
+		}
+	}
+	return nil
+}
+
+// pluralMessage reads a table of plural forms. Tables with other keys are
+// sections, not messages.
+func pluralMessage(raw map[string]any) (message, bool) {
+	if _, ok := raw["other"]; !ok {
+		return nil, false
+	}
+	msg := message{}
+	for k, v := range raw {
+		form, ok := forms[k]
+		s, isString := v.(string)
+		if !ok || !isString {
+			return nil, false
+		}
+		msg[form] = s
+	}
+	return msg, true
+}
+
+// Locales lists the supported locales, the default first
+func (b *Bundle) Locales() []string {
+	out := make([]string, len(b.tags))
+	for i, tag := range b.tags {
+		out[i] = tag.String()
+	}
+	return out
+}
+
+// Supported reports whether there is a catalog for locale
+func (b *Bundle) Supported(locale string) bool {
+	_, ok := b.catalogs[locale]
+	return ok
+}
+
+// Negotiate picks the locale for a request: preferred (e.g. the user's saved
+// choice) when it is supported, otherwise the best match for the
+// Accept-Language header, otherwise the default.
+func (b *Bundle) Negotiate(preferred, acceptLanguage string) string {
+	if b.Supported(preferred) {
+		return preferred
+	}
+	prefs, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err != nil || len(prefs) == 0 {
+		return b.tags[0].String()
+	}
+	_, index, confidence := b.matcher.Match(prefs...)
+	if confidence == language.No {
+		return b.tags[0].String()
+	}
+	return b.tags[index].String()
+}
+
+// Translator returns the translator for locale, or for the default locale if
+// locale is not supported
+func (b *Bundle) Translator(locale string) *Translator {
+	if !b.Supported(locale) {
+		locale = b.tags[0].String()
+	}
+	return &Translator{
+		tag:      language.Make(locale),
+		catalog:  b.catalogs[locale],
+		fallback: b.catalogs[b.tags[0].String()],
+	}
+}
+
+// Keys lists the message keys of locale in order
+func (b *Bundle) Keys(locale string) []string {
+	keys := make([]string, 0, len(b.catalogs[locale]))
+	for k := range b.catalogs[locale] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Translator translates messages into one locale
+type Translator struct {
+	tag      language.Tag
+	catalog  catalog
+	fallback catalog
+}
+
+// Locale returns the translator's locale, e.g. "en"
+func (t *Translator) Locale() string {
+	return t.tag.String()
+}
+
+// Has reports whether key is in the catalog or the default catalog
+func (t *Translator) Has(key string) bool {
+	_, ok := t.lookup(key)
+	return ok
+}
+
+// T translates key. args are name/value pairs filling {name} placeholders; a
+// "count" argument also picks the plural form. Unknown keys are returned
+// unchanged, so literal text passes through.
+func (t *Translator) T(key string, args ...any) string {
+	msg, ok := t.lookup(key)
+	if !ok {
+		return key
+	}
+
+	text := msg[plural.Other]
+	if n, ok := count(args); ok && len(msg) > 1 {
+		// An explicit zero form is used for 0 even in languages whose CLDR
+		// rules have none, so catalogs can say "no notes" rather than "0 notes"
+		zero, hasZero := msg[plural.Zero]
+		if n == 0 && hasZero {
+			text = zero
+		} else if s, ok := msg[plural.Cardinal.MatchPlural(t.tag, n, 0, 0, 0, 0)]; ok {
+			text = s
+		}
+	}
+
+	if len(args) < 2 || !strings.Contains(text, "{") {
+		return text
+	}
+	pairs := make([]string, 0, len(args))
+	for i := 0; i+1 < len(args); i += 2 {
+		pairs = append(pairs, "{"+fmt.Sprint(args[i])+"}", fmt.Sprint(args[i+1]))
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+// lookup finds key in the catalog, falling back to the default catalog
+func (t *Translator) lookup(key string) (message, bool) {
+	if msg, ok := t.catalog[key]; ok {
+		return msg, true
+	}
+	msg, ok := t.fallback[key]
+	return msg, ok
+}
+
+// count returns the "count" argument
+func count(args []any) (int, bool) {
+	for i := 0; i+1 < len(args); i += 2 {
+		if args[i] == "count" {
+			n, ok := args[i+1].(int)
+			return n, ok
+		}
+	}
+	return 0, false
+}
+
+// Date formats t as a localized date using the "date.format" message, e.g.
+// "{month} {day}, {year}", with month names from "date.month.1" to "date.month.12"
+func (t *Translator) Date(d time.Time) string {
+	return t.T("date.format",
+		"month", t.T(fmt.Sprintf("date.month.%d", int(d.Month()))),
+		"day", d.Day(),
+		"year", d.Year(),
+	)
+}
+
+// contextKey is the context key for the request's translator
+type contextKey struct{}
+
+// WithTranslator returns a copy of ctx carrying t
+func WithTranslator(ctx context.Context, t *Translator) context.Context {
+	return context.WithValue(ctx, contextKey{}, t)
+}
+
+// FromContext returns the translator stored by WithTranslator, or nil
+func FromContext(ctx context.Context) *Translator {
+	t, _ := ctx.Value(contextKey{}).(*Translator)
+	return t
+}
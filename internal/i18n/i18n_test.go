@@ -0,0 +1,167 @@
+package i18n
+
+import (
+	"regexp"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/darynforman/gratitude-jar1/internal/validator"
+)
+
+var placeholder = regexp.MustCompile(`\{[a-z_]+\}`)
+
+// placeholders returns the sorted, distinct placeholders in every form of msg
+func placeholders(msg message) []string {
+	seen := map[string]bool{}
+	for _, text := range msg {
+		for _, p := range placeholder.FindAllString(text, -1) {
+			seen[p] = true
+		}
+	}
+	out := make([]string, 0, len(seen))
+	for p := range seen {
+		out = append(out, p)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// TestCatalogsComplete checks every catalog has exactly the default
+// catalog's keys, with the same placeholders
+func TestCatalogsComplete(t *testing.T) {
+	b, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Locales()) < 2 {
+		t.Fatalf("expected at least two locales, got %v", b.Locales())
+	}
+
+	def := b.catalogs[DefaultLocale]
+	for _, locale := range b.Locales()[1:] {
+		cat := b.catalogs[locale]
+		for key, msg := range def {
+			translated, ok := cat[key]
+			if !ok {
+				t.Errorf("%s: missing %s", locale, key)
+				continue
+			}
+			if want, got := placeholders(msg), placeholders(translated); !equal(want, got) {
+				t.Errorf("%s: %s has placeholders %v, want %v", locale, key, got, want)
+			}
+		}
+		for key := range cat {
+			if _, ok := def[key]; !ok {
+				t.Errorf("%s: %s is not in the %s catalog", locale, key, DefaultLocale)
+			}
+		}
+	}
+}
+
+// TestValidatorKeys checks that the validator's message keys are translated
+func TestValidatorKeys(t *testing.T) {
+	b, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := b.Translator(DefaultLocale)
+
+	validators := []*validator.Validator{
+		validator.ValidateGratitudeNote("", "", "", ""),
+		validator.ValidateGratitudeNote("ab", "short", "nope", "not an emoji at all"),
+		validator.ValidatePassword("short"),
+		validator.ValidatePassword("alllowercaseletters"),
+		validator.ValidateRegistration("", "", "x", "y"),
+		validator.ValidateRegistration("ab", "no-at-sign", "Password1!", "Password1!"),
+		validator.ValidatePasswordChange("", "short", "other"),
+		validator.ValidatePasswordChange("Password1!", "Password1!", "Password1!"),
+	}
+	// One weak password for each strength warning, and one with none
+	for _, password := range []string{"Password1!", "faith", "ana.example", "zxcvbnm,./", "abcdefgh", "zzzzzzzz", "1987", "kT9#"} {
+		v := validator.NewValidator()
+		v.PasswordStrength("password", password, 3, "ana", "ana@example.com")
+		validators = append(validators, v)
+	}
+	for _, v := range validators {
+		for field, key := range v.Errors {
+			if !tr.Has(key) {
+				t.Errorf("%s: no message for %s", field, key)
+			}
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	b, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	en, es := b.Translator("en"), b.Translator("es")
+
+	tests := []struct {
+		tr   *Translator
+		key  string
+		args []any
+		want string
+	}{
+		{en, "notes.count", []any{"count", 0}, "No notes yet. Add your first one!"},
+		{en, "notes.count", []any{"count", 1}, "1 note"},
+		{en, "notes.count", []any{"count", 5}, "5 notes"},
+		{es, "notes.count", []any{"count", 1}, "1 nota"},
+		{es, "notes.count", []any{"count", 2}, "2 notas"},
+		{en, "validation.title.too_short", []any{"count", 3}, "Title must be at least 3 characters long"},
+		{en, "admin.flash.added", []any{"action", "deny", "network", "10.0.0.0/8"}, "Added deny rule for 10.0.0.0/8."},
+		{es, "nav.home", nil, "Inicio"},
+		{en, "Some literal text.", nil, "Some literal text."},
+	}
+	for _, tt := range tests {
+		if got := tt.tr.T(tt.key, tt.args...); got != tt.want {
+			t.Errorf("%s: T(%q, %v) = %q, want %q", tt.tr.Locale(), tt.key, tt.args, got, tt.want)
+		}
+	}
+
+	day := time.Date(2024, time.March, 29, 0, 0, 0, 0, time.UTC)
+	if got := en.Date(day); got != "Mar 29, 2024" {
+		t.Errorf("en date: %q", got)
+	}
+	if got := es.Date(day); got != "29 mar 2024" {
+		t.Errorf("es date: %q", got)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	b, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		preferred, acceptLanguage, want string
+	}{
+		{"", "", "en"},
+		{"", "es-MX,es;q=0.9,en;q=0.8", "es"},
+		{"", "fr-FR,fr;q=0.9", "en"},
+		{"", "fr;q=0.9,es;q=0.5", "es"},
+		{"en", "es", "en"},
+		{"xx", "es", "es"},
+		{"", "not a header;;", "en"},
+	}
+	for _, tt := range tests {
+		if got := b.Negotiate(tt.preferred, tt.acceptLanguage); got != tt.want {
+			t.Errorf("Negotiate(%q, %q) = %q, want %q", tt.preferred, tt.acceptLanguage, got, tt.want)
+		}
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,325 @@
+// Package ipfilter blocks requests by client IP.
+//
+// Rules are CIDR allow and deny entries. Allow entries win: an allowed
+// address is never denied or banned, which keeps office networks and health
+// checkers reachable. Deny entries may expire; automatic bans are simply
+// expiring deny entries for a single address, created when a client collects
+// too many strikes (rate limit violations, CSRF failures, failed logins)
+// within a window.
+package ipfilter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRuleNotFound is returned when removing a rule that does not exist
+var ErrRuleNotFound = errors.New("ip rule not found")
+
+// Action is what happens to requests matching a rule
+type Action string
+
+const (
+	Allow Action = "allow"
+	Deny  Action = "deny"
+)
+
+// Rule allows or denies a network
+type Rule struct {
+	ID        int
+	Prefix    netip.Prefix
+	Action    Action
+	Reason    string
+	CreatedBy string // username of the admin, or "system" for automatic bans
+	CreatedAt time.Time
+	ExpiresAt time.Time // zero for permanent rules
+	Static    bool      // from configuration; cannot be removed at runtime
+}
+
+// Expired reports whether the rule no longer applies at now
+func (r Rule) Expired(now time.Time) bool {
+	return !r.ExpiresAt.IsZero() && !now.Before(r.ExpiresAt)
+}
+
+// Store persists the rules managed at runtime
+type Store interface {
+	// List returns all rules that have not expired
+	List(ctx context.Context) ([]Rule, error)
+	// Insert stores rule and sets its ID and CreatedAt
+	Insert(ctx context.Context, rule *Rule) error
+	// Delete removes the rule with the given ID and returns it
+	Delete(ctx context.Context, id int) (Rule, error)
+	// DeleteExpired removes and returns the rules that expired before now
+	DeleteExpired(ctx context.Context, now time.Time) ([]Rule, error)
+}
+
+// Options configures a Filter
+type Options struct {
+	Allow []string // static allow list (CIDRs or addresses)
+	Deny  []string // static deny list (CIDRs or addresses)
+
+	BanThreshold int           // strikes within BanWindow that trigger a ban; 0 disables bans
+	BanWindow    time.Duration // how long strikes are remembered
+	BanDuration  time.Duration // how long an automatic ban lasts
+}
+
+// strikes counts offences by one address within the ban window
+type strikes struct {
+	count int
+	first time.Time
+}
+
+// Filter decides whether client addresses may reach the application
+type Filter struct {
+	store  Store
+	static []Rule
+	opts   Options
+	now    func() time.Time
+
+	mu      sync.RWMutex
+	rules   []Rule // runtime rules from the store
+	strikes map[netip.Addr]*strikes
+}
+
+// New creates a filter with the static rules from opts and loads the runtime
+// rules from store
+func New(ctx context.Context, store Store, opts Options) (*Filter, error) {
+	f := &Filter{
+		store:   store,
+		opts:    opts,
+		now:     time.Now,
+		strikes: make(map[netip.Addr]*strikes),
+	}
+	for _, list := range []struct {
+		action Action
+		items  []string
+	}{{Allow, opts.Allow}, {Deny, opts.Deny}} {
+		for _, s := range list.items {
+			prefix, err := ParsePrefix(s)
+			if err != nil {
+				return nil, err
+			}
+			f.static = append(f.static, Rule{Prefix: prefix, Action: list.action, Reason: "configuration", Static: true})
+		}
+	}
+	if err := f.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// ParsePrefix parses a CIDR ("10.0.0.0/8") or a single address, which becomes
+// a /32 or /128 prefix
+func ParsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid IP or CIDR %q", s)
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP or CIDR %q", s)
+	}
+	return prefix.Masked(), nil
+}
+
+// Reload replaces the runtime rules with the current contents of the store
+func (f *Filter) Reload(ctx context.Context) error {
+	rules, err := f.store.List(ctx)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.rules = rules
+	f.mu.Unlock()
+	return nil
+}
+
+// Blocked reports whether ip may not reach the application and, if so, the
+// deny rule responsible. Addresses that do not parse are let through.
+func (f *Filter) Blocked(ip string) (Rule, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return Rule{}, false
+	}
+	addr = addr.Unmap()
+	now := f.now()
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	var deny *Rule
+	for _, rules := range [][]Rule{f.static, f.rules} {
+		for i := range rules {
+			rule := &rules[i]
+			if rule.Expired(now) || !rule.Prefix.Contains(addr) {
+				continue
+			}
+			if rule.Action == Allow {
+				return Rule{}, false
+			}
+			if deny == nil {
+				deny = rule
+			}
+		}
+	}
+	if deny != nil {
+		return *deny, true
+	}
+	return Rule{}, false
+}
+
+// Strike records an offence by ip. When the address reaches the ban
+// threshold within the window it is banned and the new ban is returned.
+func (f *Filter) Strike(ctx context.Context, ip, reason string) (*Rule, error) {
+	if f.opts.BanThreshold <= 0 {
+		return nil, nil
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, nil
+	}
+	addr = addr.Unmap()
+	if _, blocked := f.Blocked(addr.String()); blocked || f.allowed(addr) {
+		return nil, nil
+	}
+
+	now := f.now()
+	f.mu.Lock()
+	s, ok := f.strikes[addr]
+	if !ok || now.Sub(s.first) > f.opts.BanWindow {
+		s = &strikes{first: now}
+		f.strikes[addr] = s
+	}
+	s.count++
+	reached := s.count >= f.opts.BanThreshold
+	if reached {
+		delete(f.strikes, addr)
+	}
+	f.mu.Unlock()
+
+	if !reached {
+		return nil, nil
+	}
+	rule := Rule{
+		Prefix:    netip.PrefixFrom(addr, addr.BitLen()),
+		Action:    Deny,
+		Reason:    fmt.Sprintf("automatic ban: %d strikes, last: %s", f.opts.BanThreshold, reason),
+		CreatedBy: "system",
+		ExpiresAt: now.Add(f.opts.BanDuration),
+	}
+	if err := f.Add(ctx, &rule); err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// allowed reports whether addr matches an unexpired allow rule
+func (f *Filter) allowed(addr netip.Addr) bool {
+	now := f.now()
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, rules := range [][]Rule{f.static, f.rules} {
+		for _, rule := range rules {
+			if rule.Action == Allow && !rule.Expired(now) && rule.Prefix.Contains(addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Add stores a runtime rule and applies it immediately
+func (f *Filter) Add(ctx context.Context, rule *Rule) error {
+	if rule.Action != Allow && rule.Action != Deny {
+		return fmt.Errorf("invalid action %q", rule.Action)
+	}
+	if err := f.store.Insert(ctx, rule); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.rules = append(f.rules, *rule)
+	f.mu.Unlock()
+	return nil
+}
+
+// Remove deletes a runtime rule, lifting a ban or an allowance
+func (f *Filter) Remove(ctx context.Context, id int) (Rule, error) {
+	rule, err := f.store.Delete(ctx, id)
+	if err != nil {
+		return Rule{}, err
+	}
+	f.mu.Lock()
+	for i := range f.rules {
+		if f.rules[i].ID == id {
+			f.rules = append(f.rules[:i:i], f.rules[i+1:]...)
+			break
+		}
+	}
+	f.mu.Unlock()
+	return rule, nil
+}
+
+// Rules returns the static rules followed by the unexpired runtime rules
+func (f *Filter) Rules() []Rule {
+	now := f.now()
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	rules := append([]Rule(nil), f.static...)
+	for _, rule := range f.rules {
+		if !rule.Expired(now) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// Maintain deletes expired rules, forgets old strikes and reloads the rules
+// from the store, so that bans made by other instances take effect. Expired
+// rules are returned so the caller can record them.
+func (f *Filter) Maintain(ctx context.Context) ([]Rule, error) {
+	now := f.now()
+	f.mu.Lock()
+	for addr, s := range f.strikes {
+		if now.Sub(s.first) > f.opts.BanWindow {
+			delete(f.strikes, addr)
+		}
+	}
+	f.mu.Unlock()
+
+	expired, err := f.store.DeleteExpired(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	return expired, f.Reload(ctx)
+}
+
+// RunMaintenance calls Maintain every interval until ctx is cancelled,
+// passing expired rules to onExpired
+func (f *Filter) RunMaintenance(ctx context.Context, interval time.Duration, onExpired func(Rule), onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			expired, err := f.Maintain(ctx)
+			if err != nil {
+				onError(err)
+			}
+			for _, rule := range expired {
+				onExpired(rule)
+			}
+		}
+	}
+}
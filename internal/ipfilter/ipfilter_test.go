@@ -0,0 +1,88 @@
+package ipfilter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAllowOverridesDeny(t *testing.T) {
+	f, err := New(context.Background(), NewMemoryStore(), Options{
+		Allow: []string{"10.1.0.0/16"},
+		Deny:  []string{"10.0.0.0/8", "2001:db8::/32"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]bool{
+		"10.2.3.4":        true,
+		"10.1.3.4":        false,
+		"192.0.2.1":       false,
+		"2001:db8::1":     true,
+		"::ffff:10.9.9.9": true,
+		"not an ip":       false,
+	}
+	for ip, want := range tests {
+		if _, got := f.Blocked(ip); got != want {
+			t.Errorf("Blocked(%q) = %v, expected %v", ip, got, want)
+		}
+	}
+}
+
+func TestStrikesBanAndExpire(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	f, err := New(ctx, store, Options{
+		Allow:        []string{"192.0.2.10"},
+		BanThreshold: 3,
+		BanWindow:    time.Minute,
+		BanDuration:  time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	f.now = func() time.Time { return now }
+
+	for i := 1; i <= 3; i++ {
+		ban, err := f.Strike(ctx, "192.0.2.1", "failed login")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (ban != nil) != (i == 3) {
+			t.Fatalf("strike %d: ban = %v", i, ban)
+		}
+	}
+	if _, blocked := f.Blocked("192.0.2.1"); !blocked {
+		t.Fatal("expected 192.0.2.1 to be banned")
+	}
+
+	// Allowed addresses are never banned
+	for i := 0; i < 5; i++ {
+		if ban, _ := f.Strike(ctx, "192.0.2.10", "failed login"); ban != nil {
+			t.Fatal("allowed address was banned")
+		}
+	}
+
+	// Strikes outside the window start over
+	f.Strike(ctx, "192.0.2.2", "csrf")
+	f.Strike(ctx, "192.0.2.2", "csrf")
+	now = now.Add(2 * time.Minute)
+	if ban, _ := f.Strike(ctx, "192.0.2.2", "csrf"); ban != nil {
+		t.Fatal("expected old strikes to be forgotten")
+	}
+
+	// The ban lifts once it expires
+	now = now.Add(time.Hour)
+	if _, blocked := f.Blocked("192.0.2.1"); blocked {
+		t.Fatal("expected ban to have expired")
+	}
+	expired, err := f.Maintain(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0].Prefix.String() != "192.0.2.1/32" {
+		t.Fatalf("expired = %v", expired)
+	}
+}
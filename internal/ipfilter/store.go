@@ -0,0 +1,76 @@
+package ipfilter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps runtime rules in memory. Rules are lost on restart; it
+// is meant for tests and for running without a database.
+type MemoryStore struct {
+	mu     sync.Mutex
+	rules  []Rule
+	nextID int
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{nextID: 1}
+}
+
+// List returns the unexpired rules
+func (s *MemoryStore) List(ctx context.Context) ([]Rule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var rules []Rule
+	for _, rule := range s.rules {
+		if !rule.Expired(now) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// Insert adds rule and assigns its ID
+func (s *MemoryStore) Insert(ctx context.Context, rule *Rule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rule.ID = s.nextID
+	s.nextID++
+	if rule.CreatedAt.IsZero() {
+		rule.CreatedAt = time.Now()
+	}
+	s.rules = append(s.rules, *rule)
+	return nil
+}
+
+// Delete removes the rule with the given ID
+func (s *MemoryStore) Delete(ctx context.Context, id int) (Rule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, rule := range s.rules {
+		if rule.ID == id {
+			s.rules = append(s.rules[:i:i], s.rules[i+1:]...)
+			return rule, nil
+		}
+	}
+	return Rule{}, ErrRuleNotFound
+}
+
+// DeleteExpired removes and returns the rules that expired before now
+func (s *MemoryStore) DeleteExpired(ctx context.Context, now time.Time) ([]Rule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var kept, expired []Rule
+	for _, rule := range s.rules {
+		if rule.Expired(now) {
+			expired = append(expired, rule)
+		} else {
+			kept = append(kept, rule)
+		}
+	}
+	s.rules = kept
+	return expired, nil
+}
@@ -0,0 +1,102 @@
+package ipfilter
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/netip"
+	"time"
+)
+
+// PostgresStore keeps runtime rules in the ip_rules table, so bans survive
+// restarts and are shared by every instance
+type PostgresStore struct {
+	DB *sql.DB
+}
+
+// NewPostgresStore creates a store on db; the ip_rules table comes from the migrations
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{DB: db}
+}
+
+// List returns the unexpired rules, oldest first
+func (s *PostgresStore) List(ctx context.Context) ([]Rule, error) {
+	query := `
+		SELECT id, cidr::text, action, reason, created_by, created_at, expires_at
+		FROM ip_rules
+		WHERE expires_at IS NULL OR expires_at > now()
+		ORDER BY id`
+	return s.query(ctx, query)
+}
+
+// Insert stores rule and sets its ID and CreatedAt
+func (s *PostgresStore) Insert(ctx context.Context, rule *Rule) error {
+	query := `
+		INSERT INTO ip_rules (cidr, action, reason, created_by, expires_at)
+		VALUES ($1::cidr, $2, $3, $4, $5)
+		RETURNING id, created_at`
+	return s.DB.QueryRowContext(ctx, query,
+		rule.Prefix.String(), string(rule.Action), rule.Reason, rule.CreatedBy, nullTime(rule.ExpiresAt),
+	).Scan(&rule.ID, &rule.CreatedAt)
+}
+
+// Delete removes the rule with the given ID and returns it
+func (s *PostgresStore) Delete(ctx context.Context, id int) (Rule, error) {
+	query := `
+		DELETE FROM ip_rules WHERE id = $1
+		RETURNING id, cidr::text, action, reason, created_by, created_at, expires_at`
+	rules, err := s.query(ctx, query, id)
+	if err != nil {
+		return Rule{}, err
+	}
+	if len(rules) == 0 {
+		return Rule{}, ErrRuleNotFound
+	}
+	return rules[0], nil
+}
+
+// DeleteExpired removes and returns the rules that expired before now
+func (s *PostgresStore) DeleteExpired(ctx context.Context, now time.Time) ([]Rule, error) {
+	query := `
+		DELETE FROM ip_rules WHERE expires_at <= $1
+		RETURNING id, cidr::text, action, reason, created_by, created_at, expires_at`
+	return s.query(ctx, query, now)
+}
+
+// query runs a statement returning ip_rules rows
+func (s *PostgresStore) query(ctx context.Context, query string, args ...any) ([]Rule, error) {
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []Rule
+	for rows.Next() {
+		var (
+			rule      Rule
+			cidr      string
+			action    string
+			expiresAt sql.NullTime
+		)
+		if err := rows.Scan(&rule.ID, &cidr, &action, &rule.Reason, &rule.CreatedBy, &rule.CreatedAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, errors.New("ip_rules: invalid cidr " + cidr)
+		}
+		rule.Prefix = prefix
+		rule.Action = Action(action)
+		if expiresAt.Valid {
+			rule.ExpiresAt = expiresAt.Time
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// nullTime maps the zero time to SQL NULL
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
@@ -0,0 +1,125 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageBytes(t *testing.T) {
+	msg := Message{
+		To:      "ana@example.com",
+		Subject: "Confirma tu correo",
+		Body:    "Hola,\nhttps://example.com/account/email/confirm?token=abc\n",
+	}
+	raw, err := msg.Bytes("Gratitude Jar <no-reply@example.com>", time.Date(2024, time.March, 29, 10, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"From: \"Gratitude Jar\" <no-reply@example.com>\r\n",
+		"To: <ana@example.com>\r\n",
+		"Subject: Confirma tu correo\r\n",
+		"Date: Fri, 29 Mar 2024 10:00:00 +0000\r\n",
+		"@example.com>\r\n",
+		"Content-Type: text/plain; charset=utf-8\r\n",
+		"\r\n\r\nHola,\r\nhttps://example.com/account/email/confirm?token=3Dabc\r\n",
+	} {
+		if !bytes.Contains(raw, []byte(want)) {
+			t.Errorf("message does not contain %q:\n%s", want, raw)
+		}
+	}
+
+	for _, bad := range []Message{
+		{To: "ana@example.com\r\nBcc: eve@example.com", Subject: "hi"},
+		{To: "ana@example.com", Subject: "hi\nBcc: eve@example.com"},
+		{To: "not an address", Subject: "hi"},
+	} {
+		if _, err := bad.Bytes("no-reply@example.com", time.Now()); err == nil {
+			t.Errorf("Bytes accepted %+v", bad)
+		}
+	}
+}
+
+// TestSMTPSend delivers a message to a minimal SMTP server
+func TestSMTPSend(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+
+		reply("220 localhost ESMTP")
+		var transcript strings.Builder
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			transcript.WriteString(line)
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"):
+				reply("250 localhost")
+			case cmd == "DATA":
+				reply("354 go ahead")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					transcript.WriteString(line)
+				}
+				reply("250 queued")
+			case cmd == "QUIT":
+				reply("221 bye")
+				received <- transcript.String()
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	s := &SMTP{Host: host, From: "no-reply@example.com", Timeout: 5 * time.Second}
+	s.Port, _ = net.LookupPort("tcp", port)
+
+	if err := s.Send(context.Background(), Message{To: "ana@example.com", Subject: "Hello", Body: "Hi Ana"}); err != nil {
+		t.Fatal(err)
+	}
+	transcript := <-received
+	for _, want := range []string{"MAIL FROM:<no-reply@example.com>", "RCPT TO:<ana@example.com>", "Subject: Hello", "Hi Ana"} {
+		if !strings.Contains(transcript, want) {
+			t.Errorf("transcript does not contain %q:\n%s", want, transcript)
+		}
+	}
+}
+
+func TestLogSend(t *testing.T) {
+	var buf bytes.Buffer
+	l := &Log{Logger: log.New(&buf, "", 0)}
+	if err := l.Send(context.Background(), Message{To: "ana@example.com", Subject: "Hello", Body: "link"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); !strings.Contains(got, "To: ana@example.com") || !strings.Contains(got, "link") {
+		t.Errorf("logged %q", got)
+	}
+}
@@ -0,0 +1,319 @@
+// Package migrate applies the embedded SQL migrations to the database.
+//
+// Applied state is kept in a schema_migrations table using the same layout as
+// the golang-migrate CLI (a single row holding the current version and a dirty
+// flag), so databases migrated with `make migrate-up` keep working.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// lockID is the key for the Postgres advisory lock that serializes runners
+// across instances. It is an arbitrary constant unique to this application.
+const lockID int64 = 7_361_482_905
+
+// ErrDirty is returned when a previous migration failed part way through
+var ErrDirty = errors.New("database is in a dirty migration state; fix it manually and run `migrate force <version>`")
+
+// ErrNoVersion is returned when a requested target version does not exist
+var ErrNoVersion = errors.New("no migration with that version")
+
+// Migration is a single numbered schema change with its up and down SQL
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status describes whether a migration has been applied
+type Status struct {
+	Migration
+	Applied bool
+}
+
+// Runner applies migrations from a filesystem to a database
+type Runner struct {
+	DB         *sql.DB
+	Migrations []Migration
+}
+
+var fileNameRE = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// New reads every migration in fsys and returns a Runner for db
+func New(db *sql.DB, fsys fs.FS) (*Runner, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, entry := range entries {
+		match := fileNameRE.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s: %v", entry.Name(), err)
+		}
+		body, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if match[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	r := &Runner{DB: db}
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+		}
+		r.Migrations = append(r.Migrations, *m)
+	}
+	sort.Slice(r.Migrations, func(i, j int) bool {
+		return r.Migrations[i].Version < r.Migrations[j].Version
+	})
+	return r, nil
+}
+
+// Up applies every pending migration
+func (r *Runner) Up(ctx context.Context) error {
+	if len(r.Migrations) == 0 {
+		return nil
+	}
+	return r.To(ctx, r.Migrations[len(r.Migrations)-1].Version)
+}
+
+// Down reverts the most recently applied migration
+func (r *Runner) Down(ctx context.Context) error {
+	return r.withLock(ctx, func(conn *sql.Conn) error {
+		current, err := currentVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		idx := r.index(current)
+		if idx < 0 {
+			return nil
+		}
+		return r.revert(ctx, conn, idx)
+	})
+}
+
+// To migrates up or down until version is the current version.
+// A version of 0 reverts every migration.
+func (r *Runner) To(ctx context.Context, version int64) error {
+	if version != 0 && r.index(version) < 0 {
+		return fmt.Errorf("%w: %d", ErrNoVersion, version)
+	}
+
+	return r.withLock(ctx, func(conn *sql.Conn) error {
+		current, err := currentVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i, m := range r.Migrations {
+			if m.Version > current && m.Version <= version {
+				if err := r.apply(ctx, conn, i); err != nil {
+					return err
+				}
+			}
+		}
+		for i := len(r.Migrations) - 1; i >= 0; i-- {
+			m := r.Migrations[i]
+			if m.Version <= current && m.Version > version {
+				if err := r.revert(ctx, conn, i); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Force records version as the current, clean version without running any SQL.
+// It is used to recover from a dirty state after fixing the schema by hand.
+func (r *Runner) Force(ctx context.Context, version int64) error {
+	return r.withLock(ctx, func(conn *sql.Conn) error {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := setVersion(ctx, tx, version); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// Status lists every known migration and whether it has been applied
+func (r *Runner) Status(ctx context.Context) ([]Status, error) {
+	var statuses []Status
+	err := r.withConn(ctx, func(conn *sql.Conn) error {
+		current, _, err := readVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range r.Migrations {
+			statuses = append(statuses, Status{Migration: m, Applied: m.Version <= current})
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// Version returns the current schema version and whether it is dirty
+func (r *Runner) Version(ctx context.Context) (version int64, dirty bool, err error) {
+	err = r.withConn(ctx, func(conn *sql.Conn) error {
+		version, dirty, err = readVersion(ctx, conn)
+		return err
+	})
+	return version, dirty, err
+}
+
+// apply runs the up migration at index i and records it in one transaction
+func (r *Runner) apply(ctx context.Context, conn *sql.Conn, i int) error {
+	m := r.Migrations[i]
+	log.Printf("Applying migration %d_%s", m.Version, m.Name)
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, m.Up); err != nil {
+		return fmt.Errorf("migration %d_%s up: %v", m.Version, m.Name, err)
+	}
+	if err := setVersion(ctx, tx, m.Version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// revert runs the down migration at index i and records the previous version
+func (r *Runner) revert(ctx context.Context, conn *sql.Conn, i int) error {
+	m := r.Migrations[i]
+	if m.Down == "" {
+		return fmt.Errorf("migration %d_%s has no down file", m.Version, m.Name)
+	}
+	log.Printf("Reverting migration %d_%s", m.Version, m.Name)
+
+	var previous int64
+	if i > 0 {
+		previous = r.Migrations[i-1].Version
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, m.Down); err != nil {
+		return fmt.Errorf("migration %d_%s down: %v", m.Version, m.Name, err)
+	}
+	if err := setVersion(ctx, tx, previous); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// index returns the position of version in r.Migrations, or -1
+func (r *Runner) index(version int64) int {
+	for i, m := range r.Migrations {
+		if m.Version == version {
+			return i
+		}
+	}
+	return -1
+}
+
+// withConn runs fn on a dedicated connection after making sure the
+// schema_migrations table exists
+func (r *Runner) withConn(ctx context.Context, fn func(*sql.Conn) error) error {
+	conn, err := r.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version BIGINT NOT NULL PRIMARY KEY,
+		dirty BOOLEAN NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+// withLock runs fn while holding the migration advisory lock. Session-level
+// advisory locks belong to a connection, so the lock and fn share conn.
+func (r *Runner) withLock(ctx context.Context, fn func(*sql.Conn) error) error {
+	return r.withConn(ctx, func(conn *sql.Conn) error {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockID); err != nil {
+			return fmt.Errorf("error acquiring migration lock: %v", err)
+		}
+		defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockID)
+
+		return fn(conn)
+	})
+}
+
+// currentVersion returns the applied version, refusing to continue if it is dirty
+func currentVersion(ctx context.Context, conn *sql.Conn) (int64, error) {
+	version, dirty, err := readVersion(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+	if dirty {
+		return 0, ErrDirty
+	}
+	return version, nil
+}
+
+// readVersion reads the single schema_migrations row; no row means version 0
+func readVersion(ctx context.Context, conn *sql.Conn) (int64, bool, error) {
+	var version int64
+	var dirty bool
+	err := conn.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	return version, dirty, err
+}
+
+// setVersion replaces the schema_migrations row with a clean version.
+// Version 0 leaves the table empty.
+func setVersion(ctx context.Context, tx *sql.Tx, version int64) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations`); err != nil {
+		return err
+	}
+	if version == 0 {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)`, version)
+	return err
+}
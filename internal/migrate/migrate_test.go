@@ -0,0 +1,59 @@
+package migrate
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/darynforman/gratitude-jar1/migrations"
+)
+
+// TestNewOrdersMigrations checks that files are paired and sorted by version
+func TestNewOrdersMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"000002_notes.up.sql":   {Data: []byte("CREATE TABLE notes ();")},
+		"000002_notes.down.sql": {Data: []byte("DROP TABLE notes;")},
+		"000001_users.up.sql":   {Data: []byte("CREATE TABLE users ();")},
+		"000001_users.down.sql": {Data: []byte("DROP TABLE users;")},
+		"README.md":             {Data: []byte("ignored")},
+	}
+
+	r, err := New(nil, fsys)
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+	if len(r.Migrations) != 2 {
+		t.Fatalf("got %d migrations, expected 2", len(r.Migrations))
+	}
+	if r.Migrations[0].Version != 1 || r.Migrations[1].Version != 2 {
+		t.Errorf("migrations not sorted: %d, %d", r.Migrations[0].Version, r.Migrations[1].Version)
+	}
+	if r.Migrations[1].Down != "DROP TABLE notes;" {
+		t.Errorf("got down SQL %q", r.Migrations[1].Down)
+	}
+}
+
+// TestNewRequiresUpFile checks that a down file without an up file is rejected
+func TestNewRequiresUpFile(t *testing.T) {
+	fsys := fstest.MapFS{
+		"000001_users.down.sql": {Data: []byte("DROP TABLE users;")},
+	}
+	if _, err := New(nil, fsys); err == nil {
+		t.Error("expected an error for a migration without an up file")
+	}
+}
+
+// TestEmbeddedMigrations checks that the shipped migrations are well formed
+func TestEmbeddedMigrations(t *testing.T) {
+	r, err := New(nil, migrations.FS)
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+	for i, m := range r.Migrations {
+		if m.Down == "" {
+			t.Errorf("migration %d_%s has no down file", m.Version, m.Name)
+		}
+		if i > 0 && r.Migrations[i-1].Version == m.Version {
+			t.Errorf("duplicate migration version %d", m.Version)
+		}
+	}
+}
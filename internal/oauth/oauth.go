@@ -0,0 +1,164 @@
+// Package oauth holds the protocol rules of the OAuth 2.0 authorization
+// server that lets third-party apps act on a user's notes: the scopes apps
+// can ask for, which redirect URIs may be registered and matched, and PKCE
+// (RFC 7636) verification.
+package oauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// The scopes apps can ask for. Reading and writing are granted separately,
+// so an app that only adds notes never sees the others.
+const (
+	ScopeNotesRead  = "notes:read"
+	ScopeNotesWrite = "notes:write"
+)
+
+// Scopes lists every scope in the order they are shown on the consent screen
+var Scopes = []string{ScopeNotesRead, ScopeNotesWrite}
+
+// ErrInvalidScope is returned for a scope parameter that is empty or names
+// a scope that does not exist
+var ErrInvalidScope = errors.New("oauth: invalid scope")
+
+// ParseScope splits a space-separated scope parameter into known scopes,
+// without duplicates and in the order of Scopes
+func ParseScope(s string) ([]string, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, ErrInvalidScope
+	}
+	for _, f := range fields {
+		if !slices.Contains(Scopes, f) {
+			return nil, fmt.Errorf("%w: unknown scope %q", ErrInvalidScope, f)
+		}
+	}
+	var scopes []string
+	for _, scope := range Scopes {
+		if slices.Contains(fields, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+// FormatScope joins scopes into a scope parameter
+func FormatScope(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+// Covers reports whether granted includes every requested scope
+func Covers(granted, requested []string) bool {
+	for _, scope := range requested {
+		if !slices.Contains(granted, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// Union returns the scopes in either a or b, in the order of Scopes
+func Union(a, b []string) []string {
+	var scopes []string
+	for _, scope := range Scopes {
+		if slices.Contains(a, scope) || slices.Contains(b, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// VerifyChallenge reports whether verifier is a well-formed PKCE code
+// verifier whose S256 challenge is challenge
+func VerifyChallenge(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	for _, c := range verifier {
+		if !isUnreserved(c) {
+			return false
+		}
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// ValidChallenge reports whether challenge looks like an S256 challenge, the
+// base64url encoding of a SHA-256 hash
+func ValidChallenge(challenge string) bool {
+	raw, err := base64.RawURLEncoding.DecodeString(challenge)
+	return err == nil && len(raw) == sha256.Size
+}
+
+// isUnreserved reports whether c may appear in a code verifier
+func isUnreserved(c rune) bool {
+	return c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.ContainsRune("-._~", c)
+}
+
+// CheckRedirectURI checks that uri may be registered as a redirect URI:
+// an absolute URI without a fragment that uses https, http on a loopback
+// address for apps running on the user's computer, or a private scheme such
+// as com.example.app for mobile apps (RFC 8252)
+func CheckRedirectURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() {
+		return errors.New("must be an absolute URI")
+	}
+	if u.Fragment != "" || strings.Contains(uri, "#") {
+		return errors.New("must not have a fragment")
+	}
+	switch u.Scheme {
+	case "https":
+		if u.Host == "" {
+			return errors.New("must name a host")
+		}
+	case "http":
+		if !isLoopback(u.Hostname()) {
+			return errors.New("must use https unless it is a loopback address")
+		}
+	case "javascript", "data", "file", "vbscript":
+		return fmt.Errorf("must not use the %s scheme", u.Scheme)
+	default:
+		// Private schemes are reverse domain names, so they cannot clash
+		// with another app's
+		if !strings.Contains(u.Scheme, ".") {
+			return errors.New("a private scheme must be a reverse domain name, such as com.example.app")
+		}
+	}
+	return nil
+}
+
+// MatchRedirectURI reports whether uri is one of the registered redirect
+// URIs. Matching is exact, except that apps listening on a loopback address
+// may use any port, since they pick a free one when they start (RFC 8252).
+func MatchRedirectURI(registered []string, uri string) bool {
+	if slices.Contains(registered, uri) {
+		return true
+	}
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "http" || !isLoopback(u.Hostname()) || u.Port() == "" {
+		return false
+	}
+	u.Host = u.Hostname()
+	if strings.Contains(u.Host, ":") {
+		u.Host = "[" + u.Host + "]"
+	}
+	return slices.Contains(registered, u.String())
+}
+
+// isLoopback reports whether host is a loopback IP address. "localhost" is
+// left out, since it can be resolved to something else.
+func isLoopback(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
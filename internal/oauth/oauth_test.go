@@ -0,0 +1,93 @@
+package oauth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseScope(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		invalid bool
+	}{
+		{"notes:read", []string{ScopeNotesRead}, false},
+		{"notes:write  notes:read notes:write", []string{ScopeNotesRead, ScopeNotesWrite}, false},
+		{"", nil, true},
+		{"notes:read admin", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseScope(tt.in)
+		if tt.invalid {
+			if !errors.Is(err, ErrInvalidScope) {
+				t.Errorf("ParseScope(%q) = %v, %v, expected ErrInvalidScope", tt.in, got, err)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("ParseScope(%q) = %v, %v, expected %v", tt.in, got, err, tt.want)
+		}
+	}
+
+	read, write := []string{ScopeNotesRead}, []string{ScopeNotesWrite}
+	if !Covers(Union(read, write), write) || Covers(read, write) {
+		t.Error("Covers does not match the union of the scopes")
+	}
+}
+
+func TestVerifyChallenge(t *testing.T) {
+	verifier := strings.Repeat("a1-._~", 8)
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	if !ValidChallenge(challenge) || ValidChallenge("plain-text") {
+		t.Error("ValidChallenge does not tell S256 challenges apart")
+	}
+	if !VerifyChallenge(verifier, challenge) {
+		t.Error("the verifier of the challenge was refused")
+	}
+	if VerifyChallenge(verifier+"x", challenge) {
+		t.Error("another verifier was accepted")
+	}
+	short := sha256.Sum256([]byte("short"))
+	if VerifyChallenge("short", base64.RawURLEncoding.EncodeToString(short[:])) {
+		t.Error("a verifier under 43 characters was accepted")
+	}
+}
+
+func TestRedirectURIs(t *testing.T) {
+	for uri, ok := range map[string]bool{
+		"https://habits.example.com/callback": true,
+		"http://127.0.0.1/callback":           true,
+		"http://[::1]:8080/cb":                true,
+		"com.example.journal:/oauth":          true,
+		"http://habits.example.com/callback":  false,
+		"https://habits.example.com/cb#frag":  false,
+		"/relative":                           false,
+		"javascript:alert(1)":                 false,
+		"myapp:/callback":                     false,
+	} {
+		if err := CheckRedirectURI(uri); (err == nil) != ok {
+			t.Errorf("CheckRedirectURI(%q) = %v, expected ok %v", uri, err, ok)
+		}
+	}
+
+	registered := []string{"https://habits.example.com/callback", "http://127.0.0.1/callback", "http://[::1]/callback"}
+	for uri, ok := range map[string]bool{
+		"https://habits.example.com/callback":      true,
+		"http://127.0.0.1:51234/callback":          true,
+		"http://[::1]:51234/callback":              true,
+		"https://habits.example.com/callback?x=1":  false,
+		"https://habits.example.com:8443/callback": false,
+		"http://127.0.0.1:51234/other":             false,
+		"https://habits.example.com/callback/../x": false,
+	} {
+		if MatchRedirectURI(registered, uri) != ok {
+			t.Errorf("MatchRedirectURI(%q) = %v", uri, !ok)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darynforman/gratitude-jar1/internal/oidc/oidctest"
+)
+
+const redirectURL = "https://jar.example.com/sso/callback"
+
+// authorize runs the flow against idp up to the code, without following the
+// redirect back to the client
+func authorize(t *testing.T, p *Provider, state, nonce, verifier string) string {
+	t.Helper()
+	authURL, err := p.AuthCodeURL(context.Background(), redirectURL, state, nonce, Challenge(verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || !strings.HasPrefix(back.String(), redirectURL) {
+		t.Fatalf("got status %d redirecting to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if back.Query().Get("state") != state {
+		t.Fatalf("state %q came back as %q", state, back.Query().Get("state"))
+	}
+	return back.Query().Get("code")
+}
+
+func TestFlow(t *testing.T) {
+	idp := oidctest.NewServer("jar", "s3cret")
+	defer idp.Close()
+	idp.SetIdentity(oidctest.Identity{Subject: "42", Email: "ana@example.com", EmailVerified: true, Name: "Ana"})
+
+	p := New(Config{Issuer: idp.URL + "/", ClientID: "jar", ClientSecret: "s3cret", Scopes: []string{"email"}})
+	ctx := context.Background()
+
+	code := authorize(t, p, "state-1", "nonce-1", "verifier-1")
+	claims, err := p.Exchange(ctx, code, redirectURL, "verifier-1", "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "42" || claims.Email != "ana@example.com" || !bool(claims.EmailVerified) || claims.Name != "Ana" {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	// Codes are single-use and bound to the PKCE verifier and nonce
+	if _, err := p.Exchange(ctx, code, redirectURL, "verifier-1", "nonce-1"); err == nil {
+		t.Error("a code was redeemed twice")
+	}
+	code = authorize(t, p, "state-2", "nonce-2", "verifier-2")
+	if _, err := p.Exchange(ctx, code, redirectURL, "another-verifier", "nonce-2"); err == nil {
+		t.Error("a code was redeemed with the wrong verifier")
+	}
+	code = authorize(t, p, "state-3", "nonce-3", "verifier-3")
+	if _, err := p.Exchange(ctx, code, redirectURL, "verifier-3", "another-nonce"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("wrong nonce: got %v", err)
+	}
+}
+
+func TestVerifyRejectsBadTokens(t *testing.T) {
+	idp := oidctest.NewServer("jar", "s3cret")
+	defer idp.Close()
+	p := New(Config{Issuer: idp.URL, ClientID: "jar", ClientSecret: "s3cret"})
+	ctx := context.Background()
+
+	valid := func() map[string]any {
+		return map[string]any{
+			"iss":   idp.URL,
+			"sub":   "42",
+			"aud":   "jar",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"iat":   time.Now().Unix(),
+			"nonce": "n",
+		}
+	}
+	if _, err := p.Verify(ctx, idp.Sign(valid()), "n"); err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		edit func(map[string]any)
+	}{
+		{"other issuer", func(c map[string]any) { c["iss"] = "https://evil.example.com" }},
+		{"other audience", func(c map[string]any) { c["aud"] = "someone-else" }},
+		{"several audiences without azp", func(c map[string]any) { c["aud"] = []string{"jar", "someone-else"} }},
+		{"expired", func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{"no expiry", func(c map[string]any) { delete(c, "exp") }},
+		{"issued in the future", func(c map[string]any) { c["iat"] = time.Now().Add(time.Hour).Unix() }},
+		{"other nonce", func(c map[string]any) { c["nonce"] = "m" }},
+		{"no subject", func(c map[string]any) { delete(c, "sub") }},
+	}
+	for _, tt := range tests {
+		claims := valid()
+		tt.edit(claims)
+		if _, err := p.Verify(ctx, idp.Sign(claims), "n"); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: got %v, expected ErrInvalidToken", tt.name, err)
+		}
+	}
+
+	// Tampered payloads and unsigned tokens fail the signature check
+	token := idp.Sign(valid())
+	parts := strings.Split(token, ".")
+	forged := idp.Sign(map[string]any{"sub": "admin"})
+	if _, err := p.Verify(ctx, parts[0]+"."+strings.Split(forged, ".")[1]+"."+parts[2], "n"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("tampered token: got %v", err)
+	}
+	if _, err := p.Verify(ctx, "eyJhbGciOiJub25lIn0."+parts[1]+".", "n"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("alg none: got %v", err)
+	}
+}
+
+func TestDiscoveryChecksIssuer(t *testing.T) {
+	idp := oidctest.NewServer("jar", "s3cret")
+	defer idp.Close()
+
+	// The document names the real issuer, not the one configured
+	p := New(Config{Issuer: strings.Replace(idp.URL, "127.0.0.1", "localhost", 1), ClientID: "jar"})
+	if _, err := p.Metadata(context.Background()); err == nil {
+		t.Error("discovery accepted a document for another issuer")
+	}
+}
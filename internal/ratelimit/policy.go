@@ -0,0 +1,219 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IdentityKind selects what a rule keys its buckets on
+type IdentityKind string
+
+const (
+	// IdentityIP keys buckets on the client IP address
+	IdentityIP IdentityKind = "ip"
+	// IdentityUser keys buckets on the logged-in user ID
+	IdentityUser IdentityKind = "user"
+	// IdentityToken keys buckets on the bearer API token. The token is
+	// whatever the client sent, checked only later by the handler, so these
+	// rules also count requests against the client IP address.
+	IdentityToken IdentityKind = "token"
+	// IdentityEmail keys buckets on the email address a form was submitted
+	// for. It is only known once a handler has read the form, so these rules
+	// are checked with AllowEmail rather than by the middleware.
+	IdentityEmail IdentityKind = "email"
+)
+
+// Identity describes who made a request
+type Identity struct {
+	IP     string
+	UserID int    // 0 when not logged in
+	Token  string // bearer token, empty when none was sent
+	Email  string // email address from a form, empty outside AllowEmail
+}
+
+// Rule limits requests that match a path prefix and method for one kind of identity
+type Rule struct {
+	Name       string
+	PathPrefix string       // e.g. "/user/login"; empty matches every path
+	Methods    []string     // e.g. ["POST"]; empty matches every method
+	Identity   IdentityKind // a rule only matches when this identity is present
+	Rate       float64      // tokens per second
+	Burst      int          // bucket size
+}
+
+// matches reports whether the rule applies to the request and returns the bucket key
+func (r *Rule) matches(method, path string, id Identity) (string, bool) {
+	if r.PathPrefix != "" && !strings.HasPrefix(path, r.PathPrefix) {
+		return "", false
+	}
+	if len(r.Methods) > 0 {
+		found := false
+		for _, m := range r.Methods {
+			if strings.EqualFold(m, method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", false
+		}
+	}
+
+	switch r.Identity {
+	case IdentityUser:
+		if id.UserID == 0 {
+			return "", false
+		}
+		return "user:" + strconv.Itoa(id.UserID), true
+	case IdentityToken:
+		if id.Token == "" {
+			return "", false
+		}
+		// Never keep raw tokens as map keys
+		sum := sha256.Sum256([]byte(id.Token))
+		return "token:" + hex.EncodeToString(sum[:8]), true
+	case IdentityEmail:
+		if id.Email == "" {
+			return "", false
+		}
+		// Nor raw addresses
+		sum := sha256.Sum256([]byte(strings.ToLower(id.Email)))
+		return "email:" + hex.EncodeToString(sum[:8]), true
+	default:
+		return "ip:" + id.IP, true
+	}
+}
+
+// Decision is the outcome of checking a request against a policy
+type Decision struct {
+	Allowed    bool
+	Rule       string
+	Limit      int           // bucket size of the matching rule
+	Remaining  int           // whole tokens left
+	Reset      time.Duration // time until the bucket is full again
+	RetryAfter time.Duration // when rejected, time until the next token
+}
+
+// Policy applies the first matching rule to each request, falling back to a
+// default rule keyed by IP. Every rule has its own set of buckets; all rules
+// share one Store with keys namespaced by rule.
+type Policy struct {
+	store           Store
+	rules           []Rule
+	limiters        []*RateLimiter
+	fallback        Rule
+	fallbackLimiter *RateLimiter
+}
+
+// NewPolicy creates a policy from rules in priority order and a default rule,
+// keeping bucket state in store
+func NewPolicy(store Store, rules []Rule, fallback Rule) *Policy {
+	p := &Policy{
+		store:           store,
+		rules:           rules,
+		fallback:        fallback,
+		fallbackLimiter: NewRateLimiterWithStore(store, "default|", fallback.Rate, float64(fallback.Burst)),
+	}
+	if p.fallback.Identity == "" {
+		p.fallback.Identity = IdentityIP
+	}
+	for i, r := range rules {
+		prefix := r.Name
+		if prefix == "" {
+			prefix = "rule" + strconv.Itoa(i)
+		}
+		p.limiters = append(p.limiters, NewRateLimiterWithStore(store, prefix+"|", r.Rate, float64(r.Burst)))
+	}
+	return p
+}
+
+// Allow takes a token for the request from the bucket of the first matching
+// rule. If the store fails the request is allowed and the error returned, so
+// an unavailable store does not take the site down.
+//
+// A rule keyed on bearer tokens also has a bucket per IP address, which is
+// checked first: otherwise a client making up a new token for each request
+// would never be limited, and would leave a bucket behind for every one.
+func (p *Policy) Allow(ctx context.Context, method, path string, id Identity) (Decision, error) {
+	for i := range p.rules {
+		rule := &p.rules[i]
+		key, ok := rule.matches(method, path, id)
+		if !ok {
+			continue
+		}
+		if rule.Identity != IdentityToken {
+			return take(ctx, rule, p.limiters[i], key)
+		}
+		byIP, ipErr := take(ctx, rule, p.limiters[i], "ip:"+id.IP)
+		if !byIP.Allowed {
+			return byIP, ipErr
+		}
+		byToken, err := take(ctx, rule, p.limiters[i], key)
+		if byToken.Allowed && byIP.Remaining < byToken.Remaining {
+			byToken = byIP
+		}
+		return byToken, errors.Join(ipErr, err)
+	}
+	key, _ := p.fallback.matches(method, path, id)
+	return take(ctx, &p.fallback, p.fallbackLimiter, key)
+}
+
+// AllowEmail takes a token for email from the bucket of the first matching
+// rule keyed on email addresses. Without such a rule every request is
+// allowed, as the default rule is keyed by IP and already applied by Allow.
+func (p *Policy) AllowEmail(ctx context.Context, method, path, email string) (Decision, error) {
+	id := Identity{Email: email}
+	for i := range p.rules {
+		if p.rules[i].Identity != IdentityEmail {
+			continue
+		}
+		if key, ok := p.rules[i].matches(method, path, id); ok {
+			return take(ctx, &p.rules[i], p.limiters[i], key)
+		}
+	}
+	return Decision{Allowed: true}, nil
+}
+
+// take takes a token for key from a rule's limiter and describes the outcome
+func take(ctx context.Context, rule *Rule, limiter *RateLimiter, key string) (Decision, error) {
+	res, err := limiter.Take(ctx, key)
+	if err != nil {
+		return Decision{Allowed: true, Rule: rule.Name, Limit: rule.Burst, Remaining: rule.Burst}, err
+	}
+	reset := time.Duration((float64(rule.Burst) - res.Remaining) / rule.Rate * float64(time.Second))
+
+	return Decision{
+		Allowed:    res.Allowed,
+		Rule:       rule.Name,
+		Limit:      rule.Burst,
+		Remaining:  int(math.Floor(res.Remaining)),
+		Reset:      reset,
+		RetryAfter: res.RetryAfter,
+	}, nil
+}
+
+// Cleanup drops idle buckets from every rule
+func (p *Policy) Cleanup(maxAge time.Duration) error {
+	return p.store.Cleanup(context.Background(), maxAge)
+}
+
+// RunCleanup calls Cleanup every interval until ctx is cancelled
+func (p *Policy) RunCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.Cleanup(interval)
+		}
+	}
+}
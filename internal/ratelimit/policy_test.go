@@ -0,0 +1,114 @@
+package ratelimit
+
+import (
+	"context"
+	"strconv"
+	"testing"
+)
+
+// TestPolicyMatching checks rule priority, method and identity matching
+func TestPolicyMatching(t *testing.T) {
+	p := NewPolicy(NewMemoryStore(), []Rule{
+		{Name: "login", PathPrefix: "/user/login", Methods: []string{"POST"}, Identity: IdentityIP, Rate: 1, Burst: 2},
+		{Name: "notes-read", PathPrefix: "/notes", Methods: []string{"GET"}, Identity: IdentityUser, Rate: 1, Burst: 50},
+	}, Rule{Name: "default", Rate: 1, Burst: 10})
+
+	tests := []struct {
+		method, path string
+		id           Identity
+		rule         string
+	}{
+		{"POST", "/user/login", Identity{IP: "1.2.3.4"}, "login"},
+		{"GET", "/user/login", Identity{IP: "1.2.3.4"}, "default"},
+		{"GET", "/notes", Identity{IP: "1.2.3.4", UserID: 7}, "notes-read"},
+		{"GET", "/notes", Identity{IP: "1.2.3.4"}, "default"}, // user rule needs a user
+	}
+	for _, tt := range tests {
+		d, _ := p.Allow(context.Background(), tt.method, tt.path, tt.id)
+		if d.Rule != tt.rule {
+			t.Errorf("%s %s %+v: got rule %q, expected %q", tt.method, tt.path, tt.id, d.Rule, tt.rule)
+		}
+	}
+}
+
+// TestPolicyRejectsAfterBurst checks that a bucket empties and reports Retry-After
+func TestPolicyRejectsAfterBurst(t *testing.T) {
+	p := NewPolicy(NewMemoryStore(), []Rule{
+		{Name: "login", PathPrefix: "/user/login", Identity: IdentityIP, Rate: 0.5, Burst: 2},
+	}, Rule{Name: "default", Rate: 1, Burst: 10})
+
+	id := Identity{IP: "10.0.0.1"}
+	for i := 0; i < 2; i++ {
+		if d, _ := p.Allow(context.Background(), "POST", "/user/login", id); !d.Allowed {
+			t.Fatalf("request %d rejected within burst", i+1)
+		}
+	}
+
+	d, _ := p.Allow(context.Background(), "POST", "/user/login", id)
+	if d.Allowed {
+		t.Fatal("request beyond burst was allowed")
+	}
+	if d.RetryAfter <= 0 || d.Limit != 2 || d.Remaining != 0 {
+		t.Errorf("unexpected decision %+v", d)
+	}
+
+	// Another client has its own bucket
+	if d, _ := p.Allow(context.Background(), "POST", "/user/login", Identity{IP: "10.0.0.2"}); !d.Allowed {
+		t.Error("second client was limited by the first client's bucket")
+	}
+}
+
+// TestPolicyTokenRules checks that made-up tokens do not escape a token
+// rule: requests are counted per address as well as per token
+func TestPolicyTokenRules(t *testing.T) {
+	p := NewPolicy(NewMemoryStore(), []Rule{
+		{Name: "api", PathPrefix: "/api/", Identity: IdentityToken, Rate: 0.5, Burst: 3},
+	}, Rule{Name: "default", Rate: 1, Burst: 10})
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		id := Identity{IP: "10.0.0.1", Token: "made-up-" + strconv.Itoa(i)}
+		if d, _ := p.Allow(ctx, "GET", "/api/notes", id); !d.Allowed || d.Rule != "api" || d.Remaining != 2-i {
+			t.Fatalf("request %d: unexpected decision %+v", i+1, d)
+		}
+	}
+	if d, _ := p.Allow(ctx, "GET", "/api/notes", Identity{IP: "10.0.0.1", Token: "made-up-3"}); d.Allowed {
+		t.Error("a new token from the same address was allowed beyond the burst")
+	}
+
+	// A token used from two addresses shares its bucket
+	for i, ip := range []string{"10.0.0.2", "10.0.0.2", "10.0.0.3"} {
+		if d, _ := p.Allow(ctx, "GET", "/api/notes", Identity{IP: ip, Token: "real"}); !d.Allowed {
+			t.Fatalf("request %d with the real token rejected within burst", i+1)
+		}
+	}
+	if d, _ := p.Allow(ctx, "GET", "/api/notes", Identity{IP: "10.0.0.4", Token: "real"}); d.Allowed {
+		t.Error("a token was allowed beyond its burst from a new address")
+	}
+}
+
+// TestPolicyEmailRules checks that email rules are left to AllowEmail and
+// keep a bucket per address
+func TestPolicyEmailRules(t *testing.T) {
+	p := NewPolicy(NewMemoryStore(), []Rule{
+		{Name: "login-link-email", PathPrefix: "/user/login/link", Methods: []string{"POST"}, Identity: IdentityEmail, Rate: 0.01, Burst: 1},
+	}, Rule{Name: "default", Rate: 1, Burst: 10})
+	ctx := context.Background()
+
+	if d, _ := p.Allow(ctx, "POST", "/user/login/link", Identity{IP: "10.0.0.1"}); d.Rule != "default" {
+		t.Errorf("middleware check used rule %q, expected default", d.Rule)
+	}
+
+	if d, _ := p.AllowEmail(ctx, "POST", "/user/login/link", "Ann@example.com"); !d.Allowed || d.Rule != "login-link-email" {
+		t.Fatalf("first request for an address: %+v", d)
+	}
+	if d, _ := p.AllowEmail(ctx, "POST", "/user/login/link", "ann@example.com"); d.Allowed {
+		t.Error("second request for the same address in another case was allowed")
+	}
+	if d, _ := p.AllowEmail(ctx, "POST", "/user/login/link", "bob@example.com"); !d.Allowed {
+		t.Error("another address was limited by the first one's bucket")
+	}
+	if d, _ := p.AllowEmail(ctx, "POST", "/register", "ann@example.com"); !d.Allowed {
+		t.Error("a path without an email rule was limited")
+	}
+}
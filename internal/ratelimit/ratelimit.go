@@ -1,6 +1,7 @@
 package ratelimit
 
 import (
+	"context"
 	"sync"
 	"time"
 )
@@ -26,6 +27,13 @@ func NewTokenBucket(rate, bucketSize float64) *TokenBucket {
 
 // Allow checks if a request should be allowed based on rate limit
 func (tb *TokenBucket) Allow() bool {
+	allowed, _, _ := tb.Take()
+	return allowed
+}
+
+// Take is like Allow but also reports the tokens left after the request and,
+// when the request is rejected, how long until a token becomes available
+func (tb *TokenBucket) Take() (allowed bool, remaining float64, retryAfter time.Duration) {
 	tb.mu.Lock()
 	defer tb.mu.Unlock()
 
@@ -36,9 +44,10 @@ func (tb *TokenBucket) Allow() bool {
 
 	if tb.tokens >= 1 {
 		tb.tokens--
-		return true
+		return true, tb.tokens, 0
 	}
-	return false
+	wait := time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+	return false, tb.tokens, wait
 }
 
 func min(a, b float64) float64 {
@@ -48,54 +57,52 @@ func min(a, b float64) float64 {
 	return b
 }
 
-// RateLimiter manages rate limits for multiple clients
+// RateLimiter applies one rate and burst to many clients, keeping the
+// per-client state in a Store
 type RateLimiter struct {
-	limiters   map[string]*TokenBucket
-	mu         sync.RWMutex
+	store      Store
+	prefix     string
 	rate       float64
 	bucketSize float64
 }
 
-// NewRateLimiter creates a new rate limiter
+// NewRateLimiter creates a new rate limiter backed by an in-memory store
 func NewRateLimiter(rate, bucketSize float64) *RateLimiter {
+	return NewRateLimiterWithStore(NewMemoryStore(), "", rate, bucketSize)
+}
+
+// NewRateLimiterWithStore creates a rate limiter that keeps its buckets in
+// store. prefix namespaces the keys so several limiters can share a store.
+func NewRateLimiterWithStore(store Store, prefix string, rate, bucketSize float64) *RateLimiter {
 	return &RateLimiter{
-		limiters:   make(map[string]*TokenBucket),
+		store:      store,
+		prefix:     prefix,
 		rate:       rate,
 		bucketSize: bucketSize,
 	}
 }
 
-// GetLimiter gets or creates a rate limiter for a client
-func (rl *RateLimiter) GetLimiter(key string) *TokenBucket {
-	rl.mu.RLock()
-	limiter, exists := rl.limiters[key]
-	rl.mu.RUnlock()
-
-	if exists {
-		return limiter
-	}
-
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-
-	// Double check after acquiring write lock
-	if limiter, exists = rl.limiters[key]; exists {
-		return limiter
-	}
-
-	limiter = NewTokenBucket(rl.rate, rl.bucketSize)
-	rl.limiters[key] = limiter
-	return limiter
+// Take removes a token from the bucket for a client
+func (rl *RateLimiter) Take(ctx context.Context, key string) (Result, error) {
+	return rl.store.Take(ctx, rl.prefix+key, rl.rate, rl.bucketSize)
 }
 
 // Cleanup removes old limiters (should be called periodically)
-func (rl *RateLimiter) Cleanup(maxAge time.Duration) {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
+func (rl *RateLimiter) Cleanup(maxAge time.Duration) error {
+	return rl.store.Cleanup(context.Background(), maxAge)
+}
 
-	for key, bucket := range rl.limiters {
-		if time.Since(bucket.lastRefill) > maxAge {
-			delete(rl.limiters, key)
+// RunCleanup calls Cleanup every interval until ctx is cancelled
+func (rl *RateLimiter) RunCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rl.Cleanup(interval)
 		}
 	}
 }
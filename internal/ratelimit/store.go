@@ -0,0 +1,81 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Result is the outcome of taking a token from a bucket
+type Result struct {
+	Allowed    bool
+	Remaining  float64       // tokens left after this request
+	RetryAfter time.Duration // when rejected, time until the next token
+}
+
+// Store keeps rate limit buckets. Implementations must make Take atomic for
+// a key, including across processes when the store is shared.
+type Store interface {
+	// Take refills the bucket for key at rate tokens per second up to burst
+	// and removes one token if available
+	Take(ctx context.Context, key string, rate, burst float64) (Result, error)
+	// Cleanup removes buckets that have been idle for longer than maxAge
+	Cleanup(ctx context.Context, maxAge time.Duration) error
+}
+
+// MemoryStore keeps buckets in a process-local map. Each replica of the
+// application gets its own allowance when it is used.
+type MemoryStore struct {
+	limiters map[string]*TokenBucket
+	mu       sync.RWMutex
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{limiters: make(map[string]*TokenBucket)}
+}
+
+// Take removes a token from the bucket for key, creating it full if needed
+func (s *MemoryStore) Take(ctx context.Context, key string, rate, burst float64) (Result, error) {
+	allowed, remaining, retryAfter := s.getBucket(key, rate, burst).Take()
+	return Result{Allowed: allowed, Remaining: remaining, RetryAfter: retryAfter}, nil
+}
+
+// getBucket gets or creates the bucket for key
+func (s *MemoryStore) getBucket(key string, rate, burst float64) *TokenBucket {
+	s.mu.RLock()
+	bucket, exists := s.limiters[key]
+	s.mu.RUnlock()
+
+	if exists {
+		return bucket
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Double check after acquiring write lock
+	if bucket, exists = s.limiters[key]; exists {
+		return bucket
+	}
+
+	bucket = NewTokenBucket(rate, burst)
+	s.limiters[key] = bucket
+	return bucket
+}
+
+// Cleanup removes buckets that have not been used for maxAge
+func (s *MemoryStore) Cleanup(ctx context.Context, maxAge time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, bucket := range s.limiters {
+		bucket.mu.Lock()
+		idle := time.Since(bucket.lastRefill)
+		bucket.mu.Unlock()
+		if idle > maxAge {
+			delete(s.limiters, key)
+		}
+	}
+	return nil
+}
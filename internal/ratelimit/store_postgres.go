@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"time"
+)
+
+// PostgresStore keeps buckets in the rate_limits table so every replica
+// shares one allowance per client.
+//
+// It implements GCRA (the generic cell rate algorithm): instead of a token
+// count, each key stores a theoretical arrival time (TAT). A request is
+// allowed when TAT - burst*interval <= now, in which case TAT advances by one
+// emission interval. The check and the update happen in a single upsert, so
+// concurrent requests from any number of instances cannot overspend a bucket.
+type PostgresStore struct {
+	DB *sql.DB
+}
+
+// NewPostgresStore creates a store on db; the rate_limits table comes from the migrations
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{DB: db}
+}
+
+// Take removes a token from the bucket for key
+func (s *PostgresStore) Take(ctx context.Context, key string, rate, burst float64) (Result, error) {
+	interval := 1 / rate       // seconds between tokens
+	window := interval * burst // how far TAT may run ahead of now
+
+	// Insert a fresh bucket or advance TAT, but only when the request fits.
+	// When it does not fit the WHERE clause suppresses the update and no row
+	// is returned.
+	query := `
+		INSERT INTO rate_limits AS rl (key, tat, updated_at)
+		VALUES ($1, now() + $2::float8 * interval '1 second', now())
+		ON CONFLICT (key) DO UPDATE
+		SET tat = GREATEST(rl.tat, now()) + $2::float8 * interval '1 second',
+		    updated_at = now()
+		WHERE GREATEST(rl.tat, now()) + $2::float8 * interval '1 second'
+		      - $3::float8 * interval '1 second' <= now()
+		RETURNING tat, now()`
+
+	var tat, now time.Time
+	err := s.DB.QueryRowContext(ctx, query, key, interval, window).Scan(&tat, &now)
+	switch {
+	case err == nil:
+		remaining := (now.Sub(tat).Seconds() + window) / interval
+		return Result{Allowed: true, Remaining: math.Max(0, remaining)}, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return Result{}, err
+	}
+
+	// Rejected: report when the next request would fit
+	err = s.DB.QueryRowContext(ctx, `SELECT tat, now() FROM rate_limits WHERE key = $1`, key).Scan(&tat, &now)
+	if err != nil {
+		return Result{}, err
+	}
+	allowAt := tat.Add(time.Duration((interval - window) * float64(time.Second)))
+	return Result{Allowed: false, Remaining: 0, RetryAfter: allowAt.Sub(now)}, nil
+}
+
+// Cleanup deletes buckets whose TAT is more than maxAge in the past; such
+// buckets are full and behave exactly like a missing row
+func (s *PostgresStore) Cleanup(ctx context.Context, maxAge time.Duration) error {
+	_, err := s.DB.ExecContext(ctx,
+		`DELETE FROM rate_limits WHERE tat < now() - $1::float8 * interval '1 second'`,
+		maxAge.Seconds())
+	return err
+}
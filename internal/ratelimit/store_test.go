@@ -0,0 +1,155 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// testStores returns every Store implementation to run the suite against.
+// The Postgres store needs TEST_DATABASE_DSN pointing at a migrated database.
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	stores := map[string]Store{"memory": NewMemoryStore()}
+
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Log("TEST_DATABASE_DSN not set; skipping the postgres store")
+		return stores
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("opening test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Ping(); err != nil {
+		t.Fatalf("connecting to test database: %v", err)
+	}
+	stores["postgres"] = NewPostgresStore(db)
+	return stores
+}
+
+// uniqueKey keeps runs against a shared database from seeing each other's buckets
+func uniqueKey(t *testing.T, name string) string {
+	return fmt.Sprintf("test|%s|%s|%d", t.Name(), name, time.Now().UnixNano())
+}
+
+// TestStoreConcurrentBurst fires many concurrent requests at one key and
+// checks that exactly burst of them are allowed
+func TestStoreConcurrentBurst(t *testing.T) {
+	const (
+		burst    = 10
+		requests = 100
+	)
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			key := uniqueKey(t, name)
+			var allowed atomic.Int64
+			var wg sync.WaitGroup
+			errs := make(chan error, requests)
+
+			start := make(chan struct{})
+			for i := 0; i < requests; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-start
+					// A very slow refill so only the burst is available during the test
+					res, err := store.Take(context.Background(), key, 0.001, burst)
+					if err != nil {
+						errs <- err
+						return
+					}
+					if res.Allowed {
+						allowed.Add(1)
+					}
+				}()
+			}
+			close(start)
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				t.Fatalf("Take returned error: %v", err)
+			}
+			if got := allowed.Load(); got != burst {
+				t.Errorf("got %d allowed requests, expected %d", got, burst)
+			}
+		})
+	}
+}
+
+// TestStoreKeysAreIndependent checks that concurrent clients do not share buckets
+func TestStoreKeysAreIndependent(t *testing.T) {
+	const (
+		burst   = 3
+		clients = 20
+	)
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			prefix := uniqueKey(t, name)
+			var wg sync.WaitGroup
+			counts := make([]atomic.Int64, clients)
+
+			for c := 0; c < clients; c++ {
+				for i := 0; i < burst*2; i++ {
+					wg.Add(1)
+					go func(c int) {
+						defer wg.Done()
+						key := fmt.Sprintf("%s|client%d", prefix, c)
+						res, err := store.Take(context.Background(), key, 0.001, burst)
+						if err == nil && res.Allowed {
+							counts[c].Add(1)
+						}
+					}(c)
+				}
+			}
+			wg.Wait()
+
+			for c := range counts {
+				if got := counts[c].Load(); got != burst {
+					t.Errorf("client %d: got %d allowed requests, expected %d", c, got, burst)
+				}
+			}
+		})
+	}
+}
+
+// TestStoreRetryAfterAndRefill checks the rejection details and that tokens come back
+func TestStoreRetryAfterAndRefill(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			key := uniqueKey(t, name)
+			ctx := context.Background()
+
+			// 20 tokens per second, burst of 1
+			if res, err := store.Take(ctx, key, 20, 1); err != nil || !res.Allowed {
+				t.Fatalf("first request: %+v, %v", res, err)
+			}
+			res, err := store.Take(ctx, key, 20, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Allowed {
+				t.Fatal("second immediate request was allowed")
+			}
+			if res.RetryAfter <= 0 || res.RetryAfter > 50*time.Millisecond {
+				t.Errorf("got RetryAfter %v, expected (0, 50ms]", res.RetryAfter)
+			}
+
+			time.Sleep(60 * time.Millisecond)
+			if res, err := store.Take(ctx, key, 20, 1); err != nil || !res.Allowed {
+				t.Errorf("request after refill: %+v, %v", res, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+// Package scim holds the parts of SCIM 2.0 (RFC 7643, RFC 7644) the user
+// provisioning endpoint speaks: the User resource as the app keeps it, list
+// and error messages, equality filters, and PATCH operations.
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContentType is the media type of SCIM requests and responses
+const ContentType = "application/scim+json"
+
+// The schema URNs of the resources and messages the endpoint uses
+const (
+	SchemaUser  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	SchemaList  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	SchemaPatch = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	SchemaError = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// The User attributes the app keeps, as filters and PATCH paths name them
+const (
+	AttrUserName   = "userName"
+	AttrExternalID = "externalId"
+	AttrEmails     = "emails"
+	AttrActive     = "active"
+	AttrPassword   = "password"
+)
+
+// User is a user as the directory sees it. Attributes the app does not keep,
+// such as name, are dropped when a User is read.
+type User struct {
+	Schemas    []string `json:"schemas"`
+	ID         string   `json:"id,omitempty"`
+	ExternalID string   `json:"externalId,omitempty"`
+	UserName   string   `json:"userName"`
+	Emails     []Email  `json:"emails,omitempty"`
+	Active     *bool    `json:"active,omitempty"` // nil in a request means true
+	Password   string   `json:"password,omitempty"`
+	Meta       *Meta    `json:"meta,omitempty"`
+}
+
+// Email is one of a user's email addresses. The app keeps only one, the
+// primary address or else the first.
+type Email struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// Meta describes a resource
+type Meta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+}
+
+// ListResponse is a page of the resources matching a query
+type ListResponse struct {
+	Schemas      []string `json:"schemas"`
+	TotalResults int      `json:"totalResults"`
+	StartIndex   int      `json:"startIndex"`
+	ItemsPerPage int      `json:"itemsPerPage"`
+	Resources    []User   `json:"Resources"`
+}
+
+// Error is a SCIM error response with its HTTP status and, for some errors,
+// a scimType such as "invalidFilter" or "uniqueness"
+type Error struct {
+	Status int
+	Type   string
+	Detail string
+}
+
+// Errorf returns an Error with a formatted detail message
+func Errorf(status int, scimType, format string, args ...any) *Error {
+	return &Error{Status: status, Type: scimType, Detail: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return "scim: " + e.Detail
+}
+
+// MarshalJSON encodes e as an error message, with the status as a string
+func (e *Error) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Schemas []string `json:"schemas"`
+		Status  string   `json:"status"`
+		Type    string   `json:"scimType,omitempty"`
+		Detail  string   `json:"detail,omitempty"`
+	}{[]string{SchemaError}, strconv.Itoa(e.Status), e.Type, e.Detail})
+}
+
+// IsActive reports whether u is, or is to be, active
+func (u *User) IsActive() bool {
+	return u.Active == nil || *u.Active
+}
+
+// Email returns the user's primary email address, or else the first one
+func (u *User) Email() string {
+	for _, e := range u.Emails {
+		if e.Primary {
+			return e.Value
+		}
+	}
+	if len(u.Emails) > 0 {
+		return u.Emails[0].Value
+	}
+	return ""
+}
+
+// setEmail changes the address Email returns
+func (u *User) setEmail(value string) {
+	for i, e := range u.Emails {
+		if e.Primary {
+			u.Emails[i].Value = value
+			return
+		}
+	}
+	if len(u.Emails) > 0 {
+		u.Emails[0].Value = value
+		return
+	}
+	u.Emails = []Email{{Value: value, Type: "work", Primary: true}}
+}
+
+// Filter is a filter expression of the form `attribute eq "value"`, the
+// only kind the endpoint supports, which is what directories send to look
+// up a user before creating them
+type Filter struct {
+	Attribute string // AttrUserName, AttrExternalID or AttrEmails
+	Value     string
+}
+
+// ParseFilter parses an equality filter on userName, externalId or the
+// email addresses. Attribute names are case-insensitive and may carry the
+// schema URN. Other filters are refused with an invalidFilter Error.
+func ParseFilter(s string) (Filter, error) {
+	attr, rest, _ := strings.Cut(strings.TrimSpace(s), " ")
+	op, value, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	if !strings.EqualFold(op, "eq") {
+		return Filter{}, Errorf(http.StatusBadRequest, "invalidFilter", "only filters of the form attribute eq \"value\" are supported")
+	}
+	var f Filter
+	if err := json.Unmarshal([]byte(strings.TrimSpace(value)), &f.Value); err != nil {
+		return Filter{}, Errorf(http.StatusBadRequest, "invalidFilter", "the value to compare must be a string")
+	}
+	switch name, email := attribute(attr); {
+	case email, name == AttrEmails:
+		f.Attribute = AttrEmails
+	case name == AttrUserName, name == AttrExternalID:
+		f.Attribute = name
+	default:
+		return Filter{}, Errorf(http.StatusBadRequest, "invalidFilter", "users can only be filtered by userName, externalId or emails")
+	}
+	return f, nil
+}
+
+// PatchRequest is the body of a PATCH request
+type PatchRequest struct {
+	Schemas    []string    `json:"schemas"`
+	Operations []Operation `json:"Operations"`
+}
+
+// Operation is one change of a PATCH request
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Apply makes the changes of ops to u, in order. userName, externalId,
+// emails, active and password can be added or replaced, by path or in a
+// value object without one, and externalId can be removed. Changes to
+// attributes the app does not keep are ignored. The first operation that
+// cannot be applied is returned as an Error.
+func (u *User) Apply(ops []Operation) error {
+	for _, op := range ops {
+		switch strings.ToLower(op.Op) {
+		case "add", "replace":
+			if op.Path != "" {
+				if err := u.set(op.Path, op.Value); err != nil {
+					return err
+				}
+				continue
+			}
+			var attrs map[string]json.RawMessage
+			if err := json.Unmarshal(op.Value, &attrs); err != nil {
+				return Errorf(http.StatusBadRequest, "invalidValue", "an operation without a path needs an object of attributes as its value")
+			}
+			for path, value := range attrs {
+				if err := u.set(path, value); err != nil {
+					return err
+				}
+			}
+		case "remove":
+			switch name, email := attribute(op.Path); {
+			case op.Path == "":
+				return Errorf(http.StatusBadRequest, "noTarget", "remove operations need a path")
+			case name == AttrExternalID:
+				u.ExternalID = ""
+			case email, name == AttrUserName, name == AttrEmails, name == AttrActive:
+				return Errorf(http.StatusBadRequest, "mutability", "%s cannot be removed", op.Path)
+			}
+		default:
+			return Errorf(http.StatusBadRequest, "invalidSyntax", "unknown operation %q", op.Op)
+		}
+	}
+	return nil
+}
+
+// set changes the attribute at path to the JSON value
+func (u *User) set(path string, value json.RawMessage) error {
+	name, email := attribute(path)
+	var err error
+	switch {
+	case email:
+		var v string
+		if err = json.Unmarshal(value, &v); err == nil {
+			u.setEmail(v)
+		}
+	case name == AttrEmails:
+		err = json.Unmarshal(value, &u.Emails)
+	case name == AttrUserName:
+		err = json.Unmarshal(value, &u.UserName)
+	case name == AttrExternalID:
+		err = json.Unmarshal(value, &u.ExternalID)
+	case name == AttrPassword:
+		err = json.Unmarshal(value, &u.Password)
+	case name == AttrActive:
+		var active bool
+		if active, err = parseBool(value); err == nil {
+			u.Active = &active
+		}
+	}
+	if err != nil {
+		return Errorf(http.StatusBadRequest, "invalidValue", "invalid value for %s", path)
+	}
+	return nil
+}
+
+// attribute returns the canonical name of the attribute at path, with the
+// schema URN removed, and whether path names the value of the user's email
+// address ("emails.value" or `emails[type eq "work"].value`). Paths of
+// attributes the app does not keep are returned as they are.
+func attribute(path string) (name string, email bool) {
+	if len(path) > len(SchemaUser) && strings.EqualFold(path[:len(SchemaUser)+1], SchemaUser+":") {
+		path = path[len(SchemaUser)+1:]
+	}
+	lower := strings.ToLower(path)
+	if lower == "emails.value" || (strings.HasPrefix(lower, "emails[") && strings.HasSuffix(lower, "].value")) {
+		return AttrEmails, true
+	}
+	for _, attr := range []string{AttrUserName, AttrExternalID, AttrEmails, AttrActive, AttrPassword} {
+		if strings.EqualFold(path, attr) {
+			return attr, false
+		}
+	}
+	return path, false
+}
+
+// parseBool reads a boolean, also accepted as the string "true" or "false"
+// in any case, as some directories send it
+func parseBool(value json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(value, &b); err == nil {
+		return b, nil
+	}
+	var s string
+	if err := json.Unmarshal(value, &s); err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(strings.ToLower(s))
+}
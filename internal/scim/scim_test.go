@@ -0,0 +1,93 @@
+package scim
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Filter
+		invalid bool
+	}{
+		{`userName eq "ana"`, Filter{AttrUserName, "ana"}, false},
+		{`USERNAME Eq "ana lópez"`, Filter{AttrUserName, "ana lópez"}, false},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:externalId eq "00u1"`, Filter{AttrExternalID, "00u1"}, false},
+		{`emails[type eq "work"].value eq "ana@example.com"`, Filter{}, true},
+		{`emails.value eq "ana@example.com"`, Filter{AttrEmails, "ana@example.com"}, false},
+		{`emails eq "ana@example.com"`, Filter{AttrEmails, "ana@example.com"}, false},
+		{`userName sw "a"`, Filter{}, true},
+		{`userName eq ana`, Filter{}, true},
+		{`name.givenName eq "Ana"`, Filter{}, true},
+		{`userName eq "a" and active eq true`, Filter{}, true},
+		{``, Filter{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseFilter(tt.in)
+		if tt.invalid {
+			var scimErr *Error
+			if !errors.As(err, &scimErr) || scimErr.Type != "invalidFilter" {
+				t.Errorf("ParseFilter(%q) = %v, %v, expected an invalidFilter error", tt.in, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseFilter(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	ops := func(s string) []Operation {
+		var req PatchRequest
+		if err := json.Unmarshal([]byte(s), &req); err != nil {
+			t.Fatal(err)
+		}
+		return req.Operations
+	}
+	user := func() *User {
+		return &User{UserName: "ana", ExternalID: "00u1", Emails: []Email{{Value: "old@example.com", Primary: true}}}
+	}
+
+	// Paths as Azure AD sends them, with booleans as strings
+	u := user()
+	err := u.Apply(ops(`{"Operations": [
+		{"op": "Replace", "path": "active", "value": "False"},
+		{"op": "Replace", "path": "emails[type eq \"work\"].value", "value": "new@example.com"},
+		{"op": "Add", "path": "name.givenName", "value": "Ana"}
+	]}`))
+	if err != nil || u.IsActive() || u.Email() != "new@example.com" {
+		t.Errorf("got active %v, email %q, error %v", u.IsActive(), u.Email(), err)
+	}
+
+	// A value object without a path, as Okta sends it
+	u = user()
+	err = u.Apply(ops(`{"Operations": [{"op": "replace", "value": {"active": true, "userName": "ana.l", "displayName": "Ana"}}]}`))
+	if err != nil || !u.IsActive() || u.UserName != "ana.l" {
+		t.Errorf("got active %v, userName %q, error %v", u.IsActive(), u.UserName, err)
+	}
+
+	u = user()
+	if err := u.Apply(ops(`{"Operations": [{"op": "remove", "path": "externalId"}]}`)); err != nil || u.ExternalID != "" {
+		t.Errorf("removing externalId: got %q, %v", u.ExternalID, err)
+	}
+
+	for name, body := range map[string]string{
+		"remove userName": `{"Operations": [{"op": "remove", "path": "userName"}]}`,
+		"remove all":      `{"Operations": [{"op": "remove"}]}`,
+		"bad active":      `{"Operations": [{"op": "replace", "path": "active", "value": "maybe"}]}`,
+		"bad operation":   `{"Operations": [{"op": "move", "path": "userName", "value": "x"}]}`,
+		"bad value":       `{"Operations": [{"op": "replace", "value": "ana"}]}`,
+	} {
+		u := user()
+		var scimErr *Error
+		if err := u.Apply(ops(body)); !errors.As(err, &scimErr) || scimErr.Status != 400 {
+			t.Errorf("%s: got %v", name, err)
+		}
+		if !u.IsActive() {
+			t.Errorf("%s: a failed operation deactivated the user", name)
+		}
+	}
+}
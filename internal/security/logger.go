@@ -2,7 +2,6 @@ package security
 
 import (
 	"log"
-	"net/http"
 	"time"
 )
 
@@ -18,12 +17,54 @@ const (
 	EventRegistration EventType = "REGISTRATION"
 	// EventPasswordChange represents a password change
 	EventPasswordChange EventType = "PASSWORD_CHANGE"
+	// EventUsernameChange represents a username change
+	EventUsernameChange EventType = "USERNAME_CHANGE"
+	// EventEmailChangeRequest represents a confirmation link being sent to a new email address
+	EventEmailChangeRequest EventType = "EMAIL_CHANGE_REQUEST"
+	// EventEmailChange represents an email change being confirmed from the new address
+	EventEmailChange EventType = "EMAIL_CHANGE"
+	// EventAccountDeletionRequest represents a user asking to delete their account
+	EventAccountDeletionRequest EventType = "ACCOUNT_DELETION_REQUEST"
+	// EventAccountDeletionCancel represents a scheduled deletion cancelled by logging in
+	EventAccountDeletionCancel EventType = "ACCOUNT_DELETION_CANCEL"
+	// EventAccountDeleted represents an account and its data being erased
+	EventAccountDeleted EventType = "ACCOUNT_DELETED"
+	// EventDataExportRequest represents a user asking for a copy of their data
+	EventDataExportRequest EventType = "DATA_EXPORT_REQUEST"
+	// EventDataExportDownload represents a data export being downloaded
+	EventDataExportDownload EventType = "DATA_EXPORT_DOWNLOAD"
+	// EventLoginLinkRequest represents a sign-in link being asked for by email
+	EventLoginLinkRequest EventType = "LOGIN_LINK_REQUEST"
+	// EventSSOLink represents an identity provider's user being linked to an account
+	EventSSOLink EventType = "SSO_LINK"
+	// EventOAuthClient represents an app being registered or removed as an OAuth client
+	EventOAuthClient EventType = "OAUTH_CLIENT"
+	// EventOAuthGrant represents a user authorizing an app to act on their notes
+	EventOAuthGrant EventType = "OAUTH_GRANT"
+	// EventOAuthRevoke represents a user or an app revoking an app's access
+	EventOAuthRevoke EventType = "OAUTH_REVOKE"
+	// EventUserProvision represents the directory creating or changing a user over SCIM
+	EventUserProvision EventType = "USER_PROVISION"
+	// EventAccountDeactivated represents an account being deactivated, which blocks logging in
+	EventAccountDeactivated EventType = "ACCOUNT_DEACTIVATED"
+	// EventAccountReactivated represents a deactivated account being allowed to log in again
+	EventAccountReactivated EventType = "ACCOUNT_REACTIVATED"
 	// EventAccessDenied represents an access denied event
 	EventAccessDenied EventType = "ACCESS_DENIED"
 	// EventCSRFFailure represents a CSRF token validation failure
 	EventCSRFFailure EventType = "CSRF_FAILURE"
 	// EventRateLimitExceeded represents a rate limit exceeded event
 	EventRateLimitExceeded EventType = "RATE_LIMIT_EXCEEDED"
+	// EventCSPViolation represents a Content-Security-Policy violation reported by a browser
+	EventCSPViolation EventType = "CSP_VIOLATION"
+	// EventIPBan represents an address or network being denied, manually or automatically
+	EventIPBan EventType = "IP_BAN"
+	// EventIPUnban represents a deny rule being removed or expiring
+	EventIPUnban EventType = "IP_UNBAN"
+	// EventIPAllow represents an address or network being added to the allow list
+	EventIPAllow EventType = "IP_ALLOW"
+	// EventIPAllowRemoved represents an allow rule being removed or expiring
+	EventIPAllowRemoved EventType = "IP_ALLOW_REMOVED"
 )
 
 // LogSecurityEvent logs a security event with the given details
@@ -43,15 +84,3 @@ func LogSecurityEvent(eventType EventType, userID int, username, ipAddress, deta
 		time.Now().Format(time.RFC3339),
 	)
 }
-
-// GetClientIP gets the client IP address from the request
-func GetClientIP(r *http.Request) string {
-	// Check for X-Forwarded-For header first
-	forwarded := r.Header.Get("X-Forwarded-For")
-	if forwarded != "" {
-		return forwarded
-	}
-	
-	// Otherwise, use RemoteAddr
-	return r.RemoteAddr
-}
@@ -2,47 +2,48 @@ package session
 
 import (
 	"encoding/gob"
-	"log"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/golangcollege/sessions"
 )
 
-var Manager *sessions.Session
+// Manager wraps the cookie session store with the application's session policy
+type Manager struct {
+	*sessions.Session
+
+	// IdleTimeout is how long a logged-in session may be inactive before it is ended
+	IdleTimeout time.Duration
+}
 
 func init() {
 	// Register types that will be stored in the session
 	// This must be done before the session manager is initialized
 	gob.Register(time.Time{})
+}
 
-	// Get session secret from environment variable or use a default in development
-	secretKey := os.Getenv("SESSION_SECRET")
-	if secretKey == "" {
-		// Only use this default in development
-		secretKey = "dev-session-secret-replace-in-production"
-		log.Println("WARNING: Using default session secret. Set SESSION_SECRET environment variable in production.")
-	}
-
-	Manager = sessions.New([]byte(secretKey))
-	Manager.Lifetime = 24 * time.Hour
+// New creates a session manager. secret authenticates and encrypts the
+// session cookie; secure marks the cookie Secure so it is only sent over HTTPS.
+func New(secret []byte, lifetime, idleTimeout time.Duration, secure bool) *Manager {
+	s := sessions.New(secret)
+	s.Lifetime = lifetime
 
-	// Enable secure cookies in production
-	secureMode := os.Getenv("SECURE_COOKIES") == "true"
-	Manager.Secure = secureMode
+	// Only send the cookie over HTTPS when requested
+	s.Secure = secure
 
 	// Always set HttpOnly to prevent JavaScript access
-	Manager.HttpOnly = true
+	s.HttpOnly = true
 
 	// Set SameSite attribute to prevent CSRF
-	Manager.SameSite = http.SameSiteStrictMode
+	s.SameSite = http.SameSiteStrictMode
+
+	return &Manager{Session: s, IdleTimeout: idleTimeout}
 }
 
 // GetLoggedInUser returns the user ID and role from the session, or 0, "" if not logged in
-func GetLoggedInUser(r *http.Request) (int, string) {
+func (m *Manager) GetLoggedInUser(r *http.Request) (int, string) {
 	// First check if the values exist at all
-	userIDVal := Manager.Get(r, "userID")
+	userIDVal := m.Get(r, "userID")
 	if userIDVal == nil {
 		return 0, ""
 	}
@@ -54,7 +55,7 @@ func GetLoggedInUser(r *http.Request) (int, string) {
 	}
 
 	// Get role
-	roleVal := Manager.Get(r, "role")
+	roleVal := m.Get(r, "role")
 	if roleVal == nil {
 		return 0, ""
 	}
@@ -69,17 +70,17 @@ func GetLoggedInUser(r *http.Request) (int, string) {
 }
 
 // LogoutUser properly cleans up the session and ensures the user is logged out
-func LogoutUser(w http.ResponseWriter, r *http.Request) {
+func (m *Manager) LogoutUser(w http.ResponseWriter, r *http.Request) {
 	// Clear all session data
-	Manager.Put(r, "userID", nil)
-	Manager.Put(r, "role", nil)
-	Manager.Put(r, "flash", nil)
+	m.Put(r, "userID", nil)
+	m.Put(r, "role", nil)
+	m.Put(r, "flash", nil)
 
 	// Force the session to be saved with the cleared values
-	Manager.Put(r, "_cleared", time.Now().Unix())
+	m.Put(r, "_cleared", time.Now().Unix())
 
 	// Destroy the session
-	Manager.Destroy(r)
+	m.Destroy(r)
 
 	// Explicitly remove the session cookie
 	http.SetCookie(w, &http.Cookie{
@@ -0,0 +1,488 @@
+// Package strength estimates how hard a password is to guess. It follows the
+// approach of Dropbox's zxcvbn: find the patterns an attacker would try first
+// (common passwords and words, keyboard runs, sequences, repeats, years and
+// the user's own name or email), then work out the cheapest way to build the
+// password from those patterns and brute force for the rest.
+package strength
+
+import (
+	"bufio"
+	_ "embed"
+	"math"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Warnings describe the weakest part of a password
+const (
+	WarnCommon   = "common"   // A common password
+	WarnWord     = "word"     // A dictionary word or name
+	WarnPersonal = "personal" // The user's username or email
+	WarnKeyboard = "keyboard" // A run of adjacent keys, like qwerty
+	WarnSequence = "sequence" // A sequence like abc or 1357
+	WarnRepeat   = "repeat"   // Repeated characters or chunks, like aaa or abcabc
+	WarnYear     = "year"     // A recent year
+)
+
+// Result is the estimate for a password
+type Result struct {
+	Guesses float64 // Estimated number of guesses to find the password
+	Score   int     // 0 (too guessable) to 4 (very unguessable)
+	Warning string  // What makes the password weak, or "" if nothing stands out
+}
+
+// maxLength bounds the work done on very long passwords; anything past it is
+// counted as brute force
+const maxLength = 100
+
+var (
+	//go:embed passwords.txt
+	passwordsList string
+	//go:embed words.txt
+	wordsList string
+
+	dictionaries = map[string]map[string]int{
+		"passwords": ranked(passwordsList),
+		"words":     ranked(wordsList),
+	}
+)
+
+// ranked reads a word list, one word per line with # comments, into a map
+// from word to its 1-based rank
+func ranked(list string) map[string]int {
+	ranks := map[string]int{}
+	s := bufio.NewScanner(strings.NewReader(list))
+	for s.Scan() {
+		word := strings.TrimSpace(s.Text())
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		if _, ok := ranks[word]; !ok {
+			ranks[word] = len(ranks) + 1
+		}
+	}
+	return ranks
+}
+
+// Estimate estimates how many guesses password would take. userInputs are
+// strings an attacker would try first, such as the username and email.
+func Estimate(password string, userInputs ...string) Result {
+	runes := []rune(password)
+	if len(runes) == 0 {
+		return Result{Guesses: 1}
+	}
+	extra := 0
+	if len(runes) > maxLength {
+		extra, runes = len(runes)-maxLength, runes[:maxLength]
+	}
+
+	matches := findMatches(runes, userDictionary(userInputs))
+	log10, warning := cheapest(runes, matches)
+	log10 += float64(extra) // brute force for the rest, at 10 guesses a character
+	return Result{Guesses: math.Pow(10, log10), Score: score(log10), Warning: warning}
+}
+
+// score turns log10 of the guesses into a score from 0 to 4, with the
+// thresholds zxcvbn uses for online and offline attacks
+func score(log10 float64) int {
+	switch {
+	case log10 < 3:
+		return 0
+	case log10 < 6:
+		return 1
+	case log10 < 8:
+		return 2
+	case log10 < 10:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// userDictionary ranks the user's inputs, and their words, as a dictionary
+func userDictionary(inputs []string) map[string]int {
+	ranks := map[string]int{}
+	add := func(w string) {
+		if len([]rune(w)) >= 3 {
+			if _, ok := ranks[w]; !ok {
+				ranks[w] = len(ranks) + 1
+			}
+		}
+	}
+	for _, input := range inputs {
+		input = strings.ToLower(strings.TrimSpace(input))
+		add(input)
+		for _, word := range strings.FieldsFunc(input, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) {
+			add(word)
+		}
+	}
+	return ranks
+}
+
+// match is a pattern found in password[i:j]
+type match struct {
+	i, j    int
+	log10   float64 // log10 of the guesses for this part
+	warning string
+}
+
+// cheapest finds the split of password into matches and brute-forced runs
+// that needs the fewest guesses overall. Each split costs the product of its
+// parts' guesses times the number of orders the parts could come in. It
+// returns log10 of the guesses and the warning of the longest match used.
+func cheapest(runes []rune, matches []match) (float64, string) {
+	n := len(runes)
+	byEnd := make([][]match, n+1)
+	for _, m := range matches {
+		byEnd[m.j] = append(byEnd[m.j], m)
+	}
+
+	// best[k][j] is the cheapest way to build runes[:j] from k parts
+	inf := math.Inf(1)
+	best := make([][]float64, n+1)
+	from := make([][]match, n+1)
+	for k := range best {
+		best[k] = make([]float64, n+1)
+		from[k] = make([]match, n+1)
+		for j := range best[k] {
+			best[k][j] = inf
+		}
+	}
+	best[0][0] = 0
+	for j := 1; j <= n; j++ {
+		candidates := byEnd[j]
+		for i := 0; i < j; i++ {
+			candidates = append(candidates, match{i: i, j: j, log10: bruteForce(j-i, n)})
+		}
+		for _, m := range candidates {
+			for k := 1; k <= j; k++ {
+				if prev := best[k-1][m.i]; prev+m.log10 < best[k][j] {
+					best[k][j] = prev + m.log10
+					from[k][j] = m
+				}
+			}
+		}
+	}
+
+	total, parts := inf, 0
+	for k := 1; k <= n; k++ {
+		if g := best[k][n] + logFactorial(k); g < total {
+			total, parts = g, k
+		}
+	}
+
+	// Walk back through the chosen parts for the longest named pattern
+	warning, longest := "", 0
+	for k, j := parts, n; k > 0; k-- {
+		m := from[k][j]
+		if m.warning != "" && m.j-m.i > longest {
+			warning, longest = m.warning, m.j-m.i
+		}
+		j = m.i
+	}
+	return total, warning
+}
+
+// bruteForce is log10 of the guesses for length characters tried one by
+// one, with zxcvbn's minimums for parts shorter than the password
+func bruteForce(length, passwordLength int) float64 {
+	g := float64(length)
+	if length < passwordLength {
+		if length == 1 {
+			return math.Max(g, 1.0414) // 11 guesses
+		}
+		return math.Max(g, 1.7076) // 51 guesses
+	}
+	return g
+}
+
+func logFactorial(k int) float64 {
+	lg, _ := math.Lgamma(float64(k + 1))
+	return lg / math.Ln10
+}
+
+// findMatches finds every pattern in runes
+func findMatches(runes []rune, user map[string]int) []match {
+	var matches []match
+	matches = append(matches, dictionaryMatches(runes, user)...)
+	matches = append(matches, spatialMatches(runes)...)
+	matches = append(matches, sequenceMatches(runes)...)
+	matches = append(matches, repeatMatches(runes, user)...)
+	matches = append(matches, yearMatches(runes)...)
+	return matches
+}
+
+// dictionaryMatches finds words from the dictionaries, also written
+// backwards or with l33t substitutions such as p4ssw0rd
+func dictionaryMatches(runes []rune, user map[string]int) []match {
+	lower := make([]rune, len(runes))
+	unleeted := make([]rune, len(runes))
+	for i, r := range runes {
+		r = unicode.ToLower(r)
+		lower[i] = r
+		if s, ok := l33t[r]; ok {
+			unleeted[i] = s
+		} else {
+			unleeted[i] = r
+		}
+	}
+
+	var matches []match
+	try := func(dict string, ranks map[string]int) {
+		for i := range lower {
+			for j := i + 1; j <= len(lower); j++ {
+				word := string(lower[i:j])
+				variations := upperVariations(runes[i:j])
+				if rank, ok := ranks[word]; ok {
+					matches = append(matches, dictionaryMatch(i, j, dict, rank, variations))
+				}
+				if rank, ok := ranks[reverse(word)]; ok && j-i > 1 {
+					matches = append(matches, dictionaryMatch(i, j, dict, rank, variations*2))
+				}
+				if word2 := string(unleeted[i:j]); word2 != word {
+					if rank, ok := ranks[word2]; ok {
+						matches = append(matches, dictionaryMatch(i, j, dict, rank, variations*l33tVariations(lower[i:j])))
+					}
+				}
+			}
+		}
+	}
+	for dict, ranks := range dictionaries {
+		try(dict, ranks)
+	}
+	try("user", user)
+	return matches
+}
+
+func dictionaryMatch(i, j int, dict string, rank int, variations float64) match {
+	warning := WarnWord
+	switch dict {
+	case "passwords":
+		warning = WarnCommon
+	case "user":
+		warning = WarnPersonal
+	}
+	return match{i: i, j: j, log10: math.Log10(float64(rank) * variations), warning: warning}
+}
+
+// l33t maps substitutions people make for letters back to the letters
+var l33t = map[rune]rune{
+	'4': 'a', '@': 'a', '8': 'b', '(': 'c', '{': 'c', '[': 'c', '3': 'e',
+	'6': 'g', '9': 'g', '1': 'i', '!': 'i', '|': 'l', '0': 'o', '5': 's',
+	'$': 's', '7': 't', '+': 't', '%': 'x', '2': 'z',
+}
+
+// l33tVariations is the number of ways the substituted characters of token
+// could have been chosen
+func l33tVariations(token []rune) float64 {
+	subs := 0
+	for _, r := range token {
+		if _, ok := l33t[r]; ok {
+			subs++
+		}
+	}
+	return math.Max(2, float64(subs)*2)
+}
+
+// upperVariations is the number of ways the capitals in token could have
+// been chosen. Capitalizing the first or last letter, or all of them, only
+// doubles the guesses.
+func upperVariations(token []rune) float64 {
+	upper, lower := 0, 0
+	for _, r := range token {
+		switch {
+		case unicode.IsUpper(r):
+			upper++
+		case unicode.IsLower(r):
+			lower++
+		}
+	}
+	if upper == 0 {
+		return 1
+	}
+	first, last := unicode.IsUpper(token[0]), unicode.IsUpper(token[len(token)-1])
+	if lower == 0 || (upper == 1 && (first || last)) {
+		return 2
+	}
+	variations := 0.0
+	for k := 1; k <= min(upper, lower); k++ {
+		variations += binomial(upper+lower, k)
+	}
+	return variations
+}
+
+func binomial(n, k int) float64 {
+	r := 1.0
+	for i := 1; i <= k; i++ {
+		r = r * float64(n-k+i) / float64(i)
+	}
+	return r
+}
+
+func reverse(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r)
+}
+
+// keyboardRows are the rows of a US QWERTY keyboard, unshifted and shifted
+var keyboardRows = []string{
+	"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./",
+	"~!@#$%^&*()_+", "QWERTYUIOP{}|", "ASDFGHJKL:\"", "ZXCVBNM<>?",
+}
+
+// keyPositions maps each key to its row, folding shifted rows onto the
+// unshifted ones, and its column
+var keyPositions = func() map[rune][2]int {
+	pos := map[rune][2]int{}
+	for row, keys := range keyboardRows {
+		for col, r := range keys {
+			pos[r] = [2]int{row % 4, col}
+		}
+	}
+	return pos
+}()
+
+// spatialMatches finds runs of three or more neighbouring keys in one row,
+// in either direction, such as qwerty or 0987
+func spatialMatches(runes []rune) []match {
+	var matches []match
+	for i := 0; i < len(runes); {
+		j, dir := i+1, 0
+		for ; j < len(runes); j++ {
+			a, okA := keyPositions[runes[j-1]]
+			b, okB := keyPositions[runes[j]]
+			d := b[1] - a[1]
+			if !okA || !okB || a[0] != b[0] || (d != 1 && d != -1) || (dir != 0 && d != dir) {
+				break
+			}
+			dir = d
+		}
+		if j-i >= 3 {
+			// About 47 starting keys with two neighbours each along a row
+			g := 47.0 * 2 * float64(j-i-1)
+			if shifted := countShifted(runes[i:j]); shifted > 0 && shifted < j-i {
+				g *= 2
+			}
+			matches = append(matches, match{i: i, j: j, log10: math.Log10(g), warning: WarnKeyboard})
+		}
+		if j-i >= 3 {
+			i = j
+		} else {
+			i++
+		}
+	}
+	return matches
+}
+
+func countShifted(token []rune) int {
+	n := 0
+	for _, r := range token {
+		if unicode.IsUpper(r) || strings.ContainsRune("~!@#$%^&*()_+{}|:\"<>?", r) {
+			n++
+		}
+	}
+	return n
+}
+
+// sequenceMatches finds three or more letters or digits with the same step,
+// such as abc, 2468 or zyx
+func sequenceMatches(runes []rune) []match {
+	var matches []match
+	for i := 0; i+2 < len(runes); {
+		delta := runes[i+1] - runes[i]
+		j := i + 1
+		for j < len(runes) && runes[j]-runes[j-1] == delta && sameClass(runes[i], runes[j]) {
+			j++
+		}
+		if j-i >= 3 && delta != 0 && delta >= -5 && delta <= 5 {
+			base := 26.0
+			switch {
+			case strings.ContainsRune("aAzZ019", runes[i]):
+				base = 4
+			case unicode.IsDigit(runes[i]):
+				base = 10
+			}
+			if delta < 0 {
+				base *= 2
+			}
+			matches = append(matches, match{i: i, j: j, log10: math.Log10(base * float64(j-i)), warning: WarnSequence})
+			i = j - 1
+		} else {
+			i++
+		}
+	}
+	return matches
+}
+
+// sameClass reports whether a and b are both lowercase letters, both
+// uppercase letters or both digits
+func sameClass(a, b rune) bool {
+	class := func(r rune) int {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return 1
+		case r >= 'A' && r <= 'Z':
+			return 2
+		case r >= '0' && r <= '9':
+			return 3
+		}
+		return 0
+	}
+	return class(a) != 0 && class(a) == class(b)
+}
+
+// repeatMatches finds a character or chunk repeated back to back, like aaa
+// or abcabc. The guesses are those of the chunk times the repeats.
+func repeatMatches(runes []rune, user map[string]int) []match {
+	var matches []match
+	for i := 0; i < len(runes); {
+		bestLen, bestChunk := 0, 0
+		for size := 1; i+2*size <= len(runes); size++ {
+			count := 1
+			for i+(count+1)*size <= len(runes) && string(runes[i:i+size]) == string(runes[i+count*size:i+(count+1)*size]) {
+				count++
+			}
+			if count > 1 && count*size > bestLen {
+				bestLen, bestChunk = count*size, size
+			}
+		}
+		if bestLen == 0 {
+			i++
+			continue
+		}
+		chunk := runes[i : i+bestChunk]
+		chunkLog, _ := cheapest(chunk, findMatches(chunk, user))
+		g := chunkLog + math.Log10(float64(bestLen/bestChunk))
+		matches = append(matches, match{i: i, j: i + bestLen, log10: g, warning: WarnRepeat})
+		i += bestLen
+	}
+	return matches
+}
+
+// yearMatches finds years from 1900 to 2099, which are guessed by how far
+// they are from now
+func yearMatches(runes []rune) []match {
+	var matches []match
+	now := time.Now().Year()
+	for i := 0; i+4 <= len(runes); i++ {
+		year := 0
+		for _, r := range runes[i : i+4] {
+			if r < '0' || r > '9' {
+				year = -1
+				break
+			}
+			year = year*10 + int(r-'0')
+		}
+		if year >= 1900 && year <= 2099 {
+			g := math.Max(math.Abs(float64(year-now)), 20)
+			matches = append(matches, match{i: i, j: i + 4, log10: math.Log10(g), warning: WarnYear})
+		}
+	}
+	return matches
+}
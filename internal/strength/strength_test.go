@@ -0,0 +1,49 @@
+package strength
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEstimate(t *testing.T) {
+	tests := []struct {
+		password string
+		maxScore int
+		minScore int
+		warning  string
+	}{
+		{"Password1!", 1, 0, WarnCommon},
+		{"p4ssw0rd", 0, 0, WarnCommon},
+		{"drowssap", 0, 0, WarnCommon},
+		{"zxcvbnm,./", 1, 0, WarnKeyboard},
+		{"abcdefgh", 0, 0, WarnSequence},
+		{"97531", 1, 0, WarnSequence},
+		{"aaaaaaaaaaaa", 1, 0, WarnRepeat},
+		{"xkcdxkcdxkcd", 2, 0, WarnRepeat},
+		{"faith1987", 2, 0, WarnWord},
+		{"Ana.Example.2024", 2, 0, WarnPersonal},
+		{"mapleSunrise47?", 4, 3, ""},
+		{"correct horse battery staple", 4, 4, WarnWord},
+		{"kT9#vq2!Lm", 4, 4, ""},
+	}
+	for _, tt := range tests {
+		r := Estimate(tt.password, "ana", "ana@example.com")
+		if r.Score < tt.minScore || r.Score > tt.maxScore {
+			t.Errorf("%q: score %d (%.0f guesses), want %d to %d", tt.password, r.Score, r.Guesses, tt.minScore, tt.maxScore)
+		}
+		if r.Warning != tt.warning {
+			t.Errorf("%q: warning %q, want %q", tt.password, r.Warning, tt.warning)
+		}
+	}
+}
+
+// TestEstimateEdgeCases checks inputs that could trip up the matchers
+func TestEstimateEdgeCases(t *testing.T) {
+	if r := Estimate(""); r.Score != 0 {
+		t.Errorf("empty password: score %d", r.Score)
+	}
+	// Runes whose lowercase has another length, and long passwords
+	for _, p := range []string{"İstanbul1923", "ÅÅÅÅ", strings.Repeat("ab", 200), strings.Repeat("a", 500)} {
+		Estimate(p)
+	}
+}
@@ -0,0 +1,267 @@
+// Package takeout writes a user's personal data export: a zip archive with
+// everything kept about them as JSON, one file per kind of record, and an
+// index.html that shows the same data in a browser.
+package takeout
+
+import (
+	"archive/zip"
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"html/template"
+	"io"
+	"time"
+
+	"github.com/darynforman/gratitude-jar1/internal/data"
+	"github.com/darynforman/gratitude-jar1/internal/i18n"
+	"github.com/darynforman/gratitude-jar1/internal/security"
+)
+
+//go:embed index.html.tmpl
+var indexSource string
+
+var index = template.Must(template.New("index").Parse(indexSource))
+
+// Dir is the folder the files are put in inside the archive
+const Dir = "gratitude-jar"
+
+// Export is everything kept about one user
+type Export struct {
+	GeneratedAt    time.Time       `json:"generated_at"`
+	Profile        Profile         `json:"profile"`
+	Notes          []Note          `json:"notes"`
+	Preferences    Preferences     `json:"preferences"`
+	Sessions       Sessions        `json:"sessions"`
+	Apps           []App           `json:"apps"`
+	LinkedAccounts []LinkedAccount `json:"linked_accounts"`
+	SecurityEvents []Event         `json:"security_events"`
+}
+
+// Profile is the user's account, without the password hash
+type Profile struct {
+	ID                  int        `json:"id"`
+	Username            string     `json:"username"`
+	Email               string     `json:"email"`
+	Role                string     `json:"role"`
+	CreatedAt           time.Time  `json:"created_at"`
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
+	DeactivatedAt       *time.Time `json:"deactivated_at,omitempty"`
+	ExternalID          string     `json:"external_id,omitempty"`
+}
+
+// Note is one gratitude note
+type Note struct {
+	ID        int       `json:"id"`
+	Title     string    `json:"title"`
+	Content   string    `json:"content"`
+	Category  string    `json:"category"`
+	Emoji     string    `json:"emoji"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Preferences are the user's settings
+type Preferences struct {
+	Timezone        string `json:"timezone"`
+	Locale          string `json:"locale"`
+	Theme           string `json:"theme"`
+	DefaultCategory string `json:"default_category"`
+	DefaultEmoji    string `json:"default_emoji"`
+	NotesPerPage    int    `json:"notes_per_page"`
+	SortOrder       string `json:"sort_order"`
+}
+
+// SessionStorage explains why an export lists sign-ins rather than sessions
+const SessionStorage = "Sessions are kept only in the browser's signed session cookie; none are stored on the server."
+
+// Sessions is what is known about the user's sessions: where they are
+// kept, and the sign-ins and sign-outs of the audit log
+type Sessions struct {
+	Storage string  `json:"storage"`
+	SignIns []Event `json:"sign_ins"`
+}
+
+// App is an app the user let use their account
+type App struct {
+	Name         string     `json:"name"`
+	ClientID     string     `json:"client_id"`
+	Scopes       []string   `json:"scopes"`
+	AuthorizedAt time.Time  `json:"authorized_at"`
+	LastUsedAt   *time.Time `json:"last_used_at,omitempty"`
+	Tokens       []Token    `json:"tokens"`
+}
+
+// Token is an unexpired token issued to an app. Only a hash of the token
+// itself is kept, so it cannot be exported.
+type Token struct {
+	Kind      string    `json:"kind"`
+	Scope     string    `json:"scope"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// LinkedAccount is an account at a single sign-on provider linked to the
+// user's
+type LinkedAccount struct {
+	Issuer   string    `json:"issuer"`
+	Subject  string    `json:"subject"`
+	Email    string    `json:"email"`
+	LinkedAt time.Time `json:"linked_at"`
+}
+
+// Event is an entry of the audit log about the user
+type Event struct {
+	Type      string    `json:"type"`
+	Success   bool      `json:"success"`
+	IP        string    `json:"ip"`
+	Details   string    `json:"details"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Records are the user's rows an export is made from
+type Records struct {
+	User        *data.User
+	Notes       []data.GratitudeNote
+	Preferences *data.Preferences
+	Grants      []data.OAuthGrant
+	Tokens      []data.OAuthToken
+	Identities  []data.Identity
+	Events      []data.SecurityEvent
+}
+
+// New collects a user's records into an export
+func New(rec Records, now time.Time) *Export {
+	user, prefs := rec.User, rec.Preferences
+	e := &Export{
+		GeneratedAt: now,
+		Profile: Profile{
+			ID:                  user.ID,
+			Username:            user.Username,
+			Email:               user.Email,
+			Role:                user.Role,
+			CreatedAt:           user.CreatedAt,
+			DeletionScheduledAt: user.DeletionScheduledAt,
+			DeactivatedAt:       user.DeactivatedAt,
+			ExternalID:          user.ExternalID,
+		},
+		Notes: make([]Note, 0, len(rec.Notes)),
+		Preferences: Preferences{
+			Timezone:        prefs.Timezone,
+			Locale:          prefs.Locale,
+			Theme:           prefs.Theme,
+			DefaultCategory: prefs.DefaultCategory,
+			DefaultEmoji:    prefs.DefaultEmoji,
+			NotesPerPage:    prefs.NotesPerPage,
+			SortOrder:       prefs.SortOrder,
+		},
+		Sessions:       Sessions{Storage: SessionStorage, SignIns: []Event{}},
+		Apps:           make([]App, 0, len(rec.Grants)),
+		LinkedAccounts: make([]LinkedAccount, 0, len(rec.Identities)),
+		SecurityEvents: make([]Event, 0, len(rec.Events)),
+	}
+	for _, n := range rec.Notes {
+		e.Notes = append(e.Notes, Note{
+			ID:        n.ID,
+			Title:     n.Title,
+			Content:   n.Content,
+			Category:  n.Category,
+			Emoji:     n.Emoji,
+			CreatedAt: n.CreatedAt,
+			UpdatedAt: n.UpdatedAt,
+		})
+	}
+	for _, g := range rec.Grants {
+		app := App{
+			Name:         g.ClientName,
+			ClientID:     g.ClientID,
+			Scopes:       g.Scopes(),
+			AuthorizedAt: g.CreatedAt,
+			LastUsedAt:   g.LastUsedAt,
+			Tokens:       []Token{},
+		}
+		for _, t := range rec.Tokens {
+			if t.GrantID == g.ID {
+				app.Tokens = append(app.Tokens, Token{Kind: t.Kind, Scope: t.Scope, CreatedAt: t.CreatedAt, ExpiresAt: t.ExpiresAt})
+			}
+		}
+		e.Apps = append(e.Apps, app)
+	}
+	for _, i := range rec.Identities {
+		e.LinkedAccounts = append(e.LinkedAccounts, LinkedAccount{Issuer: i.Issuer, Subject: i.Subject, Email: i.Email, LinkedAt: i.CreatedAt})
+	}
+	for _, ev := range rec.Events {
+		event := Event{
+			Type:      ev.EventType,
+			Success:   ev.Success,
+			IP:        ev.IP,
+			Details:   ev.Details,
+			CreatedAt: ev.CreatedAt,
+		}
+		e.SecurityEvents = append(e.SecurityEvents, event)
+		if ev.EventType == string(security.EventLogin) || ev.EventType == string(security.EventLogout) {
+			e.Sessions.SignIns = append(e.Sessions.SignIns, event)
+		}
+	}
+	return e
+}
+
+// page is the data for index.html: the export, translated into the user's
+// language with times in their zone
+type page struct {
+	*Export
+	*i18n.Translator
+	loc *time.Location
+}
+
+// Time formats t as a localized date and time in the user's time zone
+func (p page) Time(t time.Time) string {
+	t = t.In(p.loc)
+	return p.Translator.Date(t) + t.Format(" 15:04 MST")
+}
+
+// Write writes e as a zip archive to w. index.html is in tr's language
+// with times in loc.
+func Write(w io.Writer, e *Export, tr *i18n.Translator, loc *time.Location) error {
+	var html bytes.Buffer
+	if err := index.Execute(&html, page{Export: e, Translator: tr, loc: loc}); err != nil {
+		return err
+	}
+
+	files := []struct {
+		name string
+		v    any
+	}{
+		{"profile.json", e.Profile},
+		{"notes.json", e.Notes},
+		{"preferences.json", e.Preferences},
+		{"sessions.json", e.Sessions},
+		{"apps.json", e.Apps},
+		{"linked_accounts.json", e.LinkedAccounts},
+		{"security_events.json", e.SecurityEvents},
+	}
+
+	zw := zip.NewWriter(w)
+	if err := writeFile(zw, "index.html", html.Bytes(), e.GeneratedAt); err != nil {
+		return err
+	}
+	for _, f := range files {
+		b, err := json.MarshalIndent(f.v, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeFile(zw, f.name, append(b, '\n'), e.GeneratedAt); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// writeFile adds one file to the archive
+func writeFile(zw *zip.Writer, name string, content []byte, modified time.Time) error {
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: Dir + "/" + name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	return err
+}
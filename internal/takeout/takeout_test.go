@@ -0,0 +1,111 @@
+package takeout
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darynforman/gratitude-jar1/internal/data"
+	"github.com/darynforman/gratitude-jar1/internal/i18n"
+)
+
+func TestWrite(t *testing.T) {
+	bundle, err := i18n.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := time.Date(2024, time.March, 29, 1, 0, 0, 0, time.UTC)
+	user := &data.User{ID: 7, Username: "ana", Email: "ana@example.com", PasswordHash: "$2a$10$secret", Role: "user", CreatedAt: created}
+	notes := []data.GratitudeNote{{ID: 1, Title: "<script>alert(1)</script>", Content: "Sunrise", Category: "personal", Emoji: "✨", CreatedAt: created, UpdatedAt: created}}
+	events := []data.SecurityEvent{
+		{EventType: "LOGIN", UserID: 7, Username: "ana", IP: "203.0.113.9", Success: true, CreatedAt: created},
+		{EventType: "PASSWORD_CHANGE", UserID: 7, Username: "ana", IP: "203.0.113.9", Success: true, CreatedAt: created},
+	}
+	grants := []data.OAuthGrant{{ID: 3, ClientID: "c1", ClientName: "Journal Sync", UserID: 7, Scope: "notes:read", CreatedAt: created}}
+	tokens := []data.OAuthToken{
+		{GrantID: 3, ClientID: "c1", UserID: 7, Kind: data.TokenRefresh, Scope: "notes:read", CreatedAt: created, ExpiresAt: created.AddDate(0, 1, 0)},
+		{GrantID: 4, ClientID: "c2", UserID: 7, Kind: data.TokenAccess, Scope: "notes:read", CreatedAt: created, ExpiresAt: created.Add(time.Hour)},
+	}
+	identities := []data.Identity{{Issuer: "https://id.example.com", Subject: "248289761001", UserID: 7, Email: "ana@example.com", CreatedAt: created}}
+	export := New(Records{
+		User:        user,
+		Notes:       notes,
+		Preferences: data.DefaultPreferences(7),
+		Grants:      grants,
+		Tokens:      tokens,
+		Identities:  identities,
+		Events:      events,
+	}, created)
+
+	loc, _ := time.LoadLocation("America/Belize")
+	var buf bytes.Buffer
+	if err := Write(&buf, export, bundle.Translator("es"), loc); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		files[strings.TrimPrefix(f.Name, Dir+"/")] = string(b)
+	}
+
+	for _, name := range []string{"index.html", "profile.json", "notes.json", "preferences.json", "sessions.json", "apps.json", "linked_accounts.json", "security_events.json"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("archive has no %s", name)
+		}
+	}
+	if strings.Contains(files["profile.json"], "secret") {
+		t.Error("profile.json contains the password hash")
+	}
+
+	var got []Note
+	if err := json.Unmarshal([]byte(files["notes.json"]), &got); err != nil || len(got) != 1 || got[0].Title != notes[0].Title {
+		t.Errorf("notes.json = %s (%v)", files["notes.json"], err)
+	}
+
+	var sessions Sessions
+	if err := json.Unmarshal([]byte(files["sessions.json"]), &sessions); err != nil || sessions.Storage == "" || len(sessions.SignIns) != 1 {
+		t.Errorf("sessions.json = %s (%v)", files["sessions.json"], err)
+	}
+	var apps []App
+	if err := json.Unmarshal([]byte(files["apps.json"]), &apps); err != nil || len(apps) != 1 || len(apps[0].Tokens) != 1 || apps[0].Tokens[0].Kind != data.TokenRefresh {
+		t.Errorf("apps.json = %s (%v)", files["apps.json"], err)
+	}
+
+	html := files["index.html"]
+	for _, want := range []string{`<html lang="es">`, "Tus datos de Gratitude Jar", "&lt;script&gt;", "203.0.113.9", "28 mar 2024",
+		"Journal Sync", "Token de renovación", "https://id.example.com"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("index.html does not contain %q", want)
+		}
+	}
+}
+
+// TestIndexKeys checks every message used by index.html is translated
+func TestIndexKeys(t *testing.T) {
+	bundle, err := i18n.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := bundle.Translator(i18n.DefaultLocale)
+	for _, m := range regexp.MustCompile(`\.T "([a-z0-9_.]+)"`).FindAllStringSubmatch(indexSource, -1) {
+		if !tr.Has(m[1]) {
+			t.Errorf("no message for %s", m[1])
+		}
+	}
+}
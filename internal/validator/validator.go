@@ -4,21 +4,28 @@ package validator
 
 import (
 	"strings"
+	"time"
 	"unicode"
 	"unicode/utf8"
+
+	"github.com/darynforman/gratitude-jar1/internal/strength"
 )
 
 // Validator holds validation errors for form fields.
-// It uses a map to store field-specific error messages.
+// Errors maps each field to a message key from the i18n catalogs, such as
+// "validation.title.too_short"; Args holds the name/value pairs that fill the
+// message's placeholders. Keys that are not in the catalogs are shown as is.
 type Validator struct {
 	Errors map[string]string
+	Args   map[string][]any
 }
 
 // NewValidator creates and returns a new Validator instance
-// with an initialized errors map.
+// with initialized errors and arguments maps.
 func NewValidator() *Validator {
 	return &Validator{
 		Errors: make(map[string]string),
+		Args:   make(map[string][]any),
 	}
 }
 
@@ -28,20 +35,30 @@ func (v *Validator) ValidData() bool {
 	return len(v.Errors) == 0
 }
 
-// AddError adds an error message for a specific field.
+// AddError adds an error message key, with its arguments, for a specific field.
 // If the field already has an error, it won't be overwritten.
-func (v *Validator) AddError(field string, message string) {
+func (v *Validator) AddError(field string, key string, args ...any) {
 	_, exists := v.Errors[field]
 	if !exists {
-		v.Errors[field] = message
+		v.Errors[field] = key
+		if len(args) > 0 {
+			v.Args[field] = args
+		}
 	}
 }
 
 // Check performs a validation check and adds an error if the check fails.
-// It takes a boolean condition, field name, and error message as parameters.
-func (v *Validator) Check(ok bool, field string, message string) {
+// It takes a boolean condition, field name, message key and its arguments.
+func (v *Validator) Check(ok bool, field string, key string, args ...any) {
 	if !ok {
-		v.AddError(field, message)
+		v.AddError(field, key, args...)
+	}
+}
+
+// Merge copies the errors of other into v, keeping v's existing errors
+func (v *Validator) Merge(other *Validator) {
+	for field, key := range other.Errors {
+		v.AddError(field, key, other.Args[field]...)
 	}
 }
 
@@ -63,6 +80,26 @@ func MaxLength(value string, n int) bool {
 	return utf8.RuneCountInString(value) <= n
 }
 
+// PermittedValue checks if value is one of permitted
+func PermittedValue[T comparable](value T, permitted ...T) bool {
+	for _, p := range permitted {
+		if value == p {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidTimezone checks if name is an IANA time zone such as "Europe/Madrid".
+// "Local" is refused, since it means the server's zone.
+func ValidTimezone(name string) bool {
+	if name == "" || name == "Local" {
+		return false
+	}
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
+
 // ValidCategory checks if a category is valid.
 // Currently valid categories are: personal, work, health, relationships, other
 func ValidCategory(category string) bool {
@@ -110,20 +147,20 @@ func ValidateGratitudeNote(title, content, category, emoji string) *Validator {
 	v := NewValidator()
 
 	// Validate title
-	v.Check(NotBlank(title), "title", "Title cannot be blank")
-	v.Check(MinLength(title, 3), "title", "Title must be at least 3 characters long")
-	v.Check(MaxLength(title, 100), "title", "Title cannot be more than 100 characters long")
+	v.Check(NotBlank(title), "title", "validation.title.blank")
+	v.Check(MinLength(title, 3), "title", "validation.title.too_short", "count", 3)
+	v.Check(MaxLength(title, 100), "title", "validation.title.too_long", "count", 100)
 
 	// Validate content
-	v.Check(NotBlank(content), "content", "Content cannot be blank")
-	v.Check(MinLength(content, 10), "content", "Content must be at least 10 characters long")
-	v.Check(MaxLength(content, 1000), "content", "Content cannot be more than 1000 characters long")
+	v.Check(NotBlank(content), "content", "validation.content.blank")
+	v.Check(MinLength(content, 10), "content", "validation.content.too_short", "count", 10)
+	v.Check(MaxLength(content, 1000), "content", "validation.content.too_long", "count", 1000)
 
 	// Validate category
-	v.Check(ValidCategory(category), "category", "Please select a valid category")
+	v.Check(ValidCategory(category), "category", "validation.category.invalid")
 
 	// Validate emoji
-	v.Check(v.ValidEmoji(emoji), "emoji", "Please select a valid emoji")
+	v.Check(v.ValidEmoji(emoji), "emoji", "validation.emoji.invalid")
 
 	return v
 }
@@ -138,7 +175,7 @@ func ValidatePassword(password string) *Validator {
 	v := NewValidator()
 
 	// Check minimum length
-	v.Check(MinLength(password, 8), "password", "Password must be at least 8 characters long")
+	v.Check(MinLength(password, 8), "password", "validation.password.too_short", "count", 8)
 
 	// Check for required character types
 	var (
@@ -161,35 +198,92 @@ func ValidatePassword(password string) *Validator {
 		}
 	}
 
-	v.Check(hasUpper, "password", "Password must contain at least one uppercase letter")
-	v.Check(hasLower, "password", "Password must contain at least one lowercase letter")
-	v.Check(hasNumber, "password", "Password must contain at least one number")
-	v.Check(hasSpecial, "password", "Password must contain at least one special character")
+	v.Check(hasUpper, "password", "validation.password.no_upper")
+	v.Check(hasLower, "password", "validation.password.no_lower")
+	v.Check(hasNumber, "password", "validation.password.no_number")
+	v.Check(hasSpecial, "password", "validation.password.no_special")
 
 	return v
 }
 
+// PasswordStrength checks that password would take enough guesses to
+// score at least minScore, from 0 to 4. userInputs, such as the username and
+// email, count against it. Fields that already failed are left alone.
+func (v *Validator) PasswordStrength(field, password string, minScore int, userInputs ...string) {
+	if _, failed := v.Errors[field]; failed {
+		return
+	}
+	if r := strength.Estimate(password, userInputs...); r.Score < minScore {
+		warning := r.Warning
+		if warning == "" {
+			warning = "generic"
+		}
+		v.AddError(field, "validation.password.weak."+warning)
+	}
+}
+
+// ValidateUsername checks a username is between 3 and 30 characters
+func ValidateUsername(username string) *Validator {
+	v := NewValidator()
+	v.Check(NotBlank(username), "username", "validation.username.blank")
+	v.Check(MinLength(username, 3), "username", "validation.username.too_short", "count", 3)
+	v.Check(MaxLength(username, 30), "username", "validation.username.too_long", "count", 30)
+	return v
+}
+
+// ValidateEmail checks an email address is present and looks like one
+func ValidateEmail(email string) *Validator {
+	v := NewValidator()
+	v.Check(NotBlank(email), "email", "validation.email.blank")
+	v.Check(strings.Contains(email, "@"), "email", "validation.email.invalid")
+	return v
+}
+
 // ValidateRegistration validates all registration form fields
 func ValidateRegistration(username, email, password, confirmPassword string) *Validator {
 	v := NewValidator()
 
-	// Validate username
-	v.Check(NotBlank(username), "username", "Username cannot be blank")
-	v.Check(MinLength(username, 3), "username", "Username must be at least 3 characters long")
-	v.Check(MaxLength(username, 30), "username", "Username cannot be more than 30 characters long")
-
-	// Validate email
-	v.Check(NotBlank(email), "email", "Email cannot be blank")
-	v.Check(strings.Contains(email, "@"), "email", "Email must be a valid email address")
+	// Validate username and email
+	v.Merge(ValidateUsername(username))
+	v.Merge(ValidateEmail(email))
 
 	// Validate password
-	passwordValidator := ValidatePassword(password)
-	for field, msg := range passwordValidator.Errors {
-		v.AddError(field, msg)
-	}
+	v.Merge(ValidatePassword(password))
 
 	// Validate password confirmation
-	v.Check(password == confirmPassword, "confirm_password", "Passwords do not match")
+	v.Check(password == confirmPassword, "confirm_password", "validation.confirm_password.mismatch")
+
+	return v
+}
+
+// ValidatePasswordChange validates the change password form. The new
+// password must meet the same requirements as at registration and differ
+// from the current one; checking the current password is left to the caller.
+func ValidatePasswordChange(currentPassword, newPassword, confirmPassword string) *Validator {
+	v := NewValidator()
+
+	v.Check(NotBlank(currentPassword), "current_password", "validation.password.required")
+	if pv := ValidatePassword(newPassword); !pv.ValidData() {
+		v.AddError("new_password", pv.Errors["password"], pv.Args["password"]...)
+	}
+	v.Check(newPassword != currentPassword, "new_password", "validation.new_password.unchanged")
+	v.Check(newPassword == confirmPassword, "confirm_password", "validation.confirm_password.mismatch")
+
+	return v
+}
+
+// ValidatePreferences validates the settings form. The default category and
+// emoji may be empty, meaning none; the locale is checked by the caller
+// against the available catalogs.
+func ValidatePreferences(timezone, theme, category, emoji string, notesPerPage int, sort string) *Validator {
+	v := NewValidator()
+
+	v.Check(ValidTimezone(timezone), "timezone", "validation.timezone.invalid")
+	v.Check(PermittedValue(theme, "light", "dark"), "theme", "validation.theme.invalid")
+	v.Check(category == "" || ValidCategory(category), "default_category", "validation.category.invalid")
+	v.Check(emoji == "" || v.ValidEmoji(emoji), "default_emoji", "validation.emoji.invalid")
+	v.Check(notesPerPage >= 1 && notesPerPage <= 100, "notes_per_page", "validation.notes_per_page.range", "min", 1, "max", 100)
+	v.Check(PermittedValue(sort, "newest", "oldest"), "sort_order", "validation.sort_order.invalid")
 
 	return v
 }
@@ -0,0 +1,2 @@
+-- Migration: Drop security_events table
+DROP TABLE IF EXISTS security_events;
@@ -0,0 +1,14 @@
+-- Migration: Create security_events table (audit log)
+CREATE TABLE IF NOT EXISTS security_events (
+    id BIGSERIAL PRIMARY KEY,
+    event_type TEXT NOT NULL,
+    user_id INTEGER,
+    username TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    details TEXT NOT NULL DEFAULT '',
+    success BOOLEAN NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS security_events_created_at_idx ON security_events (created_at);
+CREATE INDEX IF NOT EXISTS security_events_user_id_idx ON security_events (user_id);
@@ -0,0 +1,2 @@
+-- Migration: Drop ip_rules table
+DROP TABLE IF EXISTS ip_rules;
@@ -0,0 +1,12 @@
+-- Migration: Create ip_rules table for allow/deny entries and temporary bans
+CREATE TABLE IF NOT EXISTS ip_rules (
+    id SERIAL PRIMARY KEY,
+    cidr CIDR NOT NULL,
+    action TEXT NOT NULL CHECK (action IN ('allow', 'deny')),
+    reason TEXT NOT NULL DEFAULT '',
+    created_by TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS ip_rules_expires_at_idx ON ip_rules (expires_at);
@@ -0,0 +1,3 @@
+-- Migration: Drop user_preferences table
+DROP INDEX IF EXISTS gratitude_notes_user_id_created_at_idx;
+DROP TABLE IF EXISTS user_preferences;
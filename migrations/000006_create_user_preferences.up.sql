@@ -0,0 +1,14 @@
+-- Migration: Create user_preferences table, one row per user who changed a setting
+CREATE TABLE IF NOT EXISTS user_preferences (
+    user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    timezone TEXT NOT NULL DEFAULT 'UTC',
+    locale TEXT NOT NULL DEFAULT '',
+    theme TEXT NOT NULL DEFAULT 'light' CHECK (theme IN ('light', 'dark')),
+    default_category TEXT NOT NULL DEFAULT '',
+    default_emoji TEXT NOT NULL DEFAULT '',
+    notes_per_page INTEGER NOT NULL DEFAULT 12 CHECK (notes_per_page BETWEEN 1 AND 100),
+    sort_order TEXT NOT NULL DEFAULT 'newest' CHECK (sort_order IN ('newest', 'oldest')),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS gratitude_notes_user_id_created_at_idx ON gratitude_notes (user_id, created_at);
@@ -0,0 +1,2 @@
+-- Migration: Drop email_changes table
+DROP TABLE IF EXISTS email_changes;
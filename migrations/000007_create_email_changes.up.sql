@@ -0,0 +1,11 @@
+-- Migration: Create email_changes table for pending email address changes,
+-- confirmed by a link sent to the new address. Only a hash of the token is kept.
+CREATE TABLE IF NOT EXISTS email_changes (
+    token_hash BYTEA PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    new_email VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS email_changes_user_id_idx ON email_changes (user_id);
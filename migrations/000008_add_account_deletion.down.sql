@@ -0,0 +1,8 @@
+-- Migration: Remove account deletion scheduling and the cascade on notes
+ALTER TABLE gratitude_notes
+    DROP CONSTRAINT IF EXISTS gratitude_notes_user_id_fkey,
+    ADD CONSTRAINT gratitude_notes_user_id_fkey
+        FOREIGN KEY (user_id) REFERENCES users(id);
+
+DROP INDEX IF EXISTS users_deletion_scheduled_at_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS deletion_scheduled_at;
@@ -0,0 +1,10 @@
+-- Migration: Schedule account deletion and erase a user's notes with the account
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deletion_scheduled_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS users_deletion_scheduled_at_idx ON users (deletion_scheduled_at)
+    WHERE deletion_scheduled_at IS NOT NULL;
+
+ALTER TABLE gratitude_notes
+    DROP CONSTRAINT IF EXISTS gratitude_notes_user_id_fkey,
+    ADD CONSTRAINT gratitude_notes_user_id_fkey
+        FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
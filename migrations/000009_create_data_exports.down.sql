@@ -0,0 +1,2 @@
+-- Migration: Drop data_exports table
+DROP TABLE IF EXISTS data_exports;
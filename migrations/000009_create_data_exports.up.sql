@@ -0,0 +1,15 @@
+-- Migration: Create data_exports table for personal data takeout archives,
+-- built in the background and kept until they expire
+CREATE TABLE IF NOT EXISTS data_exports (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'ready', 'failed')),
+    origin TEXT NOT NULL DEFAULT '',
+    archive BYTEA,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMP WITH TIME ZONE,
+    expires_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS data_exports_user_id_idx ON data_exports (user_id);
+CREATE INDEX IF NOT EXISTS data_exports_pending_idx ON data_exports (created_at) WHERE status = 'pending';
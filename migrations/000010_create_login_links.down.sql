@@ -0,0 +1,2 @@
+-- Migration: Drop login_links table
+DROP TABLE IF EXISTS login_links;
@@ -0,0 +1,12 @@
+-- Migration: Create login_links table for single-use sign-in links sent by
+-- mail. Only hashes of the token and of the nonce kept in the requesting
+-- browser's cookie are stored.
+CREATE TABLE IF NOT EXISTS login_links (
+    token_hash BYTEA PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    nonce_hash BYTEA NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS login_links_user_id_idx ON login_links (user_id);
@@ -0,0 +1,2 @@
+-- Migration: Drop user_identities table
+DROP TABLE IF EXISTS user_identities;
@@ -0,0 +1,5 @@
+-- Migration: Drop the OAuth 2.0 authorization server tables
+DROP TABLE IF EXISTS oauth_tokens;
+DROP TABLE IF EXISTS oauth_codes;
+DROP TABLE IF EXISTS oauth_grants;
+DROP TABLE IF EXISTS oauth_clients;
@@ -0,0 +1,46 @@
+-- Migration: Create the tables of the OAuth 2.0 authorization server. Apps
+-- are registered as clients; a grant records what a user let an app do,
+-- and its authorization codes and tokens go with it when it is revoked.
+-- Only hashes of client secrets, codes and tokens are stored.
+CREATE TABLE IF NOT EXISTS oauth_clients (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    secret_hash BYTEA,
+    redirect_uris TEXT[] NOT NULL,
+    created_by TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS oauth_grants (
+    id BIGSERIAL PRIMARY KEY,
+    client_id TEXT NOT NULL REFERENCES oauth_clients(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    scope TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    UNIQUE (user_id, client_id)
+);
+
+CREATE INDEX IF NOT EXISTS oauth_grants_client_id_idx ON oauth_grants (client_id);
+
+CREATE TABLE IF NOT EXISTS oauth_codes (
+    code_hash BYTEA PRIMARY KEY,
+    grant_id BIGINT NOT NULL REFERENCES oauth_grants(id) ON DELETE CASCADE,
+    scope TEXT NOT NULL,
+    redirect_uri TEXT NOT NULL,
+    code_challenge TEXT NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS oauth_codes_grant_id_idx ON oauth_codes (grant_id);
+
+CREATE TABLE IF NOT EXISTS oauth_tokens (
+    token_hash BYTEA PRIMARY KEY,
+    grant_id BIGINT NOT NULL REFERENCES oauth_grants(id) ON DELETE CASCADE,
+    kind TEXT NOT NULL CHECK (kind IN ('access', 'refresh')),
+    scope TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS oauth_tokens_grant_id_idx ON oauth_tokens (grant_id);
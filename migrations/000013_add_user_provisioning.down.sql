@@ -0,0 +1,5 @@
+-- Migration: Remove the SCIM provisioning columns
+DROP INDEX IF EXISTS users_external_id_key;
+ALTER TABLE users
+    DROP COLUMN IF EXISTS deactivated_at,
+    DROP COLUMN IF EXISTS external_id;
@@ -0,0 +1,7 @@
+-- Migration: Let a directory provision users over SCIM: its identifier for
+-- each user, and accounts it has deactivated
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS external_id TEXT,
+    ADD COLUMN IF NOT EXISTS deactivated_at TIMESTAMP WITH TIME ZONE;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_external_id_key ON users (external_id);
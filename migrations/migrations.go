@@ -0,0 +1,10 @@
+// Package migrations embeds the SQL schema migrations into the binary so
+// they can be applied by the built-in runner in internal/migrate.
+package migrations
+
+import "embed"
+
+// FS holds the *.up.sql and *.down.sql migration files
+//
+//go:embed *.sql
+var FS embed.FS
@@ -0,0 +1,10 @@
+// Package ui embeds the HTML templates and static assets into the binary, so
+// production deploys need nothing but the executable.
+package ui
+
+import "embed"
+
+// Files holds html/ (page templates, base.tmpl and partials/) and static/
+//
+//go:embed html static
+var Files embed.FS